@@ -0,0 +1,89 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package backstop publishes the agent config and Dqlite node that the
+// backstop works on, as interfaces, so that automation wrapping the backstop
+// can depend on them and be tested against the fakes in backstoptest.
+package backstop
+
+import (
+	"context"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+// AgentConfig is the configuration of a controller's machine agent, read
+// from its agent.conf.
+type AgentConfig = agent.Config
+
+// StateServingInfo holds the details a controller serves with, such as its
+// certificate and API port.
+type StateServingInfo = agent.StateServingInfo
+
+// Logger receives the log output of a NodeManager.
+type Logger = database.Logger
+
+// NodeInfo is a Dqlite node: its ID, address and role.
+type NodeInfo = dqlite.NodeInfo
+
+// NodeRole is the role of a Dqlite node in the cluster.
+type NodeRole = dqlite.NodeRole
+
+// Node roles.
+const (
+	Voter   = dqlite.Voter
+	StandBy = dqlite.StandBy
+	Spare   = dqlite.Spare
+)
+
+// NodeStore is the record a Dqlite node keeps of the cluster, in cluster.yaml,
+// and of itself, in info.yaml.
+type NodeStore interface {
+	// ClusterServers returns the nodes in cluster.yaml.
+	ClusterServers(ctx context.Context) ([]NodeInfo, error)
+	// WriteClusterServers replaces the nodes in cluster.yaml.
+	WriteClusterServers(ctx context.Context, servers []NodeInfo) error
+	// NodeInfo returns the local node from info.yaml.
+	NodeInfo() (NodeInfo, error)
+	// SetNodeInfo replaces the local node in info.yaml.
+	SetNodeInfo(server NodeInfo) error
+}
+
+// NodeManager is the local Dqlite node of a controller, which the backstop
+// inspects and repairs.
+type NodeManager interface {
+	NodeStore
+
+	// EnsureDataDir returns the Dqlite data directory, creating it if
+	// needed.
+	EnsureDataDir() (string, error)
+	// IsExistingNode returns whether the node has any data.
+	IsExistingNode() (bool, error)
+	// IsBootstrappedNode returns whether the node is the only one in its
+	// cluster, bound to the loopback address it was bootstrapped with.
+	IsBootstrappedNode(ctx context.Context) (bool, error)
+	// CheckStopped returns an error if the node appears to be running.
+	CheckStopped() error
+	// ReconfigureMembership writes the membership to the raft log only.
+	ReconfigureMembership(servers []NodeInfo) error
+	// SetClusterServers writes the membership to the raft log, then to
+	// cluster.yaml.
+	SetClusterServers(ctx context.Context, servers []NodeInfo) error
+	// Port returns the port Dqlite nodes listen on.
+	Port() int
+}
+
+var _ NodeManager = (*database.NodeManager)(nil)
+
+// ReadAgentConfig reads the agent config from the agent.conf at the path.
+func ReadAgentConfig(path string) (AgentConfig, error) {
+	return agent.ReadConfig(path)
+}
+
+// NewNodeManager returns the local Dqlite node of the controller whose agent
+// config is given.
+func NewNodeManager(cfg AgentConfig, logger Logger) NodeManager {
+	return database.NewNodeManager(cfg, logger)
+}
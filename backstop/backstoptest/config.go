@@ -0,0 +1,103 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package backstoptest provides in-memory fakes of the interfaces in
+// package backstop, for testing automation that wraps the backstop.
+package backstoptest
+
+import (
+	"github.com/juju/names/v4"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/backstop"
+)
+
+// Default identities of the fakes.
+const (
+	ControllerUUID = "deadbeef-1bad-500d-9000-4b1d0d06f00d"
+	ModelUUID      = "deadbeef-0bad-400d-8000-4b1d0d06f00d"
+)
+
+// Config is an in-memory agent config, whose fields are returned by its
+// methods.
+type Config struct {
+	DataDirectory  string
+	LogDirectory   string
+	CACertificate  string
+	Addresses      []string
+	ServingInfo    backstop.StateServingInfo
+	HasServingInfo bool
+	AgentTag       names.Tag
+	ControllerTag  names.ControllerTag
+	ModelTag       names.ModelTag
+	Version        string
+	Values         map[string]string
+}
+
+var _ backstop.AgentConfig = (*Config)(nil)
+
+// NewConfig returns the config of the machine-0 controller agent, with its
+// data in the directory given.
+func NewConfig(dataDir string) *Config {
+	return &Config{
+		DataDirectory:  dataDir,
+		LogDirectory:   "/var/log/juju",
+		Addresses:      []string{"127.0.0.1:17070"},
+		ServingInfo:    backstop.StateServingInfo{APIPort: 17070, ControllerAPIPort: 17071},
+		HasServingInfo: true,
+		AgentTag:       names.NewMachineTag("0"),
+		ControllerTag:  names.NewControllerTag(ControllerUUID),
+		ModelTag:       names.NewModelTag(ModelUUID),
+		Version:        "3.1.6",
+		Values:         map[string]string{},
+	}
+}
+
+// DataDir is part of the backstop.AgentConfig interface.
+func (c *Config) DataDir() string {
+	return c.DataDirectory
+}
+
+// LogDir is part of the backstop.AgentConfig interface.
+func (c *Config) LogDir() string {
+	return c.LogDirectory
+}
+
+// CACert is part of the backstop.AgentConfig interface.
+func (c *Config) CACert() string {
+	return c.CACertificate
+}
+
+// APIAddresses is part of the backstop.AgentConfig interface.
+func (c *Config) APIAddresses() ([]string, error) {
+	return append([]string(nil), c.Addresses...), nil
+}
+
+// StateServingInfo is part of the backstop.AgentConfig interface.
+func (c *Config) StateServingInfo() (backstop.StateServingInfo, bool) {
+	return c.ServingInfo, c.HasServingInfo
+}
+
+// Tag is part of the backstop.AgentConfig interface.
+func (c *Config) Tag() names.Tag {
+	return c.AgentTag
+}
+
+// Controller is part of the backstop.AgentConfig interface.
+func (c *Config) Controller() names.ControllerTag {
+	return c.ControllerTag
+}
+
+// Model is part of the backstop.AgentConfig interface.
+func (c *Config) Model() names.ModelTag {
+	return c.ModelTag
+}
+
+// UpgradedToVersion is part of the backstop.AgentConfig interface.
+func (c *Config) UpgradedToVersion() string {
+	return c.Version
+}
+
+// Value is part of the backstop.AgentConfig interface.
+func (c *Config) Value(key string) string {
+	return c.Values[key]
+}
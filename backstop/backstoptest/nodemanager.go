@@ -0,0 +1,101 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backstoptest
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/backstop"
+)
+
+// NodeManager is an in-memory Dqlite node, whose cluster.yaml and info.yaml
+// are kept in a NodeStore, and whose raft log holds only its membership.
+type NodeManager struct {
+	*NodeStore
+
+	mu         sync.Mutex
+	dataDir    string
+	membership []backstop.NodeInfo
+
+	// Running, when set, is returned by CheckStopped, as if the node were
+	// still serving.
+	Running error
+	// ReconfigureErr is returned by ReconfigureMembership, when set.
+	ReconfigureErr error
+}
+
+var _ backstop.NodeManager = (*NodeManager)(nil)
+
+// NewNodeManager returns a stopped node with its data in the directory
+// given, whose raft log and cluster.yaml hold the servers, the first being
+// the local node.
+func NewNodeManager(dataDir string, servers ...backstop.NodeInfo) *NodeManager {
+	return &NodeManager{
+		NodeStore:  NewNodeStore(servers...),
+		dataDir:    dataDir,
+		membership: append([]backstop.NodeInfo(nil), servers...),
+	}
+}
+
+// Membership returns the membership last written to the raft log.
+func (m *NodeManager) Membership() []backstop.NodeInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]backstop.NodeInfo(nil), m.membership...)
+}
+
+// EnsureDataDir is part of the backstop.NodeManager interface.
+func (m *NodeManager) EnsureDataDir() (string, error) {
+	return m.dataDir, nil
+}
+
+// IsExistingNode is part of the backstop.NodeManager interface.
+func (m *NodeManager) IsExistingNode() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.membership) > 0, nil
+}
+
+// IsBootstrappedNode is part of the backstop.NodeManager interface.
+func (m *NodeManager) IsBootstrappedNode(ctx context.Context) (bool, error) {
+	if extant, _ := m.IsExistingNode(); !extant {
+		return false, nil
+	}
+	servers, err := m.ClusterServers(ctx)
+	if err != nil {
+		return false, err
+	}
+	return len(servers) == 1 && strings.HasPrefix(servers[0].Address, "127.0.0.1"), nil
+}
+
+// CheckStopped is part of the backstop.NodeManager interface.
+func (m *NodeManager) CheckStopped() error {
+	return m.Running
+}
+
+// ReconfigureMembership is part of the backstop.NodeManager interface.
+func (m *NodeManager) ReconfigureMembership(servers []backstop.NodeInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ReconfigureErr != nil {
+		return m.ReconfigureErr
+	}
+	m.membership = append([]backstop.NodeInfo(nil), servers...)
+	return nil
+}
+
+// SetClusterServers is part of the backstop.NodeManager interface.
+func (m *NodeManager) SetClusterServers(ctx context.Context, servers []backstop.NodeInfo) error {
+	if err := m.ReconfigureMembership(servers); err != nil {
+		return err
+	}
+	return m.WriteClusterServers(ctx, servers)
+}
+
+// Port is part of the backstop.NodeManager interface.
+func (m *NodeManager) Port() int {
+	return 17666
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backstoptest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/backstop"
+)
+
+// NodeStore is an in-memory cluster.yaml and info.yaml. Errors set on it are
+// returned by its reads or writes, to test how failures are handled.
+type NodeStore struct {
+	mu      sync.Mutex
+	servers []backstop.NodeInfo
+	info    *backstop.NodeInfo
+
+	// ReadErr is returned by ClusterServers and NodeInfo, when set.
+	ReadErr error
+	// WriteErr is returned by WriteClusterServers and SetNodeInfo, when
+	// set.
+	WriteErr error
+}
+
+var _ backstop.NodeStore = (*NodeStore)(nil)
+
+// NewNodeStore returns a store holding the servers, with the first as the
+// local node. A store without servers has no local node either.
+func NewNodeStore(servers ...backstop.NodeInfo) *NodeStore {
+	s := &NodeStore{servers: servers}
+	if len(servers) > 0 {
+		info := servers[0]
+		s.info = &info
+	}
+	return s
+}
+
+// ClusterServers is part of the backstop.NodeStore interface.
+func (s *NodeStore) ClusterServers(ctx context.Context) ([]backstop.NodeInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ReadErr != nil {
+		return nil, s.ReadErr
+	}
+	return append([]backstop.NodeInfo(nil), s.servers...), nil
+}
+
+// WriteClusterServers is part of the backstop.NodeStore interface.
+func (s *NodeStore) WriteClusterServers(ctx context.Context, servers []backstop.NodeInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.WriteErr != nil {
+		return s.WriteErr
+	}
+	s.servers = append([]backstop.NodeInfo(nil), servers...)
+	return nil
+}
+
+// NodeInfo is part of the backstop.NodeStore interface.
+func (s *NodeStore) NodeInfo() (backstop.NodeInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ReadErr != nil {
+		return backstop.NodeInfo{}, s.ReadErr
+	}
+	if s.info == nil {
+		return backstop.NodeInfo{}, errors.NotFoundf("info.yaml")
+	}
+	return *s.info, nil
+}
+
+// SetNodeInfo is part of the backstop.NodeStore interface.
+func (s *NodeStore) SetNodeInfo(server backstop.NodeInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.WriteErr != nil {
+		return s.WriteErr
+	}
+	s.info = &server
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/pebble"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+)
+
+// agentService is the service running the machine agent: a systemd unit on
+// machines, or a Pebble service in the controller container on Kubernetes.
+type agentService struct {
+	tag    string
+	pebble bool
+}
+
+// newAgentService returns the service running the agent with the tag.
+func newAgentService(cfg agent.Config, tag string) agentService {
+	return agentService{tag: tag, pebble: cfg != nil && agent.IsCAAS(cfg)}
+}
+
+// name returns the name of the service.
+func (s agentService) name() string {
+	if s.pebble {
+		return pebble.JujudService
+	}
+	return fmt.Sprintf("jujud-%s.service", s.tag)
+}
+
+// command returns the command an operator runs, on the controller, to stop,
+// start or restart the service.
+func (s agentService) command(action string) string {
+	if s.pebble {
+		return fmt.Sprintf("%s %s %s", pebble.CLI, action, s.name())
+	}
+	return fmt.Sprintf("systemctl %s %s", action, s.name())
+}
+
+// logCommand returns the command an operator runs to read the log of the
+// service.
+func (s agentService) logCommand() string {
+	if s.pebble {
+		return fmt.Sprintf("%s logs %s", pebble.CLI, s.name())
+	}
+	return fmt.Sprintf("journalctl -u %s", s.name())
+}
+
+// run stops, starts or restarts the service, waiting for it to finish.
+func (s agentService) run(ctx context.Context, action string) error {
+	if s.pebble {
+		client := pebble.NewClient(pebble.SocketPath())
+		switch action {
+		case "stop":
+			return client.Stop(ctx, s.name())
+		case "start":
+			return client.Start(ctx, s.name())
+		case "restart":
+			return client.Restart(ctx, s.name())
+		}
+		return errors.NotValidf("service action %q", action)
+	}
+	if out, err := exec.CommandContext(ctx, "systemctl", action, s.name()).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// active returns the names of the agent services that are running.
+func (s agentService) active(ctx context.Context) ([]string, error) {
+	if !s.pebble {
+		return remote.LocalActiveJujudServices(ctx)
+	}
+	services, err := pebble.NewClient(pebble.SocketPath()).Services(ctx, s.name())
+	if err != nil {
+		return nil, errors.Annotate(err, "checking the machine agent")
+	}
+	var active []string
+	for _, service := range services {
+		if service.Active() {
+			active = append(active, service.Name)
+		}
+	}
+	return active, nil
+}
@@ -0,0 +1,287 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "analyze remove",
+		args:    "[--path <dir>] [--live <address>] [--from <host>...] [remote flags] <tag> <node> [<node>=<dqlite dir>...]",
+		summary: "report the consequences of removing a node from the cluster",
+		run:     runAnalyzeRemove,
+	})
+}
+
+func runAnalyzeRemove(args []string) {
+	flags := newFlagSet("analyze remove", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	agentFlags.addClientCertFlags(flags)
+	live := flags.String("live", "", "read the membership from the running node at this address, and check which nodes answer")
+	var from stringsFlag
+	flags.Var(&from, "from", "copy the raft log from this controller over ssh, to find entries only the node holds (repeatable)")
+	remoteDataDir := flags.String("remote-data-dir", agent.DefaultPaths.DataDir, "data directory on the other controllers")
+	timeout := flags.Duration("timeout", 5*time.Minute, "time to wait for each copy")
+	remoteFlags := addRemoteFlags(flags)
+	remoteFlags.addCompressionFlag(flags)
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		commandUsage(commands["analyze remove"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	selector, err := database.ParseNodeSelector(flags.Arg(1))
+	checkErr("parse node", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var servers []dqlite.NodeInfo
+	if *live != "" {
+		servers, err = nodeManager.LiveClusterServers(ctx, *live)
+		checkErr("get live cluster servers", err)
+	} else {
+		servers, err = nodeManager.ClusterServers(ctx)
+		checkErr("get cluster servers", err)
+	}
+	ids, err := database.MatchNodes(servers, []database.NodeSelector{selector})
+	checkErr("find node", err)
+	if len(ids) != 1 {
+		checkErr("find node", errors.Errorf("%q matches %d nodes, expected one", selector, len(ids)))
+	}
+
+	removal, err := database.AnalyzeRemoval(servers, ids[0])
+	checkErr("analyze removal", err)
+
+	var answering map[uint64]bool
+	if *live != "" {
+		answering = answeringNodes(ctx, nodeManager, removal.After)
+	}
+	risky := reportRemoval(removal, answering)
+
+	histories := removalHistories(nodeManager, servers, flags.Args()[2:])
+	if len(from) > 0 {
+		for _, h := range remoteHistories(remoteFlags.transportFor(cfg), from, *remoteDataDir, *timeout) {
+			histories = append(histories, nodeHistories(servers, hostOf(h.name), h.history)...)
+		}
+	}
+	fmt.Println("")
+	risky = reportOnlyHeld(removal.Node, histories) || risky
+
+	if risky {
+		exit(1)
+	}
+}
+
+// reportRemoval prints the membership, quorum and fault tolerance before and
+// after the removal, and whether a leader can still be elected. A rebalancing
+// of the roles that would follow is reported apart, as the removal itself
+// leaves the other roles alone. The nodes answering are those of the running
+// cluster, or nil if it was not checked. It returns true if a leader could
+// not be elected.
+func reportRemoval(removal database.Removal, answering map[uint64]bool) bool {
+	node := removal.Node
+	fmt.Printf("removing node %d at %s (%s)\n", node.ID, node.Address, node.Role)
+	fmt.Printf("before: %s\n", formatRoles(removal.Before))
+	fmt.Printf("after:  %s\n", formatRoles(removal.After))
+	fmt.Println("")
+
+	before, after := database.Voters(removal.Before), database.Voters(removal.After)
+	fmt.Printf("voters: %d, then %d\n", before, after)
+	fmt.Printf("quorum: %d, then %d\n", database.Quorum(before), database.Quorum(after))
+	fmt.Printf("voters that can be lost: %d, then %d\n", database.FaultTolerance(before), database.FaultTolerance(after))
+	if !database.SameMembership(removal.After, removal.Rebalanced) {
+		rebalanced := database.Voters(removal.Rebalanced)
+		fmt.Printf("were the roles then rebalanced: %s\n", formatRoles(removal.Rebalanced))
+		for _, promoted := range removal.Promoted {
+			fmt.Printf("  node %d at %s would be promoted to voter\n", promoted.ID, promoted.Address)
+		}
+		fmt.Printf("  voters: %d, quorum: %d, voters that can be lost: %d\n",
+			rebalanced, database.Quorum(rebalanced), database.FaultTolerance(rebalanced))
+	}
+
+	if after == 0 {
+		fmt.Println("a leader CANNOT be elected: no voters would remain")
+		return true
+	}
+	if answering == nil {
+		fmt.Printf("a leader can be elected while %d of the %d remaining voters are up\n", database.Quorum(after), after)
+		if database.FaultTolerance(after) == 0 {
+			fmt.Println("losing any remaining voter would then stop the cluster")
+		}
+		return false
+	}
+
+	var up int
+	for _, n := range removal.After {
+		if n.Role == dqlite.Voter && answering[n.ID] {
+			up++
+		}
+	}
+	if up < database.Quorum(after) {
+		fmt.Printf("a leader CANNOT be elected: only %d of the %d remaining voters answer, and %d are needed\n",
+			up, after, database.Quorum(after))
+		return true
+	}
+	fmt.Printf("a leader can be elected: %d of the %d remaining voters answer, and %d are needed\n",
+		up, after, database.Quorum(after))
+	return false
+}
+
+// formatRoles formats the nodes with their roles.
+func formatRoles(nodes []dqlite.NodeInfo) string {
+	parts := make([]string, len(nodes))
+	for i, node := range nodes {
+		parts[i] = fmt.Sprintf("%d@%s (%s)", node.ID, node.Address, node.Role)
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// answeringNodes returns which of the nodes answer with a cluster that has
+// an elected leader.
+func answeringNodes(ctx context.Context, nodeManager *database.NodeManager, nodes []dqlite.NodeInfo) map[uint64]bool {
+	answering := make(map[uint64]bool)
+	for _, node := range nodes {
+		checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err := nodeManager.CheckHealth(checkCtx, node)
+		cancel()
+		if err != nil {
+			logger.Warningf("%v", err)
+			continue
+		}
+		answering[node.ID] = true
+	}
+	return answering
+}
+
+// nodeHistory is the raft history of a member of the cluster.
+type nodeHistory struct {
+	node    dqlite.NodeInfo
+	history raft.History
+}
+
+// removalHistories returns the local raft history, as that of the local node
+// in info.yaml, and those of the directories given as <node>=<dqlite dir>.
+func removalHistories(nodeManager *database.NodeManager, servers []dqlite.NodeInfo, args []string) []nodeHistory {
+	var histories []nodeHistory
+	if info, err := nodeManager.NodeInfo(); err != nil {
+		logger.Warningf("unable to read info.yaml, so the local raft log is not used: %v", err)
+	} else if dataDir, err := nodeManager.EnsureDataDir(); err != nil {
+		logger.Warningf("unable to find the local raft log: %v", err)
+	} else if history, err := raft.ReadHistory(dataDir); err != nil {
+		logger.Warningf("unable to read the local raft log: %v", err)
+	} else {
+		histories = append(histories, nodeHistories(servers, fmt.Sprint(info.ID), history)...)
+	}
+
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			checkErr("parse arguments", fmt.Errorf("invalid directory %q, expected <node>=<dir>", arg))
+		}
+		history, err := raft.ReadHistory(parts[1])
+		checkErr("read raft log "+parts[1], err)
+		found := nodeHistories(servers, parts[0], history)
+		if len(found) == 0 {
+			checkErr("parse arguments", fmt.Errorf("%q does not match a node in the membership", parts[0]))
+		}
+		histories = append(histories, found...)
+	}
+	return histories
+}
+
+// nodeHistories returns the history as that of the node the selector
+// matches, if it matches exactly one.
+func nodeHistories(servers []dqlite.NodeInfo, value string, history raft.History) []nodeHistory {
+	selector, err := database.ParseNodeSelector(value)
+	if err != nil {
+		logger.Warningf("%v", err)
+		return nil
+	}
+	var matched []dqlite.NodeInfo
+	for _, server := range servers {
+		if selector.Matches(server) {
+			matched = append(matched, server)
+		}
+	}
+	if len(matched) != 1 {
+		logger.Warningf("%q matches %d nodes, so its raft log is not used", value, len(matched))
+		return nil
+	}
+	return []nodeHistory{{node: matched[0], history: history}}
+}
+
+// hostOf returns the host of an ssh destination, without the user.
+func hostOf(destination string) string {
+	if i := strings.LastIndex(destination, "@"); i >= 0 {
+		return destination[i+1:]
+	}
+	return destination
+}
+
+// reportOnlyHeld prints the raft log entries that only the node holds, and
+// so would be lost with it. Entries committed by the cluster are held by a
+// quorum, so any found were never committed. It returns true if there are
+// any.
+func reportOnlyHeld(node dqlite.NodeInfo, histories []nodeHistory) bool {
+	var own *raft.History
+	var others []nodeHistory
+	for i, h := range histories {
+		if h.node.ID == node.ID {
+			own = &histories[i].history
+			continue
+		}
+		others = append(others, h)
+	}
+	switch {
+	case own == nil:
+		fmt.Printf("the raft log of node %d was not given, so the entries only it holds are unknown\n", node.ID)
+		return false
+	case len(others) == 0:
+		fmt.Printf("no other raft log was given, so the entries only node %d holds are unknown\n", node.ID)
+		return false
+	}
+
+	var (
+		only     uint64
+		compared int
+	)
+	for _, other := range others {
+		d := raft.Diverge(*own, other.history)
+		if !d.Known {
+			logger.Warningf("node %d and node %d cannot be compared, their logs do not overlap", node.ID, other.node.ID)
+			continue
+		}
+		if compared == 0 || d.AOnly < only {
+			only = d.AOnly
+		}
+		compared++
+	}
+	switch {
+	case compared == 0:
+		fmt.Printf("no raft log could be compared with that of node %d, so the entries only it holds are unknown\n", node.ID)
+		return false
+	case only > 0:
+		fmt.Printf("node %d holds %d raft log entries that none of the %d nodes compared hold, which would be lost\n",
+			node.ID, only, compared)
+		return true
+	}
+	fmt.Printf("every raft log entry node %d holds is also held by at least one of the %d other nodes compared\n", node.ID, compared)
+	return false
+}
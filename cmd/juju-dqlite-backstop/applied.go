@@ -0,0 +1,64 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/journal"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+// alreadyApplied reports whether the membership is already in place on the
+// local node, as after re-running the backstop once it has succeeded:
+// cluster.yaml and the raft log both hold exactly the membership, info.yaml
+// has the local node's address from it, and no step of an earlier run was
+// interrupted. cluster.yaml alone does not show the surgery was done, as
+// reconcile and check-raft-membership write it without touching the raft log.
+func alreadyApplied(nodeManager *database.NodeManager, clusterNodes []dqlite.NodeInfo) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	current, err := nodeManager.ClusterServers(ctx)
+	if err != nil || !database.SameMembership(current, clusterNodes) {
+		return false
+	}
+	if localInfo, err := nodeManager.NodeInfo(); err == nil {
+		for _, node := range clusterNodes {
+			if node.ID == localInfo.ID && node.Address != localInfo.Address {
+				return false
+			}
+		}
+	}
+
+	dataDir, err := nodeManager.EnsureDataDir()
+	if err != nil {
+		return false
+	}
+	membership, err := raft.ReadMembership(dataDir)
+	if err != nil {
+		logger.Infof("cluster.yaml holds the membership, but the raft log cannot be read: %v", err)
+		return false
+	}
+	if !database.SameMembership(raftNodes(membership.Servers), clusterNodes) {
+		logger.Infof("cluster.yaml holds the membership, but the raft log (%s) holds %s",
+			describeRaftMembership(membership), formatMembership(raftNodes(membership.Servers)))
+		return false
+	}
+	entries, err := journal.Read(journal.Path(dataDir))
+	if err != nil && len(entries) == 0 {
+		// No journal is no interrupted step; one that cannot be read
+		// may hide one.
+		return os.IsNotExist(err)
+	}
+	if n := len(journal.Unfinished(entries)); n > 0 {
+		logger.Infof("cluster.yaml holds the membership, but %d step(s) of an earlier run were interrupted", n)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "audit",
+		args:    "[--path <dir>] [--format text|json|template] [--template <template>] <tag>",
+		summary: "show and verify the audit log of changes made by the backstop",
+		run:     runAudit,
+	})
+}
+
+func runAudit(args []string) {
+	flags := newFlagSet("audit", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	output := addOutputFlags(flags)
+	flags.Parse(args)
+	output.check()
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["audit"])
+		exit(1)
+	}
+
+	_, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	records, err := audit.Read(audit.Path(dataDir))
+	if errors.Is(err, os.ErrNotExist) && output.structured() {
+		output.write(auditOutput{Records: []audit.Record{}, Verified: true})
+		return
+	} else if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("no changes have been recorded")
+		return
+	}
+	checkErr("read audit log", err)
+
+	if output.structured() {
+		verifyErr := audit.Verify(records)
+		out := auditOutput{Records: records, Verified: verifyErr == nil}
+		if verifyErr != nil {
+			out.Error = verifyErr.Error()
+		}
+		output.write(out)
+		checkErr("verify audit log", verifyErr)
+		return
+	}
+
+	for _, rec := range records {
+		fmt.Printf("%s %s by %s on %s: %s\n",
+			rec.Time.Format(time.RFC3339), rec.Operation, rec.Operator, rec.Hostname, strings.Join(rec.Args, " "))
+		if len(rec.Before) > 0 || len(rec.After) > 0 {
+			fmt.Printf("\tmembership %s -> %s\n", formatMembership(rec.Before), formatMembership(rec.After))
+		}
+		if len(rec.Steps) > 0 {
+			steps := make([]string, len(rec.Steps))
+			for i, step := range rec.Steps {
+				steps[i] = fmt.Sprintf("%s %s", step.Name, time.Duration(step.Seconds*float64(time.Second)).Round(time.Microsecond))
+			}
+			fmt.Printf("\tsteps: %s\n", strings.Join(steps, ", "))
+		}
+	}
+	checkErr("verify audit log", audit.Verify(records))
+	fmt.Printf("%d records, hash chain verified\n", len(records))
+}
+
+// auditOutput is the data model of the audit command's JSON and template
+// output.
+type auditOutput struct {
+	Records  []audit.Record `json:"records"`
+	Verified bool           `json:"verified"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// recordAudit appends the record to the audit log. The change has already
+// been made, so a failure is reported but is not fatal.
+func recordAudit(dataDir string, rec audit.Record) {
+	if err := audit.Append(dataDir, rec); err != nil {
+		logger.Errorf("unable to record change in audit log: %v", err)
+	}
+}
+
+func formatMembership(nodes []dqlite.NodeInfo) string {
+	parts := make([]string, len(nodes))
+	for i, node := range nodes {
+		parts[i] = fmt.Sprintf("%d@%s", node.ID, node.Address)
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
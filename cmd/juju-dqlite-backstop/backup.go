@@ -0,0 +1,803 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/names/v4"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/backup"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/compress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/journal"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/progress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+	"github.com/SimonRichardson/juju-dqlite-backstop/version"
+)
+
+var restorePrompt = `
+This will move the dqlite data on this machine aside, and replace it with the
+data in the backup.
+
+Ok to proceed?`[1:]
+
+func init() {
+	registerCommand(command{
+		name:    "backup",
+		args:    "[--path <dir>] [--output <dir>|s3://<bucket>/<prefix>] [--incremental-from <backup>] [--compression <gzip|zstd|none>[:<level>]] [--include-secrets --passphrase-file <file>] [s3 flags] <tag>",
+		summary: "back up the dqlite data and agent.conf, locally or to object storage",
+		run:     runBackup,
+	})
+	registerCommand(command{
+		name:    "restore",
+		args:    "[--path <dir>] [--to-index <index>|--to-time <time>] [--rewrite-address <old>=<new>...] [--tag <tag>] [--allow-other-controller] [--allow-version-mismatch] [--passphrase-file <file>] [s3 flags] [--strict] [--yes] <tag> <file>|s3://<bucket>/<key>",
+		summary: "replace the dqlite data with that in a backup",
+		run:     runRestore,
+	})
+}
+
+func runBackup(args []string) {
+	flags := newFlagSet("backup", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	output := flags.String("output", "", "directory or s3://<bucket>/<prefix> to write the backup to, defaults to the agent data directory")
+	incrementalFrom := flags.String("incremental-from", "", "only store files changed since this backup, which must be kept alongside")
+	compression := flags.String("compression", compress.Default.String(), "compression of the backup: gzip, zstd or none, optionally followed by :<level>")
+	includeSecrets := flags.Bool("include-secrets", false, "store the agent directory and TLS material, encrypted, instead of agent.conf alone")
+	passphraseFile := flags.String("passphrase-file", "", "file holding the passphrase to encrypt the secrets with")
+	timeout := flags.Duration("timeout", time.Hour, "timeout for writing the backup")
+	s3Flags := addS3Flags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || agentFlags.path == stdinPath || *includeSecrets != (*passphraseFile != "") {
+		commandUsage(commands["backup"])
+		exit(1)
+	}
+	c, err := compress.Parse(*compression)
+	checkErr("parse --compression", err)
+
+	tag := flags.Arg(0)
+	cfg, nodeManager := loadAgent(agentFlags, tag)
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if units, err := remote.LocalActiveJujudServices(ctx); err == nil && len(units) > 0 {
+		logger.Warningf("jujud is running (%s), the backup may not be consistent", strings.Join(units, ", "))
+	}
+
+	dest := *output
+	if dest == "" && *incrementalFrom != "" {
+		dest = backupDir(*incrementalFrom)
+	} else if dest == "" {
+		dest = cfg.DataDir()
+	}
+	sources := []backup.Source{dqliteSource(dataDir)}
+	configPath := configFilePath(agentFlags, tag)
+	if *includeSecrets {
+		tmpDir, err := os.MkdirTemp("", "backup-secrets-")
+		checkErr("bundle secrets", err)
+		defer func() { _ = os.RemoveAll(tmpDir) }()
+
+		extra, err := agent.SecretFilePaths(configPath)
+		checkErr("bundle secrets", err)
+		bundle := filepath.Join(tmpDir, backup.SecretsName)
+		err = backup.WriteSecrets(bundle, readPassphrase(*passphraseFile), filepath.Dir(configPath), extra)
+		checkErr("bundle secrets", err)
+		sources = append(sources, backup.Source{Name: backup.SecretsName, Path: bundle})
+	} else {
+		sources = append(sources, backup.Source{Name: "agent.conf", Path: configPath})
+	}
+	env := backupEnvironment(ctx, cfg, nodeManager)
+	location, err := writeBackup(ctx, dest, *incrementalFrom, c, s3Flags, env, sources)
+	checkErr("backup", err)
+	fmt.Printf("backup written to %s\n", location)
+}
+
+// writeBackup writes a backup of the sources into the directory, or streams
+// it to object storage under the prefix of an s3:// destination, returning
+// where it was written. Given a base backup, only the files changed since it
+// are stored.
+func writeBackup(
+	ctx context.Context, dest, base string, c compress.Compression, s3Flags *s3Flags, env backup.Environment,
+	sources []backup.Source,
+) (string, error) {
+	var baseManifest *backup.Manifest
+	if base != "" {
+		m, err := readBackupManifest(ctx, base, s3Flags)
+		if err != nil {
+			return "", fmt.Errorf("reading base backup: %w", err)
+		}
+		baseManifest = &m
+	}
+	manifest, err := backup.BuildManifest(env, baseManifest, path.Base(filepath.ToSlash(base)), sources...)
+	if err != nil {
+		return "", err
+	}
+	if baseManifest != nil {
+		var stored int
+		for _, f := range manifest.Files {
+			if f.Stored {
+				stored++
+			}
+		}
+		fmt.Printf("%d of %d files changed since %s\n", stored, len(manifest.Files), base)
+	}
+
+	var size int64
+	for _, f := range manifest.Files {
+		if f.Stored {
+			size += f.Size
+		}
+	}
+	if !backup.IsS3URL(dest) {
+		if err := checkSpace("write the backup", dest, c.Estimate(size)); err != nil {
+			return "", err
+		}
+	}
+	meter := progress.New("backing up", size)
+
+	name := backup.FileName(env.Tag, time.Now(), c)
+	start := time.Now()
+	var (
+		location string
+		stats    backup.Stats
+	)
+	if !backup.IsS3URL(dest) {
+		location = filepath.Join(dest, name)
+		stats, err = backup.Create(location, manifest, c, meter, sources...)
+	} else {
+		var bucket, prefix string
+		if bucket, prefix, err = backup.ParseS3URL(dest); err != nil {
+			return "", err
+		}
+		key := path.Join(prefix, name)
+		location = backup.S3Scheme + bucket + "/" + key
+		client := s3Flags.client()
+
+		pr, pw := io.Pipe()
+		go func() {
+			var err error
+			stats, err = backup.Write(pw, manifest, c, meter, sources...)
+			pw.CloseWithError(err)
+		}()
+		err = client.Upload(ctx, bucket, key, pr)
+		_ = pr.CloseWithError(io.ErrClosedPipe)
+	}
+	if err != nil {
+		return location, err
+	}
+	meter.Done()
+	printThroughput(stats, time.Since(start))
+	recordBackupMetrics(env.Tag, stats, time.Since(start))
+	return location, nil
+}
+
+// printThroughput reports how quickly a backup was written.
+func printThroughput(stats backup.Stats, elapsed time.Duration) {
+	rate := float64(stats.Read) / (1 << 20) / math.Max(elapsed.Seconds(), 0.001)
+	fmt.Printf("%d files, %d bytes archived to %d bytes in %s (%.1f MiB/s)\n",
+		stats.Files, stats.Read, stats.Written, elapsed.Round(time.Millisecond), rate)
+}
+
+// backupEnvironment describes the controller being backed up. Anything that
+// cannot be read is left out, as a backup is most needed when the node is
+// broken.
+func backupEnvironment(ctx context.Context, cfg agent.Config, nodeManager *database.NodeManager) backup.Environment {
+	env := backup.Environment{
+		ToolVersion:    version.Version,
+		AgentVersion:   cfg.UpgradedToVersion(),
+		Tag:            cfg.Tag().String(),
+		ControllerUUID: cfg.Controller().Id(),
+	}
+	env.Hostname, _ = os.Hostname()
+	if dataDir, err := nodeManager.EnsureDataDir(); err == nil {
+		env.Formats, _ = raft.ReadFormats(dataDir)
+	}
+	if node, err := nodeManager.NodeInfo(); err == nil {
+		env.Node = &node
+	}
+	env.Membership, _ = nodeManager.ClusterServers(ctx)
+	return env
+}
+
+// readBackupManifest reads the manifest from the start of a backup.
+func readBackupManifest(ctx context.Context, location string, s3Flags *s3Flags) (backup.Manifest, error) {
+	r, err := openBackup(ctx, location, s3Flags)
+	if err != nil {
+		return backup.Manifest{}, err
+	}
+	defer func() { _ = r.Close() }()
+	return backup.ReadManifest(r)
+}
+
+// backupDir returns the directory, or s3:// prefix, holding the backup.
+func backupDir(location string) string {
+	if backup.IsS3URL(location) {
+		return location[:strings.LastIndex(location, "/")]
+	}
+	return filepath.Dir(location)
+}
+
+// backupChain returns the backups to restore, in order, to restore the
+// backup at the location: the full backup it is ultimately based on, then
+// each incremental backup to apply on top. Backups without a manifest are
+// treated as full backups.
+func backupChain(ctx context.Context, location string, s3Flags *s3Flags) ([]string, error) {
+	chain := []string{location}
+	for len(chain) <= 1000 {
+		m, err := readBackupManifest(ctx, chain[0], s3Flags)
+		if errors.IsNotFound(err) || (err == nil && !m.Incremental()) {
+			return chain, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", chain[0], err)
+		}
+		base := backupDir(chain[0]) + "/" + m.Base
+		if !backup.IsS3URL(base) {
+			base = filepath.Join(backupDir(chain[0]), m.Base)
+		}
+		chain = append([]string{base}, chain...)
+	}
+	return nil, fmt.Errorf("the chain of incremental backups is too long")
+}
+
+// openBackup opens a backup file, or streams one from object storage.
+func openBackup(ctx context.Context, source string, s3Flags *s3Flags) (io.ReadCloser, error) {
+	if !backup.IsS3URL(source) {
+		return os.Open(source)
+	}
+	bucket, key, err := backup.ParseS3URL(source)
+	if err != nil {
+		return nil, err
+	}
+	return s3Flags.client().Download(ctx, bucket, key)
+}
+
+// dqliteSource returns the dqlite data dir as a backup source. The journal is
+// left out: it records the runs on this node, including the one taking the
+// backup, and is kept in place rather than restored.
+func dqliteSource(dataDir string) backup.Source {
+	return backup.Source{Name: "dqlite", Path: dataDir, Skip: []string{journal.FileName}}
+}
+
+// moveContents moves the entries of the directory into another on the same
+// filesystem, and removes the emptied directory.
+func moveContents(from, to string) error {
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(os.Remove(from))
+}
+
+// contextReader fails reads once its context is done, so that extracting a
+// local backup can be abandoned as a download can.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// extractBackup extracts the dqlite data in the backup to the data dir.
+func extractBackup(ctx context.Context, location string, s3Flags *s3Flags, dataDir string) error {
+	r, err := openBackup(ctx, location, s3Flags)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+
+	// The size of a backup in S3 is not known ahead.
+	var size int64
+	if info, err := os.Stat(location); err == nil {
+		size = info.Size()
+	}
+	meter := progress.New("extracting "+path.Base(filepath.ToSlash(location)), size)
+	if err := backup.Extract(meter.Reader(contextReader{ctx: ctx, r: r}), "dqlite", dataDir, audit.FileName, journal.FileName); err != nil {
+		return err
+	}
+	meter.Done()
+	return nil
+}
+
+func runRestore(args []string) {
+	flags := newFlagSet("restore", flag.ExitOnError)
+	addHookFlags(flags)
+	addAssumeStoppedFlag(flags)
+	agentFlags := addAgentFlags(flags)
+	timeout := flags.Duration("timeout", time.Hour, "timeout for reading the backup")
+	toIndex := flags.Uint64("to-index", 0, "only replay the raft log up to this index")
+	toTime := flags.String("to-time", "", "only replay the raft log up to this time (RFC 3339)")
+	var rewrites stringsFlag
+	flags.Var(&rewrites, "rewrite-address", "rewrite a node address or host in the restored data and agent.conf, as <old>=<new> (repeatable)")
+	newTag := flags.String("tag", "", "restore the backup as the agent with this tag, writing agent.conf from the backup for it")
+	allowOther := flags.Bool("allow-other-controller", false, "restore a backup taken on another controller")
+	allowMismatch := flags.Bool("allow-version-mismatch", false, "restore a backup of an incompatible Juju version or data format")
+	passphraseFile := flags.String("passphrase-file", "", "file holding the passphrase to decrypt the secrets in the backup with")
+	strict := addStrictFlag(flags)
+	yes := flags.Bool("yes", false, "answer 'yes' to prompts")
+	s3Flags := addS3Flags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 || agentFlags.path == stdinPath || (*toIndex != 0 && *toTime != "") {
+		commandUsage(commands["restore"])
+		exit(1)
+	}
+	warnings := startStrict(*strict)
+	var until time.Time
+	if *toTime != "" {
+		var err error
+		until, err = time.Parse(time.RFC3339, *toTime)
+		checkErr("parse --to-time", err)
+	}
+	addressMap, err := database.ParseAddressPairs(rewrites)
+	checkErr("parse --rewrite-address", err)
+
+	tag, source := flags.Arg(0), flags.Arg(1)
+	if *newTag != "" {
+		tag = *newTag
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	fmt.Printf("restoring dqlite data from %s\n", source)
+	chain, err := backupChain(ctx, source, s3Flags)
+	checkErr("read backup", failure.Wrap(failure.BackupUnreadable, err))
+	if len(chain) > 1 {
+		fmt.Printf("restoring a chain of %d backups from %s\n", len(chain), chain[0])
+	}
+
+	// The agent config is taken from the backup when restoring as another
+	// agent, or onto a machine without one, and otherwise has its addresses
+	// rewritten in place.
+	var (
+		cfg         agent.Config
+		nodeManager *database.NodeManager
+		newConfig   []byte
+		secrets     []backup.SecretFile
+	)
+	configPath := configFilePath(agentFlags, tag)
+	if _, statErr := os.Stat(configPath); *newTag != "" || os.IsNotExist(statErr) {
+		var passphrase []byte
+		if *passphraseFile != "" {
+			passphrase = readPassphrase(*passphraseFile)
+		}
+		data, files, err := readBackupAgentFiles(ctx, chain, s3Flags, passphrase)
+		checkErr("read agent.conf from backup", err)
+		secrets = files
+		t, err := names.ParseTag(tag)
+		checkErr("parse tag", err)
+		newConfig, err = agent.RewriteConfig(data, t, agentFlags.path, addressMap.Rewrite)
+		checkErr("rewrite agent.conf", err)
+		cfg, err = agent.ReadConfigFrom(bytes.NewReader(newConfig))
+		checkErr("read agent.conf from backup", err)
+		checkErr("check backup secrets", checkSecretFiles(secrets, newConfig, configPath))
+		nodeManager = database.NewNodeManager(cfg, logger)
+		fmt.Printf("agent.conf from the backup will be written to %s\n", configPath)
+	} else {
+		if *passphraseFile != "" {
+			logger.Warningf("--passphrase-file is ignored: %s exists and is kept, so the secrets in the backup are not restored", configPath)
+		}
+		cfg, nodeManager = loadAgent(agentFlags, tag)
+		if len(addressMap) > 0 {
+			data, err := os.ReadFile(configPath)
+			checkErr("read agent.conf", err)
+			newConfig, err = agent.RewriteConfig(data, nil, "", addressMap.Rewrite)
+			checkErr("rewrite agent.conf", err)
+		}
+	}
+	origin, err := describeBackup(ctx, source, s3Flags)
+	checkErr("read backup", failure.Wrap(failure.BackupUnreadable, err))
+	checkErr("check backup", checkBackupOrigin(origin, cfg, *allowOther))
+	checkErr("check backup", checkBackupCompatibility(origin, cfg, *allowMismatch))
+
+	checkNodeStopped(nodeManager, localJujudStopped(ctx, newAgentService(cfg, tag)))
+	// The existing data is moved aside rather than removed, so the restored
+	// data needs space of its own.
+	if size, ok := backupSize(ctx, source, s3Flags); ok {
+		dataDir, err := nodeManager.EnsureDataDir()
+		checkErr("ensure data dir", err)
+		checkErr("check disk space", checkSpace("restore the backup", dataDir, size))
+	}
+
+	before, _ := nodeManager.ClusterServers(ctx)
+
+	enforceStrict(warnings)
+	if !*yes && !promptYN(restorePrompt) {
+		return
+	}
+
+	runPreHooks()
+	ctx, cancel = context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	journalDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+	steps := journal.New(journalDir, logger)
+
+	// The backup is extracted alongside the data directory before anything
+	// is changed, so that the download and extraction, which may take an
+	// hour, can be interrupted, abandoning the restore. Signals are only
+	// held back once the node is being changed.
+	ts := time.Now().UTC().Format("20060102T150405Z")
+	staging := journalDir + ".restoring-" + ts
+	extractCtx, stopAbort := abortOnSignal(ctx)
+	for _, location := range chain {
+		err = steps.Step("extract backup", map[string]string{"location": location, "dir": staging}, func() error {
+			return extractBackup(extractCtx, location, s3Flags, staging)
+		})
+		if err != nil {
+			err = fmt.Errorf("%s: %w", location, err)
+			break
+		}
+	}
+	if sig := stopAbort(); sig != nil || err != nil {
+		_ = os.RemoveAll(staging)
+		if sig != nil {
+			logger.Warningf("the restore was abandoned, nothing was changed")
+			interrupted(sig)
+		}
+		checkErr("restore", fmt.Errorf("%w, nothing was changed", err))
+	}
+
+	defer holdSignals()()
+	if newConfig != nil {
+		checkErr("write agent.conf", steps.Step("write agent.conf", map[string]string{"path": configPath}, func() error {
+			return agent.WriteConfig(configPath, newConfig)
+		}))
+		fmt.Printf("agent.conf written for %s\n", tag)
+	}
+	if len(secrets) > 0 {
+		checkErr("restore secrets", steps.Step("restore secrets", map[string]int{"files": len(secrets)}, func() error {
+			return restoreSecretFiles(filepath.Dir(configPath), secrets)
+		}))
+		fmt.Printf("%d more agent files restored\n", len(secrets))
+	}
+
+	// The audit log stays in place, so that the restore is recorded in it.
+	archive, err := nodeManager.ArchiveDataDir("pre-restore-"+ts, audit.FileName)
+	checkErr("archive dqlite data", err)
+	fmt.Printf("existing dqlite data moved to %s\n", archive)
+
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+	err = steps.Step("move restored data", map[string]string{"from": staging}, func() error {
+		return moveContents(staging, dataDir)
+	})
+	if err != nil {
+		checkErr("restore", fmt.Errorf("%w, the previous data is in %s", err, archive))
+	}
+
+	if *toIndex != 0 || *toTime != "" {
+		err := steps.Step("truncate restored log", map[string]interface{}{"index": *toIndex, "time": *toTime}, func() error {
+			return truncateRestored(dataDir, *toIndex, until)
+		})
+		if err != nil {
+			checkErr("point-in-time restore", fmt.Errorf("%w, the backup was restored in full, the previous data is in %s", err, archive))
+		}
+	}
+
+	// Addresses are rewritten last, as rewriting the membership appends to
+	// the raft log.
+	if len(addressMap) > 0 {
+		checkErr("rewrite addresses", rewriteRestoredAddresses(ctx, nodeManager, addressMap))
+	}
+
+	after, _ := nodeManager.ClusterServers(ctx)
+	rec := audit.NewRecord("restore", redactArgs(args))
+	rec.Before, rec.After = before, after
+	recordAudit(dataDir, rec)
+
+	fmt.Println("dqlite data restored")
+	fmt.Println("please restart the controller machine agent using:")
+	fmt.Println("")
+	fmt.Printf("\t%s\n", newAgentService(cfg, tag).command("restart"))
+	fmt.Println("")
+}
+
+// readBackupAgentFiles returns the agent.conf in the chain of backups, as of
+// the last backup, and the other files of the agent directory and the TLS
+// material if the backup holds them encrypted. They are taken from the
+// newest backup holding either agent.conf or the encrypted bundle.
+func readBackupAgentFiles(
+	ctx context.Context, chain []string, s3Flags *s3Flags, passphrase []byte,
+) ([]byte, []backup.SecretFile, error) {
+	tmpDir, err := os.MkdirTemp("", "restore-agent-conf-")
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	// An incremental backup only holds the agent files if they changed.
+	for i := len(chain) - 1; i >= 0; i-- {
+		r, err := openBackup(ctx, chain[i], s3Flags)
+		if err != nil {
+			return nil, nil, err
+		}
+		found, err := backup.ExtractFiles(r, tmpDir, agent.AgentConfigFilename, backup.SecretsName)
+		_ = r.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", chain[i], err)
+		}
+		if len(found) > 0 {
+			break
+		}
+	}
+
+	sealed, err := os.ReadFile(filepath.Join(tmpDir, backup.SecretsName))
+	if os.IsNotExist(err) {
+		data, err := os.ReadFile(filepath.Join(tmpDir, agent.AgentConfigFilename))
+		if os.IsNotExist(err) {
+			return nil, nil, errors.NotFoundf("agent.conf in backup")
+		}
+		return data, nil, err
+	} else if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if passphrase == nil {
+		return nil, nil, errors.New("the agent files in the backup are encrypted, give --passphrase-file")
+	}
+	files, err := backup.ReadSecrets(sealed, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		data   []byte
+		others []backup.SecretFile
+	)
+	for _, f := range files {
+		if !f.External && f.Path == agent.AgentConfigFilename {
+			data = f.Data
+		} else {
+			others = append(others, f)
+		}
+	}
+	if data == nil {
+		return nil, nil, errors.NotFoundf("agent.conf in the backup's secrets")
+	}
+	return data, others, nil
+}
+
+// checkSecretFiles checks that the files outside the agent directory in a
+// backup's secrets are ones the restored agent config reads its secrets
+// from, so that a bundle cannot write elsewhere.
+func checkSecretFiles(files []backup.SecretFile, configData []byte, configPath string) error {
+	paths, err := agent.ConfigSecretFilePaths(configData, configPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	referenced := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		referenced[path] = true
+	}
+	for _, f := range files {
+		if f.External && !referenced[f.Path] {
+			return fmt.Errorf("the backup's secrets hold %s, which the restored agent.conf does not reference", f.Path)
+		}
+	}
+	return nil
+}
+
+// restoreSecretFiles writes the files restored from a backup's secrets to
+// the agent directory, or to their own paths if they were outside it. They
+// replace any existing files together, which are kept with a .bak suffix.
+func restoreSecretFiles(agentDir string, files []backup.SecretFile) error {
+	replacements := make([]agent.File, len(files))
+	for i, f := range files {
+		path := f.Path
+		if !f.External {
+			path = filepath.Join(agentDir, f.Path)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return errors.Trace(err)
+		}
+		replacements[i] = agent.File{Path: path, Data: f.Data, Mode: f.Mode.Perm()}
+	}
+	return errors.Trace(agent.ReplaceFiles(replacements))
+}
+
+// readPassphrase reads the passphrase from the file, without the trailing
+// newline.
+func readPassphrase(path string) []byte {
+	data, err := os.ReadFile(path)
+	checkErr("read passphrase", err)
+	passphrase := bytes.TrimRight(data, "\r\n")
+	if len(passphrase) == 0 {
+		checkErr("read passphrase", fmt.Errorf("%s is empty", path))
+	}
+	return passphrase
+}
+
+// rewriteRestoredAddresses applies the address map to the restored
+// membership and info.yaml.
+func rewriteRestoredAddresses(ctx context.Context, nodeManager *database.NodeManager, addressMap database.AddressMap) error {
+	servers, err := nodeManager.ClusterServers(ctx)
+	if err != nil {
+		return err
+	}
+	mapped := addressMap.Apply(servers)
+	if conflicts := database.AddressConflicts(mapped); len(conflicts) > 0 {
+		return errors.New(strings.Join(conflicts, "; "))
+	}
+	for i, node := range mapped {
+		if node.Address != servers[i].Address {
+			fmt.Printf("node %d address %s rewritten to %s\n", node.ID, servers[i].Address, node.Address)
+		}
+	}
+	if err := nodeManager.SetClusterServers(ctx, mapped); err != nil {
+		return err
+	}
+
+	info, err := nodeManager.NodeInfo()
+	if err != nil {
+		return err
+	}
+	if address := addressMap.Rewrite(info.Address); address != info.Address {
+		info.Address = address
+		return nodeManager.SetNodeInfo(info)
+	}
+	return nil
+}
+
+// backupOrigin is what a backup records of where it was taken.
+type backupOrigin struct {
+	controllerUUID string
+	tag            string
+	agentVersion   string
+	formats        raft.Formats
+	jujuFormat     *backup.JujuMetadata
+}
+
+// describeBackup prints where the backup was taken, from its manifest or,
+// for a `juju create-backup` archive, its metadata.
+func describeBackup(ctx context.Context, location string, s3Flags *s3Flags) (backupOrigin, error) {
+	var origin backupOrigin
+	m, err := readBackupManifest(ctx, location, s3Flags)
+	switch {
+	case err == nil && m.Environment.Tag != "":
+		env := m.Environment
+		fmt.Printf("backup of %s on %s, controller %s, taken %s\n",
+			env.Tag, env.Hostname, env.ControllerUUID, m.Created.Format(time.RFC3339))
+		origin = backupOrigin{
+			controllerUUID: env.ControllerUUID,
+			tag:            env.Tag,
+			agentVersion:   env.AgentVersion,
+			formats:        env.Formats,
+		}
+	case err == nil:
+	case errors.IsNotFound(err):
+		jm, err := readJujuMetadata(ctx, location, s3Flags)
+		if errors.IsNotFound(err) {
+			break
+		} else if err != nil {
+			return origin, err
+		}
+		fmt.Printf("Juju %s backup of machine %s (%s), controller %s, taken %s\n",
+			jm.Version, jm.Machine, jm.Hostname, jm.ControllerUUID, jm.Started.Format(time.RFC3339))
+		origin = backupOrigin{
+			controllerUUID: jm.ControllerUUID,
+			agentVersion:   jm.Version,
+			jujuFormat:     &jm,
+		}
+		if jm.Machine != "" {
+			origin.tag = names.NewMachineTag(jm.Machine).String()
+		}
+	default:
+		return origin, err
+	}
+	return origin, nil
+}
+
+// checkBackupOrigin refuses a backup taken on another controller, unless
+// allowed, and warns if it was taken on another machine.
+func checkBackupOrigin(origin backupOrigin, cfg agent.Config, allowOther bool) error {
+	if origin.controllerUUID == "" {
+		logger.Warningf("the backup does not record which controller it was taken on")
+		return nil
+	}
+	if origin.controllerUUID != cfg.Controller().Id() {
+		if !allowOther {
+			return errors.Errorf("the backup is of controller %s, not %s", origin.controllerUUID, cfg.Controller().Id())
+		}
+		logger.Warningf("the backup is of controller %s, not %s", origin.controllerUUID, cfg.Controller().Id())
+	}
+	if origin.tag != "" && origin.tag != cfg.Tag().String() {
+		logger.Warningf("the backup is of %s, its node identity in info.yaml will be restored with it", origin.tag)
+	}
+	return nil
+}
+
+// checkBackupCompatibility refuses a backup whose Juju version or data
+// formats cannot be restored for the agent, unless allowed, in which case
+// the incompatibility is only warned about. The agent's version is that of
+// its installed binaries, or failing that the version it last upgraded to.
+func checkBackupCompatibility(origin backupOrigin, cfg agent.Config, allowMismatch bool) error {
+	targetVersion, err := agent.ToolsVersion(cfg.DataDir(), cfg.Tag())
+	if err != nil {
+		targetVersion = cfg.UpgradedToVersion()
+	}
+	if origin.agentVersion == "" || targetVersion == "" {
+		logger.Warningf("the Juju version of the backup or the agent is unknown, it is not checked")
+	}
+
+	var problems []error
+	warning, err := backup.CheckAgentVersions(origin.agentVersion, targetVersion)
+	if warning != "" {
+		logger.Warningf("%s", warning)
+	}
+	problems = append(problems, err, origin.formats.Check())
+	if origin.jujuFormat != nil {
+		problems = append(problems, backup.CheckJujuFormat(*origin.jujuFormat))
+	}
+	for _, problem := range problems {
+		if problem == nil {
+			continue
+		}
+		if !allowMismatch {
+			return errors.Errorf("%v, use --allow-version-mismatch to restore it anyway", problem)
+		}
+		logger.Warningf("%v", problem)
+	}
+	return nil
+}
+
+// readJujuMetadata reads the metadata of a backup made by `juju
+// create-backup`.
+func readJujuMetadata(ctx context.Context, location string, s3Flags *s3Flags) (backup.JujuMetadata, error) {
+	r, err := openBackup(ctx, location, s3Flags)
+	if err != nil {
+		return backup.JujuMetadata{}, err
+	}
+	defer func() { _ = r.Close() }()
+	return backup.ReadJujuMetadata(r)
+}
+
+// truncateRestored removes the entries after the index, or after the time
+// if no index is given, from the restored raft log, so that the node's
+// databases are rebuilt as they were at that point when it starts.
+func truncateRestored(dataDir string, index uint64, until time.Time) error {
+	if index == 0 {
+		var err error
+		if index, err = raft.IndexAt(dataDir, until); err != nil {
+			return err
+		}
+		fmt.Printf("the last entry known to be written by %s is at index %d\n", until.Format(time.RFC3339), index)
+	}
+	removed, err := raft.TruncateLog(dataDir, index)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %d raft log entries after index %d\n", removed, index)
+	fmt.Println("the other controllers still hold the later entries, recover this node")
+	fmt.Println("as the only survivor before they are started, or they will replicate")
+	fmt.Println("the entries back")
+	return nil
+}
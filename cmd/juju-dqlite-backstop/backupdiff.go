@@ -0,0 +1,225 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/backup"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "backup diff",
+		args:    "[--content] [s3 flags] <file>|s3://<bucket>/<key> <file>|s3://<bucket>/<key>",
+		summary: "summarise what changed between two backups",
+		run:     runBackupDiff,
+	})
+}
+
+func runBackupDiff(args []string) {
+	flags := newFlagSet("backup diff", flag.ExitOnError)
+	content := flags.Bool("content", false, "also restore both backups and compare their raft logs and databases")
+	timeout := flags.Duration("timeout", time.Hour, "timeout for reading the backups")
+	s3Flags := addS3Flags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		commandUsage(commands["backup diff"])
+		exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	a, b := flags.Arg(0), flags.Arg(1)
+	fmt.Printf("--- %s\n+++ %s\n", a, b)
+	differ, compared, err := diffManifests(ctx, a, b, s3Flags)
+	checkErr("compare backups", err)
+	if *content {
+		contentDiffers, err := diffContent(ctx, a, b, s3Flags)
+		checkErr("compare backup content", err)
+		differ = differ || contentDiffers
+	}
+	switch {
+	case differ:
+		exit(1)
+	case !compared:
+		// A backup without a manifest cannot be shown to be equivalent.
+		fmt.Println("the backups were not compared in full, as one has no manifest")
+		exit(2)
+	}
+	fmt.Println("the backups are equivalent")
+}
+
+// diffManifests prints how the environment and files recorded in the
+// manifests of the backups differ, reporting whether they do, and whether
+// they were compared at all, which they are not if either backup has no
+// manifest.
+func diffManifests(ctx context.Context, a, b string, s3Flags *s3Flags) (differ, compared bool, _ error) {
+	var manifests [2]backup.Manifest
+	for i, location := range []string{a, b} {
+		m, err := readBackupManifest(ctx, location, s3Flags)
+		if errors.IsNotFound(err) {
+			fmt.Printf("files: not compared, %s has no manifest\n", location)
+			return false, false, nil
+		} else if err != nil {
+			return false, false, fmt.Errorf("%s: %w", location, err)
+		}
+		manifests[i] = m
+	}
+	ma, mb := manifests[0], manifests[1]
+	fmt.Printf("created: %s -> %s (%s apart)\n",
+		ma.Created.Format(time.RFC3339), mb.Created.Format(time.RFC3339), mb.Created.Sub(ma.Created).Round(time.Second))
+
+	ea, eb := ma.Environment, mb.Environment
+	for _, field := range []struct {
+		name string
+		a, b string
+	}{
+		{"controller", ea.ControllerUUID, eb.ControllerUUID},
+		{"agent", ea.Tag, eb.Tag},
+		{"hostname", ea.Hostname, eb.Hostname},
+		{"juju version", ea.AgentVersion, eb.AgentVersion},
+		{"tool version", ea.ToolVersion, eb.ToolVersion},
+		{"node", formatNode(ea), formatNode(eb)},
+		{"membership", formatMembership(ea.Membership), formatMembership(eb.Membership)},
+	} {
+		if field.a == field.b {
+			continue
+		}
+		differ = true
+		fmt.Printf("%s:\n", field.name)
+		fmt.Printf("  - %s\n", valueOr(field.a, "unknown"))
+		fmt.Printf("  + %s\n", valueOr(field.b, "unknown"))
+	}
+
+	changes := backup.DiffManifests(ma, mb)
+	var added, removed, changed int
+	for _, change := range changes {
+		switch {
+		case change.A == nil:
+			added++
+		case change.B == nil:
+			removed++
+		default:
+			changed++
+		}
+	}
+	fmt.Printf("files: %d added, %d removed, %d changed\n", added, removed, changed)
+	for _, change := range changes {
+		switch {
+		case change.A == nil:
+			fmt.Printf("  + %s (%d bytes)\n", change.Path, change.B.Size)
+		case change.B == nil:
+			fmt.Printf("  - %s (%d bytes)\n", change.Path, change.A.Size)
+		default:
+			fmt.Printf("  ~ %s (%d -> %d bytes)\n", change.Path, change.A.Size, change.B.Size)
+		}
+	}
+	return differ || len(changes) > 0, true, nil
+}
+
+// formatNode describes the local node recorded in the environment.
+func formatNode(env backup.Environment) string {
+	if env.Node == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d@%s (%s)", env.Node.ID, env.Node.Address, env.Node.Role)
+}
+
+// diffContent restores both backups into temporary directories and prints
+// how their raft logs and the databases in their latest snapshots differ,
+// reporting whether they do.
+func diffContent(ctx context.Context, a, b string, s3Flags *s3Flags) (bool, error) {
+	var (
+		histories [2]raft.History
+		hashes    [2]map[string]database.DatabaseHash
+	)
+	for i, location := range []string{a, b} {
+		tmpDir, err := os.MkdirTemp("", "backup-diff-")
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		defer func() { _ = os.RemoveAll(tmpDir) }()
+
+		chain, err := backupChain(ctx, location, s3Flags)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", location, err)
+		}
+		dataDir := database.DqliteDir(tmpDir)
+		for _, backup := range chain {
+			if err := extractBackup(ctx, backup, s3Flags, dataDir); err != nil {
+				return false, fmt.Errorf("%s: %w", backup, err)
+			}
+		}
+		if histories[i], err = raft.ReadHistory(dataDir); err != nil {
+			return false, fmt.Errorf("%s: %w", location, err)
+		}
+		databases, err := dumpSnapshotDatabases(dataDir, tmpDir)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", location, err)
+		}
+		hashes[i] = make(map[string]database.DatabaseHash)
+		for _, db := range databases {
+			if hashes[i][db.name], err = database.HashDatabaseFile(ctx, db.path); err != nil {
+				return false, fmt.Errorf("%s: database %s: %w", location, db.name, err)
+			}
+		}
+	}
+
+	differ := false
+	lastA, lastB := histories[0].Last(), histories[1].Last()
+	fmt.Printf("raft log: last entry index %d term %d -> index %d term %d\n", lastA.Index, lastA.Term, lastB.Index, lastB.Term)
+	if lastA != lastB {
+		differ = true
+	}
+
+	// The databases are compared as of each backup's latest snapshot, as
+	// the log entries after it are not applied.
+	names := make(map[string]bool)
+	for _, h := range hashes {
+		for name := range h {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		ha, inA := hashes[0][name]
+		hb, inB := hashes[1][name]
+		switch {
+		case !inB:
+			fmt.Printf("database %s: only in %s\n", name, a)
+			differ = true
+		case !inA:
+			fmt.Printf("database %s: only in %s\n", name, b)
+			differ = true
+		default:
+			differences := database.CompareHashes(ha, hb, a, b)
+			if len(differences) == 0 {
+				fmt.Printf("database %s: identical as of the latest snapshots\n", name)
+				continue
+			}
+			differ = true
+			fmt.Printf("database %s:\n", name)
+			for _, difference := range differences {
+				fmt.Printf("  %s\n", difference)
+			}
+		}
+	}
+	return differ, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/backup"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "backup info",
+		args:    "[--files] [--format text|json|template] [--template <template>] [s3 flags] <file>|s3://<bucket>/<key>",
+		summary: "show where and when a backup was taken, and what it holds",
+		run:     runBackupInfo,
+	})
+}
+
+func runBackupInfo(args []string) {
+	flags := newFlagSet("backup info", flag.ExitOnError)
+	files := flags.Bool("files", false, "list each file in the backup with its checksum")
+	timeout := flags.Duration("timeout", 5*time.Minute, "timeout for reading the backup")
+	s3Flags := addS3Flags(flags)
+	output := addOutputFlags(flags)
+	flags.Parse(args)
+	output.check()
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["backup info"])
+		exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	location := flags.Arg(0)
+	m, err := readBackupManifest(ctx, location, s3Flags)
+	if errors.IsNotFound(err) {
+		// Backups made by Juju carry their own metadata instead.
+		jm, err := readJujuMetadata(ctx, location, s3Flags)
+		if errors.IsNotFound(err) {
+			err = errors.New("the backup has no manifest, and is not a Juju backup")
+		}
+		checkErr("read backup", failure.Wrap(failure.BackupUnreadable, err))
+		if output.structured() {
+			output.write(backupInfoOutput{Juju: &jm})
+			return
+		}
+		printJujuMetadata(jm)
+		return
+	}
+	checkErr("read backup", failure.Wrap(failure.BackupUnreadable, err))
+	if output.structured() {
+		output.write(backupInfoOutput{Manifest: &m, Size: m.Size()})
+		return
+	}
+	printManifest(m, *files)
+}
+
+// backupInfoOutput is the data model of the backup info command's JSON and
+// template output: the manifest of a backup made by the backstop, or the
+// metadata of one made by Juju.
+type backupInfoOutput struct {
+	Manifest *backup.Manifest     `json:"manifest,omitempty"`
+	Size     int64                `json:"size,omitempty"`
+	Juju     *backup.JujuMetadata `json:"juju,omitempty"`
+}
+
+// printManifest prints the environment the backup was taken in and a summary
+// of its files.
+func printManifest(m backup.Manifest, files bool) {
+	env := m.Environment
+	fmt.Printf("created:       %s\n", m.Created.Format(time.RFC3339))
+	if m.Incremental() {
+		fmt.Printf("based on:      %s\n", m.Base)
+	}
+	if env.Tag == "" {
+		fmt.Println("environment:   not recorded, the backup predates it")
+	} else {
+		fmt.Printf("controller:    %s\n", env.ControllerUUID)
+		fmt.Printf("agent:         %s on %s\n", env.Tag, env.Hostname)
+		fmt.Printf("juju version:  %s\n", valueOr(env.AgentVersion, "unknown"))
+		fmt.Printf("tool version:  %s\n", env.ToolVersion)
+		if env.Formats != (raft.Formats{}) {
+			fmt.Printf("raft formats:  segment %d, snapshot %d\n", env.Formats.Segment, env.Formats.Snapshot)
+		}
+		if env.Node != nil {
+			fmt.Printf("node:          %d at %s (%s)\n", env.Node.ID, env.Node.Address, env.Node.Role)
+		}
+		fmt.Printf("membership:    %s\n", formatMembership(env.Membership))
+	}
+
+	var stored int
+	for _, f := range m.Files {
+		if f.Stored {
+			stored++
+		}
+	}
+	fmt.Printf("files:         %d, %d bytes, %d stored in this backup\n", len(m.Files), m.Size(), stored)
+	if !files {
+		return
+	}
+	for _, f := range m.Files {
+		where := "stored"
+		if !f.Stored {
+			where = "in base"
+		}
+		fmt.Printf("  %s  %10d  %-7s  %s\n", f.SHA256, f.Size, where, f.Path)
+	}
+}
+
+// printJujuMetadata prints the metadata of a backup made by `juju
+// create-backup`.
+func printJujuMetadata(m backup.JujuMetadata) {
+	fmt.Println("made by:       juju create-backup")
+	fmt.Printf("created:       %s\n", m.Started.Format(time.RFC3339))
+	fmt.Printf("controller:    %s\n", m.ControllerUUID)
+	fmt.Printf("agent:         machine-%s on %s\n", m.Machine, m.Hostname)
+	fmt.Printf("juju version:  %s\n", m.Version)
+	if m.Notes != "" {
+		fmt.Printf("notes:         %s\n", m.Notes)
+	}
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
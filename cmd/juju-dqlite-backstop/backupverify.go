@@ -0,0 +1,183 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/journal"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "backup verify",
+		args:    "[--keep] [s3 flags] <file>|s3://<bucket>/<key>",
+		summary: "restore a backup into a temporary directory and check that it is intact",
+		run:     runBackupVerify,
+	})
+}
+
+func runBackupVerify(args []string) {
+	flags := newFlagSet("backup verify", flag.ExitOnError)
+	keep := flags.Bool("keep", false, "keep the restored data rather than removing it")
+	timeout := flags.Duration("timeout", time.Hour, "timeout for reading the backup")
+	s3Flags := addS3Flags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["backup verify"])
+		exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	ok, err := verifyBackup(ctx, flags.Arg(0), s3Flags, *keep)
+	checkErr("verify backup", err)
+	if !ok {
+		fmt.Println("the backup is not restorable")
+		exit(1)
+	}
+	fmt.Println("the backup is restorable")
+}
+
+// verifyBackup restores the backup, and any it is incremental to, into a
+// temporary data dir and checks the result, printing the outcome of each
+// check. An error is only returned if the checks could not be run.
+func verifyBackup(ctx context.Context, location string, s3Flags *s3Flags, keep bool) (bool, error) {
+	chain, err := backupChain(ctx, location, s3Flags)
+	if err != nil {
+		return false, errors.Annotate(err, "reading backup")
+	}
+	// The databases are written out from the restored snapshot as well.
+	if size, ok := backupSize(ctx, location, s3Flags); ok {
+		if err := checkSpace("verify the backup", os.TempDir(), 2*size); err != nil {
+			return false, err
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp("", "backup-verify-")
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if keep {
+		fmt.Printf("restoring into %s\n", tmpDir)
+	} else {
+		defer func() { _ = os.RemoveAll(tmpDir) }()
+	}
+	dataDir := database.DqliteDir(tmpDir)
+
+	ok := true
+	report := func(check string, err error) {
+		if err != nil {
+			fmt.Printf("%s: FAILED: %v\n", check, err)
+			ok = false
+			return
+		}
+		fmt.Printf("%s: ok\n", check)
+	}
+
+	for _, backup := range chain {
+		if err := extractBackup(ctx, backup, s3Flags, dataDir); err != nil {
+			report("extract "+backup, err)
+			return false, nil
+		}
+	}
+	report(fmt.Sprintf("extract %d backup(s)", len(chain)), nil)
+
+	manifest, err := readBackupManifest(ctx, location, s3Flags)
+	if errors.IsNotFound(err) {
+		fmt.Println("checksums: skipped, the backup has no manifest")
+	} else if err != nil {
+		report("checksums", err)
+	} else {
+		report("checksums", manifest.Verify("dqlite", dataDir, audit.FileName, journal.FileName))
+	}
+
+	count, err := raft.VerifyLog(dataDir)
+	report(fmt.Sprintf("raft log (%d entries)", count), err)
+	history, err := raft.ReadHistory(dataDir)
+	if err == nil && history.Snapshot == nil && len(history.Terms) == 0 {
+		err = errors.New("no snapshot or log entries")
+	}
+	if err == nil {
+		last := history.Last()
+		fmt.Printf("last log entry: index %d, term %d\n", last.Index, last.Term)
+	}
+	report("raft history", err)
+
+	report("databases", verifySnapshotDatabases(ctx, dataDir, report))
+
+	store, err := readLocalStore(tmpDir)
+	if err == nil {
+		err = database.ValidateMembership(store.Servers)
+	}
+	report("cluster.yaml", err)
+
+	return ok, nil
+}
+
+// verifySnapshotDatabases runs the SQLite integrity check against each
+// database in the latest snapshot.
+func verifySnapshotDatabases(ctx context.Context, dataDir string, report func(string, error)) error {
+	dbDir, err := os.MkdirTemp(dataDir, "databases-")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	databases, err := dumpSnapshotDatabases(dataDir, dbDir)
+	if err != nil {
+		return err
+	}
+	for _, db := range databases {
+		report("database "+db.name, database.CheckDatabaseFile(ctx, db.path))
+	}
+	return nil
+}
+
+// dumpedDatabase is a database written out from a snapshot.
+type dumpedDatabase struct {
+	name string
+	path string
+}
+
+// dumpSnapshotDatabases writes each database in the latest snapshot in the
+// Dqlite data directory to dbDir, as SQLite files.
+func dumpSnapshotDatabases(dataDir, dbDir string) ([]dumpedDatabase, error) {
+	path, err := raft.LatestSnapshot(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, errors.New("no snapshot in the data")
+	}
+	databases, err := raft.ReadSnapshotDatabases(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading %s", filepath.Base(path))
+	}
+
+	var dumped []dumpedDatabase
+	for _, db := range databases {
+		dbPath := filepath.Join(dbDir, db.Name)
+		if err := os.WriteFile(dbPath, db.Main, 0600); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(db.WAL) > 0 {
+			if err := os.WriteFile(dbPath+"-wal", db.WAL, 0600); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		dumped = append(dumped, dumpedDatabase{name: db.Name, path: dbPath})
+	}
+	return dumped, nil
+}
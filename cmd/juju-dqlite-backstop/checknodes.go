@@ -0,0 +1,137 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "check-nodes",
+		args:    "[--path <dir>] [--client-cert <file> --client-key <file>] [--format text|json|template] [--template <template>] <tag>",
+		summary: "compare the controller_node table against cluster.yaml",
+		run:     runCheckNodes,
+	})
+}
+
+func runCheckNodes(args []string) {
+	flags := newFlagSet("check-nodes", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	agentFlags.addClientCertFlags(flags)
+	timeout := flags.Duration("timeout", 30*time.Second, "time to wait for the controller database")
+	output := addOutputFlags(flags)
+	flags.Parse(args)
+	output.check()
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["check-nodes"])
+		exit(1)
+	}
+
+	nodeManager := newNodeManager(agentFlags, flags.Arg(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	servers, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+
+	// The controller database is read from a copy of the latest snapshot,
+	// so the local node is not started and nothing is written. Entries
+	// written to the log since are not included, which is reported. With a
+	// client certificate, it is read from the live cluster instead.
+	var (
+		nodes    []database.ControllerNode
+		snapshot *snapshotSource
+	)
+	if agentFlags.clientCert != "" {
+		nodes, err = nodeManager.ClusterControllerNodes(ctx)
+		checkErr("read controller nodes", err)
+	} else {
+		checkErr("read controller nodes", withSnapshotControllerDB(nodeManager, 0, func(path string) error {
+			nodes, err = database.ReadControllerNodes(ctx, path)
+			return err
+		}))
+		snapshot, err = describeSnapshotSource(nodeManager)
+		checkErr("read raft log", err)
+	}
+
+	problems := database.CompareMembership(nodes, servers)
+	if output.structured() {
+		output.write(checkNodesOutput{
+			Snapshot: snapshot,
+			Nodes:    append([]database.ControllerNode{}, nodes...),
+			Servers:  append([]dqlite.NodeInfo{}, servers...),
+			Problems: append([]string{}, problems...),
+		})
+	} else {
+		if snapshot != nil {
+			fmt.Printf("controller_node read from the snapshot at index %d, taken %s ago\n",
+				snapshot.Index, time.Since(snapshot.Taken).Round(time.Second))
+			if snapshot.EntriesAfter > 0 {
+				fmt.Printf("the %d raft log entries written since are not included, give --client-cert and --client-key to read the live cluster\n",
+					snapshot.EntriesAfter)
+			}
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) == 0 && snapshot != nil {
+			fmt.Println("controller_node table in the snapshot and cluster.yaml agree")
+		} else if len(problems) == 0 {
+			fmt.Println("controller_node table and cluster.yaml agree")
+		}
+	}
+	if len(problems) > 0 {
+		exit(1)
+	}
+}
+
+// snapshotSource describes the snapshot the controller database was read
+// from, and how many log entries were written after it.
+type snapshotSource struct {
+	Index        uint64    `json:"index"`
+	Taken        time.Time `json:"taken"`
+	EntriesAfter uint64    `json:"entries_after"`
+}
+
+// describeSnapshotSource describes the latest snapshot of the local node,
+// which withSnapshotControllerDB reads.
+func describeSnapshotSource(nodeManager *database.NodeManager) (*snapshotSource, error) {
+	dataDir, err := nodeManager.EnsureDataDir()
+	if err != nil {
+		return nil, err
+	}
+	index, taken, err := raft.LatestSnapshotTaken(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	history, err := raft.ReadHistory(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	source := &snapshotSource{Index: index, Taken: taken}
+	if last := history.Last().Index; last > index {
+		source.EntriesAfter = last - index
+	}
+	return source, nil
+}
+
+// checkNodesOutput is the data model of the check-nodes command's JSON and
+// template output. Snapshot is set when the controller database was read
+// from the local node's latest snapshot rather than the live cluster.
+type checkNodesOutput struct {
+	Snapshot *snapshotSource           `json:"snapshot,omitempty"`
+	Nodes    []database.ControllerNode `json:"nodes"`
+	Servers  []dqlite.NodeInfo         `json:"servers"`
+	Problems []string                  `json:"problems"`
+}
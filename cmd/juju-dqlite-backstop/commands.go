@@ -0,0 +1,64 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a sub-command of the backstop tool. Running the tool without a
+// sub-command performs the dqlite backstop action itself.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string)
+}
+
+var commands = make(map[string]command)
+
+func registerCommand(cmd command) {
+	commands[cmd.name] = cmd
+}
+
+// lookupCommand returns the sub-command named by the first argument, or the
+// first two for a command such as "backup verify", along with its arguments.
+func lookupCommand(args []string) (command, []string, bool) {
+	if len(args) > 1 {
+		if cmd, ok := commands[args[0]+" "+args[1]]; ok {
+			return cmd, args[2:], true
+		}
+	}
+	if len(args) == 0 {
+		return command{}, nil, false
+	}
+	cmd, ok := commands[args[0]]
+	return cmd, args[1:], ok
+}
+
+// usage prints the usage of the tool, including all sub-commands.
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] <tag>\n", os.Args[0])
+	if len(commands) == 0 {
+		return
+	}
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "       %s <command> [flags] [args]\n\ncommands:\n", os.Args[0])
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+// commandUsage prints the usage of a single sub-command.
+func commandUsage(cmd command) {
+	fmt.Fprintf(os.Stderr, "usage: %s %s %s\n", os.Args[0], cmd.name, cmd.args)
+}
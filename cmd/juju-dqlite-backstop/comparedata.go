@@ -0,0 +1,117 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "compare-data",
+		args:    "[--path <dir>] [--database <name>] [--tables] <tag> <address|file> <address|file>",
+		summary: "compare the content of a database on two nodes, table by table",
+		run:     runCompareData,
+	})
+}
+
+func runCompareData(args []string) {
+	flags := newFlagSet("compare-data", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	agentFlags.addClientCertFlags(flags)
+	name := flags.String("database", "controller", "name of the database to compare")
+	showTables := flags.Bool("tables", false, "print the hash of every table")
+	timeout := flags.Duration("timeout", time.Minute, "timeout for dumping and hashing each copy")
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		commandUsage(commands["compare-data"])
+		exit(1)
+	}
+
+	_, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+
+	sources := flags.Args()[1:]
+	hashes, err := hashDatabaseCopies(nodeManager, sources, *name, *timeout)
+	checkErr(fmt.Sprintf("hash %q database", *name), err)
+	for i, hash := range hashes {
+		fmt.Printf("%s: %d tables, %s\n", sources[i], len(hash.Tables), hash.Sum())
+		if *showTables {
+			for _, table := range sortedTables(hash) {
+				fmt.Printf("\t%s: %d rows, %s\n", table, hash.Tables[table].Rows, hash.Tables[table].Sum)
+			}
+		}
+	}
+
+	differences := database.CompareHashes(hashes[0], hashes[1], sources[0], sources[1])
+	if len(differences) == 0 {
+		fmt.Printf("the %q database is identical on both\n", *name)
+		return
+	}
+	for _, difference := range differences {
+		fmt.Println(difference)
+	}
+	exit(1)
+}
+
+// hashDatabaseCopies hashes the named database from each source, which is
+// either a dumped database file or the address of a running node to dump it
+// from. Dumps are removed once hashed.
+func hashDatabaseCopies(
+	nodeManager *database.NodeManager, sources []string, name string, timeout time.Duration,
+) ([]database.DatabaseHash, error) {
+	dir, err := os.MkdirTemp("", "backstop-compare-data-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	hashes := make([]database.DatabaseHash, len(sources))
+	for i, source := range sources {
+		if hashes[i], err = hashDatabaseCopy(nodeManager, source, name, dir, i, timeout); err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+	}
+	return hashes, nil
+}
+
+// hashDatabaseCopy hashes a dumped database file, or dumps the database from
+// the running node at the address and hashes that.
+func hashDatabaseCopy(
+	nodeManager *database.NodeManager, source, name, dir string, i int, timeout time.Duration,
+) (database.DatabaseHash, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	path := source
+	if _, err := os.Stat(source); err != nil {
+		dumpDir := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.Mkdir(dumpDir, 0700); err != nil {
+			return database.DatabaseHash{}, err
+		}
+		if path, err = nodeManager.DumpDatabase(ctx, source, name, dumpDir); err != nil {
+			return database.DatabaseHash{}, err
+		}
+	}
+	return database.HashDatabaseFile(ctx, path)
+}
+
+// sortedTables returns the table names of the hash in order.
+func sortedTables(hash database.DatabaseHash) []string {
+	tables := make([]string, 0, len(hash.Tables))
+	for table := range hash.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
@@ -0,0 +1,163 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "compare-stores",
+		args:    "[--path <dir>] [--remote-data-dir <dir>] [remote flags] [--format text|json|template] [--template <template>] <tag> [<host>...]",
+		summary: "compare cluster.yaml and info.yaml across the controllers",
+		run:     runCompareStores,
+	})
+}
+
+func runCompareStores(args []string) {
+	flags := newFlagSet("compare-stores", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	remoteDataDir := flags.String("remote-data-dir", agent.DefaultPaths.DataDir, "data directory on the other controllers")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout for reading from each controller")
+	remoteFlags := addRemoteFlags(flags)
+	output := addOutputFlags(flags)
+	flags.Parse(args)
+	output.check()
+
+	if flags.NArg() < 1 {
+		commandUsage(commands["compare-stores"])
+		exit(1)
+	}
+
+	cfg, _ := loadAgent(agentFlags, flags.Arg(0))
+	transport := remoteFlags.transportFor(cfg)
+	local, err := readLocalStore(cfg.DataDir())
+	checkErr("read local cluster.yaml", err)
+
+	// Without explicit hosts, compare with each of the other nodes the local
+	// cluster.yaml knows about.
+	hosts := flags.Args()[1:]
+	if len(hosts) == 0 {
+		for _, server := range local.Servers {
+			if local.Info != nil && server.ID == local.Info.ID {
+				continue
+			}
+			host, err := internalnet.SplitHost(server.Address)
+			checkErr("parse node address", err)
+			hosts = append(hosts, host)
+		}
+	}
+
+	copies := make([]database.StoreCopy, len(hosts))
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			defer cancel()
+
+			copies[i], errs[i] = readRemoteStore(ctx, transport, host, *remoteDataDir)
+		}(i, host)
+	}
+	wg.Wait()
+
+	reachable := []database.StoreCopy{local}
+	out := compareStoresOutput{Stores: []storeOutput{}, Unreachable: []unreachableStore{}}
+	for i, host := range hosts {
+		if errs[i] != nil {
+			logger.Warningf("%s: %v", host, errs[i])
+			out.Unreachable = append(out.Unreachable, unreachableStore{Host: host, Error: errs[i].Error()})
+			continue
+		}
+		reachable = append(reachable, copies[i])
+	}
+
+	disagreements := database.StoreDisagreements(reachable)
+	if output.structured() {
+		for _, c := range reachable {
+			out.Stores = append(out.Stores, storeOutput{Host: c.Host, Servers: c.Servers, Info: c.Info})
+		}
+		out.Disagreements = append([]string{}, disagreements...)
+		output.write(out)
+		if len(disagreements) > 0 {
+			exit(1)
+		}
+		return
+	}
+	for _, c := range reachable {
+		fmt.Printf("%s: %d nodes in cluster.yaml\n", c.Host, len(c.Servers))
+	}
+	if len(disagreements) == 0 {
+		fmt.Printf("%d of %d controllers agree\n", len(reachable), len(hosts)+1)
+		return
+	}
+	for _, disagreement := range disagreements {
+		fmt.Println(disagreement)
+	}
+	exit(1)
+}
+
+// compareStoresOutput is the data model of the compare-stores command's JSON
+// and template output.
+type compareStoresOutput struct {
+	Stores        []storeOutput      `json:"stores"`
+	Unreachable   []unreachableStore `json:"unreachable"`
+	Disagreements []string           `json:"disagreements"`
+}
+
+// storeOutput is the cluster.yaml and info.yaml read from a controller.
+type storeOutput struct {
+	Host    string            `json:"host"`
+	Servers []dqlite.NodeInfo `json:"servers"`
+	Info    *dqlite.NodeInfo  `json:"info,omitempty"`
+}
+
+// unreachableStore is a controller whose stores could not be read.
+type unreachableStore struct {
+	Host  string `json:"host"`
+	Error string `json:"error"`
+}
+
+// readLocalStore reads the cluster.yaml and info.yaml of the local controller.
+func readLocalStore(dataDir string) (database.StoreCopy, error) {
+	cluster, err := os.ReadFile(database.ClusterFilePath(dataDir))
+	if err != nil {
+		return database.StoreCopy{}, err
+	}
+	info, err := os.ReadFile(database.InfoFilePath(dataDir))
+	if err != nil && !os.IsNotExist(err) {
+		return database.StoreCopy{}, err
+	}
+	return database.ParseStoreCopy("local", cluster, info)
+}
+
+// readRemoteStore reads the cluster.yaml and info.yaml of the controller on
+// the host. A missing info.yaml is not an error, as it only exists once the
+// node has started.
+func readRemoteStore(ctx context.Context, transport remote.Transport, host, dataDir string) (database.StoreCopy, error) {
+	cluster, err := transport.ReadFile(ctx, host, database.ClusterFilePath(dataDir))
+	if err != nil {
+		return database.StoreCopy{}, err
+	}
+	info, err := transport.ReadFile(ctx, host, database.InfoFilePath(dataDir))
+	if err != nil {
+		logger.Debugf("%s: %v", host, err)
+	}
+	return database.ParseStoreCopy(host, cluster, info)
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+const (
+	// controllerDatabase is the name of the controller's Dqlite database.
+	controllerDatabase = "controller"
+	// maxControllerCheckSnapshot is the largest snapshot read to check the
+	// controller UUID, as the whole of it is read into memory.
+	maxControllerCheckSnapshot = 1 << 30
+)
+
+// checkControllerUUID refuses to continue if the controller database in the
+// latest snapshot records a different controller to the agent config, as
+// happens when a machine is reused without its data being removed. Data the
+// UUID cannot be read from is not checked.
+func checkControllerUUID(cfg agent.Config, nodeManager *database.NodeManager) {
+	expected := cfg.Controller().Id()
+	uuid, err := snapshotControllerUUID(nodeManager)
+	if err != nil {
+		logger.Infof("unable to check the Dqlite data is of controller %s: %v", expected, err)
+		return
+	}
+	if uuid != expected {
+		checkErr("check controller", failure.Wrap(failure.ControllerMismatch, fmt.Errorf(
+			"the Dqlite data is of controller %s, but the agent config is of controller %s", uuid, expected)))
+	}
+	logger.Debugf("the Dqlite data is of controller %s", uuid)
+}
+
+// snapshotControllerUUID reads the controller UUID from the controller
+// database in the latest snapshot of the local node.
+func snapshotControllerUUID(nodeManager *database.NodeManager) (string, error) {
+	var uuid string
+	err := withSnapshotControllerDB(nodeManager, maxControllerCheckSnapshot, func(path string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var err error
+		uuid, err = database.ReadControllerUUID(ctx, path)
+		return err
+	})
+	return uuid, err
+}
+
+// withSnapshotControllerDB writes the controller database in the latest
+// snapshot of the local node to a temporary file, and calls fn with its
+// path. Snapshots larger than maxSize, if not zero, are not read, as the
+// whole of the snapshot is read into memory.
+func withSnapshotControllerDB(nodeManager *database.NodeManager, maxSize int64, fn func(path string) error) error {
+	dataDir, err := nodeManager.EnsureDataDir()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	path, err := raft.LatestSnapshot(dataDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if path == "" {
+		return errors.NotFoundf("snapshot")
+	}
+	if info, err := os.Stat(path); err != nil {
+		return errors.Trace(err)
+	} else if maxSize > 0 && info.Size() > maxSize {
+		return errors.Errorf("snapshot %s is too large to read", path)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "juju-dqlite-backstop-controller-")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	databases, err := dumpSnapshotDatabases(dataDir, tmpDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, db := range databases {
+		if db.name == controllerDatabase {
+			return fn(db.path)
+		}
+	}
+	return errors.NotFoundf("%s database in the snapshot", controllerDatabase)
+}
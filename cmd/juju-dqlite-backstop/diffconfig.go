@@ -0,0 +1,89 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "diff-config",
+		args:    "[remote flags] <agent.conf> [<agent.conf>]",
+		summary: "compare agent configs, or check one against expectations",
+		run:     runDiffConfig,
+	})
+}
+
+func runDiffConfig(args []string) {
+	flags := newFlagSet("diff-config", flag.ExitOnError)
+	remoteFlags := addRemoteFlags(flags)
+	flags.Parse(args)
+	transport := remoteFlags.transportFor(nil)
+
+	paths := flags.Args()
+	if len(paths) != 1 && len(paths) != 2 {
+		commandUsage(commands["diff-config"])
+		exit(1)
+	}
+
+	a, err := readConfigFile(transport, paths[0])
+	checkErr("read agent config", err)
+
+	if len(paths) == 1 {
+		problems := agent.Validate(a)
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", paths[0], problem)
+		}
+		if len(problems) > 0 {
+			exit(1)
+		}
+		fmt.Printf("%s: ok\n", paths[0])
+		return
+	}
+
+	b, err := readConfigFile(transport, paths[1])
+	checkErr("read agent config", err)
+
+	diffs := agent.Diff(a, b)
+	if len(diffs) == 0 {
+		fmt.Println("agent configs are equivalent")
+		return
+	}
+	fmt.Printf("--- %s\n+++ %s\n", paths[0], paths[1])
+	for _, diff := range diffs {
+		fmt.Printf("%s:\n", diff.Field)
+		fmt.Printf("  - %s\n", diff.A)
+		fmt.Printf("  + %s\n", diff.B)
+	}
+	exit(1)
+}
+
+// readConfigFile reads an agent config directly from the given file, from a
+// remote machine if the path is of the form [user@]host:/path, or from stdin
+// if the path is "-".
+func readConfigFile(transport remote.Transport, path string) (agent.Config, error) {
+	if path == stdinPath {
+		return agent.ReadConfigFrom(os.Stdin)
+	}
+	if host, remotePath, ok := remote.SplitPath(path); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		data, err := transport.ReadFile(ctx, host, remotePath)
+		if err != nil {
+			return nil, err
+		}
+		return agent.ReadConfigFrom(bytes.NewReader(data))
+	}
+	return agent.ReadConfig(path)
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "discover",
+		args:    "[--path <dir>] --cidr <subnet> [--cidr <subnet>...] [--format text|json|template] [--template <template>] <tag>",
+		summary: "scan subnets for dqlite nodes using the controller CA",
+		run:     runDiscover,
+	})
+}
+
+func runDiscover(args []string) {
+	flags := newFlagSet("discover", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	agentFlags.addClientCertFlags(flags)
+	var cidrs stringsFlag
+	flags.Var(&cidrs, "cidr", "subnet to scan (repeatable)")
+	timeout := flags.Duration("timeout", 2*time.Minute, "time allowed for the whole scan")
+	concurrency := flags.Int("concurrency", 64, "number of hosts to scan at once")
+	output := addOutputFlags(flags)
+	flags.Parse(args)
+	output.check()
+
+	if flags.NArg() != 1 || len(cidrs) == 0 {
+		commandUsage(commands["discover"])
+		exit(1)
+	}
+
+	subnets, err := internalnet.ParseSubnets(cidrs)
+	checkErr("parse subnets", err)
+
+	nodeManager := newNodeManager(agentFlags, flags.Arg(0))
+	config, err := nodeManager.ClientTLSConfig()
+	checkErr("controller tls config", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	found, err := internalnet.Discover(ctx, subnets, nodeManager.Port(), config, *concurrency)
+	checkErr("discover dqlite nodes", err)
+
+	if output.structured() {
+		output.write(discoverOutput{Found: append([]string{}, found...)})
+		if len(found) == 0 {
+			exit(1)
+		}
+		return
+	}
+	if len(found) == 0 {
+		fmt.Println("no dqlite nodes found using the controller CA")
+		exit(1)
+	}
+	fmt.Println("found dqlite nodes using the controller CA:")
+	for _, address := range found {
+		fmt.Printf("\t%s\n", address)
+	}
+	fmt.Println("")
+	fmt.Println("node IDs are not discoverable, recover them from each node's info.yaml")
+}
+
+// discoverOutput is the data model of the discover command's JSON and
+// template output: the addresses of the nodes found.
+type discoverOutput struct {
+	Found []string `json:"found"`
+}
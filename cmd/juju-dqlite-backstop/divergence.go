@@ -0,0 +1,168 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "check-divergence",
+		args:    "[--path <dir>] [--from <host>...] [--copy-compression <compression>] [remote flags] <tag> [<name>=<dqlite dir>...]",
+		summary: "detect raft histories that have diverged between nodes",
+		run:     runCheckDivergence,
+	})
+}
+
+type namedHistory struct {
+	name    string
+	history raft.History
+}
+
+func runCheckDivergence(args []string) {
+	flags := newFlagSet("check-divergence", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	var from stringsFlag
+	flags.Var(&from, "from", "copy the raft log from this controller over ssh (repeatable)")
+	remoteDataDir := flags.String("remote-data-dir", agent.DefaultPaths.DataDir, "data directory on the other controllers")
+	timeout := flags.Duration("timeout", 5*time.Minute, "time to wait for each copy, made concurrently")
+	remoteFlags := addRemoteFlags(flags)
+	remoteFlags.addCompressionFlag(flags)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		commandUsage(commands["check-divergence"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	local, err := raft.ReadHistory(dataDir)
+	checkErr("read local raft log", err)
+	histories := []namedHistory{{name: "local", history: local}}
+
+	for _, arg := range flags.Args()[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			checkErr("parse arguments", fmt.Errorf("invalid directory %q, expected <name>=<dir>", arg))
+		}
+		history, err := raft.ReadHistory(parts[1])
+		checkErr("read raft log "+parts[1], err)
+		histories = append(histories, namedHistory{name: parts[0], history: history})
+	}
+
+	if len(from) > 0 {
+		histories = append(histories, remoteHistories(remoteFlags.transportFor(cfg), from, *remoteDataDir, *timeout)...)
+	}
+
+	if !reportDivergence(histories) {
+		exit(1)
+	}
+}
+
+// remoteHistories copies the raft logs from the hosts and reads them. Only the
+// segments and snapshot metadata are copied. The hosts are copied from
+// concurrently, each within the timeout, so that dead peers do not hold up
+// the others.
+func remoteHistories(transport remote.Transport, hosts []string, remoteDataDir string, timeout time.Duration) []namedHistory {
+	tmpDir, err := os.MkdirTemp("", "dqlite-backstop-raft-")
+	checkErr("create temporary directory", err)
+	defer os.RemoveAll(tmpDir)
+
+	results := make([]*namedHistory, len(hosts))
+	forEachHost(context.Background(), hosts, timeout, func(ctx context.Context, i int, host string) {
+		dir := filepath.Join(tmpDir, strconv.Itoa(i))
+		if err := os.Mkdir(dir, 0700); err != nil {
+			logger.Warningf("%s: %v", host, err)
+			return
+		}
+		if err := transport.CopyDir(ctx, host, database.DqliteDir(remoteDataDir), dir, "snapshot-*[0-9]"); err != nil {
+			logger.Warningf("%s: %v", host, err)
+			return
+		}
+		history, err := raft.ReadHistory(dir)
+		if err != nil {
+			logger.Warningf("%s: reading raft log: %v", host, err)
+			return
+		}
+		results[i] = &namedHistory{name: host, history: history}
+	})
+
+	var histories []namedHistory
+	for _, h := range results {
+		if h != nil {
+			histories = append(histories, *h)
+		}
+	}
+	return histories
+}
+
+// reportDivergence prints the histories, where they diverge, and what choosing
+// each node as the survivor would discard. It returns false if any of the
+// histories have diverged.
+func reportDivergence(histories []namedHistory) bool {
+	for _, h := range histories {
+		last := h.history.Last()
+		fmt.Printf("%s: last entry %d (term %d)", h.name, last.Index, last.Term)
+		if h.history.Snapshot != nil {
+			fmt.Printf(", snapshot at %d (term %d)", h.history.Snapshot.Index, h.history.Snapshot.Term)
+		}
+		fmt.Println("")
+	}
+	fmt.Println("")
+
+	consistent := true
+	discarded := make([][]string, len(histories))
+	for i, a := range histories {
+		for j, b := range histories {
+			if j <= i {
+				continue
+			}
+			d := raft.Diverge(a.history, b.history)
+			switch {
+			case !d.Known:
+				logger.Warningf("%s and %s cannot be compared, their logs do not overlap", a.name, b.name)
+				continue
+			case d.Diverged():
+				consistent = false
+				fmt.Printf("%s and %s have DIVERGED after entry %d (term %d): %s has %d entries and %s has %d entries the other lacks\n",
+					a.name, b.name, d.Common.Index, d.Common.Term, a.name, d.AOnly, b.name, d.BOnly)
+			}
+			if d.BOnly > 0 {
+				discarded[i] = append(discarded[i], fmt.Sprintf("%d entries from %s", d.BOnly, b.name))
+			}
+			if d.AOnly > 0 {
+				discarded[j] = append(discarded[j], fmt.Sprintf("%d entries from %s", d.AOnly, a.name))
+			}
+		}
+	}
+	if consistent {
+		fmt.Println("no diverged histories found")
+	}
+
+	fmt.Println("")
+	for i, h := range histories {
+		if len(discarded[i]) == 0 {
+			fmt.Printf("keeping %s discards nothing\n", h.name)
+			continue
+		}
+		fmt.Printf("keeping %s discards %s\n", h.name, strings.Join(discarded[i], ", "))
+	}
+	return consistent
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/cert"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/doctor"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "doctor",
+		args:    "[--path <dir>] [--format text|json|template] [--template <template>] <tag>",
+		summary: "run health checks against the local controller",
+		run:     runDoctor,
+	})
+}
+
+// doctorEnv holds what the doctor checks operate on.
+type doctorEnv struct {
+	cfg         agent.Config
+	configPath  string
+	nodeManager *database.NodeManager
+	certWarn    time.Duration
+}
+
+// doctorOutput is the data model of the doctor command's JSON and template
+// output.
+type doctorOutput struct {
+	Worst    doctor.Severity  `json:"worst"`
+	Findings []doctor.Finding `json:"findings"`
+}
+
+// doctorCheck is a single check run by the doctor command.
+type doctorCheck struct {
+	name string
+	run  func(*doctorEnv, *doctor.Report)
+}
+
+// doctorChecks are the checks run by the doctor command, in order.
+var doctorChecks = []doctorCheck{
+	{name: "certificates", run: checkCertificates},
+	{name: "permissions", run: checkPermissions},
+	{name: "raft-membership", run: checkRaftMembership},
+}
+
+func runDoctor(args []string) {
+	flags := newFlagSet("doctor", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	certWarn := flags.Duration("cert-warn", 30*24*time.Hour, "warn when certificates expire within this period")
+	output := addOutputFlags(flags)
+	flags.Parse(args)
+	output.check()
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["doctor"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	env := &doctorEnv{
+		cfg:         cfg,
+		configPath:  configFilePath(agentFlags, flags.Arg(0)),
+		nodeManager: nodeManager,
+		certWarn:    *certWarn,
+	}
+
+	var report doctor.Report
+	for _, check := range doctorChecks {
+		check.run(env, &report)
+	}
+	if output.structured() {
+		output.write(doctorOutput{Worst: report.Worst(), Findings: append([]doctor.Finding{}, report.Findings...)})
+	} else {
+		report.Write(os.Stdout)
+	}
+
+	switch report.Worst() {
+	case doctor.Error:
+		exit(2)
+	case doctor.Warning:
+		exit(1)
+	}
+}
+
+// checkCertificates reports the expiry of the CA and controller certificates,
+// along with any key mismatch or chain problem.
+func checkCertificates(env *doctorEnv, report *doctor.Report) {
+	const name = "certificates"
+
+	info, ok := env.cfg.StateServingInfo()
+	if !ok {
+		report.Add(name, doctor.Error, "agent config has no controller certificate")
+		return
+	}
+	for _, status := range cert.CheckControllerCerts(env.cfg.CACert(), info.Cert, info.PrivateKey, time.Now(), env.certWarn) {
+		for _, problem := range status.Problems {
+			report.Add(name, doctor.Error, "%s: %s", status.Name, problem)
+		}
+		if len(status.Problems) > 0 {
+			continue
+		}
+		expires := fmt.Sprintf("expires %s (in %d days)",
+			status.NotAfter.Format(time.RFC3339), int(time.Until(status.NotAfter).Hours()/24))
+		if status.Expiring {
+			report.Add(name, doctor.Warning, "%s %s, rotate it soon", status.Name, expires)
+			continue
+		}
+		report.Add(name, doctor.OK, "%s %s", status.Name, expires)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "drain",
+		args:    "[--path <dir>] <tag> <address>",
+		summary: "move leadership off a node and demote it to spare before maintenance",
+		run:     runDrain,
+	})
+}
+
+func runDrain(args []string) {
+	flags := newFlagSet("drain", flag.ExitOnError)
+	addHookFlags(flags)
+	agentFlags := addAgentFlags(flags)
+	timeout := flags.Duration("timeout", 30*time.Second, "time to wait for the cluster")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		commandUsage(commands["drain"])
+		exit(1)
+	}
+
+	_, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+
+	address := flags.Arg(1)
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(nodeManager.Port()))
+	}
+
+	defer beginChange()()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	node, leader, err := nodeManager.DrainNode(ctx, address)
+	if leader != nil {
+		fmt.Printf("leadership transferred to node %d at %s\n", leader.ID, leader.Address)
+	}
+	checkErr("drain node", err)
+
+	dataDir, _ := nodeManager.EnsureDataDir()
+	recordAudit(dataDir, audit.NewRecord("drain", redactArgs(args)))
+
+	fmt.Printf("node %d at %s is now a spare and can be taken down\n", node.ID, node.Address)
+}
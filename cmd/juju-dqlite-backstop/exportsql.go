@@ -0,0 +1,166 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/collections/set"
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/backup"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+// sqliteHeader starts every SQLite database file.
+const sqliteHeader = "SQLite format 3\x00"
+
+func init() {
+	registerCommand(command{
+		name:    "export-sql",
+		args:    "[--database <name>...] [--output <dir>|-] [s3 flags] <backup>|<dqlite data dir>|<database file>",
+		summary: "write plain-text SQL dumps of the databases in a backup, data dir or database file",
+		run:     runExportSQL,
+	})
+}
+
+func runExportSQL(args []string) {
+	flags := newFlagSet("export-sql", flag.ExitOnError)
+	var names stringsFlag
+	flags.Var(&names, "database", "only export the named database (repeatable)")
+	output := flags.String("output", ".", "directory to write <database>.sql files to, or - for stdout")
+	timeout := flags.Duration("timeout", time.Hour, "timeout for reading the source and exporting")
+	s3Flags := addS3Flags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["export-sql"])
+		exit(1)
+	}
+
+	if *output == stdinPath {
+		stdoutIsPayload()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if tmp, dumps, ok := exportSize(ctx, flags.Arg(0), s3Flags); ok {
+		checkErr("check disk space", checkSpace("read the databases", os.TempDir(), tmp))
+		if *output != stdinPath {
+			checkErr("check disk space", checkSpace("export the databases", *output, dumps))
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp("", "export-sql-")
+	checkErr("export", err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	databases, err := exportSources(ctx, flags.Arg(0), s3Flags, tmpDir)
+	checkErr("read databases", err)
+
+	wanted := set.NewStrings(names...)
+	exported := 0
+	for _, db := range databases {
+		if !wanted.IsEmpty() && !wanted.Contains(db.name) {
+			continue
+		}
+		exported++
+		if *output == stdinPath {
+			fmt.Printf("-- database: %s\n", db.name)
+			checkErr("export "+db.name, database.DumpSQL(ctx, db.path, os.Stdout))
+			continue
+		}
+		path := filepath.Join(*output, db.name+".sql")
+		checkErr("export "+db.name, writeSQLDump(ctx, db.path, path))
+		fmt.Fprintf(os.Stderr, "database %s exported to %s\n", db.name, path)
+	}
+	if exported == 0 {
+		checkErr("export", errors.NotFoundf("databases %v in %s", []string(names), flags.Arg(0)))
+	}
+}
+
+// exportSources returns the databases to export from the source: those in
+// the latest snapshot of a backup or a Dqlite data directory, written out to
+// tmpDir, or a single database file.
+func exportSources(ctx context.Context, source string, s3Flags *s3Flags, tmpDir string) ([]dumpedDatabase, error) {
+	info, err := os.Stat(source)
+	switch {
+	case err == nil && info.IsDir():
+		return dumpSnapshotDatabases(source, tmpDir)
+	case err == nil && isSQLiteFile(source):
+		return []dumpedDatabase{{name: filepath.Base(source), path: source}}, nil
+	case err != nil && !backup.IsS3URL(source):
+		return nil, errors.Trace(err)
+	}
+
+	chain, err := backupChain(ctx, source, s3Flags)
+	if err != nil {
+		return nil, err
+	}
+	dataDir := database.DqliteDir(tmpDir)
+	for _, location := range chain {
+		if err := extractBackup(ctx, location, s3Flags, dataDir); err != nil {
+			return nil, fmt.Errorf("%s: %w", location, err)
+		}
+	}
+	return dumpSnapshotDatabases(dataDir, tmpDir)
+}
+
+// exportSize estimates the space needed to export the source: in the
+// temporary directory, for the backup extracted and the databases written
+// out, and for the dumps, which are taken to be about the size of the
+// databases.
+func exportSize(ctx context.Context, source string, s3Flags *s3Flags) (int64, int64, bool) {
+	info, err := os.Stat(source)
+	switch {
+	case err == nil && info.IsDir():
+		path, err := raft.LatestSnapshot(source)
+		if err != nil || path == "" {
+			return 0, 0, false
+		}
+		snapshot, err := os.Stat(path)
+		if err != nil {
+			return 0, 0, false
+		}
+		return snapshot.Size(), snapshot.Size(), true
+	case err == nil:
+		return 0, info.Size(), true
+	}
+	size, ok := backupSize(ctx, source, s3Flags)
+	return 2 * size, size, ok
+}
+
+// isSQLiteFile reports whether the file is an SQLite database.
+func isSQLiteFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+	header := make([]byte, len(sqliteHeader))
+	_, err = io.ReadFull(f, header)
+	return err == nil && bytes.Equal(header, []byte(sqliteHeader))
+}
+
+// writeSQLDump writes the SQL dump of the database to the path.
+func writeSQLDump(ctx context.Context, dbPath, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := database.DumpSQL(ctx, dbPath, f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return errors.Trace(f.Close())
+}
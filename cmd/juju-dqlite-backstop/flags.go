@@ -0,0 +1,254 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/backup"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/compress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/retry"
+)
+
+// stringsFlag is a flag.Value that can be supplied multiple times, collecting
+// each value. Comma separated values are also accepted.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
+
+// sshFlags are the flags used by commands that operate on remote machines.
+type sshFlags struct {
+	user       string
+	jumpHosts  stringsFlag
+	socksProxy string
+	options    stringsFlag
+}
+
+// addSSHFlags adds the SSH flags to the flag set.
+func addSSHFlags(flags *flag.FlagSet) *sshFlags {
+	f := &sshFlags{}
+	flags.StringVar(&f.user, "ssh-user", "", "user to connect to remote machines as")
+	flags.Var(&f.jumpHosts, "ssh-jump", "jump host to connect to remote machines through (repeatable, as ssh -J)")
+	flags.StringVar(&f.socksProxy, "ssh-socks-proxy", "", "SOCKS5 proxy host:port to connect to remote machines through")
+	flags.Var(&f.options, "ssh-option", "additional ssh option (repeatable, as ssh -o)")
+	return f
+}
+
+// config returns the SSH config described by the flags.
+func (f *sshFlags) config() remote.SSHConfig {
+	cfg := remote.SSHConfig{
+		User:       f.user,
+		JumpHosts:  f.jumpHosts,
+		SOCKSProxy: f.socksProxy,
+		Options:    f.options,
+	}
+	checkErr("ssh flags", cfg.Validate())
+	return cfg
+}
+
+// remoteFlags are the flags used by commands that operate on the other
+// controllers, over SSH or, for controllers on Kubernetes, kubectl.
+type remoteFlags struct {
+	transport   string
+	ssh         *sshFlags
+	namespace   string
+	container   string
+	context     string
+	kubeconfig  string
+	compression string
+}
+
+// addRemoteFlags adds the SSH and Kubernetes flags to the flag set.
+func addRemoteFlags(flags *flag.FlagSet) *remoteFlags {
+	f := &remoteFlags{ssh: addSSHFlags(flags)}
+	addRetryFlags(flags)
+	flags.StringVar(&f.transport, "transport", "auto", "how to reach the other controllers: ssh, kubernetes or auto")
+	flags.StringVar(&f.namespace, "k8s-namespace", remote.InClusterNamespace(), "namespace of the controller pods")
+	flags.StringVar(&f.container, "k8s-container", remote.DefaultControllerContainer, "container of the controller pods running jujud")
+	flags.StringVar(&f.context, "k8s-context", "", "kubeconfig context to use")
+	flags.StringVar(&f.kubeconfig, "kubeconfig", "", "path to the kubeconfig file")
+	return f
+}
+
+// addCompressionFlag adds a flag for compressing the directories copied from
+// the other controllers. It is only offered by commands that copy them.
+func (f *remoteFlags) addCompressionFlag(flags *flag.FlagSet) {
+	flags.StringVar(&f.compression, "copy-compression", compress.None,
+		"compression of copied directories: gzip, zstd or none, optionally followed by :<level>")
+}
+
+// transportFor returns the transport described by the flags. With the auto
+// transport, Kubernetes is used for controllers on Kubernetes, according to
+// the agent config if there is one, and SSH otherwise.
+func (f *remoteFlags) transportFor(cfg agent.Config) remote.Transport {
+	kind := f.transport
+	if kind == "auto" {
+		kind = "ssh"
+		if cfg != nil && agent.IsCAAS(cfg) || cfg == nil && remote.InClusterNamespace() != "" {
+			kind = "kubernetes"
+		}
+	}
+	compression := compress.Compression{Algorithm: compress.None}
+	if f.compression != "" {
+		var err error
+		compression, err = compress.Parse(f.compression)
+		checkErr("parse --copy-compression", err)
+	}
+	switch kind {
+	case "ssh":
+		ssh := f.ssh.config()
+		ssh.Compression = compression
+		ssh.Retry = remoteRetryStrategy()
+		return ssh
+	case "kubernetes":
+		k8s := remote.KubernetesConfig{
+			Namespace:   f.namespace,
+			Container:   f.container,
+			Context:     f.context,
+			Kubeconfig:  f.kubeconfig,
+			Compression: compression,
+			Retry:       remoteRetryStrategy(),
+		}
+		checkErr("kubernetes flags", k8s.Validate())
+		return k8s
+	default:
+		checkErr("transport flags", fmt.Errorf("unknown transport %q", f.transport))
+		return nil
+	}
+}
+
+// agentFlags are the flags used to read the agent config of the local
+// controller.
+type agentFlags struct {
+	path       string
+	caCert     string
+	clientCert string
+	clientKey  string
+}
+
+// addAgentFlags adds the agent config flags to the flag set.
+func addAgentFlags(flags *flag.FlagSet) *agentFlags {
+	f := &agentFlags{}
+	flags.StringVar(&f.path, "path", agent.DefaultPaths.DataDir, "path to agent config, or - to read it from stdin")
+	flags.StringVar(&f.caCert, "ca-cert", "", "path to a PEM CA bundle to use instead of the CA in the agent config")
+	addRetryFlags(flags)
+	addJujuVersionFlag(flags)
+	return f
+}
+
+// retrying holds the retry flags, which are shared by the agent and remote
+// flags as both read stores and connect to the other controllers.
+var retrying = struct {
+	retry.Strategy
+	// remoteTimeout bounds each attempt at a remote command, which unlike
+	// a connection may take a long time to complete.
+	remoteTimeout time.Duration
+}{Strategy: retry.Default}
+
+// addRetryFlags adds the flags configuring how transient failures are
+// retried to the flag set, if they have not been added already.
+func addRetryFlags(flags *flag.FlagSet) {
+	if flags.Lookup("retries") != nil {
+		return
+	}
+	flags.IntVar(&retrying.Attempts, "retries", retry.Default.Attempts, "attempts made at reading stores, connecting to nodes and running remote commands")
+	flags.DurationVar(&retrying.Delay, "retry-delay", retry.Default.Delay, "wait before the first retry, doubling for each after it")
+	flags.DurationVar(&retrying.MaxDelay, "retry-max-delay", retry.Default.MaxDelay, "longest wait between retries")
+	flags.DurationVar(&retrying.Timeout, "attempt-timeout", retry.Default.Timeout, "time allowed for each store read or connection attempt, or 0 for no limit")
+	flags.DurationVar(&retrying.remoteTimeout, "remote-attempt-timeout", 0, "time allowed for each attempt at a remote command, or 0 for no limit")
+}
+
+// retryStrategy returns the retry strategy configured by the flags.
+func retryStrategy() retry.Strategy {
+	strategy := retrying.Strategy
+	if strategy.Attempts < 1 {
+		checkErr("retry flags", fmt.Errorf("--retries must be at least 1"))
+	}
+	strategy.Logger = logger
+	return strategy
+}
+
+// remoteRetryStrategy returns the retry strategy for remote commands.
+func remoteRetryStrategy() retry.Strategy {
+	strategy := retryStrategy()
+	strategy.Timeout = retrying.remoteTimeout
+	return strategy
+}
+
+// addClientCertFlags adds flags for supplying the client certificate from
+// files. These are only offered by read-only commands, so that a machine
+// without the controller's serving info can be used for diagnosis.
+func (f *agentFlags) addClientCertFlags(flags *flag.FlagSet) {
+	flags.StringVar(&f.clientCert, "client-cert", "", "path to a PEM client certificate to use instead of the controller certificate")
+	flags.StringVar(&f.clientKey, "client-key", "", "path to the PEM private key of --client-cert")
+}
+
+// s3Flags are the flags used by commands that write backups to, or read them
+// from, S3-compatible object storage. Credentials default to the standard AWS
+// environment variables.
+type s3Flags struct {
+	endpoint      string
+	region        string
+	virtualHosted bool
+	accessKey     string
+	secretKey     string
+	caCert        string
+}
+
+// addS3Flags adds the S3 flags to the flag set.
+func addS3Flags(flags *flag.FlagSet) *s3Flags {
+	f := &s3Flags{}
+	flags.StringVar(&f.endpoint, "s3-endpoint", os.Getenv("AWS_ENDPOINT_URL"), "URL of the S3-compatible endpoint, defaults to AWS in the region")
+	flags.StringVar(&f.region, "s3-region", os.Getenv("AWS_REGION"), "region of the bucket, defaults to us-east-1")
+	flags.BoolVar(&f.virtualHosted, "s3-virtual-hosted", false, "address the bucket as a subdomain of the endpoint")
+	flags.StringVar(&f.accessKey, "s3-access-key", "", "access key, defaults to $AWS_ACCESS_KEY_ID")
+	flags.StringVar(&f.secretKey, "s3-secret-key", "", "secret key, defaults to $AWS_SECRET_ACCESS_KEY")
+	flags.StringVar(&f.caCert, "s3-ca-cert", "", "path to a PEM CA certificate for the endpoint")
+	return f
+}
+
+// client returns an S3 client configured by the flags.
+func (f *s3Flags) client() *backup.S3 {
+	cfg := backup.S3Config{
+		Endpoint:      f.endpoint,
+		Region:        f.region,
+		VirtualHosted: f.virtualHosted,
+		Credentials: backup.Credentials{
+			AccessKey:    f.accessKey,
+			SecretKey:    f.secretKey,
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+	if cfg.Credentials.AccessKey == "" {
+		cfg.Credentials.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if cfg.Credentials.SecretKey == "" {
+		cfg.Credentials.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if f.caCert != "" {
+		data, err := os.ReadFile(f.caCert)
+		checkErr("read S3 CA certificate", err)
+		cfg.CACert = data
+	}
+	client, err := backup.NewS3(cfg)
+	checkErr("s3 flags", err)
+	return client
+}
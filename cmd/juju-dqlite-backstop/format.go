@@ -0,0 +1,121 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/juju/errors"
+)
+
+const (
+	formatText     = "text"
+	formatJSON     = "json"
+	formatTemplate = "template"
+)
+
+// templateFuncs are the functions available to --template, beyond those
+// built in to Go templates.
+var templateFuncs = template.FuncMap{
+	"join": func(values []interface{}, sep string) string {
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = fmt.Sprint(v)
+		}
+		return strings.Join(parts, sep)
+	},
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// outputFlags choose how a status or list command writes its output: as
+// text for people, or as JSON or a Go template over the same data, for
+// scripts and dashboards.
+type outputFlags struct {
+	format string
+	text   string
+	tmpl   *template.Template
+}
+
+// addOutputFlags adds the output format flags to the flag set.
+func addOutputFlags(flags *flag.FlagSet) *outputFlags {
+	f := &outputFlags{}
+	flags.StringVar(&f.format, "format", formatText, "output format: text, json or template")
+	flags.StringVar(&f.text, "template", "", "Go template to execute over the JSON data model, with --format template")
+	return f
+}
+
+// check validates the flags, once parsed, and parses the template. JSON and
+// template output is kept out of the run log.
+func (f *outputFlags) check() {
+	switch f.format {
+	case formatText, formatJSON:
+		if f.text != "" {
+			checkErr("parse flags", errors.Errorf("--template is only used with --format template"))
+		}
+	case formatTemplate:
+		if f.text == "" {
+			checkErr("parse flags", errors.Errorf("--format template needs a --template"))
+		}
+		tmpl, err := template.New("output").Funcs(templateFuncs).Parse(f.text)
+		checkErr("parse template", err)
+		f.tmpl = tmpl
+	default:
+		checkErr("parse flags", errors.Errorf("unknown output format %q, expected text, json or template", f.format))
+	}
+	if f.structured() {
+		stdoutIsPayload()
+	}
+}
+
+// structured returns whether the output is written by write, rather than
+// as text.
+func (f *outputFlags) structured() bool {
+	return f.format != formatText
+}
+
+// write writes the value to stdout as JSON, or executes the template over
+// the JSON, so that templates use the same names as the JSON output. A
+// template's output is ended with a newline if it lacks one.
+func (f *outputFlags) write(value interface{}) {
+	checkErr("write output", f.writeTo(os.Stdout, value))
+}
+
+func (f *outputFlags) writeTo(w io.Writer, value interface{}) error {
+	if f.tmpl == nil {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return errors.Trace(enc.Encode(value))
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var model interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&model); err != nil {
+		return errors.Trace(err)
+	}
+
+	var out strings.Builder
+	if err := f.tmpl.Execute(&out, model); err != nil {
+		return errors.Annotate(err, "executing template")
+	}
+	text := out.String()
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	_, err = fmt.Fprint(w, text)
+	return errors.Trace(err)
+}
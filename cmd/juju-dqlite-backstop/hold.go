@@ -0,0 +1,172 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/hold"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/journal"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "hold-agents",
+		args:    "[--path <dir>] [--unit <unit>...] [--mask] [--stop] <tag>",
+		summary: "stop systemd starting the machine agent while the node is being repaired",
+		run:     runHoldAgents,
+	})
+	registerCommand(command{
+		name:    "release-agents",
+		args:    "[--path <dir>] [--unit <unit>...] [--start] <tag>",
+		summary: "let systemd start the machine agent again once the node is repaired",
+		run:     runReleaseAgents,
+	})
+}
+
+// holdFlags are the flags shared by hold-agents and release-agents.
+type holdFlags struct {
+	units   stringsFlag
+	unitDir string
+}
+
+func addHoldFlags(flags *flag.FlagSet) *holdFlags {
+	f := &holdFlags{}
+	flags.Var(&f.units, "unit", "another systemd unit to hold or release, besides the machine agent (repeatable)")
+	flags.StringVar(&f.unitDir, "unit-dir", hold.DefaultUnitDir, "directory of the systemd units")
+	return f
+}
+
+// holdStep is the journal parameters of holding or releasing a unit.
+type holdStep struct {
+	Unit   string      `json:"unit"`
+	Method hold.Method `json:"method,omitempty"`
+}
+
+func runHoldAgents(args []string) {
+	flags := newFlagSet("hold-agents", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	holdFlags := addHoldFlags(flags)
+	mask := flags.Bool("mask", false, "mask the units rather than installing a drop-in, where the unit files allow it")
+	stop := flags.Bool("stop", false, "stop the units once they are held")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["hold-agents"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	if agent.IsCAAS(cfg) {
+		checkErr("hold agents", errors.Errorf(
+			"the agent cannot be held on Kubernetes, where Pebble restarts it with the pod: scale the controllers down with scale-controllers instead"))
+	}
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	method := hold.DropIn
+	if *mask {
+		method = hold.Mask
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	steps := journal.New(dataDir, logger)
+	units := append([]string{hold.Unit(flags.Arg(0))}, holdFlags.units...)
+	for _, unit := range units {
+		held, err := hold.Held(holdFlags.unitDir, unit)
+		checkErr("check hold", err)
+		if held != "" {
+			fmt.Printf("%s is already held (%s)\n", unit, held)
+			continue
+		}
+		err = steps.Step("hold agent", holdStep{Unit: unit, Method: method}, func() error {
+			return hold.Hold(ctx, holdFlags.unitDir, unit, method)
+		})
+		checkErr("hold "+unit, err)
+		fmt.Printf("%s is held (%s)\n", unit, method)
+	}
+	recordAudit(dataDir, audit.NewRecord("hold-agents", redactArgs(os.Args[1:])))
+
+	if *stop {
+		for _, unit := range units {
+			err := steps.Step("stop agent", holdStep{Unit: unit}, func() error {
+				return hold.Stop(ctx, unit)
+			})
+			checkErr("stop "+unit, err)
+		}
+	} else if active, err := remote.LocalActiveJujudServices(ctx); err != nil {
+		logger.Warningf("unable to check whether the agents are running: %v", err)
+	} else if len(active) > 0 {
+		logger.Warningf("still running, stop them before making changes: %s", strings.Join(active, ", "))
+	}
+
+	fmt.Println("")
+	fmt.Println("systemd will not start the agents, even after a reboot, until they are released using:")
+	fmt.Printf("\n\tjuju-dqlite-backstop release-agents %s\n\n", flags.Arg(0))
+	result.next("juju-dqlite-backstop release-agents %s", flags.Arg(0))
+}
+
+func runReleaseAgents(args []string) {
+	flags := newFlagSet("release-agents", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	holdFlags := addHoldFlags(flags)
+	start := flags.Bool("start", false, "start the units once they are released")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["release-agents"])
+		exit(1)
+	}
+
+	_, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	steps := journal.New(dataDir, logger)
+	units := append([]string{hold.Unit(flags.Arg(0))}, holdFlags.units...)
+	for _, unit := range units {
+		var released hold.Method
+		err := steps.Step("release agent", holdStep{Unit: unit}, func() error {
+			var err error
+			released, err = hold.Release(ctx, holdFlags.unitDir, unit)
+			return err
+		})
+		checkErr("release "+unit, err)
+		if released == "" {
+			fmt.Printf("%s was not held\n", unit)
+			continue
+		}
+		fmt.Printf("%s is released (%s)\n", unit, released)
+	}
+	recordAudit(dataDir, audit.NewRecord("release-agents", redactArgs(os.Args[1:])))
+
+	if !*start {
+		fmt.Println("")
+		fmt.Println("start the machine agent using:")
+		fmt.Printf("\n\tsystemctl start %s\n\n", hold.Unit(flags.Arg(0)))
+		result.next("systemctl start %s", hold.Unit(flags.Arg(0)))
+		return
+	}
+	for _, unit := range units {
+		err := steps.Step("start agent", holdStep{Unit: unit}, func() error {
+			return hold.Start(ctx, unit)
+		})
+		checkErr("start "+unit, err)
+		fmt.Printf("%s is started\n", unit)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+)
+
+const (
+	// defaultHooksDir holds hook scripts run around every change: those
+	// named pre-* before it, and post-* after it, in name order.
+	defaultHooksDir = "/etc/juju-dqlite-backstop/hooks.d"
+
+	// hookEnvPrefix starts the names of the environment variables
+	// describing the run to hooks.
+	hookEnvPrefix = "JUJU_DQLITE_BACKSTOP_"
+)
+
+// hooks holds the hook scripts run around the change a command makes, so
+// that sites can snapshot volumes, page someone or silence monitoring.
+var hooks = struct {
+	pre, post stringsFlag
+	dir       string
+	timeout   time.Duration
+
+	// tag, controller and dataDir describe the run to the hooks.
+	tag        string
+	controller string
+	dataDir    string
+	// began is set once the pre hooks start, so the post hooks run when
+	// the run finishes, however it finishes, to undo what they did.
+	began bool
+}{dir: defaultHooksDir}
+
+// addHookFlags adds the hook flags to the flag set of a command that makes
+// changes.
+func addHookFlags(flags *flag.FlagSet) {
+	flags.Var(&hooks.pre, "pre-hook", "script to run before making the change, which is not made if it fails (repeatable)")
+	flags.Var(&hooks.post, "post-hook", "script to run once the run finishes, whether or not the change succeeded (repeatable)")
+	flags.StringVar(&hooks.dir, "hooks-dir", defaultHooksDir, "directory of pre-* and post-* hook scripts, run after those given by flags")
+	flags.DurationVar(&hooks.timeout, "hook-timeout", 5*time.Minute, "time allowed for each hook script")
+}
+
+// beginChange runs the pre hooks, failing the run if any fails, then holds
+// signals back until the returned function is called. It is used, once the
+// operator has confirmed the change, as:
+//
+//	defer beginChange()()
+//
+// The context the change is made with is created after it, so that neither
+// the prompt nor the hooks use up the change's timeout.
+func beginChange() func() {
+	runPreHooks()
+	return holdSignals()
+}
+
+// runPreHooks runs the pre hooks, once, failing the run if any fails. A
+// command that prepares its change before holding signals back runs them
+// itself, and then calls holdSignals.
+func runPreHooks() {
+	if hooks.began {
+		return
+	}
+	hooks.began = true
+	for _, hook := range hookScripts("pre", hooks.pre) {
+		checkErr("run pre hook", failure.Wrap(failure.HookFailed, runHook(hook, "pre", nil)))
+	}
+}
+
+// runPostHooks runs the post hooks with the exit code of the run, if the
+// pre hooks were run. A failing post hook is only reported, as the change
+// has been made.
+func runPostHooks(code int) {
+	if !hooks.began {
+		return
+	}
+	hooks.began = false
+	for _, hook := range hookScripts("post", hooks.post) {
+		if err := runHook(hook, "post", []string{hookEnvPrefix + "EXIT_CODE=" + strconv.Itoa(code)}); err != nil {
+			logger.Warningf("post hook: %v", err)
+		}
+	}
+}
+
+// hookScripts returns the hooks of the kind given by flags, followed by the
+// executables in the hooks directory named after the kind.
+func hookScripts(kind string, given []string) []string {
+	scripts := append([]string{}, given...)
+	matches, err := filepath.Glob(filepath.Join(hooks.dir, kind+"-*"))
+	if err != nil {
+		logger.Warningf("unable to read hooks in %s: %v", hooks.dir, err)
+	}
+	sort.Strings(matches)
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			scripts = append(scripts, path)
+		}
+	}
+	return scripts
+}
+
+// runHook runs the hook script, with the run described in its environment.
+// Its output is passed through to the console.
+func runHook(path, kind string, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hooks.timeout)
+	defer cancel()
+
+	logger.Infof("running %s hook %s", kind, path)
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		hookEnvPrefix+"HOOK="+kind,
+		hookEnvPrefix+"COMMAND="+run.command,
+		hookEnvPrefix+"TAG="+hooks.tag,
+		hookEnvPrefix+"CONTROLLER_UUID="+hooks.controller,
+		hookEnvPrefix+"DATA_DIR="+hooks.dataDir,
+		hookEnvPrefix+"ARGS="+strings.Join(redactArgs(os.Args[1:]), " "),
+		hookEnvPrefix+"PID="+strconv.Itoa(os.Getpid()),
+	)
+	cmd.Env = append(cmd.Env, env...)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s hook %s did not finish within %s", kind, path, hooks.timeout)
+		}
+		return fmt.Errorf("%s hook %s: %w", kind, path, err)
+	}
+	return nil
+}
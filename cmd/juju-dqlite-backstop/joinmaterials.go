@@ -0,0 +1,175 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
+)
+
+// joinInstructions is written alongside the pre-seeded cluster.yaml for each
+// node removed from the membership.
+var joinInstructions = template.Must(template.New("join").Parse(`
+Node {{.Node.ID}} at {{.Node.Address}} was removed from the dqlite cluster,
+which is now:
+{{range .Membership}}
+	node {{.ID}} at {{.Address}} ({{.Role}}){{end}}
+
+To bring the controller on {{.Host}} back, it must join the cluster as a new
+node with no data. Its old data must not be reused: it no longer matches the
+cluster, and starting with it can cause a split brain.
+
+On {{.Host}}, either run:
+
+	juju-dqlite-backstop rejoin-node <tag> {{.Survivor}}
+
+or by hand:
+
+	{{.Stop}}
+	mv {{.DqliteDir}} {{.DqliteDir}}.removed
+	mkdir -m 0700 {{.DqliteDir}}
+	cp cluster.yaml {{.DqliteDir}}/cluster.yaml
+	chown -R --reference={{.DqliteDir}}.removed {{.DqliteDir}}
+	{{.Start}}
+
+where <tag> is the agent tag of the controller, for example machine-1.
+
+Once it has started, check it has joined with:
+
+	juju-dqlite-backstop wait-healthy <tag>
+
+and remove {{.DqliteDir}}.removed when the cluster is healthy.
+`[1:]))
+
+func init() {
+	registerCommand(command{
+		name:    "join-materials",
+		args:    "[--path <dir>] [--output <dir>] [--remote-data-dir <dir>] <tag>",
+		summary: "write instructions and files for re-adding the nodes last removed",
+		run:     runJoinMaterials,
+	})
+}
+
+func runJoinMaterials(args []string) {
+	flags := newFlagSet("join-materials", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	output := flags.String("output", "join-materials", "directory to write the materials to")
+	remoteDataDir := flags.String("remote-data-dir", "", "data directory on the removed controllers, if not the same as this one")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["join-materials"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	membership, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+	if len(membership) == 0 {
+		checkErr("get cluster servers", fmt.Errorf("cluster.yaml has no nodes"))
+	}
+
+	// The nodes removed are found from the last change to the membership
+	// recorded in the audit log.
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+	records, err := audit.Read(audit.Path(dataDir))
+	checkErr("read audit log", err)
+
+	var removed []dqlite.NodeInfo
+	for i := len(records) - 1; i >= 0 && len(removed) == 0; i-- {
+		removed = removedNodes(records[i].Before, membership)
+	}
+	if len(removed) == 0 {
+		fmt.Println("no removed nodes are recorded in the audit log")
+		return
+	}
+
+	if *remoteDataDir == "" {
+		*remoteDataDir = cfg.DataDir()
+	}
+	checkErr("write join materials", writeJoinMaterials(*output, removed, membership, *remoteDataDir, newAgentService(cfg, "<tag>")))
+}
+
+// removedNodes returns the nodes in before that are not in after.
+func removedNodes(before, after []dqlite.NodeInfo) []dqlite.NodeInfo {
+	var removed []dqlite.NodeInfo
+	for _, node := range before {
+		if !containsID(after, node.ID) {
+			removed = append(removed, node)
+		}
+	}
+	return removed
+}
+
+// writeJoinMaterials writes a directory for each removed node, holding a
+// cluster.yaml pointing at the membership and instructions for wiping the
+// node's data so that it rejoins as a new node. The service is that of the
+// removed controllers' agents, with <tag> for their tags.
+func writeJoinMaterials(dir string, removed, membership []dqlite.NodeInfo, remoteDataDir string, service agentService) error {
+	clusterYAML, err := yaml.Marshal(membership)
+	if err != nil {
+		return err
+	}
+	survivor := membership[0].Address
+	for _, node := range membership {
+		if node.Role == dqlite.Voter {
+			survivor = node.Address
+			break
+		}
+	}
+
+	for _, node := range removed {
+		host, err := internalnet.SplitHost(node.Address)
+		if err != nil {
+			host = node.Address
+		}
+		nodeDir := filepath.Join(dir, fmt.Sprintf("node-%d-%s", node.ID, strings.ReplaceAll(host, ":", "_")))
+		if err := os.MkdirAll(nodeDir, 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(nodeDir, "cluster.yaml"), clusterYAML, 0600); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(filepath.Join(nodeDir, "INSTRUCTIONS"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		err = joinInstructions.Execute(f, map[string]interface{}{
+			"Node":       node,
+			"Host":       host,
+			"Membership": membership,
+			"Survivor":   survivor,
+			"DqliteDir":  database.DqliteDir(remoteDataDir),
+			"Stop":       service.command("stop"),
+			"Start":      service.command("start"),
+		})
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("wrote instructions for re-adding node %d on %s to %s\n", node.ID, host, nodeDir)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/journal"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "journal",
+		args:    "[--path <dir>] [--format text|json|template] [--template <template>] <tag>",
+		summary: "show the journal of steps taken by the backstop, and any it was interrupted taking",
+		run:     runJournal,
+	})
+}
+
+func runJournal(args []string) {
+	flags := newFlagSet("journal", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	output := addOutputFlags(flags)
+	flags.Parse(args)
+	output.check()
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["journal"])
+		exit(1)
+	}
+
+	_, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	entries, err := journal.Read(journal.Path(dataDir))
+	if os.IsNotExist(err) && output.structured() {
+		output.write(journalOutput{Entries: []journalEntry{}})
+		return
+	} else if os.IsNotExist(err) {
+		fmt.Println("no steps have been journaled")
+		return
+	}
+	if err != nil && len(entries) == 0 {
+		checkErr("read journal", err)
+	} else if err != nil {
+		logger.Warningf("unable to read all of the journal: %v", err)
+	}
+
+	unfinished := make(map[int]bool)
+	for _, i := range journal.Unfinished(entries) {
+		unfinished[i] = true
+	}
+	if output.structured() {
+		out := journalOutput{Entries: make([]journalEntry, len(entries)), Interrupted: len(unfinished)}
+		for i, entry := range entries {
+			out.Entries[i] = journalEntry{Entry: entry, Interrupted: unfinished[i]}
+		}
+		output.write(out)
+		if len(unfinished) > 0 {
+			exit(1)
+		}
+		return
+	}
+	for i, entry := range entries {
+		stamp := entry.Time.Format(time.RFC3339)
+		switch entry.Phase {
+		case journal.PhaseRun:
+			controller := ""
+			if entry.Controller != "" {
+				controller = " (controller " + entry.Controller + ")"
+			}
+			fmt.Printf("%s run %s: %s %s%s\n", stamp, entry.Run, entry.Operation, strings.Join(entry.Args, " "), controller)
+		case journal.PhaseBegin:
+			status := ""
+			if unfinished[i] {
+				status = " INTERRUPTED"
+			}
+			fmt.Printf("%s\tbegin %s %s%s\n", stamp, entry.Step, string(entry.Params), status)
+		case journal.PhaseEnd:
+			if entry.Error != "" {
+				fmt.Printf("%s\tend %s: FAILED: %s\n", stamp, entry.Step, entry.Error)
+				continue
+			}
+			fmt.Printf("%s\tend %s: ok\n", stamp, entry.Step)
+		case journal.PhaseInterrupted:
+			fmt.Printf("%s\tinterrupted by %s\n", stamp, entry.Error)
+		}
+	}
+	if n := len(unfinished); n > 0 {
+		fmt.Printf("%d step(s) were interrupted, the data directory may be part way through them\n", n)
+		exit(1)
+	}
+}
+
+// journalOutput is the data model of the journal command's JSON and template
+// output. Interrupted is the number of steps begun but not ended.
+type journalOutput struct {
+	Entries     []journalEntry `json:"entries"`
+	Interrupted int            `json:"interrupted"`
+}
+
+// journalEntry is an entry of the journal, marked if it begins a step that
+// was interrupted.
+type journalEntry struct {
+	journal.Entry
+	Interrupted bool `json:"interrupted,omitempty"`
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/names/v4"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/jujuversion"
+)
+
+// ignoreJujuVersion lets the backstop run against a Juju version whose
+// Dqlite layout it does not understand.
+var ignoreJujuVersion bool
+
+// addJujuVersionFlag adds --ignore-juju-version to the flag set, if it has
+// not been added already.
+func addJujuVersionFlag(flags *flag.FlagSet) {
+	if flags.Lookup("ignore-juju-version") != nil {
+		return
+	}
+	flags.BoolVar(&ignoreJujuVersion, "ignore-juju-version", false,
+		"run against a Juju version whose Dqlite layout the backstop does not understand")
+}
+
+// checkJujuVersion refuses to continue if the agent's Juju version is one
+// whose Dqlite layout the backstop does not understand, unless
+// --ignore-juju-version is given. Both the version of the installed agent
+// binaries and the version the agent last upgraded to are checked, as the
+// data is in the layout of one and is about to be used by the other.
+func checkJujuVersion(cfg agent.Config, tag names.Tag) {
+	var versions []string
+	if tools, err := agent.ToolsVersion(cfg.DataDir(), tag); err == nil {
+		versions = append(versions, tools)
+	}
+	if upgraded := cfg.UpgradedToVersion(); upgraded != "" && (len(versions) == 0 || versions[0] != upgraded) {
+		versions = append(versions, upgraded)
+	}
+	if len(versions) == 0 {
+		logger.Warningf("the Juju version of the agent is unknown, so it is not checked against %s", jujuversion.Supports())
+		return
+	}
+
+	var problems []string
+	for _, version := range versions {
+		support, reason, err := jujuversion.Check(version)
+		switch {
+		case err != nil:
+			logger.Warningf("unable to check the Juju version: %v", err)
+		case support == jujuversion.Untested:
+			logger.Warningf("%s", reason)
+		case support == jujuversion.Unsupported:
+			problems = append(problems, reason)
+		}
+	}
+	if len(problems) == 0 {
+		return
+	}
+	if ignoreJujuVersion {
+		for _, problem := range problems {
+			logger.Warningf("%s, continuing with --ignore-juju-version", problem)
+		}
+		return
+	}
+	checkErr("check juju version", failure.Wrap(failure.UnsupportedVersion, errors.New(strings.Join(problems, "; "))))
+}
@@ -0,0 +1,369 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/collections/set"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
+)
+
+// resolveNodeTimeout is the time allowed to resolve each node address.
+const resolveNodeTimeout = 5 * time.Second
+
+// describeNodeAddress returns the node address along with the local interface
+// that its IP is on, for example "10.0.0.5:17666 (10.0.0.5 on eth0)".
+func describeNodeAddress(address string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ips, err := resolveNodeAddress(ctx, address)
+	if err != nil {
+		return address
+	}
+	lifetimes, err := internalnet.AddressLifetimes()
+	if err != nil {
+		logger.Debugf("unable to read address lifetimes: %v", err)
+	}
+	for _, ip := range ips {
+		desc := internalnet.DescribeIP(ip.String())
+		if desc == ip.String() {
+			continue
+		}
+		if lifetime, ok := lifetimes[ip.String()]; ok {
+			desc = fmt.Sprintf("%s, %s", desc, lifetime)
+		}
+		return fmt.Sprintf("%s (%s)", address, desc)
+	}
+	return fmt.Sprintf("%s (not a local address)", address)
+}
+
+// spaceSubnets returns the subnets of the controller's HA and management
+// spaces. These are read from the live cluster, which is often unavailable
+// when the backstop is required, so any failure only results in a warning.
+func spaceSubnets(ctx context.Context, nodeManager *database.NodeManager) []*net.IPNet {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	subnets, err := nodeManager.ControllerSpaceSubnets(ctx)
+	if err != nil {
+		logger.Warningf("unable to determine controller space subnets: %v", err)
+		return nil
+	}
+	if len(subnets) > 0 {
+		logger.Infof("preferring addresses in controller space subnets %v", subnets)
+	}
+	return subnets
+}
+
+func findLeaderNode(
+	ctx context.Context,
+	nodeInfo []dqlite.NodeInfo, addresses []string,
+	preferred []*net.IPNet, resolveTimeout time.Duration, opts ...internalnet.Option,
+) ([]dqlite.NodeInfo, string, error) {
+	// If the number of addresses matches the number of nodes, then work out
+	// which ip address is actually ours. Then we can remove all the others
+	// from the node list.
+	addrs := set.NewStrings()
+	source := "api address"
+	if len(nodeInfo) == 1 || len(addresses) > 1 {
+		source = "local address"
+		local, err := internalnet.LocalAddresses(opts...)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to find external ips: %w", err)
+		}
+		for _, addr := range local {
+			logger.Infof("found local address %s", addr)
+			addrs.Add(addr.IP)
+		}
+	} else {
+		for _, addr := range addresses {
+			addrs.Add(addr)
+		}
+	}
+
+	var hostnames []string
+	for _, addr := range addrs.SortedValues() {
+		host, err := internalnet.SplitHost(addr)
+		checkErr("split host port", err)
+		hostnames = append(hostnames, host)
+	}
+
+	// API addresses may be DNS names, so resolve them to match against the
+	// node addresses.
+	hosts, err := internalnet.ResolveHosts(ctx, hostnames, resolveTimeout)
+	if err != nil {
+		if hosts.IsEmpty() {
+			return nil, "", fmt.Errorf("unable to resolve addresses: %w", err)
+		}
+		logger.Warningf("%v", err)
+	}
+
+	// Node addresses may also be DNS names, in which case they're resolved
+	// and matched on any of their addresses. The node is written back with
+	// the address unchanged.
+	resolved := resolveNodeAddresses(ctx, nodeInfo)
+	var matches []candidate
+	for _, info := range nodeInfo {
+		ips, ok := resolved[info.ID]
+		if !ok {
+			continue
+		}
+		var matched []net.IP
+		for _, ip := range ips {
+			if hosts.Contains(ip.String()) {
+				matched = append(matched, ip)
+			}
+		}
+		if len(matched) > 0 {
+			matches = append(matches, candidate{node: info, ips: matched})
+		}
+	}
+	if len(matches) == 0 {
+		return nil, "", fmt.Errorf("unable to find leader node")
+	}
+
+	rankCandidates(ctx, matches, nodeInfo, preferred)
+
+	// If the best candidates can't be told apart, for example when two
+	// interfaces carry addresses in the same subnet, then picking one would
+	// be a guess. Require the operator to choose instead.
+	if ambiguous := tiedCandidates(matches); len(ambiguous) > 1 {
+		var desc []string
+		for _, c := range ambiguous {
+			desc = append(desc, fmt.Sprintf("node %d %s", c.node.ID, describeNodeAddress(c.node.Address)))
+		}
+		return nil, "", fmt.Errorf(
+			"multiple local addresses match cluster nodes equally well:\n\t%s\n"+
+				"use --interface or --cidr to choose one", strings.Join(desc, "\n\t"))
+	}
+	return []dqlite.NodeInfo{matches[0].node}, matches[0].reason(source, len(matches)), nil
+}
+
+// tiedCandidates returns the ranked candidates that are as suitable as the
+// first one.
+func tiedCandidates(candidates []candidate) []candidate {
+	if len(candidates) == 0 {
+		return nil
+	}
+	best := candidates[0]
+	tied := []candidate{best}
+	for _, c := range candidates[1:] {
+		if c.inSpace != best.inSpace || c.peerCount != best.peerCount {
+			break
+		}
+		tied = append(tied, c)
+	}
+	return tied
+}
+
+// candidate is a node from cluster.yaml that has an address on this machine.
+type candidate struct {
+	node dqlite.NodeInfo
+	// ips are the resolved addresses of the node that are local.
+	ips []net.IP
+
+	inSpace   bool
+	peerCount int
+}
+
+// reason describes why the candidate was chosen.
+func (c candidate) reason(source string, total int) string {
+	var matched []string
+	for _, ip := range c.ips {
+		matched = append(matched, internalnet.DescribeIP(ip.String()))
+	}
+	reason := fmt.Sprintf("node %d address %s matched %s %s",
+		c.node.ID, c.node.Address, source, strings.Join(matched, ", "))
+	if total > 1 {
+		reason += fmt.Sprintf(", ranked first of %d candidates", total)
+	}
+	if c.inSpace {
+		reason += ", in a controller space"
+	}
+	if c.peerCount > 0 {
+		reason += fmt.Sprintf(", sharing a subnet with %d peers", c.peerCount)
+	}
+	return reason
+}
+
+// rankCandidates orders the candidates so that the most suitable is first.
+// Nodes in the controller spaces are preferred, so that the survivor is
+// bound to an address that the peers can reach. After that, nodes whose local
+// subnet is shared with the most other nodes in cluster.yaml are preferred,
+// as a multi-homed controller commonly has valid but unsuitable addresses.
+func rankCandidates(ctx context.Context, candidates []candidate, nodeInfo []dqlite.NodeInfo, preferred []*net.IPNet) {
+	local, err := internalnet.LocalAddresses()
+	if err != nil {
+		logger.Debugf("unable to rank candidates by subnet: %v", err)
+	}
+
+	peers := resolveNodeAddresses(ctx, nodeInfo)
+
+	for i := range candidates {
+		c := &candidates[i]
+		for _, ip := range c.ips {
+			c.inSpace = c.inSpace || subnetsContain(preferred, ip)
+			network := localNetwork(local, ip)
+			if network == nil {
+				continue
+			}
+			var count int
+			for id, ips := range peers {
+				if id == c.node.ID {
+					continue
+				}
+				for _, peerIP := range ips {
+					if network.Contains(peerIP) {
+						count++
+						break
+					}
+				}
+			}
+			if count > c.peerCount {
+				c.peerCount = count
+			}
+		}
+		logger.Infof("candidate node %d %s: in space %t, shares subnet with %d peers",
+			c.node.ID, c.node.Address, c.inSpace, c.peerCount)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].inSpace != candidates[j].inSpace {
+			return candidates[i].inSpace
+		}
+		return candidates[i].peerCount > candidates[j].peerCount
+	})
+}
+
+// localNetwork returns the subnet configured for the local IP address.
+func localNetwork(local []internalnet.Address, ip net.IP) *net.IPNet {
+	for _, addr := range local {
+		if addr.IP == ip.String() {
+			return addr.Network
+		}
+	}
+	return nil
+}
+
+// resolveNodeAddresses resolves the addresses of all the nodes concurrently,
+// returning the IP addresses keyed by node ID. Nodes that cannot be resolved
+// are logged and omitted.
+func resolveNodeAddresses(ctx context.Context, nodes []dqlite.NodeInfo) map[uint64][]net.IP {
+	results := make([][]net.IP, len(nodes))
+	forEachNode(ctx, nodes, resolveNodeTimeout, func(ctx context.Context, i int, node dqlite.NodeInfo) {
+		ips, err := resolveNodeAddress(ctx, node.Address)
+		if err != nil {
+			logger.Warningf("unable to resolve node %d address %q: %v", node.ID, node.Address, err)
+			return
+		}
+		results[i] = ips
+	})
+
+	resolved := make(map[uint64][]net.IP, len(nodes))
+	for i, node := range nodes {
+		if results[i] != nil {
+			resolved[node.ID] = results[i]
+		}
+	}
+	return resolved
+}
+
+// resolveNodeAddress returns the IP addresses of the node address, resolving
+// the host if it is a DNS name.
+func resolveNodeAddress(ctx context.Context, address string) ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := internalnet.ResolveHosts(ctx, []string{host}, resolveNodeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range resolved.SortedValues() {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+func subnetsContain(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressWarnings checks that the survivor's address can be dialled by its
+// peers. Writing an address that the peers cannot reach only moves the
+// outage, so a warning is returned if the address is not routable, or is
+// private while the peers use public addresses (or vice versa). Whether the
+// local node's address is on this machine is checked by checkLocalAddress.
+func addressWarnings(ctx context.Context, survivor dqlite.NodeInfo, peers []dqlite.NodeInfo) []string {
+	ips, err := resolveNodeAddress(ctx, survivor.Address)
+	if err != nil {
+		return []string{fmt.Sprintf("unable to resolve survivor address %q: %v", survivor.Address, err)}
+	}
+
+	// A node that was bootstrapped on the loopback address and has never
+	// been clustered is expected to have an unroutable address.
+	if len(peers) <= 1 && len(ips) == 1 && ips[0].IsLoopback() {
+		return nil
+	}
+
+	var (
+		warnings []string
+		private  bool
+	)
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			warnings = append(warnings, fmt.Sprintf("survivor address %s is not routable", ip))
+		}
+		private = private || ip.IsPrivate()
+	}
+	if lifetimes, err := internalnet.AddressLifetimes(); err == nil {
+		for _, ip := range ips {
+			if lifetime, ok := lifetimes[ip.String()]; ok && !lifetime.Permanent {
+				warnings = append(warnings, fmt.Sprintf(
+					"survivor address %s is %s (DHCP or temporary), the cluster will break again if it changes",
+					ip, lifetime))
+			}
+		}
+	}
+	var privatePeers, publicPeers int
+	resolved := resolveNodeAddresses(ctx, peers)
+	for _, peer := range peers {
+		peerIPs := resolved[peer.ID]
+		if peer.ID == survivor.ID || len(peerIPs) == 0 {
+			continue
+		}
+		if peerIPs[0].IsPrivate() {
+			privatePeers++
+		} else {
+			publicPeers++
+		}
+	}
+	switch {
+	case private && privatePeers == 0 && publicPeers > 0:
+		warnings = append(warnings, fmt.Sprintf(
+			"survivor address %q is private, but the peers use public addresses", survivor.Address))
+	case !private && publicPeers == 0 && privatePeers > 0:
+		warnings = append(warnings, fmt.Sprintf(
+			"survivor address %q is public, but the peers use private addresses", survivor.Address))
+	}
+	return warnings
+}
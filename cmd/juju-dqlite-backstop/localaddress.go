@@ -0,0 +1,84 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
+)
+
+// checkLocalAddress refuses to continue if the local node is to be kept at an
+// address this machine does not have, as the node would fail to bind to it
+// when restarted. An address netplan will configure is only warned about.
+// The local node is the one in info.yaml or, without it, the one chosen by
+// matching local addresses.
+func checkLocalAddress(nodeManager *database.NodeManager, clusterNodes []dqlite.NodeInfo, allow bool) {
+	local, ok := keptLocalNode(nodeManager, clusterNodes)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := resolveNodeAddress(ctx, local.Address)
+	if err != nil {
+		logger.Warningf("unable to resolve node %d address %q to check it is local: %v", local.ID, local.Address, err)
+		return
+	}
+	var planned map[string]string
+	for _, ip := range ips {
+		assigned, err := internalnet.IsAssigned(ip)
+		if err != nil {
+			logger.Warningf("unable to check %s is a local address: %v", ip, err)
+			return
+		}
+		if assigned {
+			return
+		}
+		if planned == nil {
+			if planned, err = internalnet.PlannedAddresses(internalnet.NetplanDir); err != nil {
+				logger.Debugf("unable to read the netplan configuration: %v", err)
+			}
+		}
+		if iface, ok := planned[ip.String()]; ok {
+			logger.Warningf("node %d address %s is not configured yet, but netplan will configure it on %s; "+
+				"apply netplan before restarting the machine agent", local.ID, ip, iface)
+			return
+		}
+	}
+
+	err = failure.Wrap(failure.AddressNotLocal, fmt.Errorf(
+		"node %d, this node, would be kept at %s, which is not an address of this machine, so it could not bind to it",
+		local.ID, local.Address))
+	if allow {
+		logger.Warningf("%v", err)
+		return
+	}
+	checkErr("check local address", err)
+}
+
+// keptLocalNode returns the local node from the nodes being kept.
+func keptLocalNode(nodeManager *database.NodeManager, clusterNodes []dqlite.NodeInfo) (dqlite.NodeInfo, bool) {
+	localInfo, err := nodeManager.NodeInfo()
+	if err != nil {
+		// Without info.yaml, a single node is the one matched to a local
+		// address.
+		if len(clusterNodes) != 1 {
+			return dqlite.NodeInfo{}, false
+		}
+		return clusterNodes[0], true
+	}
+	for _, node := range clusterNodes {
+		if node.ID == localInfo.ID {
+			return node, true
+		}
+	}
+	return dqlite.NodeInfo{}, false
+}
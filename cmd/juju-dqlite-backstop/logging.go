@@ -4,11 +4,23 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/loggo"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/logfile"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/progress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/systemlog"
+	"github.com/SimonRichardson/juju-dqlite-backstop/version"
 )
 
 var logger = loggo.GetLogger("dqlite-backstop")
@@ -17,10 +29,88 @@ const defaultLogConfig = "<root>=DEBUG"
 
 var loggingConfig = defaultLogConfig
 
+const (
+	// logDirEnvKey overrides the directory the run log is written to. Set
+	// to "none", no run log is written.
+	logDirEnvKey = "JUJU_DQLITE_BACKSTOP_LOG_DIR"
+	// logFileName is the name of the run log in the log directory.
+	logFileName = "juju-dqlite-backstop.log"
+	// logMaxSize is the size at which the run log is rotated, and
+	// logBackups the number of rotated logs kept.
+	logMaxSize = 10 << 20
+	logBackups = 5
+
+	// systemLogEnvKey chooses the system log to write to: "journald",
+	// "syslog", "none", or "auto", the default, which writes to the
+	// journal, or syslog without one, when run by systemd or without a
+	// terminal.
+	systemLogEnvKey = "JUJU_DQLITE_BACKSTOP_SYSLOG"
+	// systemLogIdentifier identifies the backstop's messages in the
+	// system log.
+	systemLogIdentifier = "juju-dqlite-backstop"
+)
+
+var (
+	// consoleOut and consoleErr are the terminal's stdout and stderr, as
+	// os.Stdout and os.Stderr are replaced to copy them to the run log.
+	consoleOut = os.Stdout
+	consoleErr = os.Stderr
+
+	// runLog holds the state of the run log, if one is being written.
+	runLog struct {
+		file    *logfile.Writer
+		tees    []*runLogTee
+		copying sync.WaitGroup
+	}
+
+	// systemLog holds the state of the system log, if it is written to.
+	systemLog struct {
+		writer systemlog.Writer
+		// replacesConsole is set when stderr is the journal, which the
+		// log messages are already written to with their priorities.
+		replacesConsole bool
+	}
+)
+
+// Console verbosity levels.
+const (
+	// verbosityTerse only shows warnings and errors.
+	verbosityTerse = iota
+	// verbosityDecisions also shows each decision taken, such as how
+	// addresses were matched and nodes selected.
+	verbosityDecisions
+	// verbosityDetail also shows debug messages.
+	verbosityDetail
+	// verbosityDebug also shows the Dqlite library's own messages.
+	verbosityDebug
+)
+
+// verbosity is how much is logged to the console. Everything is logged to
+// the run log regardless.
+var verbosity = verbosityTerse
+
+// dqliteModule is the logger module of the Dqlite library's messages.
+const dqliteModule = "dqlite"
+
 func setupLogging() error {
-	writer := loggo.NewSimpleWriter(os.Stderr, logFormatter)
-	loggo.ReplaceDefaultWriter(writer)
-	return loggo.ConfigureLoggers(loggingConfig)
+	writer := loggo.NewSimpleWriter(consoleErr, logFormatter)
+	loggo.ReplaceDefaultWriter(consoleWriter{writer})
+	if err := loggo.ConfigureLoggers(loggingConfig); err != nil {
+		return err
+	}
+	if err := startRunLog(); err != nil {
+		logger.Warningf("not writing a run log: %v", err)
+	}
+	if err := startSystemLog(); err != nil {
+		logger.Warningf("not writing to the system log: %v", err)
+	}
+	// A progress bar is drawn straight to the terminal, rather than
+	// filling the run log with redraws.
+	progress.Output, progress.Interactive = os.Stderr, isTerminal(consoleErr) && isTerminal(os.Stdin)
+	if progress.Interactive {
+		progress.Output = consoleErr
+	}
+	return nil
 }
 
 func logFormatter(entry loggo.Entry) string {
@@ -28,3 +118,374 @@ func logFormatter(entry loggo.Entry) string {
 	return fmt.Sprintf("%s %s %s", ts, entry.Level.Short(), entry.Message)
 
 }
+
+// consoleWriter only writes the messages the verbosity shows.
+type consoleWriter struct {
+	loggo.Writer
+}
+
+func (w consoleWriter) Write(entry loggo.Entry) {
+	if consoleShows(entry) {
+		w.Writer.Write(entry)
+	}
+}
+
+// consoleShows reports whether the console shows the message.
+func consoleShows(entry loggo.Entry) bool {
+	if systemLog.replacesConsole {
+		return false
+	}
+	if entry.Level >= loggo.WARNING {
+		return true
+	}
+	if entry.Module == dqliteModule || strings.HasPrefix(entry.Module, dqliteModule+".") {
+		return verbosity >= verbosityDebug
+	}
+	if entry.Level >= loggo.INFO {
+		return verbosity >= verbosityDecisions
+	}
+	return verbosity >= verbosityDetail
+}
+
+// verbosityFlag is a boolean flag that raises the verbosity to its level.
+type verbosityFlag int
+
+func (f verbosityFlag) String() string   { return "false" }
+func (f verbosityFlag) IsBoolFlag() bool { return true }
+
+func (f verbosityFlag) Set(value string) error {
+	if value == "true" && int(f) > verbosity {
+		verbosity = int(f)
+	}
+	if verbosity >= verbosityDebug {
+		dqlite.EnableTracing()
+	}
+	return nil
+}
+
+// addVerbosityFlags adds -v, -vv and --debug to the flag set.
+func addVerbosityFlags(flags *flag.FlagSet) {
+	flags.Var(verbosityFlag(verbosityDecisions), "v", "show each decision taken")
+	flags.Var(verbosityFlag(verbosityDetail), "vv", "show debug messages")
+	flags.Var(verbosityFlag(verbosityDebug), "debug", "show debug messages, including the Dqlite library's")
+}
+
+// parseVerbosity applies the verbosity flags given before the command, and
+// returns the remaining arguments.
+func parseVerbosity(args []string) []string {
+	for len(args) > 0 {
+		var level verbosityFlag
+		switch strings.TrimLeft(args[0], "-") {
+		case "v":
+			level = verbosityDecisions
+		case "vv":
+			level = verbosityDetail
+		case "debug":
+			level = verbosityDebug
+		default:
+			return args
+		}
+		_ = level.Set("true")
+		args = args[1:]
+	}
+	return args
+}
+
+// runLogDir returns the directory to write the run log to: the Juju log
+// directory unless overridden.
+func runLogDir() string {
+	if dir := os.Getenv(logDirEnvKey); dir != "" {
+		return dir
+	}
+	return agent.LogDir(agent.CurrentOS())
+}
+
+// redacted replaces the value of a secret flag wherever arguments are
+// recorded.
+const redacted = "REDACTED"
+
+// secretFlags are the flags whose values are secrets, rather than the paths
+// of files holding them, as --passphrase-file and --client-key are.
+var secretFlags = map[string]bool{
+	"s3-access-key": true,
+	"s3-secret-key": true,
+}
+
+// redactArgs returns the arguments with the values of secret flags, such as
+// --s3-secret-key, replaced, so that they can be written to logs, the
+// journal, the audit log and hooks. Both --flag value and --flag=value are
+// redacted, up to a "--" ending the flags.
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	copy(out, args)
+	for i := 0; i < len(out); i++ {
+		arg := out[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if j := strings.Index(name, "="); j >= 0 {
+			if secretFlags[name[:j]] {
+				out[i] = arg[:len(arg)-len(name)+j+1] + redacted
+			}
+			continue
+		}
+		if secretFlags[name] && i+1 < len(out) {
+			i++
+			out[i] = redacted
+		}
+	}
+	return out
+}
+
+// startRunLog starts writing a detailed log of the run to the log directory,
+// whatever is shown on the console: every log message at debug level, and
+// everything written to stdout and stderr.
+func startRunLog() error {
+	dir := runLogDir()
+	if dir == "none" {
+		return nil
+	}
+	file, err := logfile.Open(filepath.Join(dir, logFileName), logMaxSize, logBackups)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(file, "\n=== %s %s %s (pid %d, uid %d)\n",
+		time.Now().UTC().Format(time.RFC3339), filepath.Base(os.Args[0]), version.Version, os.Getpid(), os.Getuid())
+	fmt.Fprintf(file, "=== args: %s\n", strings.Join(redactArgs(os.Args[1:]), " "))
+
+	if err := loggo.RegisterWriter("run-log", loggo.NewMinimumLevelWriter(
+		loggo.NewSimpleWriter(file, logFormatter), loggo.TRACE)); err != nil {
+		_ = file.Close()
+		return err
+	}
+	runLog.file = file
+	os.Stdout = teeToRunLog(consoleOut, file)
+	os.Stderr = teeToRunLog(consoleErr, file)
+	return nil
+}
+
+// runLogTee is a pipe whose writes are copied to both a console stream and
+// the run log.
+type runLogTee struct {
+	pipe    *os.File
+	console *os.File
+	// copied is closed once the pipe is closed and all written to it has
+	// been copied.
+	copied chan struct{}
+}
+
+// teeToRunLog returns a file whose writes are copied to both the console and
+// the run log.
+func teeToRunLog(console *os.File, file io.Writer) *os.File {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return console
+	}
+	tee := &runLogTee{pipe: w, console: console, copied: make(chan struct{})}
+	runLog.tees = append(runLog.tees, tee)
+	runLog.copying.Add(1)
+	go func() {
+		defer runLog.copying.Done()
+		defer close(tee.copied)
+		_, _ = io.Copy(io.MultiWriter(console, &plainWriter{w: file}), r)
+		_ = r.Close()
+	}()
+	return w
+}
+
+// plainWriter writes to the run log with ANSI escape sequences, such as
+// colours, removed, so that the log holds the plain text shown on the
+// console. A sequence may be split across writes.
+type plainWriter struct {
+	w io.Writer
+	// escape is set after an escape character, and csi within a control
+	// sequence, up to its final byte.
+	escape, csi bool
+}
+
+func (p *plainWriter) Write(b []byte) (int, error) {
+	plain := make([]byte, 0, len(b))
+	for _, c := range b {
+		switch {
+		case p.csi:
+			p.csi = c < 0x40 || c > 0x7e
+		case p.escape:
+			p.escape, p.csi = false, c == '['
+		case c == 0x1b:
+			p.escape = true
+		default:
+			plain = append(plain, c)
+		}
+	}
+	if _, err := p.w.Write(plain); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// stdoutIsPayload stops copying stdout to the run log, for a command whose
+// stdout is data rather than messages for people, such as a SQL dump or
+// JSON output. Such data may hold secrets, and would rotate the earlier run
+// logs away. The run log records that it was not logged.
+func stdoutIsPayload() {
+	if runLog.file == nil {
+		return
+	}
+	for _, tee := range runLog.tees {
+		if os.Stdout != tee.pipe {
+			continue
+		}
+		// Stdout may have been moved to stderr by --result-file -, which
+		// is still copied for the log messages written to it.
+		os.Stdout = tee.console
+		if tee.console == consoleOut {
+			_ = tee.pipe.Close()
+			<-tee.copied
+		}
+		fmt.Fprintln(runLog.file, "=== the command's output was written to stdout, and is not logged")
+		return
+	}
+}
+
+// closeRunLog waits for the output so far to be copied to the run log, and
+// closes it.
+func closeRunLog() {
+	if runLog.file == nil {
+		return
+	}
+	os.Stdout, os.Stderr = consoleOut, consoleErr
+	for _, tee := range runLog.tees {
+		_ = tee.pipe.Close()
+	}
+	runLog.copying.Wait()
+	_, _ = loggo.RemoveWriter("run-log")
+	_ = runLog.file.Close()
+	runLog.file = nil
+}
+
+// startSystemLog starts writing log messages, from info level, to the
+// system log, so that fleet-wide log collection picks them up.
+func startSystemLog() error {
+	target := os.Getenv(systemLogEnvKey)
+	switch target {
+	case "none":
+		return nil
+	case "", "auto":
+		if isTerminal(os.Stdin) && !systemlog.UnderSystemd() {
+			return nil
+		}
+		target = ""
+		if systemlog.IsJournalStream(consoleErr) {
+			target = systemlog.TargetJournald
+		}
+	}
+	writer, err := systemlog.Open(systemLogIdentifier, target)
+	if err != nil && target == "" {
+		// A machine without a system log is not worth warning about,
+		// unless one was asked for.
+		logger.Debugf("not writing to the system log: %v", err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := loggo.RegisterWriter("system-log", loggo.NewMinimumLevelWriter(
+		systemLogWriter{writer}, loggo.INFO)); err != nil {
+		_ = writer.Close()
+		return err
+	}
+	systemLog.writer = writer
+	systemLog.replacesConsole = target == systemlog.TargetJournald && systemlog.IsJournalStream(consoleErr)
+	_ = writer.Write(systemlog.Message{
+		Priority: systemlog.Notice,
+		Text:     fmt.Sprintf("%s started: %s", version.Version, strings.Join(redactArgs(os.Args[1:]), " ")),
+	})
+	return nil
+}
+
+// finishSystemLog records the end of the run in the system log.
+func finishSystemLog(code int) {
+	if systemLog.writer == nil {
+		return
+	}
+	msg := systemlog.Message{Priority: systemlog.Notice, Text: "finished"}
+	if code != 0 {
+		msg = systemlog.Message{Priority: systemlog.Err, Text: fmt.Sprintf("failed with exit code %d", code)}
+	}
+	_ = systemLog.writer.Write(msg)
+	_, _ = loggo.RemoveWriter("system-log")
+	_ = systemLog.writer.Close()
+	systemLog.writer = nil
+}
+
+// systemLogWriter writes log messages to the system log, with the priority
+// of their level.
+type systemLogWriter struct {
+	writer systemlog.Writer
+}
+
+func (w systemLogWriter) Write(entry loggo.Entry) {
+	priority := systemlog.Debug
+	switch {
+	case entry.Level >= loggo.CRITICAL:
+		priority = systemlog.Crit
+	case entry.Level >= loggo.ERROR:
+		priority = systemlog.Err
+	case entry.Level >= loggo.WARNING:
+		priority = systemlog.Warning
+	case entry.Level >= loggo.INFO:
+		priority = systemlog.Info
+	}
+	// A message that cannot be written is dropped, as there is nowhere
+	// left to report it.
+	_ = w.writer.Write(systemlog.Message{
+		Priority: priority,
+		Text:     entry.Message,
+		Fields: map[string]string{
+			"JUJU_DQLITE_BACKSTOP_MODULE": entry.Module,
+			"CODE_FILE":                   entry.Filename,
+			"CODE_LINE":                   fmt.Sprint(entry.Line),
+		},
+	})
+}
+
+// finishRun runs the post hooks, then records the end of the run with the
+// status code: its metrics, system log entry, result and profiles. These run
+// as root, even if privileges were dropped to make the change.
+func finishRun(code int) {
+	if regainPrivileges != nil {
+		if err := regainPrivileges(); err != nil {
+			logger.Warningf("%v", err)
+		}
+		regainPrivileges = nil
+	}
+	runPostHooks(code)
+	recordRunMetrics(code)
+	finishSystemLog(code)
+	writeResult(code)
+	stopProfiling()
+}
+
+// exit ends the program with the status code, once the run is finished and
+// the run log complete.
+func exit(code int) {
+	finishRun(code)
+	closeRunLog()
+	os.Exit(code)
+}
+
+// newFlagSet returns a flag set that completes the run log before printing
+// its usage message, as a flag error or -h then exits the program directly.
+func newFlagSet(name string, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, errorHandling)
+	addVerbosityFlags(flags)
+	flags.Usage = func() {
+		closeRunLog()
+		fmt.Fprintf(flags.Output(), "Usage of %s:\n", name)
+		flags.PrintDefaults()
+	}
+	return flags
+}
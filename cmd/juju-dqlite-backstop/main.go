@@ -10,16 +10,22 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/juju/collections/set"
+	"github.com/juju/errors"
 	"github.com/juju/names/v4"
-	"gopkg.in/yaml.v3"
 
 	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
 	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
 	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/fips"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/fs"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/journal"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/jujuversion"
 	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
 	"github.com/SimonRichardson/juju-dqlite-backstop/version"
 )
@@ -35,103 +41,621 @@ controller machine agents are running.
 
 Ok to proceed?`[1:]
 
+// stdinPath is the --path value that reads the agent config from stdin.
+const stdinPath = "-"
+
 type commandLineArgs struct {
 	controllerTag   string
-	agentConfigPath string
+	agentFlags      *agentFlags
 	doPrompt        bool
+	interfaces      []string
+	subnets         []*net.IPNet
+	excluded        []string
+	allowLinkLocal  bool
+	resolveTimeout  time.Duration
+	ignoreSpaces    bool
+	addressMapPath  string
+	acceptHeuristic bool
+	acceptNonVoter  bool
+	allowNonLocal   bool
+	strict          bool
+	rehearse        bool
+	rehearseDir     string
+	dropPrivileges  bool
+	checkStopped    bool
+	ignoreRunning   bool
+	remote          *remoteFlags
+	survivors       []uint64
+	keepCount       int
+	keep            []database.NodeSelector
+	joinMaterials   string
+	resultFile      string
 }
 
 func main() {
 	checkErr("setupLogging", setupLogging())
-	args := commandLine()
-
-	if args.doPrompt && !promptYN(controllerPrompt) {
+	defer closeRunLog()
+	trapSignals()
+
+	globalArgs := parseGlobalFlags(os.Args[1:])
+	if cmd, args, ok := lookupCommand(globalArgs); ok {
+		startRunMetrics(cmd.name)
+		journal.StartRun(cmd.name, redactArgs(args))
+		cmd.run(args)
+		finishRun(0)
 		return
 	}
+	startRunMetrics("backstop")
+	journal.StartRun("backstop", redactArgs(os.Args[1:]))
+	defer finishRun(0)
+
+	args := commandLine(globalArgs)
+	if args.resultFile != "" {
+		startResult("backstop", redactArgs(os.Args[1:]), args.resultFile)
+		result.Tag = args.controllerTag
+	}
 
-	t, err := names.ParseTag(args.controllerTag)
-	checkErr("parse controller tag", err)
-
-	agent, err := agent.ReadConfig(agent.ConfigPath(args.agentConfigPath, t))
-	checkErr("read agent config", err)
-
-	nodeManager := database.NewNodeManager(agent, logger)
-	_, err = nodeManager.EnsureDataDir()
-	checkErr("ensure data dir", err)
-
-	// If we've already got a local node info, then we can just use that.
-	// Otherwise we need to find the leader node and use that from the api
-	// addresses.
-	var clusterNodes []dqlite.NodeInfo
-	if localInfo, err := nodeManager.NodeInfo(); err == nil {
+	// Warnings are recorded from before the agent is loaded, as loading it
+	// warns of such as an untested Juju version.
+	strict := startStrict(args.strict)
+	timer := newStepTimer()
+	agent, nodeManager := loadAgent(args.agentFlags, args.controllerTag)
+	timer.done("config read")
+
+	// If the nodes to keep or the surviving nodes are given, keep them. If we've already got a
+	// local node info, then we can just use that. Otherwise we need to find
+	// the leader node and use that from the api addresses. When keeping more
+	// than one node, their roles are rebalanced so quorum can be reached.
+	var (
+		clusterNodes []dqlite.NodeInfo
+		reason       string
+	)
+	if len(args.keep) > 0 {
+		clusterNodes = selectKept(nodeManager, args.keep)
+		result.decide("kept the nodes selected by --keep")
+	} else if len(args.survivors) > 0 {
+		clusterNodes = selectSurvivors(nodeManager, args.survivors)
+		result.decide("kept the nodes given by --survivors")
+	} else if localInfo, err := nodeManager.NodeInfo(); err == nil {
 		clusterNodes = []dqlite.NodeInfo{localInfo}
+		result.decide("kept the local node %d from info.yaml", localInfo.ID)
 	} else {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warningf("unable to use info.yaml, choosing from cluster.yaml: %v", err)
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
 		nodeInfo, err := nodeManager.ClusterServers(ctx)
 		checkErr("get cluster servers", err)
+		if len(nodeInfo) == 0 {
+			checkErr("get cluster servers", failure.Wrap(failure.StoreEmpty, fmt.Errorf("cluster.yaml lists no nodes")))
+		}
 
 		addresses, err := agent.APIAddresses()
 		checkErr("get api addresses", err)
 
-		clusterNodes, err = findLeaderNode(nodeInfo, addresses)
-		checkErr("unable to locate cluster nodes", err)
+		var preferred []*net.IPNet
+		if !args.ignoreSpaces {
+			preferred = spaceSubnets(ctx, nodeManager)
+		}
+
+		// Each name resolved is bounded by --resolve-timeout alone.
+		clusterNodes, reason, err = findLeaderNode(context.Background(), nodeInfo, addresses, preferred, args.resolveTimeout, args.addressOptions()...)
+		checkErr("unable to locate cluster nodes", failure.Wrap(failure.NoLeaderCandidate, err))
+		result.decide("kept node %d, chosen heuristically: %s", clusterNodes[0].ID, reason)
+	}
+	if args.keepCount > 1 {
+		clusterNodes = keepNodes(nodeManager, clusterNodes[0].ID, args.keepCount)
+		result.decide("kept %d nodes, starting with node %d", len(clusterNodes), clusterNodes[0].ID)
+	}
+	if len(clusterNodes) > 1 {
+		clusterNodes = rebalanceRoles(clusterNodes)
+		result.decide("rebalanced the roles of the %d kept nodes", len(clusterNodes))
 	}
 
-	fmt.Println("updating cluster.yaml")
+	if args.addressMapPath != "" {
+		addressMap, err := database.ReadAddressMap(args.addressMapPath)
+		checkErr("read address map", err)
+
+		mapped := addressMap.Apply(clusterNodes)
+		for i, node := range mapped {
+			if node.Address != clusterNodes[i].Address {
+				fmt.Printf("node %d address %s will be rewritten to %s\n", node.ID, clusterNodes[i].Address, node.Address)
+				result.decide("rewrote node %d address %s to %s", node.ID, clusterNodes[i].Address, node.Address)
+			}
+		}
+		clusterNodes = mapped
+	}
+
+	timer.done("store read")
+
+	checkConflicts(nodeManager, clusterNodes)
+	if alreadyApplied(nodeManager, clusterNodes) {
+		fmt.Println("cluster.yaml already holds this membership:")
+		fmt.Println("")
+		for _, node := range clusterNodes {
+			fmt.Printf("  %s\n", describeMember(node))
+		}
+		fmt.Println("")
+		fmt.Println("nothing to do")
+		if result != nil {
+			result.Outcome = outcomeUnchanged
+			result.decide("left the membership, which was already in place")
+			result.Before, result.After = clusterNodes, clusterNodes
+		}
+		return
+	}
+	checkAddresses(nodeManager, clusterNodes)
+	checkLocalAddress(nodeManager, clusterNodes, args.allowNonLocal)
+	checkNodeStopped(nodeManager)
+	checkControllerUUID(agent, nodeManager)
+	warnPermissionProblems(agent, configFilePath(args.agentFlags, args.controllerTag), nodeManager)
+	if args.checkStopped {
+		checkPeersStopped(nodeManager, args.remote.transportFor(agent), clusterNodes, args.ignoreRunning)
+	}
+
+	timer.done("checks")
+
+	current, _ := nodeManager.ClusterServers(context.Background())
+	fmt.Println("cluster.yaml will be updated:")
+	fmt.Println("")
+	printMembershipChange(current, clusterNodes)
 	fmt.Println("")
-	bytes, _ := yaml.Marshal(clusterNodes)
-	fmt.Println(string(bytes))
+	for _, node := range clusterNodes {
+		fmt.Printf("node %d will use %s\n", node.ID, describeNodeAddress(node.Address))
+	}
+	fmt.Println("")
+	warnings := survivorWarnings(nodeManager, clusterNodes)
+	for _, warning := range warnings {
+		logger.Warningf("%s", warning)
+	}
+	if reason != "" && args.strict {
+		checkErr("strict mode", failure.Wrap(failure.HeuristicUnconfirmed, fmt.Errorf(
+			"refusing to keep a node chosen heuristically with --strict, give it with --survivors or --keep")))
+	}
+	enforceStrict(strict)
+
+	if args.doPrompt && !args.rehearse && !promptYN(controllerPrompt) {
+		return
+	}
+
+	// The survivor was chosen by matching addresses, rather than from the
+	// local node information. Explain why, and require a separate
+	// confirmation of the choice.
+	if reason != "" {
+		fmt.Printf("the surviving node was chosen heuristically: %s\n", reason)
+		if args.rehearse {
+			fmt.Println("the real run will ask to confirm it, or need --accept-heuristic with --yes")
+		} else if args.doPrompt {
+			if !promptYN("Is this the correct node to keep?") {
+				return
+			}
+		} else if !args.acceptHeuristic {
+			checkErr("confirm surviving node", failure.Wrap(failure.HeuristicUnconfirmed, fmt.Errorf(
+				"the surviving node was chosen heuristically, use --accept-heuristic with --yes to accept it")))
+		}
+		result.decide("accepted the heuristically chosen node")
+	}
+
+	// Keeping a node that may lack committed data loses that data, so it
+	// also needs a separate confirmation.
+	if len(warnings) > 0 {
+		if args.rehearse {
+			fmt.Println("the real run will ask to confirm keeping these nodes, or need --accept-non-voter with --yes")
+		} else if args.doPrompt {
+			if !promptYN("Keep these nodes even though they may not have all of the data?") {
+				return
+			}
+		} else if !args.acceptNonVoter {
+			checkErr("confirm surviving nodes", failure.Wrap(failure.SurvivorNotVoter, fmt.Errorf(
+				"a kept node may not have all of the data, use --accept-non-voter with --yes to keep it")))
+		}
+		result.decide("kept nodes that may not have all of the data: %s", strings.Join(warnings, "; "))
+	}
+
+	if args.rehearse {
+		rehearse(agent, nodeManager, clusterNodes, args.rehearseDir)
+		return
+	}
+	timer.skip()
+
+	// The pre hooks run as root, before privileges are dropped.
+	defer beginChange()()
+	if args.dropPrivileges {
+		dropPrivileges(nodeManager)
+	}
+	fmt.Println("updating cluster.yaml")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	err = nodeManager.SetClusterServers(ctx, clusterNodes)
-	checkErr("set cluster servers", err)
+	before, _ := nodeManager.ClusterServers(ctx)
+	infoChanged, err := writeMembership(ctx, nodeManager, clusterNodes, timer)
+	if infoChanged {
+		fmt.Println("updated info.yaml")
+		dataDir, _ := nodeManager.EnsureDataDir()
+		result.changed(filepath.Join(dataDir, "info.yaml"))
+	}
+	checkErr("write membership", err)
+
+	rec := audit.NewRecord("backstop", redactArgs(os.Args[1:]))
+	rec.Before, rec.After, rec.Steps = before, clusterNodes, timer.steps
+	dataDir, _ := nodeManager.EnsureDataDir()
+	recordAudit(dataDir, rec)
+	if result != nil {
+		result.Outcome = outcomeComplete
+		result.Before, result.After, result.Steps = before, clusterNodes, timer.steps
+		result.changed(dataDir, filepath.Join(dataDir, "cluster.yaml"))
+	}
 
 	fmt.Println("dqlite backstop action complete")
+	timer.print()
+	if args.joinMaterials != "" {
+		if removed := removedNodes(before, clusterNodes); len(removed) > 0 {
+			checkErr("write join materials", writeJoinMaterials(args.joinMaterials, removed, clusterNodes, agent.DataDir(), newAgentService(agent, "<tag>")))
+			result.changed(args.joinMaterials)
+			result.next("re-add each removed node using the instructions in %s", args.joinMaterials)
+		}
+	}
+	if len(clusterNodes) > 1 {
+		fmt.Println("run the backstop with the same membership on each of the other surviving nodes")
+		fmt.Println("before restarting any of them")
+		result.next("run the backstop with the same membership on each of the other surviving nodes before restarting any of them")
+	}
+	restart := newAgentService(agent, args.controllerTag).command("restart")
+	result.next("%s", restart)
 	fmt.Println("please restart the controller machine agents using:")
 	fmt.Println("")
-	fmt.Printf("\tsystemctl restart jujud-%s.service\n", args.controllerTag)
+	fmt.Printf("\t%s\n", restart)
 	fmt.Println("")
 }
 
+// writeMembership writes the membership to the node's raft log and
+// cluster.yaml, and any new address of the local node to info.yaml,
+// returning whether info.yaml was rewritten.
+func writeMembership(ctx context.Context, nodeManager *database.NodeManager, clusterNodes []dqlite.NodeInfo, timer *stepTimer) (bool, error) {
+	if err := nodeManager.ReconfigureMembership(clusterNodes); err != nil {
+		return false, errors.Annotate(err, "reconfiguring cluster membership")
+	}
+	timer.done("reconfigure")
+	if err := nodeManager.WriteClusterServers(ctx, clusterNodes); err != nil {
+		return false, errors.Annotate(err, "writing cluster servers")
+	}
+
+	// Keep the local node information in step with any rewritten address,
+	// otherwise the node will bind to its old address.
+	var infoChanged bool
+	if localInfo, err := nodeManager.NodeInfo(); err == nil {
+		for _, node := range clusterNodes {
+			if node.ID == localInfo.ID && node.Address != localInfo.Address {
+				if err := nodeManager.SetNodeInfo(node); err != nil {
+					return infoChanged, errors.Annotate(err, "setting node info")
+				}
+				infoChanged = true
+			}
+		}
+	}
+	timer.done("store write")
+	return infoChanged, nil
+}
+
+// regainPrivileges, once privileges were dropped, switches back to root.
+var regainPrivileges func() error
+
+// dropPrivileges switches to the owner of the data dir, so that the files we
+// write remain readable by jujud. The run switches back to root when it
+// finishes, to run the post hooks and record its result.
+func dropPrivileges(nodeManager *database.NodeManager) {
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	owner, err := fs.PathOwner(dataDir)
+	checkErr("read data dir owner", err)
+
+	logger.Infof("dropping privileges to %d:%d", owner.UID, owner.GID)
+	regain, err := fs.DropPrivileges(owner)
+	checkErr("drop privileges", err)
+	regainPrivileges = regain
+}
+
+// checkConflicts refuses to continue if the membership to be written has
+// two nodes sharing an address, or if the local node shares its address with
+// another node in cluster.yaml.
+func checkConflicts(nodeManager *database.NodeManager, clusterNodes []dqlite.NodeInfo) {
+	conflicts := database.AddressConflicts(clusterNodes)
+
+	if localInfo, err := nodeManager.NodeInfo(); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if servers, err := nodeManager.ClusterServers(ctx); err == nil {
+			conflicts = append(conflicts, database.LocalNodeConflicts(localInfo, servers)...)
+		}
+	}
+	if len(conflicts) == 0 {
+		return
+	}
+	for _, conflict := range conflicts {
+		logger.Errorf("%s", conflict)
+	}
+	checkErr("check address conflicts", failure.Wrap(failure.AddressConflict, fmt.Errorf(
+		"refusing to write membership with conflicting node addresses, "+
+			"this is usually caused by cloning a controller machine; "+
+			"each node must have a unique address and ID")))
+}
+
+// checkAddresses warns about any node address that the peers in cluster.yaml
+// may be unable to dial.
+func checkAddresses(nodeManager *database.NodeManager, clusterNodes []dqlite.NodeInfo) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	peers, err := nodeManager.ClusterServers(ctx)
+	if err != nil {
+		logger.Warningf("unable to read peers from cluster.yaml: %v", err)
+	}
+	for _, node := range clusterNodes {
+		for _, warning := range addressWarnings(ctx, node, peers) {
+			logger.Warningf("%s", warning)
+		}
+	}
+}
+
 func checkErr(label string, err error) {
 	if err != nil {
 		logger.Errorf("%s: %s", label, err)
-		os.Exit(1)
+		if guidance, ok := failure.GuidanceFor(err); ok {
+			printGuidance(guidance)
+		} else if kind := failure.KindOf(err); kind != "" {
+			fmt.Fprintf(os.Stderr, "hint: %s\n", kind.Hint())
+		}
+		result.fail(label, err)
+		exit(1)
+	}
+}
+
+// printGuidance explains a well-known failure, and what to do next.
+func printGuidance(g failure.Guidance) {
+	fmt.Fprintf(os.Stderr, "\n%s.\n\nlikely causes:\n", g.Explanation)
+	for _, cause := range g.Causes {
+		fmt.Fprintf(os.Stderr, "  - %s\n", cause)
+	}
+	fmt.Fprintf(os.Stderr, "\nnext, run:\n  %s\n", g.Next)
+	if g.Then != "" {
+		fmt.Fprintf(os.Stderr, "then %s.\n", g.Then)
+	}
+}
+
+// checkInteractive fails the run if the question cannot be asked, as stdin
+// is not a terminal.
+func checkInteractive(question string) {
+	if isTerminal(os.Stdin) {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(question), "\n")
+	checkErr("prompt", failure.Wrap(failure.NotInteractive, fmt.Errorf(
+		"unable to ask %q, as stdin is not a terminal", lines[len(lines)-1])))
+}
+
+// parseGlobalFlags applies the flags given before the command, in any
+// order, and returns the remaining arguments.
+func parseGlobalFlags(args []string) []string {
+	for {
+		rest := parseProfiling(parseVerbosity(args))
+		if len(rest) == len(args) {
+			return rest
+		}
+		args = rest
 	}
 }
 
-func commandLine() commandLineArgs {
-	flags := flag.NewFlagSet("dqlite-backstop", flag.ExitOnError)
+func commandLine(cmdArgs []string) commandLineArgs {
+	flags := newFlagSet("dqlite-backstop", flag.ExitOnError)
+	addHookFlags(flags)
+	addAssumeStoppedFlag(flags)
+	flags.Usage = func() {
+		closeRunLog()
+		usage()
+		fmt.Fprintf(os.Stderr, "\nflags:\n")
+		flags.PrintDefaults()
+	}
 	var a commandLineArgs
 	yes := flags.Bool("yes", false, "answer 'yes' to prompts")
 	showVersion := flags.Bool("version", false, "show version")
-	path := flags.String("path", agent.DefaultPaths.DataDir, "path to agent config")
-
-	flags.Parse(os.Args[1:])
+	agentFlags := addAgentFlags(flags)
+	var interfaces stringsFlag
+	flags.Var(&interfaces, "interface", "only consider local addresses on this interface (repeatable)")
+	var excluded stringsFlag
+	flags.Var(&excluded, "exclude-interface", fmt.Sprintf(
+		"exclude interfaces matching this pattern (repeatable), in addition to %v",
+		internalnet.DefaultExcludedInterfaces))
+	noDefaultExcludes := flags.Bool("no-default-excludes", false, "do not exclude the default bridge and VPN interfaces")
+	allowLinkLocal := flags.Bool("allow-link-local", false, "consider link-local addresses")
+	var cidrs stringsFlag
+	flags.Var(&cidrs, "cidr", "only consider local addresses within this subnet (repeatable)")
+	ignoreSpaces := flags.Bool("ignore-spaces", false, "do not prefer addresses in the juju-ha-space or juju-mgmt-space subnets")
+	acceptHeuristic := flags.Bool("accept-heuristic", false, "with --yes, accept a surviving node chosen by address matching")
+	acceptNonVoter := flags.Bool("accept-non-voter", false, "with --yes, keep nodes that are not voters or have no raft data")
+	addressMap := flags.String("address-map", "", "path to a YAML file mapping old node addresses to new ones")
+	allowNonLocal := flags.Bool("allow-non-local-address", false, "keep the local node at an address this machine does not have")
+	strict := addStrictFlag(flags)
+	rehearse := flags.Bool("rehearse", false, "make the change to a copy of the Dqlite data, verify it, and leave the real data untouched")
+	rehearseDir := flags.String("rehearse-dir", "", "with --rehearse, copy the data to this new directory and keep it, rather than to a temporary one")
+	dropPrivs := flags.Bool("drop-privileges", false, "when run as root, switch to the owner of the data dir before writing")
+	var survivors stringsFlag
+	flags.Var(&survivors, "survivors", "IDs of the nodes to keep, preserving their IDs (repeatable)")
+	var keep stringsFlag
+	flags.Var(&keep, "keep", "IDs, addresses or /regexps/ of addresses of the nodes to keep, removing all others (repeatable)")
+	keepCount := flags.Int("keep-count", 1, "number of nodes to keep, starting with the local node and preferring voters")
+	checkStopped := flags.Bool("check-peers-stopped", false, "connect to the other controllers over ssh and check that jujud is stopped")
+	ignoreRunning := flags.Bool("ignore-running-peers", false, "continue even if jujud is running on other controllers")
+	joinMaterials := flags.String("join-materials", "", "write instructions for re-adding each removed node to this directory")
+	remoteFlags := addRemoteFlags(flags)
+	resolveTimeout := flags.Duration("resolve-timeout", 5*time.Second, "timeout for resolving each host name in api addresses")
+	resultFile := flags.String("result-file", "", "write a JSON summary of the run to this file, or to stdout if -")
+
+	flags.Parse(cmdArgs)
 
 	if *showVersion {
 		fmt.Fprintf(os.Stderr, "%s\n%s-%s\n", version.Version, version.GitCommit, version.GitTreeState)
-		os.Exit(0)
+		fmt.Fprintf(os.Stderr, "supports %s\n", jujuversion.Supports())
+		if fips.Backend {
+			fmt.Fprintf(os.Stderr, "FIPS crypto backend\n")
+		}
+		exit(0)
 	}
 
 	args := flags.Args()
 	if len(args) != 1 {
-		fmt.Fprintf(os.Stderr, "usage: %s <tag>\n", os.Args[0])
-		os.Exit(1)
+		usage()
+		exit(1)
+	}
+
+	if agentFlags.path == stdinPath && !*yes {
+		// The prompt is answered on stdin, which is already consumed by
+		// the agent config.
+		fmt.Fprintf(os.Stderr, "--yes is required when reading the agent config from stdin\n")
+		exit(1)
 	}
 
 	a.doPrompt = !*yes
 	a.controllerTag = args[0]
-	a.agentConfigPath = *path
+	a.agentFlags = agentFlags
+	a.interfaces = interfaces
+
+	if !*noDefaultExcludes {
+		excluded = append(append([]string{}, internalnet.DefaultExcludedInterfaces...), excluded...)
+	}
+	if err := internalnet.ValidatePatterns(excluded); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(1)
+	}
+	a.excluded = excluded
+	a.allowLinkLocal = *allowLinkLocal
+
+	subnets, err := internalnet.ParseSubnets(cidrs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(1)
+	}
+	a.subnets = subnets
+	a.resolveTimeout = *resolveTimeout
+	a.ignoreSpaces = *ignoreSpaces
+	a.addressMapPath = *addressMap
+	a.acceptHeuristic = *acceptHeuristic
+	a.acceptNonVoter = *acceptNonVoter
+	a.allowNonLocal = *allowNonLocal
+	a.strict = *strict
+	a.rehearse = *rehearse || *rehearseDir != ""
+	a.rehearseDir = *rehearseDir
+	a.dropPrivileges = *dropPrivs
+	a.checkStopped = *checkStopped
+	a.ignoreRunning = *ignoreRunning
+	a.remote = remoteFlags
+	a.joinMaterials = *joinMaterials
+	a.resultFile = *resultFile
+
+	if a.survivors, err = parseNodeIDs(survivors); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(1)
+	}
+	if a.keep, err = parseNodeSelectors(keep); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(1)
+	}
+	if len(a.keep) > 0 && len(a.survivors) > 0 {
+		fmt.Fprintf(os.Stderr, "--keep cannot be used with --survivors\n")
+		exit(1)
+	}
+	a.keepCount = *keepCount
+	if a.keepCount < 1 || (a.keepCount > 1 && len(a.survivors)+len(a.keep) > 0) {
+		fmt.Fprintf(os.Stderr, "--keep-count must be at least 1, and cannot be used with --survivors or --keep\n")
+		exit(1)
+	}
 
 	return a
 }
 
+// addressOptions returns the options used to constrain local address
+// discovery.
+func (a commandLineArgs) addressOptions() []internalnet.Option {
+	var opts []internalnet.Option
+	for _, name := range a.interfaces {
+		opts = append(opts, internalnet.WithInterface(name))
+	}
+	for _, subnet := range a.subnets {
+		opts = append(opts, internalnet.WithSubnet(subnet))
+	}
+	for _, pattern := range a.excluded {
+		opts = append(opts, internalnet.WithExcludedInterface(pattern))
+	}
+	if !a.allowLinkLocal {
+		opts = append(opts, internalnet.WithoutLinkLocal())
+	}
+	return opts
+}
+
+// loadAgent reads the agent config for the given controller tag, and returns
+// it along with a node manager for the local Dqlite node.
+func loadAgent(f *agentFlags, controllerTag string) (agent.Config, *database.NodeManager) {
+	t, err := names.ParseTag(controllerTag)
+	checkErr("parse controller tag", err)
+
+	cfg, err := readAgentConfig(f.path, t)
+	checkErr("read agent config", err)
+	checkJujuVersion(cfg, t)
+	journal.SetController(cfg.Controller().Id())
+	hooks.tag, hooks.controller = t.String(), cfg.Controller().Id()
+
+	if f.caCert != "" {
+		caCert, err := os.ReadFile(f.caCert)
+		checkErr("read CA certificate", err)
+		cfg = agent.WithCACert(cfg, string(caCert))
+	}
+
+	nodeManager := database.NewNodeManager(cfg, logger)
+	nodeManager.SetRetryStrategy(retryStrategy())
+	if f.clientCert != "" || f.clientKey != "" {
+		if f.clientCert == "" || f.clientKey == "" {
+			checkErr("client certificate", fmt.Errorf("--client-cert and --client-key must be supplied together"))
+		}
+		clientCert, err := os.ReadFile(f.clientCert)
+		checkErr("read client certificate", err)
+		clientKey, err := os.ReadFile(f.clientKey)
+		checkErr("read client key", err)
+		checkErr("client certificate", nodeManager.SetClientCert(string(clientCert), string(clientKey)))
+	}
+
+	hooks.dataDir, err = nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	return cfg, nodeManager
+}
+
+// newNodeManager returns a node manager for the local Dqlite node of the
+// given controller tag.
+func newNodeManager(f *agentFlags, controllerTag string) *database.NodeManager {
+	_, nodeManager := loadAgent(f, controllerTag)
+	return nodeManager
+}
+
+// readAgentConfig reads the agent config for the given tag from the data
+// directory, or from stdin if the path is "-".
+func readAgentConfig(path string, tag names.Tag) (agent.Config, error) {
+	if path == stdinPath {
+		cfg, err := agent.ReadConfigFrom(os.Stdin)
+		return cfg, failure.Wrap(failure.ConfigUnreadable, err)
+	}
+	cfg, err := agent.ReadConfig(agent.ConfigPath(path, tag))
+	return cfg, failure.Wrap(failure.ConfigUnreadable, err)
+}
+
+// promptYN asks the question, returning whether it was answered yes. Without
+// a terminal to answer on, the run fails rather than waiting for an answer
+// that will never come.
 func promptYN(question string) bool {
+	checkInteractive(question)
 	fmt.Printf("%s [y/n] ", question)
 	os.Stdout.Sync()
 	scanner := bufio.NewScanner(os.Stdin)
@@ -145,53 +669,3 @@ func promptYN(question string) bool {
 		return false
 	}
 }
-
-func findLeaderNode(nodeInfo []dqlite.NodeInfo, addresses []string) ([]dqlite.NodeInfo, error) {
-	// If the number of addresses matches the number of nodes, then work out
-	// which ip address is actually ours. Then we can remove all the others
-	// from the node list.
-	var addrs set.Strings
-	if len(nodeInfo) == 1 || len(addresses) > 1 {
-		var err error
-		addrs, err = internalnet.ExternalIPs()
-		if err != nil {
-			return nil, fmt.Errorf("unable to find external ips: %w", err)
-		}
-	} else {
-		for _, addr := range addresses {
-			addrs.Add(addr)
-		}
-	}
-
-	hosts := set.NewStrings()
-	for _, addr := range addrs.Values() {
-		var host string
-		if strings.Contains(addr, ":") {
-			var err error
-			host, _, err = net.SplitHostPort(addr)
-			checkErr("split host port", err)
-		} else {
-			host = addr
-		}
-		hosts.Add(host)
-	}
-
-	var (
-		leader dqlite.NodeInfo
-		found  bool
-	)
-	for _, info := range nodeInfo {
-		host, _, err := net.SplitHostPort(info.Address)
-		checkErr("split node host port", err)
-		if hosts.Contains(host) {
-			leader = info
-			found = true
-			break
-		}
-	}
-	if !found {
-		return nil, fmt.Errorf("unable to find leader node")
-	}
-
-	return []dqlite.NodeInfo{leader}, nil
-}
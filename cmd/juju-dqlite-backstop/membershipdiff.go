@@ -0,0 +1,85 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+// ANSI colours for the membership diff.
+const (
+	colourRed    = "\x1b[31m"
+	colourGreen  = "\x1b[32m"
+	colourYellow = "\x1b[33m"
+	colourReset  = "\x1b[0m"
+)
+
+// printMembershipChange shows how the membership in cluster.yaml changes
+// from the current to the planned one, highlighting the nodes dropped,
+// added and changed, so that the operator can see at a glance what the
+// change does.
+func printMembershipChange(current, planned []dqlite.NodeInfo) {
+	byID := make(map[uint64]dqlite.NodeInfo, len(planned))
+	for _, node := range planned {
+		byID[node.ID] = node
+	}
+	colour := useColour()
+	line := func(code, prefix, text string) {
+		if colour && code != "" {
+			fmt.Printf("%s%s %s%s\n", code, prefix, text, colourReset)
+			return
+		}
+		fmt.Printf("%s %s\n", prefix, text)
+	}
+
+	var kept, dropped, changed, added int
+	seen := make(map[uint64]bool, len(current))
+	for _, node := range current {
+		seen[node.ID] = true
+		next, ok := byID[node.ID]
+		switch {
+		case !ok:
+			dropped++
+			line(colourRed, "-", describeMember(node))
+		case next.Address != node.Address || next.Role != node.Role:
+			changed++
+			line(colourYellow, "~", fmt.Sprintf("%s -> %s (%s)", describeMember(node), next.Address, next.Role))
+		default:
+			kept++
+			line("", " ", describeMember(node))
+		}
+	}
+	for _, node := range planned {
+		if !seen[node.ID] {
+			added++
+			line(colourGreen, "+", describeMember(node))
+		}
+	}
+	fmt.Printf("\n%d kept, %d dropped, %d changed, %d added\n", kept, dropped, changed, added)
+}
+
+// describeMember describes a node in cluster.yaml.
+func describeMember(node dqlite.NodeInfo) string {
+	return fmt.Sprintf("node %d %s (%s)", node.ID, node.Address, node.Role)
+}
+
+// useColour reports whether output to the console may be coloured: only
+// when run interactively on a terminal, and not when NO_COLOR is set. A
+// script may leave stdout on a terminal while it drives stdin. The colours
+// are removed from the copy in the run log.
+func useColour() bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return isTerminal(consoleOut) && isTerminal(os.Stdin)
+}
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
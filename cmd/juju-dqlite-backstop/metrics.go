@@ -0,0 +1,147 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/backup"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/metrics"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+// textfileDirEnvKey is the node exporter textfile collector directory to
+// write metrics to. Unset, no metrics are written.
+const textfileDirEnvKey = "JUJU_DQLITE_BACKSTOP_TEXTFILE_DIR"
+
+// metricPrefix starts the name of every metric.
+const metricPrefix = "juju_dqlite_backstop_"
+
+// run describes this run of the tool, for its metrics.
+var run struct {
+	command string
+	started time.Time
+	done    bool
+}
+
+func init() {
+	registerCommand(command{
+		name:    "metrics",
+		args:    "[--path <dir>] [--textfile-dir <dir>] <tag>",
+		summary: "write node exporter textfile metrics describing the Dqlite data directory",
+		run:     runMetrics,
+	})
+}
+
+func runMetrics(args []string) {
+	flags := newFlagSet("metrics", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	dir := flags.String("textfile-dir", os.Getenv(textfileDirEnvKey),
+		"node exporter textfile collector directory, the metrics are written to stdout if unset")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["metrics"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("find Dqlite data directory", err)
+
+	gauges, err := dataMetrics(cfg.Tag().String(), dataDir)
+	checkErr("read Dqlite data directory", err)
+	if *dir == "" {
+		stdoutIsPayload()
+		checkErr("write metrics", metrics.Write(os.Stdout, gauges))
+		return
+	}
+	checkErr("write metrics", metrics.WriteTextfile(*dir, "juju_dqlite_backstop_data", gauges))
+}
+
+// dataMetrics describes the size and progress of the Dqlite data directory.
+func dataMetrics(tag, dataDir string) ([]metrics.Gauge, error) {
+	usage, err := raft.ReadUsage(dataDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	history, err := raft.ReadHistory(dataDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	last := history.Last()
+	labels := map[string]string{"tag": tag}
+	gauges := []metrics.Gauge{
+		{Name: metricPrefix + "data_bytes", Help: "Size of the Dqlite data directory.", Value: float64(usage.Bytes)},
+		{Name: metricPrefix + "raft_segments", Help: "Number of raft log segments.", Value: float64(usage.Segments)},
+		{Name: metricPrefix + "raft_snapshots", Help: "Number of raft snapshots.", Value: float64(usage.Snapshots)},
+		{Name: metricPrefix + "raft_last_index", Help: "Index of the last raft log entry.", Value: float64(last.Index)},
+		{Name: metricPrefix + "raft_last_term", Help: "Term of the last raft log entry.", Value: float64(last.Term)},
+	}
+	if usage.Snapshots > 0 {
+		gauges = append(gauges, metrics.Gauge{
+			Name:  metricPrefix + "raft_last_snapshot_timestamp_seconds",
+			Help:  "When the latest raft snapshot was taken.",
+			Value: float64(usage.LatestSnapshot.Unix()),
+		})
+	}
+	for i := range gauges {
+		gauges[i].Labels = labels
+	}
+	return gauges, nil
+}
+
+// recordBackupMetrics records a successful backup, if metrics are written.
+func recordBackupMetrics(tag string, stats backup.Stats, elapsed time.Duration) {
+	dir := os.Getenv(textfileDirEnvKey)
+	if dir == "" {
+		return
+	}
+	labels := map[string]string{"tag": tag}
+	err := metrics.WriteTextfile(dir, "juju_dqlite_backstop_backup", []metrics.Gauge{
+		{Name: metricPrefix + "last_backup_timestamp_seconds", Help: "When the last successful backup completed.", Labels: labels, Value: float64(time.Now().Unix())},
+		{Name: metricPrefix + "last_backup_duration_seconds", Help: "How long the last successful backup took.", Labels: labels, Value: elapsed.Seconds()},
+		{Name: metricPrefix + "last_backup_bytes", Help: "Size of the last successful backup.", Labels: labels, Value: float64(stats.Written)},
+		{Name: metricPrefix + "last_backup_files", Help: "Number of files in the last successful backup.", Labels: labels, Value: float64(stats.Files)},
+	})
+	if err != nil {
+		logger.Warningf("unable to write backup metrics: %v", err)
+	}
+}
+
+// startRunMetrics notes the command being run, for its metrics.
+func startRunMetrics(command string) {
+	run.command = command
+	run.started = time.Now()
+}
+
+// recordRunMetrics records the result of the run, if metrics are written.
+// Each command's last run is written to its own file.
+func recordRunMetrics(code int) {
+	dir := os.Getenv(textfileDirEnvKey)
+	if dir == "" || run.command == "" || run.done {
+		return
+	}
+	run.done = true
+	success := 0.0
+	if code == 0 {
+		success = 1
+	}
+	labels := map[string]string{"command": run.command}
+	name := "juju_dqlite_backstop_run_" + strings.NewReplacer("-", "_", " ", "_").Replace(run.command)
+	err := metrics.WriteTextfile(dir, name, []metrics.Gauge{
+		{Name: metricPrefix + "last_run_timestamp_seconds", Help: "When the command last finished.", Labels: labels, Value: float64(time.Now().Unix())},
+		{Name: metricPrefix + "last_run_duration_seconds", Help: "How long the command last took.", Labels: labels, Value: time.Since(run.started).Seconds()},
+		{Name: metricPrefix + "last_run_exit_code", Help: "Exit code of the command's last run.", Labels: labels, Value: float64(code)},
+		{Name: metricPrefix + "last_run_success", Help: "Whether the command's last run succeeded.", Labels: labels, Value: success},
+	})
+	if err != nil {
+		logger.Warningf("unable to write run metrics: %v", err)
+	}
+}
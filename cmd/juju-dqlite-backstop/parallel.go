@@ -0,0 +1,46 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+// forEachNode calls fn for each of the nodes concurrently, each with its own
+// timeout, and waits for them all to complete. With several controllers and
+// some of them dead, checking the nodes serially makes every command crawl.
+// Results should be written to an index of a pre-allocated slice, so that
+// they are aggregated in the order of the nodes.
+func forEachNode(ctx context.Context, nodes []dqlite.NodeInfo, timeout time.Duration, fn func(context.Context, int, dqlite.NodeInfo)) {
+	forEachIndex(ctx, len(nodes), timeout, func(ctx context.Context, i int) {
+		fn(ctx, i, nodes[i])
+	})
+}
+
+// forEachHost is forEachNode for hosts reached over the remote transport.
+func forEachHost(ctx context.Context, hosts []string, timeout time.Duration, fn func(context.Context, int, string)) {
+	forEachIndex(ctx, len(hosts), timeout, func(ctx context.Context, i int) {
+		fn(ctx, i, hosts[i])
+	})
+}
+
+func forEachIndex(ctx context.Context, n int, timeout time.Duration, fn func(context.Context, int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			indexCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			fn(indexCtx, i)
+		}(i)
+	}
+	wg.Wait()
+}
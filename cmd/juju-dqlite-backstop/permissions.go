@@ -0,0 +1,136 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/juju/names/v4"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/doctor"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/fs"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "permissions",
+		args:    "[--path <dir>] [--fix] <tag>",
+		summary: "check, and optionally repair, data directory permissions",
+		run:     runPermissions,
+	})
+}
+
+func runPermissions(args []string) {
+	flags := newFlagSet("permissions", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	fix := flags.Bool("fix", false, "repair the ownership and modes")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || agentFlags.path == stdinPath {
+		commandUsage(commands["permissions"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	problems, err := permissionProblems(cfg, configFilePath(agentFlags, flags.Arg(0)), dataDir)
+	checkErr("check permissions", err)
+
+	if len(problems) == 0 {
+		fmt.Println("permissions are as expected")
+		return
+	}
+	for _, problem := range problems {
+		if !*fix {
+			fmt.Println(problem)
+			continue
+		}
+		checkErr("fix permissions", problem.Fix())
+		fmt.Printf("fixed %s\n", problem)
+	}
+	if !*fix {
+		fmt.Println("run with --fix to repair")
+		exit(1)
+	}
+	recordAudit(dataDir, audit.NewRecord("permissions", redactArgs(args)))
+}
+
+// configFilePath returns the path of the agent config file, or an empty string
+// if it was read from stdin.
+func configFilePath(f *agentFlags, controllerTag string) string {
+	if f.path == stdinPath {
+		return ""
+	}
+	t, err := names.ParseTag(controllerTag)
+	checkErr("parse controller tag", err)
+	return agent.ConfigPath(f.path, t)
+}
+
+// permissionProblems checks that the agent config and the Dqlite data
+// directory have the ownership and modes that jujud expects. Files created by
+// root during manual recovery often break the agent on restart. They are
+// expected to be owned by the owner of the agent's data directory, which is
+// the user jujud runs as.
+func permissionProblems(cfg agent.Config, configPath, dataDir string) ([]fs.Problem, error) {
+	owner, err := fs.PathOwner(cfg.DataDir())
+	if err != nil {
+		return nil, errors.Annotate(err, "reading the owner of the agent data directory")
+	}
+	problems, err := fs.CheckTree(dataDir, owner)
+	if err != nil {
+		return nil, err
+	}
+	if configPath != "" {
+		configProblems, err := fs.CheckFile(configPath, fs.FileMode, owner)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, configProblems...)
+	}
+	return problems, nil
+}
+
+// warnPermissionProblems logs a warning for each permission problem, before
+// the data directory is changed.
+func warnPermissionProblems(cfg agent.Config, configPath string, nodeManager *database.NodeManager) {
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+	problems, err := permissionProblems(cfg, configPath, dataDir)
+	if err != nil {
+		logger.Warningf("unable to check permissions: %v", err)
+		return
+	}
+	for _, problem := range problems {
+		logger.Warningf("%s, repair with the permissions command", problem)
+	}
+}
+
+// checkPermissions is the doctor check for data directory permissions.
+func checkPermissions(env *doctorEnv, report *doctor.Report) {
+	const name = "permissions"
+
+	dataDir, err := env.nodeManager.EnsureDataDir()
+	if err != nil {
+		report.Add(name, doctor.Error, "%v", err)
+		return
+	}
+	problems, err := permissionProblems(env.cfg, env.configPath, dataDir)
+	if err != nil {
+		report.Add(name, doctor.Error, "%v", err)
+		return
+	}
+	for _, problem := range problems {
+		report.Add(name, doctor.Warning, "%s, repair with the permissions command", problem)
+	}
+	if len(problems) == 0 {
+		report.Add(name, doctor.OK, "agent config and data directory permissions are as expected")
+	}
+}
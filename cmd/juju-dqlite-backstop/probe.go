@@ -0,0 +1,136 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "probe",
+		args:    "[--path <dir>] [--samples <n>] [--threshold <duration>] [--format text|json|template] [--template <template>] <tag>",
+		summary: "measure latency and jitter to each node in cluster.yaml",
+		run:     runProbe,
+	})
+}
+
+func runProbe(args []string) {
+	flags := newFlagSet("probe", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	samples := flags.Int("samples", 5, "number of samples to take for each node")
+	interval := flags.Duration("interval", 200*time.Millisecond, "time to wait between samples")
+	threshold := flags.Duration("threshold", 100*time.Millisecond,
+		"flag nodes whose latency plus jitter exceeds this, dqlite heartbeats are sensitive to slow links")
+	output := addOutputFlags(flags)
+	flags.Parse(args)
+	output.check()
+
+	if flags.NArg() != 1 || *samples < 1 {
+		commandUsage(commands["probe"])
+		exit(1)
+	}
+
+	nodeManager := newNodeManager(agentFlags, flags.Arg(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	servers, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+
+	results := make([]internalnet.ProbeResult, len(servers))
+	nodeTimeout := time.Duration(*samples) * (*interval + 5*time.Second)
+	forEachNode(context.Background(), servers, nodeTimeout, func(ctx context.Context, i int, server dqlite.NodeInfo) {
+		results[i] = internalnet.Probe(ctx, server.Address, *samples, *interval)
+	})
+
+	var (
+		flagged int
+		out     = probeOutput{Nodes: []probeNode{}}
+	)
+	for i, server := range servers {
+		result := results[i]
+
+		status, detail := probeOK, ""
+		switch {
+		case !result.Reachable():
+			status, detail = probeUnreachable, fmt.Sprint(result.Err)
+		case result.Mean+result.Jitter > *threshold:
+			status, detail = probeSlow, fmt.Sprintf("exceeds %v", *threshold)
+		case result.Failures > 0:
+			status, detail = probeLossy, fmt.Sprintf("%d/%d samples failed", result.Failures, result.Samples)
+		}
+		if status != probeOK {
+			flagged++
+		}
+		if output.structured() {
+			out.Nodes = append(out.Nodes, probeNode{
+				ID:       server.ID,
+				Address:  server.Address,
+				Samples:  result.Samples,
+				Failures: result.Failures,
+				Min:      result.Min.Seconds(),
+				Mean:     result.Mean.Seconds(),
+				Max:      result.Max.Seconds(),
+				Jitter:   result.Jitter.Seconds(),
+				Status:   status,
+				Detail:   detail,
+			})
+			continue
+		}
+		text := status
+		if detail != "" {
+			text = fmt.Sprintf("%s: %s", strings.ToUpper(status), detail)
+		}
+		fmt.Printf("node %d %s: min=%v mean=%v max=%v jitter=%v %s\n",
+			server.ID, server.Address,
+			result.Min.Round(time.Microsecond), result.Mean.Round(time.Microsecond),
+			result.Max.Round(time.Microsecond), result.Jitter.Round(time.Microsecond),
+			text)
+	}
+	if output.structured() {
+		out.Flagged = flagged
+		output.write(out)
+	}
+	if flagged > 0 {
+		exit(1)
+	}
+}
+
+// The statuses probe gives each node.
+const (
+	probeOK          = "ok"
+	probeUnreachable = "unreachable"
+	probeSlow        = "slow"
+	probeLossy       = "lossy"
+)
+
+// probeOutput is the data model of the probe command's JSON and template
+// output. Flagged is the number of nodes not ok.
+type probeOutput struct {
+	Nodes   []probeNode `json:"nodes"`
+	Flagged int         `json:"flagged"`
+}
+
+// probeNode is the result of probing a node, with times in seconds.
+type probeNode struct {
+	ID       uint64  `json:"id"`
+	Address  string  `json:"address"`
+	Samples  int     `json:"samples"`
+	Failures int     `json:"failures"`
+	Min      float64 `json:"min"`
+	Mean     float64 `json:"mean"`
+	Max      float64 `json:"max"`
+	Jitter   float64 `json:"jitter"`
+	Status   string  `json:"status"`
+	Detail   string  `json:"detail,omitempty"`
+}
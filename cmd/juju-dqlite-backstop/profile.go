@@ -0,0 +1,133 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strings"
+	"time"
+)
+
+// The profiling flags are hidden, given before the command, as they are
+// only needed to diagnose the tool itself.
+const (
+	// pprofFlag serves net/http/pprof on the address for the run.
+	pprofFlag = "pprof"
+	// profileDirFlag writes a CPU profile of the run, and a heap profile
+	// at its end, to the directory.
+	profileDirFlag = "profile-dir"
+)
+
+// profiling holds the state of the profiles being taken.
+var profiling struct {
+	server  *http.Server
+	cpuFile *os.File
+	dir     string
+	// suffix ends the name of each profile written by the run.
+	suffix string
+}
+
+// parseProfiling starts the profiling asked for by the flags given before
+// the command, and returns the remaining arguments.
+func parseProfiling(args []string) []string {
+	for len(args) > 0 {
+		name, value, ok := strings.Cut(strings.TrimLeft(args[0], "-"), "=")
+		if !strings.HasPrefix(args[0], "-") || (name != pprofFlag && name != profileDirFlag) {
+			return args
+		}
+		args = args[1:]
+		if !ok {
+			if len(args) == 0 {
+				fmt.Fprintf(os.Stderr, "flag needs an argument: --%s\n", name)
+				exit(2)
+			}
+			value, args = args[0], args[1:]
+		}
+		var err error
+		switch name {
+		case pprofFlag:
+			err = servePprof(value)
+		case profileDirFlag:
+			err = startProfiles(value)
+		}
+		checkErr("start profiling", err)
+	}
+	return args
+}
+
+// servePprof serves the pprof handlers on the address, printing the address
+// served, which may have been chosen by the system.
+func servePprof(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = server.Serve(listener) }()
+	profiling.server = server
+	fmt.Fprintf(os.Stderr, "serving pprof on http://%s/debug/pprof/\n", listener.Addr())
+	return nil
+}
+
+// startProfiles starts writing a CPU profile to the directory.
+func startProfiles(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	profiling.suffix = fmt.Sprintf("%s-%d.pprof", time.Now().UTC().Format("20060102T150405Z"), os.Getpid())
+	f, err := os.Create(filepath.Join(dir, "cpu-"+profiling.suffix))
+	if err != nil {
+		return err
+	}
+	if err := rpprof.StartCPUProfile(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	profiling.cpuFile, profiling.dir = f, dir
+	return nil
+}
+
+// stopProfiling completes the CPU profile and writes a heap profile, if
+// profiles are written, and stops serving pprof.
+func stopProfiling() {
+	if profiling.server != nil {
+		_ = profiling.server.Close()
+		profiling.server = nil
+	}
+	if profiling.cpuFile == nil {
+		return
+	}
+	rpprof.StopCPUProfile()
+	_ = profiling.cpuFile.Close()
+	profiling.cpuFile = nil
+
+	path := filepath.Join(profiling.dir, "heap-"+profiling.suffix)
+	f, err := os.Create(path)
+	if err == nil {
+		// Collect garbage first, so that the profile shows what is live.
+		runtime.GC()
+		err = rpprof.WriteHeapProfile(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		logger.Warningf("unable to write heap profile: %v", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "profiles written to %s\n", profiling.dir)
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/doctor"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+// The sides of the membership that check-raft-membership can rewrite.
+const (
+	rewriteClusterYAML = "cluster.yaml"
+	rewriteRaft        = "raft"
+)
+
+var raftMembershipPrompt = `
+This will rewrite %s with the membership shown above. The jujud service must
+be stopped.
+
+Ok to proceed?`[1:]
+
+func init() {
+	registerCommand(command{
+		name:    "check-raft-membership",
+		args:    "[--path <dir>] [--rewrite cluster.yaml|raft] [--yes] <tag>",
+		summary: "compare the membership in the raft log with cluster.yaml, and repair either",
+		run:     runCheckRaftMembership,
+	})
+}
+
+func runCheckRaftMembership(args []string) {
+	flags := newFlagSet("check-raft-membership", flag.ExitOnError)
+	addHookFlags(flags)
+	addAssumeStoppedFlag(flags)
+	agentFlags := addAgentFlags(flags)
+	rewrite := flags.String("rewrite", "", "rewrite the side that is wrong with the other: cluster.yaml or raft")
+	yes := flags.Bool("yes", false, "answer 'yes' to prompts")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (*rewrite != "" && *rewrite != rewriteClusterYAML && *rewrite != rewriteRaft) {
+		commandUsage(commands["check-raft-membership"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	servers, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+	membership, err := raft.ReadMembership(dataDir)
+	checkErr("read raft membership", err)
+	logged := raftNodes(membership.Servers)
+
+	fmt.Printf("raft log (%s):\n", describeRaftMembership(membership))
+	for _, node := range logged {
+		fmt.Printf("  %s\n", describeMember(node))
+	}
+	fmt.Println("cluster.yaml:")
+	for _, node := range servers {
+		fmt.Printf("  %s\n", describeMember(node))
+	}
+	fmt.Println("")
+	if database.SameMembership(servers, logged) {
+		fmt.Println("the raft log and cluster.yaml agree")
+		return
+	}
+	if *rewrite == "" {
+		fmt.Println("the raft log and cluster.yaml have drifted apart")
+		fmt.Println("use --rewrite cluster.yaml or --rewrite raft to replace the side that is wrong")
+		exit(1)
+	}
+
+	// The side being rewritten is replaced by the other.
+	current, replacement := logged, servers
+	if *rewrite == rewriteClusterYAML {
+		current, replacement = servers, logged
+	}
+	fmt.Printf("%s will be updated:\n\n", *rewrite)
+	printMembershipChange(current, replacement)
+	fmt.Println("")
+
+	checkNodeStopped(nodeManager)
+	checkControllerUUID(cfg, nodeManager)
+	if !*yes && !promptYN(fmt.Sprintf(raftMembershipPrompt, *rewrite)) {
+		return
+	}
+
+	defer beginChange()()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if *rewrite == rewriteClusterYAML {
+		checkErr("write cluster servers", nodeManager.WriteClusterServers(ctx, replacement))
+	} else {
+		checkErr("reconfigure cluster membership", nodeManager.ReconfigureMembership(replacement))
+	}
+
+	rec := audit.NewRecord("check-raft-membership", redactArgs(args))
+	rec.Before, rec.After = current, replacement
+	recordAudit(dataDir, rec)
+	fmt.Printf("%s rewritten\n", *rewrite)
+}
+
+// checkRaftMembership reports whether the membership raft will start with
+// matches cluster.yaml.
+func checkRaftMembership(env *doctorEnv, report *doctor.Report) {
+	const name = "raft-membership"
+
+	dataDir, err := env.nodeManager.EnsureDataDir()
+	if err != nil {
+		report.Add(name, doctor.Error, "unable to find the Dqlite data directory: %v", err)
+		return
+	}
+	membership, err := raft.ReadMembership(dataDir)
+	if err != nil {
+		report.Add(name, doctor.Warning, "unable to read the raft membership: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	servers, err := env.nodeManager.ClusterServers(ctx)
+	if err != nil {
+		report.Add(name, doctor.Error, "unable to read cluster.yaml: %v", err)
+		return
+	}
+	if !database.SameMembership(servers, raftNodes(membership.Servers)) {
+		report.Add(name, doctor.Warning, "the raft log (%s) and cluster.yaml have drifted apart, see check-raft-membership",
+			describeRaftMembership(membership))
+		return
+	}
+	report.Add(name, doctor.OK, "the raft log and cluster.yaml agree")
+}
+
+// describeRaftMembership describes where the membership was read from.
+func describeRaftMembership(m raft.Membership) string {
+	if m.FromSnapshot {
+		return fmt.Sprintf("snapshot at index %d", m.Index)
+	}
+	return fmt.Sprintf("configuration change at index %d", m.Index)
+}
+
+// raftNodes returns the servers of a raft configuration as Dqlite nodes.
+func raftNodes(servers []raft.Server) []dqlite.NodeInfo {
+	nodes := make([]dqlite.NodeInfo, len(servers))
+	for i, server := range servers {
+		nodes[i] = dqlite.NodeInfo{ID: server.ID, Address: server.Address, Role: dqliteRole(server.Role)}
+	}
+	return nodes
+}
+
+// dqliteRole returns the Dqlite role of a raft role.
+func dqliteRole(role raft.Role) dqlite.NodeRole {
+	switch role {
+	case raft.Voter:
+		return dqlite.Voter
+	case raft.StandBy:
+		return dqlite.StandBy
+	default:
+		return dqlite.Spare
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/journal"
+)
+
+var rebuildPrompt = `
+This will move the dqlite data on this machine aside, and replace it with a
+copy of the data from the healthy peer, as a new node with the ID and address
+shown above.
+
+Ok to proceed?`[1:]
+
+func init() {
+	registerCommand(command{
+		name:    "rebuild",
+		args:    "[--path <dir>] --from <host> --address <address> [--copy-compression <compression>] [remote flags] [--strict] [--yes] <tag>",
+		summary: "rebuild the local node from a copy of a healthy peer's data",
+		run:     runRebuild,
+	})
+	registerCommand(command{
+		name:    "add-node",
+		args:    "[--path <dir>] [--role <role>] <tag> <id> <address>",
+		summary: "register a rebuilt node with the running cluster",
+		run:     runAddNode,
+	})
+}
+
+func runRebuild(args []string) {
+	flags := newFlagSet("rebuild", flag.ExitOnError)
+	addHookFlags(flags)
+	addAssumeStoppedFlag(flags)
+	agentFlags := addAgentFlags(flags)
+	from := flags.String("from", "", "host of the healthy peer to copy the data from")
+	address := flags.String("address", "", "address of the rebuilt node")
+	remoteDataDir := flags.String("remote-data-dir", agent.DefaultPaths.DataDir, "data directory on the healthy peer")
+	ignoreRunning := flags.Bool("ignore-running-peers", false, "copy the data even if jujud is running on the healthy peer")
+	timeout := flags.Duration("timeout", 10*time.Minute, "time to wait for the copy")
+	strict := addStrictFlag(flags)
+	yes := flags.Bool("yes", false, "answer 'yes' to prompts")
+	remoteFlags := addRemoteFlags(flags)
+	remoteFlags.addCompressionFlag(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *from == "" || *address == "" || agentFlags.path == stdinPath {
+		commandUsage(commands["rebuild"])
+		exit(1)
+	}
+	warnings := startStrict(*strict)
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	transport := remoteFlags.transportFor(cfg)
+	nodeAddress := *address
+	if _, _, err := net.SplitHostPort(nodeAddress); err != nil {
+		nodeAddress = net.JoinHostPort(nodeAddress, strconv.Itoa(nodeManager.Port()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	// The Raft log is only consistent if the peer is not writing to it.
+	units, err := transport.ActiveJujudServices(ctx, *from)
+	checkErr("check healthy peer", err)
+	if len(units) > 0 && !*ignoreRunning {
+		checkErr("check healthy peer", failure.Wrap(failure.PeersRunning, fmt.Errorf(
+			"jujud is running on %s: %s, stop it first or use --ignore-running-peers", *from, strings.Join(units, ", "))))
+	}
+
+	data, err := transport.ReadFile(ctx, *from, database.ClusterFilePath(*remoteDataDir))
+	checkErr("read healthy peer cluster.yaml", err)
+	source, err := database.ParseStoreCopy(*from, data, nil)
+	checkErr("read healthy peer cluster.yaml", err)
+
+	node := dqlite.NodeInfo{
+		ID:      dqlite.GenerateID(nodeAddress),
+		Address: nodeAddress,
+		Role:    dqlite.Voter,
+	}
+	membership := append(append([]dqlite.NodeInfo{}, source.Servers...), node)
+	if conflicts := database.AddressConflicts(membership); len(conflicts) > 0 {
+		checkErr("check address conflicts", failure.Wrap(failure.AddressConflict, fmt.Errorf("%s", strings.Join(conflicts, "; "))))
+	}
+
+	// The local data is moved aside rather than removed, so the copy needs
+	// space of its own.
+	if size, err := remoteDirSize(ctx, transport, *from, database.DqliteDir(*remoteDataDir)); err == nil {
+		dataDir, err := nodeManager.EnsureDataDir()
+		checkErr("ensure data dir", err)
+		checkErr("check disk space", checkSpace("copy the data", dataDir, size))
+	} else {
+		logger.Warningf("unable to read the size of the data on %s: %v", *from, err)
+	}
+
+	fmt.Printf("the rebuilt node will be node %d at %s\n", node.ID, node.Address)
+	fmt.Println("cluster.yaml will be written as:")
+	fmt.Println("")
+	printMembershipChange(source.Servers, membership)
+	fmt.Println("")
+
+	checkNodeStopped(nodeManager)
+	enforceStrict(warnings)
+	if !*yes && !promptYN(rebuildPrompt) {
+		return
+	}
+
+	defer beginChange()()
+	ctx, cancel = context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	archive, err := nodeManager.ArchiveDataDir("rebuild-"+time.Now().UTC().Format("20060102T150405Z"), audit.FileName)
+	checkErr("archive data dir", err)
+	fmt.Printf("dqlite data archived to %s\n", archive)
+
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	fmt.Printf("copying dqlite data from %s\n", *from)
+	checkErr("copy data", transport.CopyDir(ctx, *from, database.DqliteDir(*remoteDataDir), dataDir,
+		"info.yaml", "cluster.yaml", audit.FileName, journal.FileName))
+
+	checkErr("set cluster servers", nodeManager.SetClusterServers(ctx, membership))
+	checkErr("set node info", nodeManager.SetNodeInfo(node))
+
+	rec := audit.NewRecord("rebuild", redactArgs(args))
+	rec.Before, rec.After = source.Servers, membership
+	recordAudit(dataDir, rec)
+
+	fmt.Println("node rebuilt")
+	fmt.Println("restart the machine agent on the healthy peer, then on this machine using:")
+	fmt.Println("")
+	fmt.Printf("\t%s\n", newAgentService(cfg, flags.Arg(0)).command("restart"))
+	fmt.Println("")
+	fmt.Println("then register the node with the cluster using:")
+	fmt.Println("")
+	fmt.Printf("\tjuju-dqlite-backstop add-node %s %d %s\n", flags.Arg(0), node.ID, node.Address)
+	fmt.Println("")
+}
+
+func runAddNode(args []string) {
+	flags := newFlagSet("add-node", flag.ExitOnError)
+	addHookFlags(flags)
+	agentFlags := addAgentFlags(flags)
+	role := flags.String("role", "voter", "role of the node: voter, stand-by or spare")
+	timeout := flags.Duration("timeout", time.Minute, "time to wait for the cluster")
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		commandUsage(commands["add-node"])
+		exit(1)
+	}
+
+	id, err := strconv.ParseUint(flags.Arg(1), 10, 64)
+	checkErr("parse node ID", err)
+	node := dqlite.NodeInfo{ID: id, Address: flags.Arg(2)}
+	switch *role {
+	case "voter":
+		node.Role = dqlite.Voter
+	case "stand-by":
+		node.Role = dqlite.StandBy
+	case "spare":
+		node.Role = dqlite.Spare
+	default:
+		checkErr("parse role", fmt.Errorf("unknown role %q", *role))
+	}
+
+	_, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	if _, _, err := net.SplitHostPort(node.Address); err != nil {
+		node.Address = net.JoinHostPort(node.Address, strconv.Itoa(nodeManager.Port()))
+	}
+
+	defer beginChange()()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	assigned, err := nodeManager.AddNode(ctx, node)
+	checkErr("add node", err)
+
+	dataDir, _ := nodeManager.EnsureDataDir()
+	recordAudit(dataDir, audit.NewRecord("add-node", redactArgs(args)))
+
+	if !assigned {
+		fmt.Printf("node %d added as a spare, promote it once it is online and has caught up\n", node.ID)
+		return
+	}
+	fmt.Printf("node %d at %s added as a %s\n", node.ID, node.Address, node.Role)
+}
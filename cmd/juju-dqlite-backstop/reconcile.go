@@ -0,0 +1,287 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+)
+
+var reconcilePrompt = `
+This will replace cluster.yaml with the membership shown above, leaving the
+Raft log untouched. The jujud service must be stopped on every controller that
+is updated.
+
+Ok to proceed?`[1:]
+
+func init() {
+	registerCommand(command{
+		name: "reconcile",
+		args: "[--path <dir>] [--strategy union|intersection] [--prefer <host>] [--exclude <id>...] " +
+			"[--host <host>=<tag>...] [--membership <file>] [remote flags] [--strict] [--yes] <tag>",
+		summary: "reconcile differing cluster.yaml copies into one membership",
+		run:     runReconcile,
+	})
+}
+
+func runReconcile(args []string) {
+	flags := newFlagSet("reconcile", flag.ExitOnError)
+	addHookFlags(flags)
+	addAssumeStoppedFlag(flags)
+	agentFlags := addAgentFlags(flags)
+	remoteDataDir := flags.String("remote-data-dir", agent.DefaultPaths.DataDir, "data directory on the other controllers")
+	strategy := flags.String("strategy", string(database.ReconcileUnion), "keep nodes found in any copy (union) or in every copy (intersection)")
+	prefer := flags.String("prefer", "", "where copies disagree about a node, use the version from this host, or local")
+	var excluded stringsFlag
+	flags.Var(&excluded, "exclude", "IDs of nodes to leave out of the membership (repeatable)")
+	var hosts stringsFlag
+	flags.Var(&hosts, "host", "other controller to read and update, as <host>=<tag> (repeatable)")
+	remoteBinary := flags.String("remote-binary", "juju-dqlite-backstop", "path of this tool on the other controllers")
+	membershipPath := flags.String("membership", "", "apply the membership in this YAML file, or - for stdin, instead of reconciling")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout for reading from each controller")
+	strict := addStrictFlag(flags)
+	yes := flags.Bool("yes", false, "answer 'yes' to prompts")
+	remoteFlags := addRemoteFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["reconcile"])
+		exit(1)
+	}
+	warnings := startStrict(*strict)
+	if *membershipPath == stdinPath && (agentFlags.path == stdinPath || !*yes) {
+		checkErr("read membership", fmt.Errorf("--yes is required, and the agent config must be read from a file, when reading the membership from stdin"))
+	}
+	remotes, err := parseRemoteHosts(hosts)
+	checkErr("parse hosts", err)
+	excludedIDs, err := parseNodeIDs(excluded)
+	checkErr("parse excluded nodes", err)
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	transport := remoteFlags.transportFor(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	servers, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+
+	var membership []dqlite.NodeInfo
+	if *membershipPath != "" {
+		data, err := readAddressMapData(*membershipPath)
+		checkErr("read membership", err)
+		checkErr("parse membership", yaml.Unmarshal(data, &membership))
+	} else {
+		copies := readStoreCopies(cfg.DataDir(), remotes, transport, *remoteDataDir, *timeout)
+		disagreements := database.StoreDisagreements(copies)
+		if len(disagreements) == 0 {
+			fmt.Printf("%d controllers agree, nothing to reconcile\n", len(copies))
+			return
+		}
+		for _, disagreement := range disagreements {
+			fmt.Println(disagreement)
+		}
+		fmt.Println("")
+
+		choose := chooseVariant(*prefer, !*yes)
+		membership, err = database.ReconcileMembership(
+			database.CandidateNodes(copies), database.ReconcileStrategy(*strategy), choose)
+		checkErr("reconcile membership", err)
+	}
+	membership = excludeNodes(membership, excludedIDs)
+	checkErr("check membership", database.ValidateMembership(membership))
+
+	localInfo, infoErr := nodeManager.NodeInfo()
+	if infoErr == nil && !containsID(membership, localInfo.ID) {
+		checkErr("check membership", fmt.Errorf("the local node %d is not in the membership", localInfo.ID))
+	}
+
+	fmt.Println("cluster.yaml will be updated:")
+	fmt.Println("")
+	printMembershipChange(servers, membership)
+	fmt.Println("")
+	bytes, _ := yaml.Marshal(membership)
+
+	// Every controller being updated must be stopped first.
+	for host := range remotes {
+		units, err := transport.ActiveJujudServices(ctx, host)
+		checkErr("check "+host, err)
+		if len(units) > 0 {
+			checkErr("check "+host, fmt.Errorf("jujud is running: %s", strings.Join(units, ", ")))
+		}
+	}
+	checkNodeStopped(nodeManager)
+	checkControllerUUID(cfg, nodeManager)
+
+	enforceStrict(warnings)
+	if !*yes && !promptYN(reconcilePrompt) {
+		return
+	}
+
+	defer beginChange()()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	fmt.Println("updating cluster.yaml")
+	checkErr("write cluster servers", nodeManager.WriteClusterServers(ctx, membership))
+	if infoErr == nil {
+		for _, node := range membership {
+			if node.ID == localInfo.ID && node.Address != localInfo.Address {
+				fmt.Println("updating info.yaml")
+				checkErr("set node info", nodeManager.SetNodeInfo(node))
+			}
+		}
+	}
+
+	dataDir, _ := nodeManager.EnsureDataDir()
+	rec := audit.NewRecord("reconcile", redactArgs(args))
+	rec.Before, rec.After = servers, membership
+	recordAudit(dataDir, rec)
+
+	var failed []string
+	for host, tag := range remotes {
+		fmt.Printf("updating %s on %s\n", tag, host)
+		command := []string{*remoteBinary, "reconcile", "--yes", "--membership", stdinPath, tag}
+		if err := runRemote(ctx, transport, host, bytes, quoteCommand(transport, command...)...); err != nil {
+			logger.Errorf("%s: %v", host, err)
+			failed = append(failed, host)
+		}
+	}
+	if len(failed) > 0 {
+		checkErr("reconcile", fmt.Errorf("failed on %s, rerun reconcile there with --membership", strings.Join(failed, ", ")))
+	}
+	if len(remotes) == 0 && *membershipPath == "" {
+		fmt.Println("apply the same membership on each of the other controllers with --membership")
+	}
+	fmt.Println("membership reconciled")
+}
+
+// readStoreCopies reads the local cluster.yaml and info.yaml, and those of
+// the remote controllers. Without any remote controllers, those known to the
+// local cluster.yaml are read. Unreachable controllers are skipped.
+func readStoreCopies(
+	dataDir string, remotes map[string]string, transport remote.Transport, remoteDataDir string, timeout time.Duration,
+) []database.StoreCopy {
+	local, err := readLocalStore(dataDir)
+	checkErr("read local cluster.yaml", err)
+
+	var hosts []string
+	for host := range remotes {
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		for _, server := range local.Servers {
+			if local.Info != nil && server.ID == local.Info.ID {
+				continue
+			}
+			host, err := internalnet.SplitHost(server.Address)
+			checkErr("parse node address", err)
+			hosts = append(hosts, host)
+		}
+	}
+
+	// The controllers are read concurrently, so that unreachable ones do
+	// not each use up the timeout in turn.
+	remoteCopies := make([]database.StoreCopy, len(hosts))
+	errs := make([]error, len(hosts))
+	forEachHost(context.Background(), hosts, timeout, func(ctx context.Context, i int, host string) {
+		remoteCopies[i], errs[i] = readRemoteStore(ctx, transport, host, remoteDataDir)
+	})
+
+	copies := []database.StoreCopy{local}
+	for i, host := range hosts {
+		if errs[i] != nil {
+			logger.Warningf("%s: %v", host, errs[i])
+			continue
+		}
+		copies = append(copies, remoteCopies[i])
+	}
+	return copies
+}
+
+// chooseVariant returns a function choosing between differing versions of
+// a node: the version from the preferred host if there is one, otherwise
+// the operator's choice when prompting is allowed.
+func chooseVariant(prefer string, interactive bool) func(database.CandidateNode) (database.NodeVariant, error) {
+	return func(candidate database.CandidateNode) (database.NodeVariant, error) {
+		if prefer != "" {
+			for _, variant := range candidate.Variants {
+				for _, host := range variant.Hosts {
+					if host == prefer {
+						return variant, nil
+					}
+				}
+			}
+		}
+		if !interactive {
+			return database.NodeVariant{}, fmt.Errorf("copies disagree, and %q has no version of it", prefer)
+		}
+
+		checkInteractive(fmt.Sprintf("which version of node %d should be kept?", candidate.ID))
+		fmt.Printf("copies disagree about node %d:\n", candidate.ID)
+		for i, variant := range candidate.Variants {
+			fmt.Printf("\t%d) %s (%s) in %s\n", i+1, variant.Node.Address, variant.Node.Role, strings.Join(variant.Hosts, ", "))
+		}
+		choice, ok := promptChoice(os.Stdin, "which version should be kept?", len(candidate.Variants))
+		if !ok {
+			return database.NodeVariant{}, fmt.Errorf("no version chosen")
+		}
+		return candidate.Variants[choice], nil
+	}
+}
+
+// promptChoice asks for a number between 1 and n, returning its index.
+func promptChoice(in io.Reader, question string, n int) (int, bool) {
+	fmt.Printf("%s [1-%d] ", question, n)
+	os.Stdout.Sync()
+	scanner := bufio.NewScanner(in)
+	if !scanner.Scan() {
+		return 0, false
+	}
+	choice, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+	if err != nil || choice < 1 || choice > n {
+		return 0, false
+	}
+	return choice - 1, true
+}
+
+// excludeNodes returns the membership without the nodes with the IDs.
+func excludeNodes(membership []dqlite.NodeInfo, ids []uint64) []dqlite.NodeInfo {
+	excluded := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		excluded[id] = true
+	}
+	var kept []dqlite.NodeInfo
+	for _, node := range membership {
+		if !excluded[node.ID] {
+			kept = append(kept, node)
+		}
+	}
+	return kept
+}
+
+// containsID reports whether the membership has a node with the ID.
+func containsID(membership []dqlite.NodeInfo, id uint64) bool {
+	for _, node := range membership {
+		if node.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/backup"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/compress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/doctor"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "recover",
+		args:    "[--path <dir>] [--from <host>...] [--backup-dir <dir>|s3://<bucket>/<prefix>] [--backup-compression <compression>] [remote flags] [s3 flags] [--restart] [--yes] <tag>",
+		summary: "recover a cluster that has lost quorum to this node, in phases",
+		run:     runRecover,
+	})
+}
+
+// recovery holds the state shared between the phases of the recover command.
+type recovery struct {
+	tag         string
+	yes         bool
+	strict      bool
+	cfg         agent.Config
+	configPath  string
+	nodeManager *database.NodeManager
+	dataDir     string
+	local       dqlite.NodeInfo
+	transport   remote.Transport
+}
+
+func runRecover(args []string) {
+	flags := newFlagSet("recover", flag.ExitOnError)
+	addHookFlags(flags)
+	addAssumeStoppedFlag(flags)
+	agentFlags := addAgentFlags(flags)
+	var from stringsFlag
+	flags.Var(&from, "from", "other controller to compare raft logs with (repeatable), defaults to the peers in cluster.yaml")
+	remoteDataDir := flags.String("remote-data-dir", agent.DefaultPaths.DataDir, "data directory on the other controllers")
+	backupDir := flags.String("backup-dir", "", "directory or s3://<bucket>/<prefix> to write the backup to, defaults to the agent data directory")
+	compression := flags.String("backup-compression", compress.Default.String(), "compression of the backup: gzip, zstd or none, optionally followed by :<level>")
+	ignoreRunning := flags.Bool("ignore-running-peers", false, "continue even if jujud is running on other controllers")
+	restart := flags.Bool("restart", false, "restart the machine agent once the membership is rewritten")
+	wait := flags.Duration("wait", 5*time.Minute, "time to wait for the node to become healthy after the restart")
+	yes := flags.Bool("yes", false, "answer 'yes' to prompts")
+	strict := flags.Bool("strict", false, "stop on warnings from the preflight checks, as well as errors")
+	remoteFlags := addRemoteFlags(flags)
+	s3Flags := addS3Flags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || agentFlags.path == stdinPath {
+		commandUsage(commands["recover"])
+		exit(1)
+	}
+	c, err := compress.Parse(*compression)
+	checkErr("parse --backup-compression", err)
+
+	r := &recovery{
+		tag:        flags.Arg(0),
+		yes:        *yes,
+		strict:     *strict,
+		configPath: configFilePath(agentFlags, flags.Arg(0)),
+	}
+	r.cfg, r.nodeManager = loadAgent(agentFlags, r.tag)
+	r.transport = remoteFlags.transportFor(r.cfg)
+
+	r.phase("preflight checks")
+	r.preflight()
+
+	r.phase("checking the machine agents are stopped")
+	r.checkStopped(*ignoreRunning)
+
+	r.phase("comparing raft logs")
+	r.checkFreshest(from, *remoteDataDir)
+	r.gate("Continue with this node as the survivor?")
+
+	r.phase("backing up")
+	dir := *backupDir
+	if dir == "" {
+		dir = r.cfg.DataDir()
+	}
+	r.backup(dir, c, s3Flags)
+
+	r.phase("rewriting the membership")
+	r.reconfigure(args)
+
+	r.phase("restarting")
+	r.restart(*restart, *wait)
+}
+
+func (r *recovery) phase(name string) {
+	fmt.Printf("\n== %s\n", name)
+}
+
+// gate asks for confirmation before the next phase, stopping if it is not
+// given.
+func (r *recovery) gate(question string) {
+	if !r.yes && !promptYN(question) {
+		fmt.Println("recovery stopped, nothing further has been changed")
+		exit(1)
+	}
+}
+
+func (r *recovery) preflight() {
+	local, err := r.nodeManager.NodeInfo()
+	if err != nil {
+		checkErr("read info.yaml", fmt.Errorf(
+			"%v, this node has never run dqlite, use the backstop without a command instead", err))
+	}
+	r.local = local
+	r.dataDir, err = r.nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	env := &doctorEnv{
+		cfg:         r.cfg,
+		configPath:  r.configPath,
+		nodeManager: r.nodeManager,
+		certWarn:    30 * 24 * time.Hour,
+	}
+	var report doctor.Report
+	for _, check := range doctorChecks {
+		check.run(env, &report)
+	}
+	report.Write(os.Stdout)
+	if report.Worst() == doctor.Error {
+		checkErr("preflight checks", fmt.Errorf("fix the errors above before recovering"))
+	}
+	if r.strict && report.Worst() == doctor.Warning {
+		checkErr("preflight checks", failure.Wrap(failure.StrictWarnings, fmt.Errorf(
+			"fix the warnings above before recovering, or recover without --strict")))
+	}
+}
+
+func (r *recovery) checkStopped(ignoreRunning bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	checkNodeStopped(r.nodeManager, localJujudStopped(ctx, newAgentService(r.cfg, r.tag)))
+	checkControllerUUID(r.cfg, r.nodeManager)
+	fmt.Println("local: jujud is stopped")
+
+	checkPeersStopped(r.nodeManager, r.transport, []dqlite.NodeInfo{r.local}, ignoreRunning)
+}
+
+// checkFreshest refuses to continue if another controller has a more recent
+// raft log than this node, as keeping this node would discard its entries.
+func (r *recovery) checkFreshest(hosts []string, remoteDataDir string) {
+	if len(hosts) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		servers, err := r.nodeManager.ClusterServers(ctx)
+		checkErr("get cluster servers", err)
+		for _, server := range servers {
+			if server.ID == r.local.ID {
+				continue
+			}
+			host, err := internalnet.SplitHost(server.Address)
+			checkErr("parse node address", err)
+			hosts = append(hosts, host)
+		}
+	}
+
+	local, err := raft.ReadHistory(r.dataDir)
+	checkErr("read local raft log", err)
+	histories := append([]namedHistory{{name: "local", history: local}},
+		remoteHistories(r.transport, hosts, remoteDataDir, 5*time.Minute)...)
+
+	reportDivergence(histories)
+
+	raw := make([]raft.History, len(histories))
+	for i, h := range histories {
+		raw[i] = h.history
+	}
+	freshest := histories[raft.Freshest(raw)]
+	if freshest.name != "local" && freshest.history.Last() != local.Last() {
+		checkErr("select survivor", fmt.Errorf(
+			"%s has a more recent raft log than this node, run recover there instead", freshest.name))
+	}
+	fmt.Println("this node has the most recent raft log of the reachable controllers")
+}
+
+func (r *recovery) backup(dest string, c compress.Compression, s3Flags *s3Flags) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	sources := []backup.Source{dqliteSource(r.dataDir)}
+	if r.configPath != "" {
+		sources = append(sources, backup.Source{Name: "agent.conf", Path: r.configPath})
+	}
+	env := backupEnvironment(ctx, r.cfg, r.nodeManager)
+	location, err := writeBackup(ctx, dest, "", c, s3Flags, env, sources)
+	checkErr("backup", err)
+	fmt.Printf("backup written to %s\n", location)
+}
+
+func (r *recovery) reconfigure(args []string) {
+	fmt.Printf("the membership will be rewritten to node %d at %s\n", r.local.ID, r.local.Address)
+	r.gate(controllerPrompt)
+
+	defer beginChange()()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	before, _ := r.nodeManager.ClusterServers(ctx)
+	servers := []dqlite.NodeInfo{r.local}
+	checkErr("set cluster servers", r.nodeManager.SetClusterServers(ctx, servers))
+
+	rec := audit.NewRecord("recover", redactArgs(args))
+	rec.Before, rec.After = before, servers
+	recordAudit(r.dataDir, rec)
+	fmt.Println("membership rewritten")
+}
+
+// restart restarts the machine agent, or waits for the operator to, and then
+// waits for the node to become healthy.
+func (r *recovery) restart(restart bool, wait time.Duration) {
+	service := newAgentService(r.cfg, r.tag)
+	if restart {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		checkErr("restart machine agent", service.run(ctx, "restart"))
+	} else {
+		fmt.Printf("restart the machine agent using:\n\n\t%s\n\n", service.command("restart"))
+		r.gate("Has the machine agent been restarted?")
+	}
+
+	checkErr("wait for node", waitHealthy(r.nodeManager, service, r.local, wait, 2*time.Second))
+	fmt.Println("recovery complete")
+}
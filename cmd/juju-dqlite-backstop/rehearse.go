@@ -0,0 +1,162 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/doctor"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/fs"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+// rehearse makes the change to a copy of the Dqlite data directory, in the
+// new directory given or a temporary one, then verifies the copy and reports
+// what the real run would do. The real data is left untouched. The copy is
+// kept only if the directory was given.
+func rehearse(cfg agent.Config, nodeManager *database.NodeManager, clusterNodes []dqlite.NodeInfo, dir string) {
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+
+	keep := dir != ""
+	if keep {
+		checkErr("create rehearsal directory", os.Mkdir(dir, 0700))
+	} else {
+		dir, err = os.MkdirTemp("", "juju-dqlite-backstop-rehearsal-")
+		checkErr("create rehearsal directory", err)
+	}
+	fmt.Println("rehearsing the change on a copy of the data")
+	report, err := rehearseIn(cfg, dataDir, clusterNodes, dir)
+	if keep {
+		fmt.Printf("the rehearsed copy is in %s\n", dir)
+	} else if err := os.RemoveAll(dir); err != nil {
+		logger.Warningf("unable to remove the rehearsal copy in %s: %v", dir, err)
+	}
+	checkErr("rehearse", err)
+
+	fmt.Println("")
+	fmt.Println("verification of the rehearsed copy:")
+	report.Write(os.Stdout)
+	fmt.Println("")
+	fmt.Println("the real data was not changed")
+	if result != nil {
+		result.Outcome = outcomeRehearsed
+		result.decide("rehearsed the change on a copy of the data, whose verification found %s", report.Worst())
+	}
+
+	switch report.Worst() {
+	case doctor.Error:
+		exit(2)
+	case doctor.Warning:
+		exit(1)
+	}
+}
+
+// rehearseIn copies the Dqlite data directory into dir, writes the
+// membership to the copy as the real run would, and verifies the result.
+func rehearseIn(cfg agent.Config, dataDir string, clusterNodes []dqlite.NodeInfo, dir string) (*doctor.Report, error) {
+	size, err := fs.TreeSize(dataDir)
+	if err != nil {
+		return nil, errors.Annotate(err, "sizing the Dqlite data")
+	}
+	if err := checkSpace("rehearse the change", dir, size); err != nil {
+		return nil, errors.Trace(err)
+	}
+	copyDir := database.DqliteDir(dir)
+	if err := fs.CopyTree(dataDir, copyDir); err != nil {
+		return nil, errors.Annotate(err, "copying the Dqlite data")
+	}
+
+	rehearsal := database.NewNodeManager(agent.WithDataDir(cfg, dir), logger)
+	rehearsal.SetRetryStrategy(retryStrategy())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	timer := newStepTimer()
+	infoChanged, err := writeMembership(ctx, rehearsal, clusterNodes, timer)
+	if err != nil {
+		return nil, errors.Annotate(err, "writing the membership to the copy")
+	}
+	if infoChanged {
+		fmt.Println("info.yaml would be updated")
+	}
+	timer.print()
+	return verifyRehearsal(ctx, rehearsal, copyDir, clusterNodes), nil
+}
+
+// verifyRehearsal checks that the rehearsed copy holds the membership
+// everywhere the node reads it from when it starts.
+func verifyRehearsal(ctx context.Context, rehearsal *database.NodeManager, copyDir string, clusterNodes []dqlite.NodeInfo) *doctor.Report {
+	var report doctor.Report
+
+	if dqlite.Enabled {
+		verifyRehearsedStores(ctx, rehearsal, copyDir, clusterNodes, &report)
+	} else {
+		report.Add("dqlite", doctor.Warning, "this build cannot write the raft log or cluster.yaml, so they were not rehearsed")
+	}
+
+	info, err := rehearsal.NodeInfo()
+	conflicts := database.AddressConflicts(clusterNodes)
+	if err != nil {
+		report.Add("info.yaml", doctor.Warning, "unable to read it back: %v", err)
+	} else if node, ok := findNode(clusterNodes, info.ID); !ok {
+		report.Add("info.yaml", doctor.Error, "the local node %d is not in the membership written", info.ID)
+	} else if node.Address != info.Address {
+		report.Add("info.yaml", doctor.Error, "the local node %d is at %s rather than %s", info.ID, info.Address, node.Address)
+	} else {
+		report.Add("info.yaml", doctor.OK, "the local node %d is in the membership, at %s", info.ID, info.Address)
+		conflicts = append(conflicts, database.LocalNodeConflicts(info, clusterNodes)...)
+	}
+
+	for _, conflict := range conflicts {
+		report.Add("conflicts", doctor.Error, "%s", conflict)
+	}
+	if len(conflicts) == 0 {
+		report.Add("conflicts", doctor.OK, "no two nodes share an address or ID")
+	}
+	return &report
+}
+
+// verifyRehearsedStores checks that the raft log and cluster.yaml of the
+// rehearsed copy hold the membership.
+func verifyRehearsedStores(ctx context.Context, rehearsal *database.NodeManager, copyDir string, clusterNodes []dqlite.NodeInfo, report *doctor.Report) {
+	servers, err := rehearsal.ClusterServers(ctx)
+	switch {
+	case err != nil:
+		report.Add("cluster.yaml", doctor.Error, "unable to read it back: %v", err)
+	case !database.SameMembership(servers, clusterNodes):
+		report.Add("cluster.yaml", doctor.Error, "it holds %s rather than the membership written", formatMembership(servers))
+	default:
+		report.Add("cluster.yaml", doctor.OK, "it holds the membership written")
+	}
+
+	membership, err := raft.ReadMembership(copyDir)
+	switch {
+	case err != nil:
+		report.Add("raft-membership", doctor.Error, "unable to read it back: %v", err)
+	case !database.SameMembership(raftNodes(membership.Servers), clusterNodes):
+		report.Add("raft-membership", doctor.Error, "the raft log (%s) holds %s rather than the membership written",
+			describeRaftMembership(membership), formatMembership(raftNodes(membership.Servers)))
+	default:
+		report.Add("raft-membership", doctor.OK, "the raft log (%s) holds the membership written", describeRaftMembership(membership))
+	}
+}
+
+// findNode returns the node with the ID, if there is one.
+func findNode(nodes []dqlite.NodeInfo, id uint64) (dqlite.NodeInfo, bool) {
+	for _, node := range nodes {
+		if node.ID == id {
+			return node, true
+		}
+	}
+	return dqlite.NodeInfo{}, false
+}
@@ -0,0 +1,213 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/names/v4"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+)
+
+var reipPrompt = `
+This will rewrite the addresses of every node in the membership, cluster.yaml
+and info.yaml, keeping their IDs and roles. Every controller must be stopped,
+and must be given the same address map.
+
+Ok to proceed?`[1:]
+
+func init() {
+	registerCommand(command{
+		name:    "reip",
+		args:    "[--path <dir>] --address-map <file> [--host <host>=<tag>...] [--allow-non-local-address] [remote flags] [--strict] [--yes] <tag>",
+		summary: "rewrite the address of every node, for a controller IP migration",
+		run:     runReIP,
+	})
+}
+
+func runReIP(args []string) {
+	flags := newFlagSet("reip", flag.ExitOnError)
+	addHookFlags(flags)
+	addAssumeStoppedFlag(flags)
+	agentFlags := addAgentFlags(flags)
+	addressMapPath := flags.String("address-map", "", "path to a YAML file mapping old node addresses to new ones, or - for stdin")
+	var hosts stringsFlag
+	flags.Var(&hosts, "host", "other controller to rewrite remotely, as <host>=<tag> (repeatable)")
+	remoteBinary := flags.String("remote-binary", "juju-dqlite-backstop", "path of this tool on the other controllers")
+	allowPartial := flags.Bool("allow-partial", false, "allow nodes without a new address")
+	allowNonLocal := flags.Bool("allow-non-local-address", false, "keep the local node at an address this machine does not have")
+	strict := addStrictFlag(flags)
+	yes := flags.Bool("yes", false, "answer 'yes' to prompts")
+	remoteFlags := addRemoteFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *addressMapPath == "" {
+		commandUsage(commands["reip"])
+		exit(1)
+	}
+	warnings := startStrict(*strict)
+	if *addressMapPath == stdinPath && (agentFlags.path == stdinPath || !*yes) {
+		checkErr("read address map", fmt.Errorf("--yes is required, and the agent config must be read from a file, when reading the address map from stdin"))
+	}
+
+	remotes, err := parseRemoteHosts(hosts)
+	checkErr("parse hosts", err)
+
+	mapData, err := readAddressMapData(*addressMapPath)
+	checkErr("read address map", err)
+	addressMap, err := database.ParseAddressMap(mapData)
+	checkErr("read address map", err)
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	transport := remoteFlags.transportFor(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	servers, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+
+	if unmapped := addressMap.Unmapped(servers); len(unmapped) > 0 {
+		for _, node := range unmapped {
+			logger.Warningf("node %d address %s has no new address", node.ID, node.Address)
+		}
+		if !*allowPartial {
+			checkErr("check address map", fmt.Errorf("%d nodes have no new address, use --allow-partial to continue", len(unmapped)))
+		}
+	}
+	mapped := addressMap.Apply(servers)
+	if conflicts := database.AddressConflicts(mapped); len(conflicts) > 0 {
+		checkErr("check address conflicts", failure.Wrap(failure.AddressConflict, fmt.Errorf("%s", strings.Join(conflicts, "; "))))
+	}
+	for i, node := range mapped {
+		fmt.Printf("node %d address %s will be rewritten to %s\n", node.ID, servers[i].Address, node.Address)
+	}
+	fmt.Println("")
+
+	// Every controller must be stopped before any of them is rewritten.
+	for host := range remotes {
+		units, err := transport.ActiveJujudServices(ctx, host)
+		checkErr("check "+host, err)
+		if len(units) > 0 {
+			checkErr("check "+host, fmt.Errorf("jujud is running: %s", strings.Join(units, ", ")))
+		}
+	}
+	checkLocalAddress(nodeManager, mapped, *allowNonLocal)
+	checkNodeStopped(nodeManager)
+	checkControllerUUID(cfg, nodeManager)
+
+	enforceStrict(warnings)
+	if !*yes && !promptYN(reipPrompt) {
+		return
+	}
+
+	defer beginChange()()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	fmt.Println("updating cluster.yaml")
+	checkErr("set cluster servers", nodeManager.SetClusterServers(ctx, mapped))
+	if localInfo, err := nodeManager.NodeInfo(); err == nil {
+		for _, node := range mapped {
+			if node.ID == localInfo.ID && node.Address != localInfo.Address {
+				fmt.Println("updating info.yaml")
+				checkErr("set node info", nodeManager.SetNodeInfo(node))
+			}
+		}
+	}
+
+	dataDir, _ := nodeManager.EnsureDataDir()
+	rec := audit.NewRecord("reip", redactArgs(args))
+	rec.Before, rec.After = servers, mapped
+	recordAudit(dataDir, rec)
+
+	var failed []string
+	for host, tag := range remotes {
+		fmt.Printf("rewriting %s on %s\n", tag, host)
+		if err := remoteReIP(ctx, transport, host, tag, *remoteBinary, mapData, *allowPartial, *allowNonLocal); err != nil {
+			logger.Errorf("%s: %v", host, err)
+			failed = append(failed, host)
+		}
+	}
+	if len(failed) > 0 {
+		checkErr("reip", fmt.Errorf("failed on %s, rerun reip there with the same address map", strings.Join(failed, ", ")))
+	}
+
+	fmt.Println("addresses rewritten")
+	fmt.Println("please restart the controller machine agents")
+}
+
+// readAddressMapData reads the address map from the file, or stdin if the
+// path is "-".
+func readAddressMapData(path string) ([]byte, error) {
+	if path == stdinPath {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// parseRemoteHosts parses the --host flags, each of the form <host>=<tag>,
+// into a map of host to agent tag.
+func parseRemoteHosts(hosts []string) (map[string]string, error) {
+	remotes := make(map[string]string)
+	for _, host := range hosts {
+		parts := strings.SplitN(host, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid host %q, expected <host>=<tag>", host)
+		}
+		if _, err := names.ParseTag(parts[1]); err != nil {
+			return nil, err
+		}
+		remotes[parts[0]] = parts[1]
+	}
+	return remotes, nil
+}
+
+// remoteReIP runs reip on the host, passing the address map on stdin.
+func remoteReIP(ctx context.Context, transport remote.Transport, host, tag, binary string, mapData []byte, allowPartial, allowNonLocal bool) error {
+	command := []string{binary, "reip", "--yes", "--address-map", stdinPath}
+	if allowPartial {
+		command = append(command, "--allow-partial")
+	}
+	if allowNonLocal {
+		command = append(command, "--allow-non-local-address")
+	}
+	return runRemote(ctx, transport, host, mapData, quoteCommand(transport, append(command, tag)...)...)
+}
+
+// quoteCommand quotes each argument of the remote command for the transport.
+func quoteCommand(transport remote.Transport, command ...string) []string {
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = transport.Quote(arg)
+	}
+	return quoted
+}
+
+// runRemote runs the command on the host with the input on stdin, printing
+// its output prefixed with the host.
+func runRemote(ctx context.Context, transport remote.Transport, host string, input []byte, command ...string) error {
+	cmd, err := transport.Command(ctx, host, command...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	out, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			fmt.Printf("\t%s: %s\n", host, line)
+		}
+	}
+	return err
+}
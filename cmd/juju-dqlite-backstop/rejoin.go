@@ -0,0 +1,111 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+var rejoinPrompt = `
+This will move the dqlite data on this machine aside, and point the node at
+the surviving cluster, so that it joins it as a new node when the machine
+agent is restarted. The cluster must already have had this node removed from
+its membership.
+
+Ok to proceed?`[1:]
+
+func init() {
+	registerCommand(command{
+		name:    "rejoin-node",
+		args:    "[--path <dir>] [--survivor-id <id>] [--yes] <tag> <survivor-address>",
+		summary: "archive the local dqlite data and prepare the node to rejoin the cluster",
+		run:     runRejoinNode,
+	})
+}
+
+func runRejoinNode(args []string) {
+	flags := newFlagSet("rejoin-node", flag.ExitOnError)
+	addHookFlags(flags)
+	addAssumeStoppedFlag(flags)
+	agentFlags := addAgentFlags(flags)
+	survivorID := flags.Uint64("survivor-id", 0, "node ID of the survivor, if its membership cannot be read")
+	timeout := flags.Duration("timeout", 30*time.Second, "time to wait for the survivor")
+	yes := flags.Bool("yes", false, "answer 'yes' to prompts")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 || agentFlags.path == stdinPath {
+		commandUsage(commands["rejoin-node"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+
+	survivor := flags.Arg(1)
+	if _, _, err := net.SplitHostPort(survivor); err != nil {
+		survivor = net.JoinHostPort(survivor, strconv.Itoa(nodeManager.Port()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	// Prefer the membership reported by the survivor, so that the node has
+	// every member to try when it starts.
+	servers, err := nodeManager.LiveClusterServers(ctx, survivor)
+	if err != nil {
+		if *survivorID == 0 {
+			checkErr("read survivor membership", fmt.Errorf("%v, use --survivor-id to continue without it", err))
+		}
+		logger.Warningf("unable to read survivor membership: %v", err)
+		servers = []dqlite.NodeInfo{{ID: *survivorID, Address: survivor, Role: dqlite.Voter}}
+	}
+
+	if localInfo, err := nodeManager.NodeInfo(); err == nil {
+		for _, server := range servers {
+			if server.ID == localInfo.ID || strings.EqualFold(server.Address, localInfo.Address) {
+				checkErr("check membership", fmt.Errorf(
+					"node %d at %s is still a member of the cluster, remove it on the survivor first", server.ID, server.Address))
+			}
+		}
+	}
+
+	fmt.Println("cluster.yaml will be written as:")
+	for _, server := range servers {
+		fmt.Printf("\tnode %d %s (%s)\n", server.ID, server.Address, server.Role)
+	}
+	fmt.Println("")
+
+	checkNodeStopped(nodeManager)
+	if !*yes && !promptYN(rejoinPrompt) {
+		return
+	}
+
+	defer beginChange()()
+	ctx, cancel = context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	archive, err := nodeManager.ArchiveDataDir("rejoin-"+time.Now().UTC().Format("20060102T150405Z"), audit.FileName)
+	checkErr("archive data dir", err)
+	fmt.Printf("dqlite data archived to %s\n", archive)
+
+	checkErr("write cluster.yaml", nodeManager.WriteClusterServers(ctx, servers))
+
+	dataDir, _ := nodeManager.EnsureDataDir()
+	rec := audit.NewRecord("rejoin-node", redactArgs(args))
+	rec.After = servers
+	recordAudit(dataDir, rec)
+
+	fmt.Println("node prepared to rejoin the cluster")
+	fmt.Println("please restart the controller machine agent using:")
+	fmt.Println("")
+	fmt.Printf("\t%s\n", newAgentService(cfg, flags.Arg(0)).command("restart"))
+	fmt.Println("")
+}
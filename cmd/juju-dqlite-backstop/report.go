@@ -0,0 +1,274 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/gzip"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/backup"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+// reportTailSize bounds how much of the end of a log is read for its
+// excerpt.
+const reportTailSize = 8 << 20
+
+func init() {
+	registerCommand(command{
+		name:    "report",
+		args:    "[--path <dir>] [--output <file>] [--log-lines <n>] <tag>",
+		summary: "collect the controller's configuration, data listing, checks and logs into a support bundle",
+		run:     runReport,
+	})
+}
+
+// reportBundle is a support bundle being written.
+type reportBundle struct {
+	tw     *tar.Writer
+	prefix string
+	now    time.Time
+	// problems are the items that could not be collected.
+	problems []string
+}
+
+func runReport(args []string) {
+	flags := newFlagSet("report", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	output := flags.String("output", "", "file to write the bundle to, defaults to juju-dqlite-backstop-report-<tag>-<time>.tar.gz")
+	logLines := flags.Int("log-lines", 2000, "number of lines to include from the end of each log")
+	samples := flags.Int("samples", 3, "number of samples to take when probing each node")
+	timeout := flags.Duration("timeout", 5*time.Minute, "timeout for collecting the report")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *logLines < 0 || *samples < 1 {
+		commandUsage(commands["report"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	tag := cfg.Tag().String()
+	now := time.Now().UTC()
+	if *output == "" {
+		*output = "juju-dqlite-backstop-report-" + tag + "-" + now.Format("20060102T150405Z") + ".tar.gz"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	f, err := os.OpenFile(*output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	checkErr("create report", err)
+	zw := gzip.NewWriter(f)
+	bundle := &reportBundle{
+		tw:     tar.NewWriter(zw),
+		prefix: strings.TrimSuffix(filepath.Base(*output), ".tar.gz") + "/",
+		now:    now,
+	}
+
+	bundle.collect("agent.conf", func() ([]byte, error) {
+		data, err := os.ReadFile(configFilePath(agentFlags, flags.Arg(0)))
+		if err != nil {
+			return nil, err
+		}
+		return agent.RedactConfig(data)
+	})
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("find Dqlite data directory", err)
+	for _, name := range []string{"cluster.yaml", "info.yaml"} {
+		bundle.collect(name, func() ([]byte, error) {
+			return os.ReadFile(filepath.Join(dataDir, name))
+		})
+	}
+	bundle.collect("listing.json", func() ([]byte, error) {
+		manifest, err := backup.BuildManifest(backupEnvironment(ctx, cfg, nodeManager), nil, "",
+			backup.Source{Name: "dqlite", Path: dataDir})
+		if err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(manifest, "", "  ")
+	})
+	bundle.collect("verify.txt", func() ([]byte, error) {
+		return reportVerification(ctx, cfg.DataDir(), dataDir), nil
+	})
+	bundle.collect("probe.txt", func() ([]byte, error) {
+		return reportProbes(ctx, nodeManager, *samples)
+	})
+	logs := []string{filepath.Join(cfg.LogDir(), tag+".log")}
+	if dir := runLogDir(); dir != "none" {
+		logs = append(logs, filepath.Join(dir, logFileName))
+	}
+	for _, path := range logs {
+		bundle.collect("logs/"+filepath.Base(path), func() ([]byte, error) {
+			return tailLines(path, *logLines)
+		})
+	}
+	if len(bundle.problems) > 0 {
+		bundle.collect("problems.txt", func() ([]byte, error) {
+			return []byte(strings.Join(bundle.problems, "\n") + "\n"), nil
+		})
+	}
+
+	err = bundle.tw.Close()
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	checkErr("write report", err)
+	fmt.Printf("report written to %s\n", *output)
+	if len(bundle.problems) > 0 {
+		fmt.Printf("%d item(s) could not be collected, see problems.txt in the report\n", len(bundle.problems))
+	}
+}
+
+// collect adds the named item to the bundle. An item that cannot be
+// collected is recorded as a problem, rather than failing the report, as the
+// report is most needed when the controller is in a bad way.
+func (b *reportBundle) collect(name string, fn func() ([]byte, error)) {
+	data, err := fn()
+	if err != nil {
+		logger.Warningf("unable to collect %s: %v", name, err)
+		b.problems = append(b.problems, fmt.Sprintf("%s: %v", name, err))
+		return
+	}
+	err = b.tw.WriteHeader(&tar.Header{
+		Name:    b.prefix + name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: b.now,
+	})
+	if err == nil {
+		_, err = b.tw.Write(data)
+	}
+	checkErr("write report", err)
+}
+
+// reportVerification runs the offline checks of the Dqlite data directory,
+// describing the result of each.
+func reportVerification(ctx context.Context, agentDataDir, dataDir string) []byte {
+	var buf bytes.Buffer
+	report := func(check string, err error) {
+		if err != nil {
+			fmt.Fprintf(&buf, "%s: FAILED: %v\n", check, err)
+			return
+		}
+		fmt.Fprintf(&buf, "%s: ok\n", check)
+	}
+
+	formats, err := raft.ReadFormats(dataDir)
+	if err == nil {
+		err = formats.Check()
+	}
+	report(fmt.Sprintf("raft formats (segment %d, snapshot %d)", formats.Segment, formats.Snapshot), err)
+
+	count, err := raft.VerifyLog(dataDir)
+	report(fmt.Sprintf("raft log (%d entries)", count), err)
+	history, err := raft.ReadHistory(dataDir)
+	if err == nil {
+		last := history.Last()
+		fmt.Fprintf(&buf, "last log entry: index %d, term %d\n", last.Index, last.Term)
+	}
+	report("raft history", err)
+
+	// The databases are written out from the latest snapshot to a
+	// temporary directory, leaving the data directory untouched.
+	tmpDir, err := os.MkdirTemp("", "report-")
+	if err == nil {
+		defer func() { _ = os.RemoveAll(tmpDir) }()
+		var databases []dumpedDatabase
+		if databases, err = dumpSnapshotDatabases(dataDir, tmpDir); err == nil {
+			for _, db := range databases {
+				report("database "+db.name, database.CheckDatabaseFile(ctx, db.path))
+			}
+		}
+	}
+	report("databases", err)
+
+	store, err := readLocalStore(agentDataDir)
+	if err == nil {
+		err = database.ValidateMembership(store.Servers)
+	}
+	report("cluster.yaml", err)
+	return buf.Bytes()
+}
+
+// reportProbes measures the latency to each node in cluster.yaml.
+func reportProbes(ctx context.Context, nodeManager *database.NodeManager, samples int) ([]byte, error) {
+	servers, err := nodeManager.ClusterServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]internalnet.ProbeResult, len(servers))
+	forEachNode(ctx, servers, time.Duration(samples)*10*time.Second, func(ctx context.Context, i int, server dqlite.NodeInfo) {
+		results[i] = internalnet.Probe(ctx, server.Address, samples, 200*time.Millisecond)
+	})
+
+	var buf bytes.Buffer
+	for i, server := range servers {
+		result := results[i]
+		status := "ok"
+		if !result.Reachable() {
+			status = fmt.Sprintf("UNREACHABLE: %v", result.Err)
+		} else if result.Failures > 0 {
+			status = fmt.Sprintf("LOSSY: %d/%d samples failed", result.Failures, result.Samples)
+		}
+		fmt.Fprintf(&buf, "node %d %s (%s): min=%v mean=%v max=%v jitter=%v %s\n",
+			server.ID, server.Address, server.Role,
+			result.Min.Round(time.Microsecond), result.Mean.Round(time.Microsecond),
+			result.Max.Round(time.Microsecond), result.Jitter.Round(time.Microsecond),
+			status)
+	}
+	return buf.Bytes(), nil
+}
+
+// tailLines returns up to the last n lines of the file.
+func tailLines(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	offset := info.Size() - reportTailSize
+	if offset < 0 {
+		offset = 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, offset, info.Size()-offset))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	for i, end := 0, len(data); i < n; i++ {
+		j := bytes.LastIndexByte(data[:end], '\n')
+		if j < 0 {
+			return append(data, '\n'), nil
+		}
+		if i == n-1 {
+			return append(data[j+1:], '\n'), nil
+		}
+		end = j
+	}
+	return nil, nil
+}
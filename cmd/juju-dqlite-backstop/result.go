@@ -0,0 +1,152 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/version"
+)
+
+// Run outcomes, as reported in the result.
+const (
+	// outcomeComplete is a run that made its changes.
+	outcomeComplete = "complete"
+	// outcomeUnchanged is a run that found its changes already made.
+	outcomeUnchanged = "unchanged"
+	// outcomeRehearsed is a run that made its changes to a copy of the
+	// data only, with --rehearse.
+	outcomeRehearsed = "rehearsed"
+	// outcomeAborted is a run that stopped, without changes, at a prompt.
+	outcomeAborted = "aborted"
+	// outcomeFailed is a run that failed.
+	outcomeFailed = "failed"
+)
+
+// runResult is the machine-readable summary of a run, written at its end
+// for wrapper automation.
+type runResult struct {
+	Version   string    `json:"version"`
+	Command   string    `json:"command"`
+	Args      []string  `json:"args"`
+	Tag       string    `json:"tag,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Outcome   string    `json:"outcome"`
+	ExitCode  int       `json:"exit_code"`
+	Error     string    `json:"error,omitempty"`
+	ErrorKind string    `json:"error_kind,omitempty"`
+	Hint      string    `json:"hint,omitempty"`
+	Decisions []string  `json:"decisions,omitempty"`
+	// Before and After are the membership before and after the run.
+	Before       []dqlite.NodeInfo `json:"before,omitempty"`
+	After        []dqlite.NodeInfo `json:"after,omitempty"`
+	FilesChanged []string          `json:"files_changed,omitempty"`
+	Steps        []audit.Step      `json:"steps,omitempty"`
+	NextSteps    []string          `json:"next_steps,omitempty"`
+
+	// path is where the result is written, or "-" for stdout.
+	path string
+	// out is the original stdout, when the result is written to it.
+	out     *os.File
+	written bool
+}
+
+// result is the result of this run, if one was asked for.
+var result *runResult
+
+// startResult starts recording the result of the run, to be written to the
+// path, or to stdout if it is "-". When written to stdout, the rest of the
+// output is moved to stderr, so that stdout holds only the result.
+func startResult(command string, args []string, path string) {
+	result = &runResult{
+		Version: version.Version,
+		Command: command,
+		Args:    args,
+		Started: time.Now().UTC(),
+		path:    path,
+	}
+	if path == "-" {
+		result.out = os.Stdout
+		os.Stdout = os.Stderr
+	}
+}
+
+// decide records a decision taken during the run.
+func (r *runResult) decide(format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.Decisions = append(r.Decisions, fmt.Sprintf(format, args...))
+}
+
+// changed records the files changed by the run.
+func (r *runResult) changed(paths ...string) {
+	if r == nil {
+		return
+	}
+	r.FilesChanged = append(r.FilesChanged, paths...)
+}
+
+// next records an instruction for the operator to follow after the run.
+func (r *runResult) next(format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.NextSteps = append(r.NextSteps, fmt.Sprintf(format, args...))
+}
+
+// fail records the error the run failed with.
+func (r *runResult) fail(label string, err error) {
+	if r == nil {
+		return
+	}
+	r.Error = fmt.Sprintf("%s: %v", label, err)
+	if kind := failure.KindOf(err); kind != "" {
+		r.ErrorKind, r.Hint = string(kind), kind.Hint()
+	}
+}
+
+// writeResult writes the result of the run with the exit code, once. A run
+// that neither completed nor failed stopped at a prompt.
+func writeResult(code int) {
+	if result == nil || result.written {
+		return
+	}
+	result.written = true
+	result.Finished = time.Now().UTC()
+	result.ExitCode = code
+	switch {
+	case code != 0 && result.Outcome != outcomeRehearsed:
+		// A rehearsal's exit code is the outcome of its verification.
+		result.Outcome = outcomeFailed
+	case result.Outcome == "":
+		result.Outcome = outcomeAborted
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(result)
+	if err != nil {
+		logger.Errorf("unable to write result: %v", err)
+		return
+	}
+	if result.out != nil {
+		_, err = result.out.Write(buf.Bytes())
+	} else {
+		err = os.WriteFile(result.path, buf.Bytes(), 0600)
+	}
+	if err != nil {
+		logger.Errorf("unable to write result: %v", err)
+	}
+}
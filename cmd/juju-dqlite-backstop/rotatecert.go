@@ -0,0 +1,149 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/juju/names/v4"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/cert"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+var rotateCertPrompt = `
+This will replace the controller certificate and key in agent.conf with a
+new certificate signed by the controller CA. The previous agent.conf and any
+secret files are kept with a .bak suffix.
+
+Ok to proceed?`[1:]
+
+func init() {
+	registerCommand(command{
+		name:    "rotate-cert",
+		args:    "[--path <dir>] [--validity <duration>] [--check-peers=false] [--yes] <tag>",
+		summary: "replace the controller certificate with one signed by the CA",
+		run:     runRotateCert,
+	})
+}
+
+func runRotateCert(args []string) {
+	flags := newFlagSet("rotate-cert", flag.ExitOnError)
+	addHookFlags(flags)
+	path := flags.String("path", agent.DefaultPaths.DataDir, "path to agent config")
+	validity := flags.Duration("validity", 10*365*24*time.Hour, "validity period of the new certificate")
+	checkPeers := flags.Bool("check-peers", true, "check that the dqlite peers in cluster.yaml accept the new certificate")
+	yes := flags.Bool("yes", false, "answer 'yes' to prompts")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *path == stdinPath {
+		commandUsage(commands["rotate-cert"])
+		exit(1)
+	}
+
+	tag, err := names.ParseTag(flags.Arg(0))
+	checkErr("parse controller tag", err)
+	configPath := agent.ConfigPath(*path, tag)
+
+	cfg, err := agent.ReadConfig(configPath)
+	checkErr("read agent config", err)
+	hooks.tag, hooks.controller = tag.String(), cfg.Controller().Id()
+
+	info, ok := cfg.StateServingInfo()
+	if !ok || info.CAPrivateKey == "" {
+		checkErr("rotate cert", fmt.Errorf("agent config has no CA private key, this is not a controller agent config"))
+	}
+
+	// Keep the names and addresses of the existing certificate, if it can
+	// still be parsed.
+	dnsNames := cert.DefaultControllerNames
+	existing, err := cert.ParseCertificate(info.Cert)
+	if err == nil {
+		if len(existing.DNSNames) > 0 {
+			dnsNames = existing.DNSNames
+		}
+		fmt.Printf("existing certificate expires %s\n", existing.NotAfter.Format(time.RFC3339))
+	} else {
+		logger.Warningf("unable to parse existing controller certificate: %v", err)
+	}
+
+	certPEM, keyPEM, err := cert.NewControllerCert(cfg.CACert(), info.CAPrivateKey, dnsNames, ipAddresses(existing), *validity)
+	checkErr("generate controller certificate", err)
+	checkErr("verify new controller certificate", cert.Verify(certPEM, keyPEM, cfg.CACert(), time.Now()))
+
+	newCert, _ := cert.ParseCertificate(certPEM)
+	fmt.Printf("new certificate expires %s\n", newCert.NotAfter.Format(time.RFC3339))
+
+	if *checkPeers {
+		nodeManager := database.NewNodeManager(cfg, logger)
+		_, err := nodeManager.EnsureDataDir()
+		checkErr("ensure data dir", err)
+		checkPeersAccept(nodeManager, certPEM, keyPEM, cfg.CACert())
+	}
+
+	if !*yes && !promptYN(rotateCertPrompt) {
+		return
+	}
+
+	nodeManager := database.NewNodeManager(cfg, logger)
+	dataDir, dataDirErr := nodeManager.EnsureDataDir()
+	hooks.dataDir = dataDir
+	defer beginChange()()
+	checkErr("update agent config", agent.UpdateControllerCert(configPath, certPEM, keyPEM))
+
+	if dataDirErr == nil {
+		recordAudit(dataDir, audit.NewRecord("rotate-cert", redactArgs(args)))
+	}
+
+	fmt.Println("controller certificate rotated")
+	fmt.Println("please restart the controller machine agent using:")
+	fmt.Println("")
+	fmt.Printf("\t%s\n", newAgentService(cfg, tag.String()).command("restart"))
+	fmt.Println("")
+}
+
+// checkPeersAccept checks that each of the peers in cluster.yaml accepts the
+// new certificate as a client certificate.
+func checkPeersAccept(nodeManager *database.NodeManager, certPEM, keyPEM, caPEM string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	servers, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+
+	results := make([]error, len(servers))
+	forEachNode(ctx, servers, 10*time.Second, func(ctx context.Context, i int, server dqlite.NodeInfo) {
+		results[i] = cert.CheckPeerAccepts(ctx, server.Address, certPEM, keyPEM, caPEM)
+	})
+
+	var failed int
+	for i, server := range servers {
+		if results[i] != nil {
+			logger.Warningf("node %d %s: %v", server.ID, server.Address, results[i])
+			failed++
+			continue
+		}
+		fmt.Printf("node %d %s accepts the new certificate\n", server.ID, server.Address)
+	}
+	if failed > 0 {
+		checkErr("check peers", fmt.Errorf(
+			"%d of %d peers did not accept the new certificate, use --check-peers=false if they are down", failed, len(servers)))
+	}
+}
+
+// ipAddresses returns the IP addresses of the certificate, if any.
+func ipAddresses(c *x509.Certificate) []net.IP {
+	if c == nil {
+		return nil
+	}
+	return c.IPAddresses
+}
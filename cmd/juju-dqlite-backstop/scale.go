@@ -0,0 +1,50 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "scale-controllers",
+		args:    "[--statefulset <name>] [kubernetes flags] <replicas>",
+		summary: "scale the controller stateful set of a controller on Kubernetes",
+		run:     runScaleControllers,
+	})
+}
+
+func runScaleControllers(args []string) {
+	flags := newFlagSet("scale-controllers", flag.ExitOnError)
+	addHookFlags(flags)
+	remoteFlags := addRemoteFlags(flags)
+	statefulSet := flags.String("statefulset", remote.DefaultControllerStatefulSet, "name of the controller stateful set")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["scale-controllers"])
+		exit(1)
+	}
+	replicas, err := strconv.Atoi(flags.Arg(0))
+	if err != nil || replicas < 0 {
+		checkErr("parse replicas", fmt.Errorf("invalid number of replicas %q", flags.Arg(0)))
+	}
+
+	remoteFlags.transport = "kubernetes"
+	k8s := remoteFlags.transportFor(nil).(remote.KubernetesConfig)
+
+	defer beginChange()()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	checkErr("scale controllers", k8s.ScaleStatefulSet(ctx, *statefulSet, replicas))
+	fmt.Printf("stateful set %s scaled to %d replicas\n", *statefulSet, replicas)
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/journal"
+)
+
+// signals holds SIGINT and SIGTERM back while a change is being made, so
+// that the node is never left part way through one, such as with the raft
+// log reconfigured but cluster.yaml not yet written.
+var signals struct {
+	mu sync.Mutex
+	// held counts the changes being made.
+	held int
+	// pending is the signal received while held, acted on once released.
+	pending os.Signal
+	// abort, when set, cancels the step being taken rather than the signal
+	// stopping the run, and aborted is the signal that cancelled it.
+	abort   context.CancelFunc
+	aborted os.Signal
+}
+
+// trapSignals handles SIGINT and SIGTERM for the rest of the run.
+func trapSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range ch {
+			handleSignal(sig)
+		}
+	}()
+}
+
+func handleSignal(sig os.Signal) {
+	signals.mu.Lock()
+	if signals.held == 0 && signals.abort != nil {
+		if signals.aborted == nil {
+			signals.aborted = sig
+			fmt.Fprintf(consoleErr, "\n%s received, abandoning the step being taken\n", signalName(sig))
+			signals.abort()
+		}
+		signals.mu.Unlock()
+		return
+	}
+	if signals.held == 0 {
+		signals.mu.Unlock()
+		interrupted(sig)
+		return
+	}
+	if signals.pending == nil {
+		signals.pending = sig
+		fmt.Fprintf(consoleErr, "\n%s received, finishing the change being made before stopping\n", signalName(sig))
+	} else {
+		fmt.Fprintf(consoleErr, "\nstill finishing the change being made, stopping now would leave the node inconsistent\n")
+	}
+	signals.mu.Unlock()
+}
+
+// holdSignals holds SIGINT and SIGTERM back until the returned function is
+// called, once the change being made is complete. It is used as:
+//
+//	defer holdSignals()()
+func holdSignals() func() {
+	signals.mu.Lock()
+	signals.held++
+	signals.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signals.mu.Lock()
+			signals.held--
+			sig := signals.pending
+			if signals.held > 0 {
+				sig = nil
+			}
+			signals.mu.Unlock()
+			if sig != nil {
+				logger.Warningf("the change being made was completed before stopping")
+				interrupted(sig)
+			}
+		})
+	}
+}
+
+// abortOnSignal returns a context that SIGINT and SIGTERM cancel, rather than
+// stopping the run, for a long step that can be abandoned before anything is
+// changed. The returned function ends this, and returns the signal that
+// cancelled the context, if any, for the caller to stop the run with once it
+// has cleaned up.
+func abortOnSignal(parent context.Context) (context.Context, func() os.Signal) {
+	ctx, cancel := context.WithCancel(parent)
+	signals.mu.Lock()
+	signals.abort, signals.aborted = cancel, nil
+	signals.mu.Unlock()
+	return ctx, func() os.Signal {
+		signals.mu.Lock()
+		defer signals.mu.Unlock()
+		signals.abort = nil
+		cancel()
+		return signals.aborted
+	}
+}
+
+// interrupted records that the run was stopped by the signal, and exits
+// with 128 plus the signal number, as a shell does.
+func interrupted(sig os.Signal) {
+	name := signalName(sig)
+	journal.Interrupted(name, logger)
+	fmt.Fprintln(consoleErr)
+	logger.Errorf("stopped by %s", name)
+	result.fail("interrupted", fmt.Errorf("stopped by %s", name))
+
+	code := 128 + int(syscall.SIGINT)
+	if s, ok := sig.(syscall.Signal); ok {
+		code = 128 + int(s)
+	}
+	exit(code)
+}
+
+func signalName(sig os.Signal) string {
+	switch sig {
+	case os.Interrupt:
+		return "SIGINT"
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	}
+	return sig.String()
+}
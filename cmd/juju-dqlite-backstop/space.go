@@ -0,0 +1,65 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/fs"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/progress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+)
+
+// spaceMargin is the space left free after an operation, so that it does not
+// leave the machine with a full disk.
+const spaceMargin = 64 << 20
+
+// checkSpace returns an error if the filesystem that holds the path has less
+// than the space needed, plus a margin, free. Checking it before starting an
+// operation fails it early, rather than part way through. If the free space
+// cannot be read, the operation goes ahead.
+func checkSpace(operation, path string, need int64) error {
+	free, err := fs.FreeSpace(path)
+	if err != nil {
+		logger.Warningf("unable to check there is space to %s in %s: %v", operation, path, err)
+		return nil
+	}
+	logger.Debugf("%s needs about %s in %s, %s is free",
+		operation, progress.FormatBytes(need), path, progress.FormatBytes(free))
+	if need+spaceMargin <= free {
+		return nil
+	}
+	return failure.Wrap(failure.InsufficientSpace, fmt.Errorf(
+		"not enough space to %s: about %s is needed in %s, and %s kept free, but only %s is free",
+		operation, progress.FormatBytes(need), path, progress.FormatBytes(spaceMargin), progress.FormatBytes(free)))
+}
+
+// backupSize returns the size of the data in the backup, including that only
+// stored in the backups it is incremental to, from its manifest. A backup
+// without one, such as one from `juju create-backup`, is not sized.
+func backupSize(ctx context.Context, location string, s3Flags *s3Flags) (int64, bool) {
+	m, err := readBackupManifest(ctx, location, s3Flags)
+	if err != nil {
+		logger.Infof("unable to tell the size of %s: %v", location, err)
+		return 0, false
+	}
+	return m.Size(), true
+}
+
+// remoteDirSize returns the size of the directory on the host.
+func remoteDirSize(ctx context.Context, transport remote.Transport, host, dir string) (int64, error) {
+	out, err := transport.Output(ctx, host, "du", "-sb", transport.Quote(dir))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected output from du: %q", out)
+	}
+	return strconv.ParseInt(fields[0], 10, 64)
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/journal"
+	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/remote"
+)
+
+const checkStoppedTimeout = 15 * time.Second
+
+// assumeStoppedPhrase must be typed to continue with --assume-stopped.
+const assumeStoppedPhrase = "the node is stopped"
+
+// assumeStopped skips the checks that the local node is stopped, for when
+// they cannot be trusted, such as under an unusual init system.
+var assumeStopped bool
+
+// addAssumeStoppedFlag adds --assume-stopped to the flag set of a command
+// that checks the local node is stopped.
+func addAssumeStoppedFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&assumeStopped, "assume-stopped", false,
+		"continue whatever the checks that the local node is stopped find, once acknowledged")
+}
+
+// checkNodeStopped refuses to continue if the local Dqlite node appears to
+// be serving, whatever runs it, or if any of the earlier checks given found
+// it running. With --assume-stopped, the operator must acknowledge the
+// override instead, and it is recorded.
+func checkNodeStopped(nodeManager *database.NodeManager, found ...error) {
+	found = append(found, nodeManager.CheckStopped())
+	if !assumeStopped {
+		for _, err := range found {
+			checkErr("check node stopped", err)
+		}
+		return
+	}
+
+	var problems []string
+	for _, err := range found {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	logger.Warningf("--assume-stopped given: not checking that the local Dqlite node is stopped")
+	for _, problem := range problems {
+		logger.Warningf("ignoring: %s", problem)
+	}
+	question := fmt.Sprintf(assumeStoppedPrompt, assumeStoppedPhrase)
+	checkInteractive(question)
+	fmt.Printf("%s ", question)
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != assumeStoppedPhrase {
+		checkErr("check node stopped", failure.Wrap(failure.NodeRunning, fmt.Errorf(
+			"--assume-stopped was not acknowledged")))
+	}
+
+	dataDir, err := nodeManager.EnsureDataDir()
+	checkErr("ensure data dir", err)
+	err = journal.New(dataDir, logger).Step("assume stopped", map[string][]string{"ignored": problems}, func() error {
+		return nil
+	})
+	checkErr("journal override", err)
+	recordAudit(dataDir, audit.NewRecord("assume-stopped", redactArgs(os.Args[1:])))
+}
+
+var assumeStoppedPrompt = `
+--assume-stopped skips the checks that the local Dqlite node is stopped. If
+it is running, changing its data will corrupt it.
+
+Type '%s' to continue:`[1:]
+
+// localJujudStopped returns an error if systemd, or Pebble on Kubernetes,
+// reports the machine agent as running on this machine, or cannot be asked.
+func localJujudStopped(ctx context.Context, service agentService) error {
+	units, err := service.active(ctx)
+	if err != nil {
+		return errors.Annotate(err, "checking the machine agent")
+	}
+	if len(units) > 0 {
+		return failure.Wrap(failure.NodeRunning, fmt.Errorf("jujud is running: %s, stop it first", strings.Join(units, ", ")))
+	}
+	return nil
+}
+
+// checkPeersStopped connects to each of the peers in cluster.yaml that are not
+// being kept, and refuses to continue if jujud is running on any of them. A
+// running peer would overwrite the repaired membership as soon as it can
+// reach this node again. Peers that cannot be reached are reported, as they
+// are usually the dead controllers being removed.
+func checkPeersStopped(nodeManager *database.NodeManager, transport remote.Transport, clusterNodes []dqlite.NodeInfo, ignore bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	servers, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+
+	kept := make(map[uint64]bool)
+	for _, node := range clusterNodes {
+		kept[node.ID] = true
+	}
+	var peers []dqlite.NodeInfo
+	for _, server := range servers {
+		if !kept[server.ID] {
+			peers = append(peers, server)
+		}
+	}
+
+	type status struct {
+		host  string
+		units []string
+		err   error
+	}
+	results := make([]status, len(peers))
+	forEachNode(context.Background(), peers, checkStoppedTimeout, func(ctx context.Context, i int, peer dqlite.NodeInfo) {
+		host, err := internalnet.SplitHost(peer.Address)
+		if err != nil {
+			results[i] = status{host: peer.Address, err: err}
+			return
+		}
+		units, err := transport.ActiveJujudServices(ctx, host)
+		results[i] = status{host: host, units: units, err: err}
+	})
+
+	var running int
+	for i, peer := range peers {
+		result := results[i]
+		switch {
+		case result.err != nil:
+			logger.Warningf("node %d %s: unable to check jujud: %v", peer.ID, result.host, result.err)
+		case len(result.units) > 0:
+			logger.Errorf("node %d %s: jujud is running: %s", peer.ID, result.host, strings.Join(result.units, ", "))
+			running++
+		default:
+			fmt.Printf("node %d %s: jujud is stopped\n", peer.ID, result.host)
+		}
+	}
+	if running == 0 {
+		return
+	}
+	if ignore {
+		logger.Warningf("continuing with jujud running on %d peers", running)
+		return
+	}
+	checkErr("check peers stopped", failure.Wrap(failure.PeersRunning, fmt.Errorf(
+		"jujud is running on %d peers, stop them first or use --ignore-running-peers", running)))
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/juju/loggo"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+)
+
+// strictWriterName is the name of the log writer recording the warnings
+// logged by the preflight checks.
+const strictWriterName = "strict"
+
+// strictWarnings records the warnings logged while the preflight checks run,
+// so that --strict can refuse to continue after any of them.
+type strictWarnings struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+// Write is part of the loggo.Writer interface.
+func (w *strictWarnings) Write(entry loggo.Entry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.messages = append(w.messages, entry.Message)
+}
+
+// addStrictFlag adds the --strict flag to the flag set.
+func addStrictFlag(flags *flag.FlagSet) *bool {
+	return flags.Bool("strict", false, "refuse to continue after any warning from the checks made before changing the node")
+}
+
+// startStrict starts recording the warnings logged, for enforceStrict. It
+// does nothing unless strict.
+func startStrict(strict bool) *strictWarnings {
+	if !strict {
+		return nil
+	}
+	w := &strictWarnings{}
+	err := loggo.RegisterWriter(strictWriterName, loggo.NewMinimumLevelWriter(w, loggo.WARNING))
+	checkErr("start strict mode", err)
+	return w
+}
+
+// enforceStrict stops recording warnings, and refuses to continue if any
+// were logged. It does nothing if not started.
+func enforceStrict(w *strictWarnings) {
+	if w == nil {
+		return
+	}
+	_, _ = loggo.RemoveWriter(strictWriterName)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.messages) == 0 {
+		return
+	}
+	checkErr("strict mode", failure.Wrap(failure.StrictWarnings, fmt.Errorf(
+		"refusing to continue after %d warnings with --strict: %s", len(w.messages), strings.Join(w.messages, "; "))))
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+// parseNodeIDs parses the node IDs given on the command line.
+func parseNodeIDs(values []string) ([]uint64, error) {
+	ids := make([]uint64, len(values))
+	for i, value := range values {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node ID %q", value)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// selectSurvivors returns the nodes in cluster.yaml with the given IDs, so that
+// a surviving majority can be kept rather than collapsing the cluster to a
+// single node. The local node must be one of them.
+func selectSurvivors(nodeManager *database.NodeManager, ids []uint64) []dqlite.NodeInfo {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	servers, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+
+	survivors, err := database.SelectNodes(servers, ids)
+	checkErr("select surviving nodes", err)
+
+	if localInfo, err := nodeManager.NodeInfo(); err == nil {
+		var found bool
+		for _, node := range survivors {
+			found = found || node.ID == localInfo.ID
+		}
+		if !found {
+			checkErr("select surviving nodes", fmt.Errorf("the local node %d is not one of the survivors", localInfo.ID))
+		}
+	}
+	if !database.IsMajority(servers, survivors) {
+		logger.Warningf("the survivors are not a majority of the voters, the cluster cannot have been making progress")
+	}
+	return survivors
+}
+
+// keepNodes returns count nodes from cluster.yaml, including the local node,
+// for shrinking the cluster rather than collapsing it to a single node.
+func keepNodes(nodeManager *database.NodeManager, localID uint64, count int) []dqlite.NodeInfo {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	servers, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+
+	kept, err := database.ChooseNodes(servers, localID, count)
+	checkErr("choose nodes to keep", err)
+	if !database.IsMajority(servers, kept) {
+		logger.Warningf("the kept nodes are not a majority of the voters, the cluster cannot have been making progress")
+	}
+	return kept
+}
+
+// rebalanceRoles reassigns the roles of the kept nodes so that quorum can be
+// reached, reporting any that change.
+func rebalanceRoles(nodes []dqlite.NodeInfo) []dqlite.NodeInfo {
+	assigned := database.AssignRoles(nodes)
+	for i, node := range assigned {
+		if node.Role != nodes[i].Role {
+			fmt.Printf("node %d role will change from %s to %s\n", node.ID, nodes[i].Role, node.Role)
+		}
+	}
+	return assigned
+}
+
+// parseNodeSelectors parses the --keep selectors given on the command line.
+func parseNodeSelectors(values []string) ([]database.NodeSelector, error) {
+	selectors := make([]database.NodeSelector, len(values))
+	for i, value := range values {
+		s, err := database.ParseNodeSelector(value)
+		if err != nil {
+			return nil, err
+		}
+		selectors[i] = s
+	}
+	return selectors, nil
+}
+
+// selectKept returns the nodes in cluster.yaml matched by the selectors.
+func selectKept(nodeManager *database.NodeManager, selectors []database.NodeSelector) []dqlite.NodeInfo {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	servers, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+
+	ids, err := database.MatchNodes(servers, selectors)
+	checkErr("select nodes to keep", err)
+	return selectSurvivors(nodeManager, ids)
+}
+
+// survivorWarnings describes each kept node that may not hold the data the
+// cluster has committed: one that is not a voter in cluster.yaml, as only
+// voters are sure to have it, and the local node if its raft log is empty,
+// as on a node added or rebuilt before it caught up.
+func survivorWarnings(nodeManager *database.NodeManager, clusterNodes []dqlite.NodeInfo) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	roles := make(map[uint64]dqlite.NodeRole)
+	if servers, err := nodeManager.ClusterServers(ctx); err == nil {
+		for _, server := range servers {
+			roles[server.ID] = server.Role
+		}
+	}
+	var warnings []string
+	for _, node := range clusterNodes {
+		if role, ok := roles[node.ID]; ok && role != dqlite.Voter {
+			warnings = append(warnings, fmt.Sprintf(
+				"node %d %s is a %s, not a voter, so it may not have all of the committed data", node.ID, node.Address, role))
+		}
+	}
+
+	localID := clusterNodes[0].ID
+	if localInfo, err := nodeManager.NodeInfo(); err == nil {
+		localID = localInfo.ID
+	}
+	dataDir, err := nodeManager.EnsureDataDir()
+	if err != nil {
+		return warnings
+	}
+	if history, err := raft.ReadHistory(dataDir); err == nil && history.Snapshot == nil && len(history.Terms) == 0 {
+		warnings = append(warnings, fmt.Sprintf(
+			"node %d, this node, has no raft log or snapshot, it may have been added recently and not have caught up", localID))
+	}
+	return warnings
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+)
+
+// stepTimer records how long each step of a run takes, to size timeouts
+// and to spot slow disks.
+type stepTimer struct {
+	last  time.Time
+	steps []audit.Step
+}
+
+func newStepTimer() *stepTimer {
+	return &stepTimer{last: time.Now()}
+}
+
+// done records the step as taking the time since the previous step.
+func (t *stepTimer) done(name string) {
+	now := time.Now()
+	t.steps = append(t.steps, audit.Step{Name: name, Seconds: now.Sub(t.last).Seconds()})
+	logger.Debugf("%s took %s", name, now.Sub(t.last))
+	t.last = now
+}
+
+// skip discards the time since the previous step, such as that spent
+// waiting for the operator.
+func (t *stepTimer) skip() {
+	t.last = time.Now()
+}
+
+// print writes how long each step took.
+func (t *stepTimer) print() {
+	fmt.Println("step timings:")
+	for _, step := range t.steps {
+		d := time.Duration(step.Seconds * float64(time.Second))
+		fmt.Printf("  %-16s %s\n", step.Name, d.Round(time.Microsecond))
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "transfer-leadership",
+		args:    "[--path <dir>] <tag> <address>",
+		summary: "move leadership of the running cluster to another node",
+		run:     runTransferLeadership,
+	})
+}
+
+func runTransferLeadership(args []string) {
+	flags := newFlagSet("transfer-leadership", flag.ExitOnError)
+	addHookFlags(flags)
+	agentFlags := addAgentFlags(flags)
+	timeout := flags.Duration("timeout", 30*time.Second, "time to wait for the cluster")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		commandUsage(commands["transfer-leadership"])
+		exit(1)
+	}
+
+	_, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+
+	address := flags.Arg(1)
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(nodeManager.Port()))
+	}
+
+	defer beginChange()()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	from, to, err := nodeManager.TransferLeadership(ctx, address)
+	if errors.IsAlreadyExists(err) {
+		fmt.Printf("node %d at %s is already the leader\n", to.ID, to.Address)
+		return
+	}
+	checkErr("transfer leadership", err)
+
+	dataDir, _ := nodeManager.EnsureDataDir()
+	recordAudit(dataDir, audit.NewRecord("transfer-leadership", redactArgs(args)))
+
+	fmt.Printf("leadership transferred from node %d at %s to node %d at %s\n", from.ID, from.Address, to.ID, to.Address)
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/audit"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	internalnet "github.com/SimonRichardson/juju-dqlite-backstop/internal/net"
+)
+
+var unbindPrompt = `
+This will rebind the bootstrapped dqlite node from the loopback address to the
+address shown above, so that other controllers can join it.
+
+Ok to proceed?`[1:]
+
+func init() {
+	registerCommand(command{
+		name:    "unbind-loopback",
+		args:    "[--path <dir>] [--address <ip>] [--interface <name>...] [--cidr <subnet>...] [--yes] <tag>",
+		summary: "rebind a loopback-bootstrapped node to a routable address",
+		run:     runUnbindLoopback,
+	})
+}
+
+func runUnbindLoopback(args []string) {
+	flags := newFlagSet("unbind-loopback", flag.ExitOnError)
+	addHookFlags(flags)
+	addAssumeStoppedFlag(flags)
+	agentFlags := addAgentFlags(flags)
+	address := flags.String("address", "", "address to bind to, instead of selecting a local address")
+	var interfaces stringsFlag
+	flags.Var(&interfaces, "interface", "only consider local addresses on this interface (repeatable)")
+	var cidrs stringsFlag
+	flags.Var(&cidrs, "cidr", "only consider local addresses within this subnet (repeatable)")
+	yes := flags.Bool("yes", false, "answer 'yes' to prompts")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || agentFlags.path == stdinPath {
+		commandUsage(commands["unbind-loopback"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bootstrapped, err := nodeManager.IsBootstrappedNode(ctx)
+	checkErr("check bootstrapped node", err)
+	if !bootstrapped {
+		checkErr("check bootstrapped node", fmt.Errorf("the node is not a single node bound to the loopback address"))
+	}
+	servers, err := nodeManager.ClusterServers(ctx)
+	checkErr("get cluster servers", err)
+	node := servers[0]
+
+	ip := *address
+	if ip == "" {
+		subnets, err := internalnet.ParseSubnets(cidrs)
+		checkErr("parse subnets", err)
+		opts := []internalnet.Option{internalnet.WithoutLinkLocal()}
+		for _, name := range interfaces {
+			opts = append(opts, internalnet.WithInterface(name))
+		}
+		for _, subnet := range subnets {
+			opts = append(opts, internalnet.WithSubnet(subnet))
+		}
+		for _, pattern := range internalnet.DefaultExcludedInterfaces {
+			opts = append(opts, internalnet.WithExcludedInterface(pattern))
+		}
+		ips, err := internalnet.ExternalIPs(opts...)
+		checkErr("find local addresses", err)
+		if ips.Size() != 1 {
+			checkErr("select address", fmt.Errorf(
+				"found %d candidate addresses %v, select one with --address, --interface or --cidr",
+				ips.Size(), ips.SortedValues()))
+		}
+		ip = ips.Values()[0]
+	}
+	if parsed := net.ParseIP(ip); parsed == nil || parsed.IsLoopback() {
+		checkErr("select address", fmt.Errorf("%q is not a routable IP address", ip))
+	}
+
+	_, port, err := net.SplitHostPort(node.Address)
+	if err != nil {
+		port = strconv.Itoa(nodeManager.Port())
+	}
+	rebound := node
+	rebound.Address = net.JoinHostPort(ip, port)
+
+	fmt.Printf("node %d will be rebound from %s to %s\n", node.ID, node.Address, describeNodeAddress(rebound.Address))
+	checkNodeStopped(nodeManager)
+	checkControllerUUID(cfg, nodeManager)
+	if !*yes && !promptYN(unbindPrompt) {
+		return
+	}
+
+	defer beginChange()()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	membership := []dqlite.NodeInfo{rebound}
+	checkErr("set cluster servers", nodeManager.SetClusterServers(ctx, membership))
+	if localInfo, err := nodeManager.NodeInfo(); err == nil && localInfo.ID == node.ID {
+		checkErr("set node info", nodeManager.SetNodeInfo(rebound))
+	}
+
+	dataDir, _ := nodeManager.EnsureDataDir()
+	rec := audit.NewRecord("unbind-loopback", redactArgs(args))
+	rec.Before, rec.After = servers, membership
+	recordAudit(dataDir, rec)
+
+	fmt.Println("node rebound")
+	fmt.Println("please restart the controller machine agent using:")
+	fmt.Println("")
+	fmt.Printf("\t%s\n", newAgentService(cfg, flags.Arg(0)).command("restart"))
+	fmt.Println("")
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+func init() {
+	registerCommand(command{
+		name:    "wait-healthy",
+		args:    "[--path <dir>] [--timeout <duration>] [--interval <duration>] <tag>",
+		summary: "wait for the restarted node to rejoin a cluster with a leader",
+		run:     runWaitHealthy,
+	})
+}
+
+func runWaitHealthy(args []string) {
+	flags := newFlagSet("wait-healthy", flag.ExitOnError)
+	agentFlags := addAgentFlags(flags)
+	agentFlags.addClientCertFlags(flags)
+	timeout := flags.Duration("timeout", 5*time.Minute, "time to wait for the node to become healthy")
+	interval := flags.Duration("interval", 2*time.Second, "time between checks")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		commandUsage(commands["wait-healthy"])
+		exit(1)
+	}
+
+	cfg, nodeManager := loadAgent(agentFlags, flags.Arg(0))
+	node, err := nodeManager.NodeInfo()
+	checkErr("read info.yaml", err)
+
+	checkErr("wait for node", waitHealthy(nodeManager, newAgentService(cfg, flags.Arg(0)), node, *timeout, *interval))
+}
+
+// waitHealthy polls the running node until it is a member of a cluster with
+// an elected leader, printing each change in its state. On timeout the last
+// failure is returned, along with what can be found out locally about why.
+func waitHealthy(
+	nodeManager *database.NodeManager, service agentService, node dqlite.NodeInfo, timeout, interval time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	fmt.Printf("waiting for node %d at %s\n", node.ID, node.Address)
+	var last string
+	for {
+		checkCtx, checkCancel := context.WithTimeout(ctx, interval+5*time.Second)
+		health, err := nodeManager.CheckHealth(checkCtx, node)
+		checkCancel()
+		if err == nil {
+			fmt.Printf("node %d is healthy: node %d is leader of %d members\n", node.ID, health.Leader.ID, len(health.Members))
+			return nil
+		}
+		if msg := err.Error(); msg != last {
+			fmt.Printf("\t%s\n", msg)
+			last = msg
+		}
+
+		select {
+		case <-ctx.Done():
+			diagnoseUnhealthy(service)
+			return fmt.Errorf("node %d did not become healthy within %s: %v", node.ID, timeout, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// diagnoseUnhealthy prints what can be found out locally about why the node
+// is not healthy.
+func diagnoseUnhealthy(service agentService) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	units, err := service.active(ctx)
+	switch {
+	case err != nil:
+		fmt.Printf("unable to check the machine agent: %v\n", err)
+	case len(units) == 0:
+		fmt.Printf("the machine agent is not running, start it using:\n\n\t%s\n\n", service.command("start"))
+	default:
+		fmt.Printf("the machine agent is running (%s), check its log using:\n\n\t%s\n\n",
+			strings.Join(units, ", "), service.logCommand())
+	}
+}
@@ -8,7 +8,9 @@ require (
 	github.com/juju/errors v1.0.0
 	github.com/juju/loggo v1.0.0
 	github.com/juju/names/v4 v4.0.0
+	github.com/klauspost/compress v1.17.0
 	github.com/mattn/go-sqlite3 v1.14.17
+	golang.org/x/crypto v0.3.0
 	gopkg.in/yaml.v2 v2.4.0
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -19,7 +21,6 @@ require (
 	github.com/juju/clock v1.0.2 // indirect
 	github.com/juju/utils/v3 v3.0.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/crypto v0.3.0 // indirect
 	golang.org/x/net v0.2.0 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/sys v0.2.0 // indirect
@@ -4,12 +4,16 @@
 package agent
 
 import (
+	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/juju/errors"
 	"github.com/juju/names/v4"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/safeyaml"
 )
 
 const (
@@ -48,6 +52,37 @@ type Config interface {
 	// a controller and reports whether those details
 	// are available
 	StateServingInfo() (StateServingInfo, bool)
+
+	// Tag returns the tag of the entity on whose behalf the state connection
+	// will be made.
+	Tag() names.Tag
+
+	// Controller returns the tag of the controller.
+	Controller() names.ControllerTag
+
+	// Model returns the tag for the model that the agent belongs to.
+	Model() names.ModelTag
+
+	// UpgradedToVersion returns the Juju version the agent last upgraded
+	// to, which is the version of its data.
+	UpgradedToVersion() string
+
+	// Value returns the value associated with the key, or an empty string
+	// if the key is not found.
+	Value(key string) string
+}
+
+const (
+	// ProviderType is the key of the value holding the cloud provider type.
+	ProviderType = "PROVIDER_TYPE"
+	// ProviderKubernetes is the provider type of CAAS controllers.
+	ProviderKubernetes = "kubernetes"
+)
+
+// IsCAAS reports whether the agent belongs to a controller running on
+// Kubernetes, either from its provider type or from running inside a pod.
+func IsCAAS(cfg Config) bool {
+	return cfg.Value(ProviderType) == ProviderKubernetes || os.Getenv("KUBERNETES_SERVICE_HOST") != ""
 }
 
 // StateServingInfo holds network/auth information needed by a controller.
@@ -84,6 +119,26 @@ func ConfigPath(dataDir string, tag names.Tag) string {
 	return filepath.Join(Dir(dataDir, tag), AgentConfigFilename)
 }
 
+// ToolsVersion returns the Juju version of the agent binaries installed for
+// the agent, from the link in the tools directory to the binaries of a
+// version, such as 3.1.6-ubuntu-amd64.
+func ToolsVersion(dataDir string, tag names.Tag) (string, error) {
+	target, err := os.Readlink(filepath.Join(dataDir, "tools", tag.String()))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	binary := filepath.Base(target)
+	// Strip the OS and architecture.
+	for i := 0; i < 2; i++ {
+		index := strings.LastIndex(binary, "-")
+		if index <= 0 {
+			return "", errors.NotValidf("agent binaries %q", filepath.Base(target))
+		}
+		binary = binary[:index]
+	}
+	return binary, nil
+}
+
 // Paths holds the directory paths used by the agent.
 type Paths struct {
 	// DataDir is the data directory where each agent has a subdirectory
@@ -132,14 +187,17 @@ type configInternal struct {
 	controller     names.ControllerTag
 	model          names.ModelTag
 	caCert         string
+	upgradedTo     string
 	servingInfo    *StateServingInfo
+	secretFiles    *secretFiles
 	apiDetails     *apiDetails
+	values         map[string]string
 }
 
 // ReadConfig reads configuration data from the given location.
 func ReadConfig(configFilePath string) (Config, error) {
 	var config *configInternal
-	configData, err := os.ReadFile(configFilePath)
+	configData, err := safeyaml.ReadFile(configFilePath)
 	if err != nil {
 		return nil, errors.Annotatef(err, "cannot read agent config %q", configFilePath)
 	}
@@ -147,10 +205,31 @@ func ReadConfig(configFilePath string) (Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := config.resolveSecrets(filepath.Dir(configFilePath)); err != nil {
+		return nil, errors.Annotatef(err, "cannot load secrets for agent config %q", configFilePath)
+	}
 	config.configFilePath = configFilePath
 	return config, nil
 }
 
+// ReadConfigFrom reads configuration data from the given reader, such as
+// stdin. Secret files referenced by relative paths are resolved against the
+// agent directory named by the config itself.
+func ReadConfigFrom(r io.Reader) (Config, error) {
+	configData, err := safeyaml.ReadAll(r)
+	if err != nil {
+		return nil, errors.Annotate(err, "cannot read agent config")
+	}
+	_, config, err := parseConfigData(configData)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.resolveSecrets(config.Dir()); err != nil {
+		return nil, errors.Annotate(err, "cannot load secrets for agent config")
+	}
+	return config, nil
+}
+
 func (c *configInternal) DataDir() string {
 	return c.paths.DataDir
 }
@@ -189,6 +268,50 @@ func (c *configInternal) Controller() names.ControllerTag {
 	return c.controller
 }
 
+func (c *configInternal) UpgradedToVersion() string {
+	return c.upgradedTo
+}
+
+func (c *configInternal) Value(key string) string {
+	return c.values[key]
+}
+
 func (c *configInternal) Dir() string {
 	return Dir(c.paths.DataDir, c.tag)
 }
+
+// caCertConfig overrides the CA certificate of an agent config.
+type caCertConfig struct {
+	Config
+	caCert string
+}
+
+// WithCACert returns a config that reports the given CA certificate, rather
+// than the one from the agent config. This is used when the CA in the agent
+// config is wrong, or a bundle of old and new CAs is needed.
+func WithCACert(cfg Config, caCert string) Config {
+	return caCertConfig{Config: cfg, caCert: caCert}
+}
+
+// CACert returns the overridden CA certificate.
+func (c caCertConfig) CACert() string {
+	return c.caCert
+}
+
+// dataDirConfig overrides the data directory of an agent config.
+type dataDirConfig struct {
+	Config
+	dataDir string
+}
+
+// WithDataDir returns a config that reports the given data directory, rather
+// than the one from the agent config. This is used to work on a copy of the
+// agent's data.
+func WithDataDir(cfg Config, dataDir string) Config {
+	return dataDirConfig{Config: cfg, dataDir: dataDir}
+}
+
+// DataDir returns the overridden data directory.
+func (c dataDirConfig) DataDir() string {
+	return c.dataDir
+}
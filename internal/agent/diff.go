@@ -0,0 +1,139 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// FieldDiff describes a single field that differs between two agent
+// configs. Secret values are masked.
+type FieldDiff struct {
+	Field string
+	A     string
+	B     string
+}
+
+// field is a single named value extracted from an agent config.
+type field struct {
+	name   string
+	value  string
+	secret bool
+}
+
+// Diff returns the field level differences between the two agent configs.
+// Secrets are never returned verbatim, instead a short fingerprint is used so
+// that it is still possible to tell whether they match.
+func Diff(a, b Config) []FieldDiff {
+	fa, fb := configFields(a), configFields(b)
+	var diffs []FieldDiff
+	for i := range fa {
+		if fa[i].value == fb[i].value {
+			continue
+		}
+		diffs = append(diffs, FieldDiff{
+			Field: fa[i].name,
+			A:     fa[i].display(),
+			B:     fb[i].display(),
+		})
+	}
+	return diffs
+}
+
+// Validate checks the agent config against the expectations of the backstop
+// tool, returning a description of each problem found.
+func Validate(cfg Config) []string {
+	var problems []string
+	if cfg.Tag() == nil || cfg.Tag().Kind() != "machine" && cfg.Tag().Kind() != "controller" {
+		problems = append(problems, "tag is not a machine or controller tag")
+	}
+	if cfg.CACert() == "" {
+		problems = append(problems, "cacert is missing")
+	}
+	if addrs, err := cfg.APIAddresses(); err != nil || len(addrs) == 0 {
+		problems = append(problems, "apiaddresses are missing")
+	}
+	info, ok := cfg.StateServingInfo()
+	if !ok {
+		return append(problems, "state serving info is missing, this is not a controller agent config")
+	}
+	if info.Cert == "" {
+		problems = append(problems, "controller certificate is missing")
+	} else if _, err := tls.X509KeyPair([]byte(info.Cert), []byte(info.PrivateKey)); err != nil {
+		problems = append(problems, fmt.Sprintf("controller certificate and key do not form a valid pair: %v", err))
+	}
+	if info.APIPort == 0 {
+		problems = append(problems, "apiport is missing")
+	}
+	return problems
+}
+
+func configFields(cfg Config) []field {
+	addrs, _ := cfg.APIAddresses()
+	info, _ := cfg.StateServingInfo()
+	return []field{
+		{name: "tag", value: tagString(cfg.Tag())},
+		{name: "controller", value: cfg.Controller().String()},
+		{name: "model", value: cfg.Model().String()},
+		{name: "datadir", value: cfg.DataDir()},
+		{name: "logdir", value: cfg.LogDir()},
+		{name: "cacert", value: cfg.CACert(), secret: true},
+		{name: "apiaddresses", value: strings.Join(addrs, ",")},
+		{name: "apiport", value: portString(info.APIPort)},
+		{name: "controllerapiport", value: portString(info.ControllerAPIPort)},
+		{name: "controllercert", value: info.Cert, secret: true},
+		{name: "controllerkey", value: info.PrivateKey, secret: true},
+		{name: "caprivatekey", value: info.CAPrivateKey, secret: true},
+		{name: "sharedsecret", value: info.SharedSecret, secret: true},
+		{name: "systemidentity", value: info.SystemIdentity, secret: true},
+	}
+}
+
+func (f field) display() string {
+	if f.value == "" {
+		return "<unset>"
+	}
+	if !f.secret {
+		return f.value
+	}
+	return MaskSecret(f.value)
+}
+
+// maskKey keys the fingerprints of secrets. It is random to each run, so a
+// fingerprint cannot be used to check guesses of the secret offline.
+var maskKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("generating secret mask key: %v", err))
+	}
+	return key
+}()
+
+// MaskSecret returns a short fingerprint of the secret, which can be used to
+// compare secrets without revealing them. Fingerprints are only comparable
+// within the same run.
+func MaskSecret(secret string) string {
+	mac := hmac.New(sha256.New, maskKey)
+	_, _ = mac.Write([]byte(secret))
+	return fmt.Sprintf("<masked hmac-sha256:%x>", mac.Sum(nil)[:4])
+}
+
+func tagString(tag interface{ String() string }) string {
+	if tag == nil {
+		return ""
+	}
+	return tag.String()
+}
+
+func portString(port int) string {
+	if port == 0 {
+		return ""
+	}
+	return fmt.Sprint(port)
+}
@@ -24,6 +24,8 @@ type format_2_0Serialization struct {
 	DataDir string `yaml:"datadir,omitempty"`
 	LogDir  string `yaml:"logdir,omitempty"`
 
+	UpgradedToVersion string `yaml:"upgradedToVersion,omitempty"`
+
 	CACert string `yaml:"cacert,omitempty"`
 
 	Controller   string   `yaml:"controller,omitempty"`
@@ -39,6 +41,16 @@ type format_2_0Serialization struct {
 	ControllerAPIPort int    `yaml:"controllerapiport,omitempty"`
 	SharedSecret      string `yaml:"sharedsecret,omitempty"`
 	SystemIdentity    string `yaml:"systemidentity,omitempty"`
+
+	// Controller secrets can be stored outside of agent.conf, either as
+	// individual files or in a secrets directory.
+	ControllerCertFile string `yaml:"controllercertfile,omitempty"`
+	ControllerKeyFile  string `yaml:"controllerkeyfile,omitempty"`
+	CAPrivateKeyFile   string `yaml:"caprivatekeyfile,omitempty"`
+	SharedSecretFile   string `yaml:"sharedsecretfile,omitempty"`
+	SecretsDir         string `yaml:"secretsdir,omitempty"`
+
+	Values map[string]string `yaml:"values"`
 }
 
 func init() {
@@ -77,13 +89,29 @@ func (formatter_2_0) unmarshal(data []byte) (*configInternal, error) {
 		controller: controllerTag,
 		model:      modelTag,
 		caCert:     format.CACert,
+		upgradedTo: format.UpgradedToVersion,
+		values:     format.Values,
 	}
 	if len(format.APIAddresses) > 0 {
 		config.apiDetails = &apiDetails{
 			addresses: format.APIAddresses,
 		}
 	}
-	if len(format.ControllerKey) != 0 {
+	if format.ControllerCertFile != "" || format.ControllerKeyFile != "" ||
+		format.CAPrivateKeyFile != "" || format.SharedSecretFile != "" ||
+		format.SecretsDir != "" {
+		config.secretFiles = &secretFiles{
+			dir:            format.SecretsDir,
+			controllerCert: format.ControllerCertFile,
+			controllerKey:  format.ControllerKeyFile,
+			caPrivateKey:   format.CAPrivateKeyFile,
+			sharedSecret:   format.SharedSecretFile,
+		}
+	}
+	// The serving info is kept if there is any hint that this is a
+	// controller, as the secrets may still be resolved from files. It is
+	// discarded by resolveSecrets if no private key is found.
+	if len(format.ControllerKey) != 0 || format.APIPort != 0 || config.secretFiles != nil {
 		config.servingInfo = &StateServingInfo{
 			Cert:              format.ControllerCert,
 			PrivateKey:        format.ControllerKey,
@@ -93,7 +121,6 @@ func (formatter_2_0) unmarshal(data []byte) (*configInternal, error) {
 			SharedSecret:      format.SharedSecret,
 			SystemIdentity:    format.SystemIdentity,
 		}
-
 	}
 	return config, nil
 }
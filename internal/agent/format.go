@@ -7,6 +7,10 @@ import (
 	"bytes"
 	"fmt"
 	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/safeyaml"
 )
 
 // Current agent config format is defined as follows:
@@ -67,7 +71,7 @@ func getFormatter(version string) (formatter, error) {
 func parseConfigData(data []byte) (formatter, *configInternal, error) {
 	i := bytes.IndexByte(data, '\n')
 	if i == -1 {
-		return nil, nil, fmt.Errorf("invalid agent config format: %s", string(data))
+		return nil, nil, fmt.Errorf("invalid agent config format: no format line")
 	}
 	version, configData := string(data[0:i]), data[i+1:]
 	if !strings.HasPrefix(version, formatPrefix) {
@@ -78,6 +82,9 @@ func parseConfigData(data []byte) (formatter, *configInternal, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	if err := safeyaml.Check(configData); err != nil {
+		return nil, nil, errors.Annotate(err, "invalid agent config")
+	}
 	config, err := format.unmarshal(configData)
 	if err != nil {
 		return nil, nil, err
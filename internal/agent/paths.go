@@ -4,10 +4,20 @@
 
 package agent
 
+import (
+	"fmt"
+	"runtime"
+)
+
 type OS int // strongly typed runtime.GOOS value to help with refactoring
 
+// The zero value is reserved for OSUnknown, so that an unset OS is not
+// mistaken for any one of them.
 const (
+	OSUnknown  OS = 0
 	OSUnixLike OS = 1
+	OSWindows  OS = 2
+	OSDarwin   OS = 3
 )
 
 type osVarType int
@@ -36,20 +46,62 @@ var nixVals = map[osVarType]string{
 	certDir: "/etc/juju/certs.d",
 }
 
+// winVals are the paths on Windows, where controllers do not run. They are
+// used for development, and for reading data directories copied off a
+// controller.
+var winVals = map[osVarType]string{
+	tmpDir:  "C:/Juju/tmp",
+	logDir:  "C:/Juju/log",
+	dataDir: "C:/Juju/lib/juju",
+	confDir: "C:/Juju/etc",
+	certDir: "C:/Juju/certs",
+}
+
+// darwinVals are the paths on macOS, where controllers do not run either,
+// kept out of the system directories macOS protects.
+var darwinVals = map[osVarType]string{
+	tmpDir:  "/tmp",
+	logDir:  "/usr/local/var/log",
+	dataDir: "/usr/local/var/lib/juju",
+	confDir: "/usr/local/etc/juju",
+	certDir: "/usr/local/etc/juju/certs.d",
+}
+
 // CurrentOS returns the OS value for the currently-running system.
 func CurrentOS() OS {
-	return OSUnixLike
+	return OSType(runtime.GOOS)
 }
 
-// OSType converts the given os name to an OS value.
+// OSType converts the given os name, as in runtime.GOOS, to an OS value, or
+// OSUnknown if Juju has no paths for it.
 func OSType(osName string) OS {
-	return OSUnixLike
+	switch osName {
+	case "windows":
+		return OSWindows
+	case "darwin":
+		return OSDarwin
+	case "linux", "android", "freebsd", "netbsd", "openbsd", "dragonfly",
+		"solaris", "illumos", "aix", "hurd", "ios", "zos":
+		return OSUnixLike
+	default:
+		return OSUnknown
+	}
 }
 
 // osVal will lookup the value of the key valname
 // in the appropriate map, based on the OS value.
+// It panics for OSUnknown, which has no paths.
 func osVal(os OS, valname osVarType) string {
-	return nixVals[valname]
+	switch os {
+	case OSUnixLike:
+		return nixVals[valname]
+	case OSWindows:
+		return winVals[valname]
+	case OSDarwin:
+		return darwinVals[valname]
+	default:
+		panic(fmt.Sprintf("no paths for OS %d", os))
+	}
 }
 
 // LogDir returns filesystem path the directory where juju may
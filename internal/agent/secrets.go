@@ -0,0 +1,208 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/safeyaml"
+)
+
+const (
+	// SecretsDirName is the name of the directory, relative to the agent
+	// directory, that is searched for controller secrets when agent.conf
+	// does not reference a secrets directory explicitly.
+	SecretsDirName = "secrets"
+
+	controllerCertFilename = "controller.crt"
+	controllerKeyFilename  = "controller.key"
+	caPrivateKeyFilename   = "ca.key"
+	sharedSecretFilename   = "shared-secret"
+)
+
+// secretFiles holds references to files containing the controller secrets,
+// for agent configs that do not store them inline.
+type secretFiles struct {
+	dir            string
+	controllerCert string
+	controllerKey  string
+	caPrivateKey   string
+	sharedSecret   string
+}
+
+// resolveSecrets loads any controller secrets that are not inline in the
+// agent config from the files referenced by the config, or from the secrets
+// directory. Relative paths are resolved against baseDir, which is the
+// directory containing agent.conf.
+func (c *configInternal) resolveSecrets(baseDir string) error {
+	var info StateServingInfo
+	if c.servingInfo != nil {
+		info = *c.servingInfo
+	}
+
+	files := c.secretFiles
+	if files == nil {
+		files = &secretFiles{}
+	}
+	dir := files.dir
+	if dir == "" && baseDir != "" {
+		dir = filepath.Join(baseDir, SecretsDirName)
+	}
+
+	for _, s := range []struct {
+		value    *string
+		file     string
+		filename string
+	}{
+		{value: &info.Cert, file: files.controllerCert, filename: controllerCertFilename},
+		{value: &info.PrivateKey, file: files.controllerKey, filename: controllerKeyFilename},
+		{value: &info.CAPrivateKey, file: files.caPrivateKey, filename: caPrivateKeyFilename},
+		{value: &info.SharedSecret, file: files.sharedSecret, filename: sharedSecretFilename},
+	} {
+		if *s.value != "" {
+			continue
+		}
+		value, err := readSecret(baseDir, dir, s.file, s.filename)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		*s.value = value
+	}
+
+	if info.PrivateKey == "" {
+		c.servingInfo = nil
+		return nil
+	}
+	c.servingInfo = &info
+	return nil
+}
+
+// readSecret reads a single secret. An explicitly referenced file must exist,
+// whereas a missing file in the secrets directory is not an error.
+func readSecret(baseDir, dir, file, filename string) (string, error) {
+	if file != "" {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(baseDir, file)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", errors.Annotatef(err, "reading secret file %q", file)
+		}
+		return trimSecret(filename, data), nil
+	}
+	if dir == "" {
+		return "", nil
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(baseDir, dir)
+	}
+	name := filepath.Join(dir, filename)
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Annotatef(err, "reading secret file %q", name)
+	}
+	return trimSecret(filename, data), nil
+}
+
+// trimSecret removes the trailing newline that editors and tooling
+// commonly add to single line secrets. PEM material is left untouched.
+func trimSecret(filename string, data []byte) string {
+	if filename == sharedSecretFilename {
+		return strings.TrimRight(string(data), "\r\n")
+	}
+	return string(data)
+}
+
+// SecretFilePaths returns the paths of the files holding the controller
+// secrets of the agent config at the path, whether referenced by the config
+// or found in the secrets directory.
+func SecretFilePaths(configFilePath string) ([]string, error) {
+	data, err := safeyaml.ReadFile(configFilePath)
+	if err != nil {
+		return nil, errors.Annotatef(err, "cannot read agent config %q", configFilePath)
+	}
+	candidates, err := secretFileCandidates(data, configFilePath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var paths []string
+	for _, c := range candidates {
+		if _, err := os.Stat(c.path); os.IsNotExist(err) && !c.referenced {
+			continue
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "secret file %q", c.path)
+		}
+		paths = append(paths, c.path)
+	}
+	return paths, nil
+}
+
+// ConfigSecretFilePaths returns the paths the agent config data, to be
+// written to the path, may read its controller secrets from, whether or not
+// the files exist yet.
+func ConfigSecretFilePaths(data []byte, configFilePath string) ([]string, error) {
+	candidates, err := secretFileCandidates(data, configFilePath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	paths := make([]string, len(candidates))
+	for i, c := range candidates {
+		paths[i] = c.path
+	}
+	return paths, nil
+}
+
+// secretFile is a path the controller secrets may be read from, and whether
+// the agent config references it rather than it being in the secrets
+// directory.
+type secretFile struct {
+	path       string
+	referenced bool
+}
+
+func secretFileCandidates(data []byte, configFilePath string) ([]secretFile, error) {
+	_, config, err := parseConfigData(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	baseDir := filepath.Dir(configFilePath)
+	files := config.secretFiles
+	if files == nil {
+		files = &secretFiles{}
+	}
+	dir := files.dir
+	if dir == "" {
+		dir = SecretsDirName
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(baseDir, dir)
+	}
+
+	var candidates []secretFile
+	for _, s := range []struct {
+		file     string
+		filename string
+	}{
+		{file: files.controllerCert, filename: controllerCertFilename},
+		{file: files.controllerKey, filename: controllerKeyFilename},
+		{file: files.caPrivateKey, filename: caPrivateKeyFilename},
+		{file: files.sharedSecret, filename: sharedSecretFilename},
+	} {
+		path := s.file
+		switch {
+		case path == "":
+			path = filepath.Join(dir, s.filename)
+		case !filepath.IsAbs(path):
+			path = filepath.Join(baseDir, path)
+		}
+		candidates = append(candidates, secretFile{path: filepath.Clean(path), referenced: s.file != ""})
+	}
+	return candidates, nil
+}
@@ -0,0 +1,339 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package agent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/names/v4"
+	"gopkg.in/yaml.v3"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/safeyaml"
+)
+
+// UpdateControllerCert replaces the controller certificate and private key of
+// the agent config at the given path. Where the config references the secrets
+// from files, those files are rewritten instead, as a pair, so that a failure
+// does not leave a certificate with the wrong key. All other content of the
+// config is preserved. The previous config and secret files are kept
+// alongside, with a .bak suffix.
+func UpdateControllerCert(configFilePath, certPEM, keyPEM string) error {
+	data, err := safeyaml.ReadFile(configFilePath)
+	if err != nil {
+		return errors.Annotatef(err, "cannot read agent config %q", configFilePath)
+	}
+	_, config, err := parseConfigData(data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	header, doc, err := parseConfigDocument(data)
+	if err != nil {
+		return errors.Annotatef(err, "agent config %q", configFilePath)
+	}
+	root := doc.Content[0]
+
+	baseDir := filepath.Dir(configFilePath)
+	files := config.secretFiles
+	if files == nil {
+		files = &secretFiles{}
+	}
+	var replacements []File
+	for _, s := range []struct {
+		key      string
+		file     string
+		filename string
+		value    string
+	}{
+		{key: "controllercert", file: files.controllerCert, filename: controllerCertFilename, value: certPEM},
+		{key: "controllerkey", file: files.controllerKey, filename: controllerKeyFilename, value: keyPEM},
+	} {
+		path := secretPath(baseDir, files, s.file, s.filename)
+		if mappingValue(root, s.key) != nil || path == "" {
+			setMappingValue(root, s.key, s.value)
+			continue
+		}
+		replacements = append(replacements, File{Path: path, Data: []byte(s.value)})
+	}
+	if err := ReplaceFiles(replacements); err != nil {
+		return errors.Annotate(err, "writing secret files")
+	}
+
+	updated, err := encodeConfigDocument(header, doc)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := writeFileAtomic(configFilePath+".bak", data); err != nil {
+		return errors.Annotate(err, "backing up agent config")
+	}
+	return errors.Annotatef(writeFileAtomic(configFilePath, updated), "writing agent config %q", configFilePath)
+}
+
+// RewriteConfig returns the agent config data with its tag and data dir
+// replaced, if given, and its API addresses rewritten, so that the config of one
+// controller can be restored onto a replacement machine. All other content of
+// the config is preserved.
+func RewriteConfig(data []byte, tag names.Tag, dataDir string, rewriteAddress func(string) string) ([]byte, error) {
+	if _, _, err := parseConfigData(data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	header, doc, err := parseConfigDocument(data)
+	if err != nil {
+		return nil, errors.Annotate(err, "agent config")
+	}
+	root := doc.Content[0]
+
+	if tag != nil {
+		setMappingValue(root, "tag", tag.String())
+	}
+	if dataDir != "" {
+		setMappingValue(root, "datadir", dataDir)
+	}
+	if addresses := mappingValue(root, "apiaddresses"); addresses != nil && addresses.Kind == yaml.SequenceNode {
+		for _, address := range addresses.Content {
+			address.Value = rewriteAddress(address.Value)
+		}
+	}
+	return encodeConfigDocument(header, doc)
+}
+
+// redactedKeys are the keys of the agent config holding secrets.
+var redactedKeys = []string{
+	"apipassword", "oldpassword", "statepassword",
+	"controllerkey", "caprivatekey", "sharedsecret", "systemidentity",
+}
+
+// RedactConfig returns the agent config data with each secret replaced by a
+// fingerprint, so that the config can be shared without revealing them.
+func RedactConfig(data []byte) ([]byte, error) {
+	header, doc, err := parseConfigDocument(data)
+	if err != nil {
+		return nil, errors.Annotate(err, "agent config")
+	}
+	root := doc.Content[0]
+	for _, key := range redactedKeys {
+		if node := mappingValue(root, key); node != nil && node.Value != "" {
+			setMappingValue(root, key, MaskSecret(node.Value))
+		}
+	}
+	return encodeConfigDocument(header, doc)
+}
+
+// WriteConfig validates the agent config data and writes it to the path. Any
+// previous config is kept alongside, with a .bak suffix.
+func WriteConfig(configFilePath string, data []byte) error {
+	if _, _, err := parseConfigData(data); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(configFilePath), 0755); err != nil {
+		return errors.Trace(err)
+	}
+	if previous, err := os.ReadFile(configFilePath); err == nil {
+		if err := writeFileAtomic(configFilePath+".bak", previous); err != nil {
+			return errors.Annotate(err, "backing up agent config")
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	return errors.Annotatef(writeFileAtomic(configFilePath, data), "writing agent config %q", configFilePath)
+}
+
+// parseConfigDocument splits the format line from the agent config data, and
+// parses the rest as a YAML document whose root is a mapping.
+func parseConfigDocument(data []byte) ([]byte, *yaml.Node, error) {
+	i := bytes.IndexByte(data, '\n')
+	header, body := data[:i+1], data[i+1:]
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		return nil, nil, errors.Annotate(err, "cannot parse")
+	}
+	if len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, errors.NotValidf("content")
+	}
+	return header, &doc, nil
+}
+
+// encodeConfigDocument encodes the document after the format line.
+func encodeConfigDocument(header []byte, doc *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(header)
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, errors.Annotate(err, "encoding agent config")
+	}
+	if err := enc.Close(); err != nil {
+		return nil, errors.Annotate(err, "encoding agent config")
+	}
+	return buf.Bytes(), nil
+}
+
+// secretPath returns the path of the file that a secret was loaded from, or
+// an empty string if it is not stored in a file.
+func secretPath(baseDir string, files *secretFiles, file, filename string) string {
+	if file != "" {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(baseDir, file)
+		}
+		return file
+	}
+	if files.dir != "" {
+		dir := files.dir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(baseDir, dir)
+		}
+		return filepath.Join(dir, filename)
+	}
+	path := filepath.Join(baseDir, SecretsDirName, filename)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	return ""
+}
+
+// mappingValue returns the value node for the key in the mapping node.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue sets the string value for the key in the mapping node,
+// adding the key if it is not present. Multi-line values use the literal
+// block style, to match the way Juju writes certificates.
+func setMappingValue(mapping *yaml.Node, key, value string) {
+	node := mappingValue(mapping, key)
+	if node == nil {
+		mapping.Content = append(mapping.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+			&yaml.Node{Kind: yaml.ScalarNode})
+		node = mapping.Content[len(mapping.Content)-1]
+	}
+	node.Kind = yaml.ScalarNode
+	node.Tag = "!!str"
+	node.Value = value
+	node.Style = 0
+	if strings.Contains(value, "\n") {
+		node.Style = yaml.LiteralStyle
+	}
+}
+
+// writeFileAtomic writes the data to a temporary file alongside the path, and
+// renames it into place. The mode of an existing file is preserved, and a
+// symlink is written through rather than replaced.
+func writeFileAtomic(path string, data []byte) error {
+	staged, err := stageFile(path, data, 0)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(staged.tmp)
+	return errors.Trace(os.Rename(staged.tmp, staged.path))
+}
+
+// File is the new content of a file. A zero Mode keeps the mode of the file
+// being replaced.
+type File struct {
+	Path string
+	Data []byte
+	Mode os.FileMode
+}
+
+// ReplaceFiles replaces the files with their new contents, all or none of
+// them. Each existing file is first kept with a .bak suffix, then every new
+// file is written alongside, and only then are they renamed into place.
+// Should a rename fail, the files already replaced are put back.
+func ReplaceFiles(files []File) error {
+	previous := make(map[string][]byte)
+	for _, f := range files {
+		data, err := os.ReadFile(f.Path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		if err := writeFileAtomic(f.Path+".bak", data); err != nil {
+			return errors.Annotatef(err, "backing up %q", f.Path)
+		}
+		previous[f.Path] = data
+	}
+
+	staged := make([]stagedFile, 0, len(files))
+	defer func() {
+		for _, f := range staged {
+			_ = os.Remove(f.tmp)
+		}
+	}()
+	for _, f := range files {
+		s, err := stageFile(f.Path, f.Data, f.Mode)
+		if err != nil {
+			return errors.Annotatef(err, "writing %q", f.Path)
+		}
+		staged = append(staged, s)
+	}
+
+	for i, s := range staged {
+		if err := os.Rename(s.tmp, s.path); err != nil {
+			for _, done := range files[:i] {
+				if data, ok := previous[done.Path]; ok {
+					_ = writeFileAtomic(done.Path, data)
+				} else {
+					_ = os.Remove(done.Path)
+				}
+			}
+			return errors.Annotatef(err, "replacing %q", s.path)
+		}
+	}
+	return nil
+}
+
+// stagedFile is new content written alongside the file it is to replace.
+type stagedFile struct {
+	tmp, path string
+}
+
+// stageFile writes the data to a synced temporary file alongside the path,
+// or the file a symlink at the path points to. It has the mode given, or
+// failing that the mode of the existing file.
+func stageFile(path string, data []byte, mode os.FileMode) (stagedFile, error) {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	if mode == 0 {
+		mode = 0600
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return stagedFile{}, errors.Trace(err)
+	}
+	fail := func(err error) (stagedFile, error) {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return stagedFile{}, errors.Trace(err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return stagedFile{}, errors.Trace(err)
+	}
+	return stagedFile{tmp: tmp.Name(), path: path}, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+// FileName is the name of the audit log in the dqlite data dir.
+const FileName = "backstop-audit.log"
+
+// Record is a single entry in the audit log. Each record includes the hash of
+// the previous record, so any edit or removal of a record breaks the chain.
+type Record struct {
+	Time      time.Time         `json:"time"`
+	Operation string            `json:"operation"`
+	Args      []string          `json:"args"`
+	Operator  string            `json:"operator"`
+	Hostname  string            `json:"hostname"`
+	Before    []dqlite.NodeInfo `json:"before,omitempty"`
+	After     []dqlite.NodeInfo `json:"after,omitempty"`
+	Steps     []Step            `json:"steps,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash"`
+}
+
+// Step is how long a step of the operation took.
+type Step struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// NewRecord returns a record of the given operation, performed now by the
+// current operator on this host.
+func NewRecord(operation string, args []string) Record {
+	hostname, _ := os.Hostname()
+	return Record{
+		Time:      time.Now().UTC(),
+		Operation: operation,
+		Args:      args,
+		Operator:  operator(),
+		Hostname:  hostname,
+	}
+}
+
+// operator returns the name of the user running the tool, including the user
+// that invoked sudo, if any.
+func operator() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" && sudoUser != name {
+		name = fmt.Sprintf("%s (via sudo from %s)", name, sudoUser)
+	}
+	return name
+}
+
+// Path returns the path of the audit log in the given data dir.
+func Path(dataDir string) string {
+	return filepath.Join(dataDir, FileName)
+}
+
+// Append chains the record to the last record in the audit log in the given
+// data dir, and appends it.
+func Append(dataDir string, rec Record) error {
+	path := Path(dataDir)
+	records, err := Read(path)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return errors.Trace(err)
+	}
+	if len(records) > 0 {
+		rec.PrevHash = records[len(records)-1].Hash
+	}
+	if rec.Hash, err = hash(rec); err != nil {
+		return errors.Trace(err)
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Close())
+}
+
+// Read returns the records in the audit log at the given path.
+func Read(path string) ([]Record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var records []Record
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, errors.Annotatef(err, "line %d", line)
+		}
+		records = append(records, rec)
+	}
+	return records, errors.Trace(scanner.Err())
+}
+
+// Verify checks the hash chain of the given records, returning an error
+// describing the first record that has been tampered with.
+func Verify(records []Record) error {
+	var prev string
+	for i, rec := range records {
+		if rec.PrevHash != prev {
+			return errors.Errorf("record %d does not follow record %d, records have been removed or reordered", i+1, i)
+		}
+		h, err := hash(rec)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if h != rec.Hash {
+			return errors.Errorf("record %d has been modified", i+1)
+		}
+		prev = rec.Hash
+	}
+	return nil
+}
+
+// hash returns the SHA-256 of the record, excluding its own hash.
+func hash(rec Record) (string, error) {
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
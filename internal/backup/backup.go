@@ -0,0 +1,372 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/compress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/progress"
+)
+
+// Source is a file or directory to include in a backup, stored under Name in
+// the archive. Files at the skipped paths, relative to the source, are left
+// out.
+type Source struct {
+	Name string
+	Path string
+	Skip []string
+}
+
+// FileName returns the file name of a backup of the controller taken at the
+// given time.
+func FileName(tag string, t time.Time, c compress.Compression) string {
+	return "dqlite-backup-" + tag + "-" + t.UTC().Format("20060102T150405Z") + c.Extension()
+}
+
+// Stats describes a backup written.
+type Stats struct {
+	// Files is the number of files stored.
+	Files int
+	// Read is the number of bytes of file content stored, and Written the
+	// size of the compressed archive.
+	Read    int64
+	Written int64
+}
+
+// Create writes a compressed tar archive of the sources to the path. The
+// archive is written to a temporary file first, so a failed backup never
+// leaves a truncated archive behind. The meter, if any, measures the file
+// content read.
+func Create(path string, m Manifest, c compress.Compression, meter *progress.Meter, sources ...Source) (Stats, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".backup-")
+	if err != nil {
+		return Stats{}, errors.Trace(err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	stats, err := Write(tmp, m, c, meter, sources...)
+	if err != nil {
+		_ = tmp.Close()
+		return Stats{}, errors.Trace(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return Stats{}, errors.Trace(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return Stats{}, errors.Trace(err)
+	}
+	return stats, errors.Trace(os.Rename(tmp.Name(), path))
+}
+
+// Write streams a compressed tar archive of the sources to the writer,
+// starting with the manifest. Only the files the manifest marks as stored are
+// written. Files are read concurrently ahead of the compression, and never
+// held in memory whole. The meter, if any, measures the file content read.
+func Write(w io.Writer, m Manifest, c compress.Compression, meter *progress.Meter, sources ...Source) (Stats, error) {
+	counter := &countingWriter{w: w}
+	cw, err := c.NewWriter(counter)
+	if err != nil {
+		return Stats{}, errors.Trace(err)
+	}
+	tw := tar.NewWriter(cw)
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return Stats{}, errors.Trace(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    ManifestName,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: m.Created,
+	}); err != nil {
+		return Stats{}, errors.Trace(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return Stats{}, errors.Trace(err)
+	}
+
+	stored := make(map[string]bool, len(m.Files))
+	for _, f := range m.Files {
+		stored[f.Path] = f.Stored
+	}
+	var entries []archiveEntry
+	for _, source := range sources {
+		sourceEntries, err := listEntries(source, stored)
+		if err != nil {
+			return Stats{}, errors.Annotatef(err, "adding %s", source.Path)
+		}
+		entries = append(entries, sourceEntries...)
+	}
+	stats, err := writeEntries(tw, entries, meter)
+	if err != nil {
+		return Stats{}, errors.Trace(err)
+	}
+	if err := tw.Close(); err != nil {
+		return Stats{}, errors.Trace(err)
+	}
+	if err := cw.Close(); err != nil {
+		return Stats{}, errors.Trace(err)
+	}
+	stats.Written = counter.n
+	return stats, nil
+}
+
+// Extract reads a compressed tar archive and writes the entries stored under
+// the source name to dest: the directory's content for a directory source,
+// or the file itself for a file source. Entries with paths escaping dest are
+// rejected, and those at the skipped paths, relative to the source, are left
+// alone. An incremental backup is applied on top of its base, which must
+// already have been extracted to dest: files it does not list are removed.
+func Extract(r io.Reader, name, dest string, skip ...string) error {
+	cr, err := compress.NewReader(r)
+	if err != nil {
+		return errors.Annotate(err, "reading backup")
+	}
+	defer func() { _ = cr.Close() }()
+
+	x := extractor{targets: []extractTarget{{name: name, dest: dest}}, skip: skip, found: make(map[string]bool)}
+	if err := x.extract(tar.NewReader(cr), nil); err != nil {
+		return errors.Trace(err)
+	}
+	if !x.found[name] {
+		return errors.NotFoundf("%q in backup", name)
+	}
+	if x.manifest != nil && x.manifest.Incremental() {
+		return errors.Trace(removeUnlisted(*x.manifest, name, dest, x.skip))
+	}
+	return nil
+}
+
+// ExtractFiles reads a compressed tar archive and writes each of the named
+// file sources it holds to the directory, under its name, in one pass. The
+// names found are returned.
+func ExtractFiles(r io.Reader, dir string, names ...string) ([]string, error) {
+	cr, err := compress.NewReader(r)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading backup")
+	}
+	defer func() { _ = cr.Close() }()
+
+	x := extractor{found: make(map[string]bool)}
+	for _, name := range names {
+		x.targets = append(x.targets, extractTarget{name: name, dest: filepath.Join(dir, name)})
+	}
+	if err := x.extract(tar.NewReader(cr), nil); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var found []string
+	for _, name := range names {
+		if x.found[name] {
+			found = append(found, name)
+		}
+	}
+	return found, nil
+}
+
+// extractor writes the entries stored under source names in an archive to
+// their destinations.
+type extractor struct {
+	targets  []extractTarget
+	skip     []string
+	manifest *Manifest
+	// found records the source names with entries in the archive.
+	found map[string]bool
+}
+
+// extractTarget is a source name to extract, and where to.
+type extractTarget struct {
+	name string
+	dest string
+}
+
+// extract reads the entries of the archive. When given, rename maps the name
+// of each entry to the name it would have in a backstop backup, or reports
+// that it is not wanted.
+func (x *extractor) extract(tr *tar.Reader, rename func(string) (string, bool)) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Annotate(err, "reading backup")
+		}
+
+		entry := strings.TrimSuffix(hdr.Name, "/")
+		switch {
+		case rename != nil:
+			var ok bool
+			if entry, ok = rename(entry); !ok {
+				continue
+			}
+		case hdr.Name == ManifestName:
+			x.manifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(x.manifest); err != nil {
+				return errors.Annotate(err, "parsing backup manifest")
+			}
+			continue
+		case strings.TrimPrefix(hdr.Name, "./") == jujuRootArchive:
+			if err := x.extract(tar.NewReader(tr), jujuEntryName); err != nil {
+				return errors.Annotatef(err, "reading %s", jujuRootArchive)
+			}
+			continue
+		}
+
+		name, target, err := x.target(entry, hdr.Typeflag)
+		if err != nil {
+			return errors.Annotatef(err, "backup entry %q", hdr.Name)
+		} else if target == "" {
+			continue
+		}
+		x.found[name] = true
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return errors.Trace(err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return errors.Trace(err)
+			}
+			if err := extractFile(tr, target); err != nil {
+				return errors.Annotatef(err, "extracting %s", hdr.Name)
+			}
+			// Modification times tell when raft segments were written.
+			if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+}
+
+// target returns the source name the entry is stored under and the path to
+// extract it to, or no path if the entry is not wanted.
+func (x *extractor) target(entry string, typeflag byte) (string, string, error) {
+	for _, t := range x.targets {
+		switch {
+		case entry == t.name && typeflag == tar.TypeReg:
+			return t.name, t.dest, nil
+		case entry == t.name:
+			return "", "", nil
+		case strings.HasPrefix(entry, t.name+"/"):
+			rel := filepath.FromSlash(strings.TrimPrefix(entry, t.name+"/"))
+			if !filepath.IsLocal(rel) {
+				return "", "", errors.NotValidf("path")
+			}
+			if contains(x.skip, filepath.ToSlash(rel)) {
+				return "", "", nil
+			}
+			return t.name, filepath.Join(t.dest, rel), nil
+		}
+	}
+	return "", "", nil
+}
+
+// removeUnlisted removes the files under dest that the manifest does not
+// list, as they were removed since the base backup was taken.
+func removeUnlisted(m Manifest, name, dest string, skip []string) error {
+	listed := m.paths()
+	return walkSource(Source{Name: name, Path: dest}, func(entry, path string, info os.FileInfo) error {
+		if info.IsDir() || listed[entry] {
+			return nil
+		}
+		if contains(skip, strings.TrimPrefix(entry, name+"/")) {
+			return nil
+		}
+		return os.Remove(path)
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func extractFile(r io.Reader, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// archiveEntry is a file or directory to write to an archive.
+type archiveEntry struct {
+	hdr  *tar.Header
+	path string
+}
+
+// listEntries returns the entries of the source to archive: its directories
+// and the files marked as stored.
+func listEntries(source Source, stored map[string]bool) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	err := walkSource(source, func(name, path string, info os.FileInfo) error {
+		if info.Mode().IsRegular() && !stored[name] {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		entries = append(entries, archiveEntry{hdr: hdr, path: path})
+		return nil
+	})
+	return entries, err
+}
+
+// writeEntries writes the entries to the archive, reading the files ahead
+// concurrently.
+func writeEntries(tw *tar.Writer, entries []archiveEntry, meter *progress.Meter) (Stats, error) {
+	var paths []string
+	for _, entry := range entries {
+		if entry.hdr.Typeflag == tar.TypeReg {
+			paths = append(paths, entry.path)
+		}
+	}
+	files := newReadAhead(paths)
+	defer files.close()
+
+	var stats Stats
+	for _, entry := range entries {
+		if err := tw.WriteHeader(entry.hdr); err != nil {
+			return Stats{}, errors.Trace(err)
+		}
+		if entry.hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		n, err := files.copyTo(meter.Writer(tw), stats.Files)
+		if err == nil && n != entry.hdr.Size {
+			err = errors.Errorf("changed size while being backed up")
+		}
+		if err != nil {
+			return Stats{}, errors.Annotatef(err, "adding %s", entry.path)
+		}
+		stats.Files++
+		stats.Read += n
+	}
+	return stats, nil
+}
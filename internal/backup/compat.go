@@ -0,0 +1,51 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/jujuversion"
+)
+
+// jujuFormatVersion is the latest format of `juju create-backup` archives
+// that can be restored.
+const jujuFormatVersion = 1
+
+// CheckAgentVersions compares the Juju version of the machine agent a backup
+// was taken from with that of the agent it is restored for. Restoring across
+// major versions, or onto an older minor version, is refused, as the agent
+// would run against a schema it does not know. Restoring onto a newer minor
+// version returns a warning, as the agent's upgrade steps then run against
+// the restored data. Versions that are unknown are not compared.
+func CheckAgentVersions(backupVersion, targetVersion string) (string, error) {
+	from, err := jujuversion.Parse(backupVersion)
+	if err != nil {
+		return "", nil
+	}
+	to, err := jujuversion.Parse(targetVersion)
+	if err != nil {
+		return "", nil
+	}
+	switch {
+	case from.Major != to.Major:
+		return "", errors.NotSupportedf("restoring a Juju %s backup for a Juju %s agent", backupVersion, targetVersion)
+	case to.Less(from):
+		return "", errors.NotSupportedf("restoring a Juju %s backup for an older Juju %s agent", backupVersion, targetVersion)
+	case from.Less(to):
+		return fmt.Sprintf("the backup is of Juju %s, the agent will upgrade it to %s when it starts", backupVersion, targetVersion), nil
+	}
+	return "", nil
+}
+
+// CheckJujuFormat returns an error if a `juju create-backup` archive is of a
+// format that cannot be restored.
+func CheckJujuFormat(m JujuMetadata) error {
+	if m.FormatVersion > jujuFormatVersion {
+		return errors.NotSupportedf("juju backup format %d", m.FormatVersion)
+	}
+	return nil
+}
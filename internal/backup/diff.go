@@ -0,0 +1,41 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import "sort"
+
+// FileChange is a file that differs between two backups. A is nil for a file
+// only in the second backup, and B for one only in the first.
+type FileChange struct {
+	Path string
+	A, B *FileEntry
+}
+
+// DiffManifests returns the files that were added, removed or changed
+// between the backups described by the manifests, in path order.
+func DiffManifests(a, b Manifest) []FileChange {
+	files := make(map[string]*FileChange)
+	for i, f := range a.Files {
+		files[f.Path] = &FileChange{Path: f.Path, A: &a.Files[i]}
+	}
+	for i, f := range b.Files {
+		if change, ok := files[f.Path]; ok {
+			change.B = &b.Files[i]
+		} else {
+			files[f.Path] = &FileChange{Path: f.Path, B: &b.Files[i]}
+		}
+	}
+
+	var changes []FileChange
+	for _, change := range files {
+		if change.A != nil && change.B != nil && change.A.SHA256 == change.B.SHA256 && change.A.Mode == change.B.Mode {
+			continue
+		}
+		changes = append(changes, *change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/compress"
+)
+
+const (
+	// jujuMetadata and jujuRootArchive are the metadata and the archive of
+	// the controller's files in a backup made by `juju create-backup`.
+	jujuMetadata    = "juju-backup/metadata.json"
+	jujuRootArchive = "juju-backup/root.tar"
+
+	// jujuDataDir is where the files of a machine controller are held in
+	// root.tar.
+	jujuDataDir = "var/lib/juju"
+)
+
+// JujuMetadata describes a backup made by `juju create-backup`.
+type JujuMetadata struct {
+	ID             string    `json:"ID"`
+	Started        time.Time `json:"Started"`
+	Finished       time.Time `json:"Finished"`
+	Notes          string    `json:"Notes"`
+	ModelUUID      string    `json:"ModelUUID"`
+	ControllerUUID string    `json:"ControllerUUID"`
+	Machine        string    `json:"Machine"`
+	Hostname       string    `json:"Hostname"`
+	Version        string    `json:"Version"`
+	HANodes        int64     `json:"HANodes"`
+	FormatVersion  int64     `json:"FormatVersion"`
+}
+
+// ReadJujuMetadata reads the metadata of a backup made by `juju
+// create-backup`. It returns a not found error for other archives.
+func ReadJujuMetadata(r io.Reader) (JujuMetadata, error) {
+	cr, err := compress.NewReader(r)
+	if err != nil {
+		return JujuMetadata{}, errors.Annotate(err, "reading backup")
+	}
+	defer func() { _ = cr.Close() }()
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return JujuMetadata{}, errors.NotFoundf("Juju backup metadata")
+		} else if err != nil {
+			return JujuMetadata{}, errors.Annotate(err, "reading backup")
+		}
+		if strings.TrimPrefix(hdr.Name, "./") != jujuMetadata {
+			continue
+		}
+		var m JujuMetadata
+		err = json.NewDecoder(tr).Decode(&m)
+		return m, errors.Annotate(err, "parsing Juju backup metadata")
+	}
+}
+
+// jujuEntryName maps a file in the root.tar of a Juju backup to its name in
+// a backstop backup: the Dqlite data directory to "dqlite", and the machine
+// agent's config to "agent.conf".
+func jujuEntryName(name string) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	rel, ok := strings.CutPrefix(name, jujuDataDir+"/")
+	if !ok {
+		return "", false
+	}
+	if rel == "dqlite" || strings.HasPrefix(rel, "dqlite/") {
+		return rel, true
+	}
+	if dir, file := path.Split(rel); file == "agent.conf" && path.Dir(path.Clean(dir)) == "agents" {
+		return "agent.conf", true
+	}
+	return "", false
+}
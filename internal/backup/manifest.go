@@ -0,0 +1,278 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/compress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/progress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/raft"
+)
+
+// ManifestName is the name of the manifest in a backup archive. It is always
+// the first entry, so it can be read without reading the whole archive.
+const ManifestName = "manifest.json"
+
+// Manifest describes the files in a backup. It lists every file backed up,
+// including, for an incremental backup, those unchanged since the base and so
+// not stored in the archive.
+type Manifest struct {
+	Created time.Time `json:"created"`
+	// Base is the file name of the backup this one is incremental to. It
+	// must be kept alongside this backup.
+	Base        string      `json:"base,omitempty"`
+	Environment Environment `json:"environment"`
+	Files       []FileEntry `json:"files"`
+}
+
+// Environment describes the controller a backup was taken on, so that a
+// backup can be told apart from those of other controllers.
+type Environment struct {
+	// ToolVersion is the version of this tool that took the backup.
+	ToolVersion string `json:"tool-version"`
+	// AgentVersion is the Juju version the machine agent upgraded to.
+	AgentVersion   string `json:"agent-version,omitempty"`
+	Tag            string `json:"tag"`
+	ControllerUUID string `json:"controller-uuid,omitempty"`
+	Hostname       string `json:"hostname,omitempty"`
+	// Formats are the on-disk formats of the raft data backed up.
+	Formats raft.Formats `json:"formats"`
+	// Node is the local node in info.yaml, and Membership the nodes in
+	// cluster.yaml, when the backup was taken.
+	Node       *dqlite.NodeInfo  `json:"node,omitempty"`
+	Membership []dqlite.NodeInfo `json:"membership,omitempty"`
+}
+
+// FileEntry is a file in a backup.
+type FileEntry struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod-time"`
+	SHA256  string      `json:"sha256"`
+	// Stored is whether the file's content is in this archive, rather than
+	// unchanged in the base.
+	Stored bool `json:"stored"`
+}
+
+// Incremental reports whether the backup only stores files changed since
+// its base.
+func (m Manifest) Incremental() bool {
+	return m.Base != ""
+}
+
+// paths returns the set of file paths in the manifest.
+func (m Manifest) paths() map[string]bool {
+	paths := make(map[string]bool, len(m.Files))
+	for _, f := range m.Files {
+		paths[f.Path] = true
+	}
+	return paths
+}
+
+// BuildManifest checksums every file in the sources, recording the
+// environment. Given the manifest of a base backup, only files that differ
+// from it are marked as stored. Files
+// with the same size and modification time as in the base are assumed to be
+// unchanged, as closed raft segments and snapshots are never rewritten.
+func BuildManifest(env Environment, base *Manifest, baseName string, sources ...Source) (Manifest, error) {
+	m := Manifest{Created: time.Now().UTC(), Environment: env}
+	baseFiles := make(map[string]FileEntry)
+	if base != nil {
+		m.Base = baseName
+		for _, f := range base.Files {
+			baseFiles[f.Path] = f
+		}
+	}
+	// Files are checksummed concurrently, as reading them dominates.
+	var paths []string
+	for _, source := range sources {
+		err := walkSource(source, func(name, path string, info os.FileInfo) error {
+			if info.IsDir() {
+				return nil
+			}
+			entry := FileEntry{
+				Path:    name,
+				Size:    info.Size(),
+				Mode:    info.Mode().Perm(),
+				ModTime: info.ModTime().UTC(),
+			}
+			prev, inBase := baseFiles[name]
+			if inBase && prev.Size == entry.Size && prev.ModTime.Equal(entry.ModTime) {
+				entry.SHA256 = prev.SHA256
+			}
+			m.Files = append(m.Files, entry)
+			paths = append(paths, path)
+			return nil
+		})
+		if err != nil {
+			return Manifest{}, errors.Annotatef(err, "checksumming %s", source.Path)
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		jobs     = make(chan int)
+		failures = make([]error, len(m.Files))
+	)
+	for n := readers(); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				m.Files[i].SHA256, failures[i] = fileSHA256(paths[i], nil)
+			}
+		}()
+	}
+	for i, f := range m.Files {
+		if f.SHA256 == "" {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i := range m.Files {
+		if failures[i] != nil {
+			return Manifest{}, errors.Annotatef(failures[i], "checksumming %s", paths[i])
+		}
+		prev, inBase := baseFiles[m.Files[i].Path]
+		m.Files[i].Stored = !inBase || prev.SHA256 != m.Files[i].SHA256
+	}
+	return m, nil
+}
+
+// ReadManifest reads the manifest from the start of a backup archive.
+func ReadManifest(r io.Reader) (Manifest, error) {
+	cr, err := compress.NewReader(r)
+	if err != nil {
+		return Manifest{}, errors.Annotate(err, "reading backup")
+	}
+	defer func() { _ = cr.Close() }()
+	tr := tar.NewReader(cr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return Manifest{}, errors.Annotate(err, "reading backup")
+	}
+	if hdr.Name != ManifestName {
+		return Manifest{}, errors.NotFoundf("manifest in backup")
+	}
+	var m Manifest
+	err = json.NewDecoder(tr).Decode(&m)
+	return m, errors.Annotate(err, "parsing backup manifest")
+}
+
+func fileSHA256(path string, meter *progress.Meter) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, meter.Reader(f)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// walkSource calls fn for each directory and regular file in the source,
+// with its name in the archive. A source that is a symlink is followed, as
+// are symlinks to files within it, which are stored as the files they point
+// to. Symlinks to directories within it are refused, as they may lead out of
+// the source or back into it.
+func walkSource(source Source, fn func(name, path string, info os.FileInfo) error) error {
+	root, err := filepath.EvalSymlinks(source.Path)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(path); err != nil {
+				return errors.Annotatef(err, "following symlink %s", path)
+			}
+			if info.IsDir() {
+				return errors.NotSupportedf("symlink %s to a directory", path)
+			}
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if contains(source.Skip, filepath.ToSlash(rel)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(filepath.ToSlash(filepath.Join(source.Name, rel)), path, info)
+	})
+}
+
+// Verify checks the files of the named source, extracted to the directory,
+// against the checksums in the manifest. Files at the skipped paths, relative
+// to the source, are not checked.
+func (m Manifest) Verify(name, dir string, skip ...string) error {
+	checked := func(f FileEntry) (string, bool) {
+		rel, ok := strings.CutPrefix(f.Path, name+"/")
+		return rel, ok && !contains(skip, rel)
+	}
+	var total int64
+	for _, f := range m.Files {
+		if _, ok := checked(f); ok {
+			total += f.Size
+		}
+	}
+	meter := progress.New("verifying checksums", total)
+
+	var problems []string
+	for _, f := range m.Files {
+		rel, ok := checked(f)
+		if !ok {
+			continue
+		}
+		sum, err := fileSHA256(filepath.Join(dir, filepath.FromSlash(rel)), meter)
+		if os.IsNotExist(err) {
+			problems = append(problems, f.Path+" is missing")
+		} else if err != nil {
+			return errors.Trace(err)
+		} else if sum != f.SHA256 {
+			problems = append(problems, f.Path+" has the wrong checksum")
+		}
+	}
+	meter.Done()
+	if len(problems) > 0 {
+		return errors.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Size returns the total size of the files in the backup, including those
+// only stored in its base.
+func (m Manifest) Size() int64 {
+	var size int64
+	for _, f := range m.Files {
+		size += f.Size
+	}
+	return size
+}
@@ -0,0 +1,294 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/fips"
+)
+
+const (
+	// S3Scheme is the URL scheme of backups held in object storage, as
+	// s3://<bucket>/<key>.
+	S3Scheme = "s3://"
+
+	// partSize is the size of each part of a multipart upload. Only one part
+	// is held in memory at a time.
+	partSize = 16 << 20
+)
+
+// S3Config configures access to an S3-compatible object store.
+type S3Config struct {
+	// Endpoint is the URL of the object store. It defaults to AWS S3 in the
+	// region.
+	Endpoint string
+	// Region is the region requests are signed for.
+	Region string
+	// VirtualHosted addresses buckets as <bucket>.<endpoint> rather than
+	// <endpoint>/<bucket>, which many S3-compatible stores do not support.
+	VirtualHosted bool
+	// Credentials sign each request.
+	Credentials Credentials
+	// CACert is an optional PEM CA certificate for the endpoint.
+	CACert []byte
+}
+
+// S3 streams backups to and from an S3-compatible object store.
+type S3 struct {
+	cfg    S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewS3 returns an S3 client for the configuration.
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	if cfg.Credentials.AccessKey == "" || cfg.Credentials.SecretKey == "" {
+		return nil, errors.NotValidf("S3 credentials without an access key and secret key")
+	}
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, errors.Annotatef(err, "parsing S3 endpoint")
+	}
+
+	tlsConfig := fips.Restrict(&tls.Config{MinVersion: tls.VersionTLS12})
+	if len(cfg.CACert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cfg.CACert) {
+			return nil, errors.NotValidf("S3 CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &S3{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport},
+		now:    time.Now,
+	}, nil
+}
+
+// ParseS3URL splits an s3://<bucket>/<key> URL into its bucket and key.
+func ParseS3URL(s string) (string, string, error) {
+	if !IsS3URL(s) {
+		return "", "", errors.NotValidf("S3 URL %q", s)
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(s, S3Scheme), "/")
+	if bucket == "" {
+		return "", "", errors.NotValidf("S3 URL %q without a bucket", s)
+	}
+	return bucket, key, nil
+}
+
+// IsS3URL reports whether the location is in object storage.
+func IsS3URL(s string) bool {
+	return strings.HasPrefix(s, S3Scheme)
+}
+
+// Upload streams the content to the key in the bucket, using a multipart
+// upload so that the size need not be known and the archive is never written
+// to local disk. A failed upload is aborted, so no partial object is left.
+func (s *S3) Upload(ctx context.Context, bucket, key string, r io.Reader) error {
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Small enough for a single request.
+		return errors.Trace(s.put(ctx, bucket, key, nil, buf[:n]))
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+
+	uploadID, err := s.createMultipart(ctx, bucket, key)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var parts []completedPart
+	for number := 1; n > 0; number++ {
+		etag, err := s.uploadPart(ctx, bucket, key, uploadID, number, buf[:n])
+		if err != nil {
+			s.abortMultipart(bucket, key, uploadID)
+			return errors.Annotatef(err, "uploading part %d", number)
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.abortMultipart(bucket, key, uploadID)
+			return errors.Trace(err)
+		}
+	}
+	if err := s.completeMultipart(ctx, bucket, key, uploadID, parts); err != nil {
+		s.abortMultipart(bucket, key, uploadID)
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Download returns a reader streaming the object with the key in the bucket.
+// The reader must be closed.
+func (s *S3) Download(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, bucket, key, nil, nil)
+	if err != nil {
+		return nil, errors.Annotatef(err, "downloading s3://%s/%s", bucket, key)
+	}
+	return resp.Body, nil
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *S3) put(ctx context.Context, bucket, key string, query url.Values, body []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, bucket, key, query, body)
+	if err != nil {
+		return errors.Annotatef(err, "uploading s3://%s/%s", bucket, key)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (s *S3) createMultipart(ctx context.Context, bucket, key string) (string, error) {
+	resp, err := s.do(ctx, http.MethodPost, bucket, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", errors.Annotatef(err, "starting upload of s3://%s/%s", bucket, key)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", errors.Errorf("starting upload of s3://%s/%s: no upload ID in response", bucket, key)
+	}
+	return result.UploadID, nil
+}
+
+func (s *S3) uploadPart(ctx context.Context, bucket, key, uploadID string, number int, body []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	resp, err := s.do(ctx, http.MethodPut, bucket, key, query, body)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	_ = resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *S3) completeMultipart(ctx context.Context, bucket, key, uploadID string, parts []completedPart) error {
+	var body bytes.Buffer
+	body.WriteString("<CompleteMultipartUpload>")
+	for _, part := range parts {
+		fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>", part.PartNumber)
+		_ = xml.EscapeText(&body, []byte(part.ETag))
+		body.WriteString("</ETag></Part>")
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+
+	resp, err := s.do(ctx, http.MethodPost, bucket, key, url.Values{"uploadId": {uploadID}}, body.Bytes())
+	if err != nil {
+		return errors.Annotatef(err, "completing upload of s3://%s/%s", bucket, key)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// A completion can fail after the response has started, in which case
+	// the error is in the body.
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Annotatef(err, "completing upload of s3://%s/%s", bucket, key)
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return errors.Errorf("completing upload of s3://%s/%s: %s", bucket, key, s3ErrorMessage(data))
+	}
+	return nil
+}
+
+// abortMultipart discards the parts uploaded so far. It is best effort, and
+// runs even if the upload was cancelled.
+func (s *S3) abortMultipart(bucket, key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := s.do(ctx, http.MethodDelete, bucket, key, url.Values{"uploadId": {uploadID}}, nil)
+	if err == nil {
+		_ = resp.Body.Close()
+	}
+}
+
+// do sends a signed request, returning an error for any unsuccessful status.
+func (s *S3) do(ctx context.Context, method, bucket, key string, query url.Values, body []byte) (*http.Response, error) {
+	u, err := s.objectURL(bucket, key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	u.RawQuery = query.Encode()
+
+	var reader io.Reader
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		reader = bytes.NewReader(body)
+		payloadHash = hexSHA256(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	signV4(req, s.cfg.Credentials, s.cfg.Region, payloadHash, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if resp.StatusCode/100 != 2 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		_ = resp.Body.Close()
+		return nil, errors.Errorf("%s: %s", resp.Status, s3ErrorMessage(data))
+	}
+	return resp, nil
+}
+
+func (s *S3) objectURL(bucket, key string) (*url.URL, error) {
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.cfg.VirtualHosted {
+		u.Host = bucket + "." + u.Host
+	} else {
+		path += "/" + bucket
+	}
+	u.Path = path + "/" + key
+	return u, nil
+}
+
+// s3ErrorMessage extracts the message from an S3 error response.
+func s3ErrorMessage(data []byte) string {
+	var resp struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(data, &resp); err != nil || resp.Code == "" {
+		return strings.TrimSpace(string(data))
+	}
+	return resp.Code + ": " + resp.Message
+}
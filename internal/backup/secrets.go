@@ -0,0 +1,204 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SecretsName is the name in a backup archive of the encrypted bundle of the
+// agent directory and the controller's TLS material.
+const SecretsName = "agent-secrets.enc"
+
+const (
+	// secretsMagic starts an encrypted bundle, followed by the key
+	// derivation salt and iterations, and the AES-GCM nonce.
+	secretsMagic = "BSTSEC01"
+	saltSize     = 16
+	// keyIterations is the number of PBKDF2-SHA256 iterations used to
+	// derive the key from the passphrase.
+	keyIterations = 600000
+
+	agentPrefix    = "agent/"
+	externalPrefix = "external/"
+)
+
+// SecretFile is a file restored from an encrypted bundle. Files of the agent
+// directory have a path relative to it, and those outside it an absolute
+// path.
+type SecretFile struct {
+	Path     string
+	Mode     os.FileMode
+	Data     []byte
+	External bool
+}
+
+// WriteSecrets writes to the path an encrypted bundle of the agent directory
+// and of the extra files outside it, such as TLS material the agent config
+// references by absolute path.
+func WriteSecrets(path string, passphrase []byte, agentDir string, extra []string) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := filepath.Walk(agentDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(agentDir, path)
+		if err != nil {
+			return err
+		}
+		return addSecretFile(tw, agentPrefix+filepath.ToSlash(rel), path, info)
+	})
+	if err != nil {
+		return errors.Annotatef(err, "bundling %s", agentDir)
+	}
+	for _, path := range extra {
+		if rel, err := filepath.Rel(agentDir, path); err == nil && filepath.IsLocal(rel) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := addSecretFile(tw, externalPrefix+strings.TrimPrefix(filepath.ToSlash(path), "/"), path, info); err != nil {
+			return errors.Annotatef(err, "bundling %s", path)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	sealed, err := encrypt(buf.Bytes(), passphrase)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.WriteFile(path, sealed, 0600))
+}
+
+// ReadSecrets decrypts a bundle written by WriteSecrets.
+func ReadSecrets(data, passphrase []byte) ([]SecretFile, error) {
+	plain, err := decrypt(data, passphrase)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var files []SecretFile
+	tr := tar.NewReader(bytes.NewReader(plain))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, errors.Annotate(err, "reading secrets")
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Annotate(err, "reading secrets")
+		}
+		file := SecretFile{Mode: hdr.FileInfo().Mode().Perm(), Data: content}
+		switch {
+		case strings.HasPrefix(hdr.Name, agentPrefix):
+			file.Path = filepath.FromSlash(strings.TrimPrefix(hdr.Name, agentPrefix))
+			if !filepath.IsLocal(file.Path) {
+				return nil, errors.NotValidf("secrets entry %q", hdr.Name)
+			}
+		case strings.HasPrefix(hdr.Name, externalPrefix):
+			file.Path = filepath.Clean(filepath.FromSlash("/" + strings.TrimPrefix(hdr.Name, externalPrefix)))
+			file.External = true
+		default:
+			continue
+		}
+		files = append(files, file)
+	}
+}
+
+func addSecretFile(tw *tar.Writer, name, path string, info os.FileInfo) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    int64(info.Mode().Perm()),
+		Size:    int64(len(data)),
+		ModTime: info.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// encrypt seals the data with AES-256-GCM, under a key derived from the
+// passphrase with PBKDF2-SHA256.
+func encrypt(data, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Trace(err)
+	}
+	aead, err := secretsCipher(passphrase, salt, keyIterations)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	header := append([]byte(secretsMagic), salt...)
+	header = binary.BigEndian.AppendUint32(header, keyIterations)
+	header = append(header, nonce...)
+	// The header is authenticated along with the data.
+	return aead.Seal(header, nonce, data, header), nil
+}
+
+// decrypt opens data sealed by encrypt.
+func decrypt(data, passphrase []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(secretsMagic)) {
+		return nil, errors.NotValidf("encrypted secrets")
+	}
+	rest := data[len(secretsMagic):]
+	if len(rest) < saltSize+4 {
+		return nil, errors.NotValidf("encrypted secrets")
+	}
+	salt, iterations := rest[:saltSize], binary.BigEndian.Uint32(rest[saltSize:])
+	if iterations == 0 || iterations > 100*keyIterations {
+		return nil, errors.NotValidf("encrypted secrets")
+	}
+	aead, err := secretsCipher(passphrase, salt, int(iterations))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	headerSize := len(secretsMagic) + saltSize + 4 + aead.NonceSize()
+	if len(data) < headerSize {
+		return nil, errors.NotValidf("encrypted secrets")
+	}
+	header := data[:headerSize]
+	plain, err := aead.Open(nil, header[headerSize-aead.NonceSize():], data[headerSize:], header)
+	if err != nil {
+		return nil, errors.New("cannot decrypt secrets, the passphrase is wrong or the bundle is corrupt")
+	}
+	return plain, nil
+}
+
+func secretsCipher(passphrase, salt []byte, iterations int) (cipher.AEAD, error) {
+	key := pbkdf2.Key(passphrase, salt, iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+const (
+	// chunkSize is the size of the buffers files are read in.
+	chunkSize = 1 << 20
+	// chunksAhead is the number of chunks of a file read ahead of the
+	// archive writer, bounding memory use to readers()*chunksAhead chunks.
+	chunksAhead = 4
+)
+
+var chunkPool = sync.Pool{
+	New: func() any { return make([]byte, chunkSize) },
+}
+
+// readers returns the number of files read concurrently.
+func readers() int {
+	if n := runtime.GOMAXPROCS(0); n < 8 {
+		return n
+	}
+	return 8
+}
+
+// chunk is part of a file read ahead, or the error that ended the read.
+type chunk struct {
+	data []byte
+	err  error
+}
+
+// readAhead reads the files concurrently, in order, ahead of a consumer
+// reading them one at a time, so that reading from disk overlaps with
+// compression. Only as many files as there are readers are read at once,
+// and each only a few chunks ahead.
+type readAhead struct {
+	files []chan chunk
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newReadAhead(paths []string) *readAhead {
+	r := &readAhead{
+		files: make([]chan chunk, len(paths)),
+		done:  make(chan struct{}),
+	}
+	for i := range paths {
+		r.files[i] = make(chan chunk, chunksAhead)
+	}
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range paths {
+			select {
+			case jobs <- i:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	for n := readers(); n > 0; n-- {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			for i := range jobs {
+				r.read(paths[i], r.files[i])
+			}
+		}()
+	}
+	return r
+}
+
+// read sends the chunks of the file on the channel, then closes it.
+func (r *readAhead) read(path string, out chan<- chunk) {
+	defer close(out)
+	send := func(c chunk) bool {
+		select {
+		case out <- c:
+			return true
+		case <-r.done:
+			return false
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		send(chunk{err: err})
+		return
+	}
+	defer func() { _ = f.Close() }()
+	for {
+		buf := chunkPool.Get().([]byte)
+		n, err := io.ReadFull(f, buf)
+		if n > 0 && !send(chunk{data: buf[:n]}) {
+			return
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		} else if err != nil {
+			send(chunk{err: err})
+			return
+		}
+	}
+}
+
+// copyTo writes the content of the i'th file to w, returning the number of
+// bytes written.
+func (r *readAhead) copyTo(w io.Writer, i int) (int64, error) {
+	var written int64
+	for c := range r.files[i] {
+		if c.err != nil {
+			return written, c.err
+		}
+		n, err := w.Write(c.data)
+		written += int64(n)
+		chunkPool.Put(c.data[:cap(c.data)])
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// close stops reading ahead and waits for the readers to finish.
+func (r *readAhead) close() {
+	close(r.done)
+	r.wg.Wait()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
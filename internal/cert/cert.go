@@ -0,0 +1,156 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cert
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// controllerKeyBits is the size of the RSA key generated for a controller
+// certificate.
+const controllerKeyBits = 3072
+
+// ControllerName is the fixed DNS name that Juju includes in every
+// controller certificate, which identifies a peer as a controller when it is
+// dialled by an address the certificate may not carry.
+const ControllerName = "juju-apiserver"
+
+// DefaultControllerNames are the DNS names that Juju includes in a controller
+// certificate.
+var DefaultControllerNames = []string{"localhost", ControllerName, "juju-mongodb", "anything"}
+
+// ParseCertificate parses the first certificate from the PEM data.
+func ParseCertificate(certPEM string) (*x509.Certificate, error) {
+	rest := []byte(certPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.NotFoundf("certificate in PEM data")
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			return cert, errors.Annotate(err, "parsing certificate")
+		}
+	}
+}
+
+// ParsePrivateKey parses a PKCS#1, PKCS#8 or EC private key from the PEM
+// data.
+func ParsePrivateKey(keyPEM string) (crypto.Signer, error) {
+	rest := []byte(keyPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.NotFoundf("private key in PEM data")
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			return key, errors.Annotate(err, "parsing private key")
+		case "EC PRIVATE KEY":
+			key, err := x509.ParseECPrivateKey(block.Bytes)
+			return key, errors.Annotate(err, "parsing private key")
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, errors.Annotate(err, "parsing private key")
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, errors.NotSupportedf("private key type %T", key)
+			}
+			return signer, nil
+		}
+	}
+}
+
+// NewControllerCert returns a new controller certificate and private key in
+// PEM format, signed by the CA. The certificate is valid for the given DNS
+// names and IP addresses, and can be used for both server and client
+// authentication, as Dqlite nodes use it for both.
+func NewControllerCert(caCertPEM, caKeyPEM string, names []string, ips []net.IP, validity time.Duration) (string, string, error) {
+	caCert, err := ParseCertificate(caCertPEM)
+	if err != nil {
+		return "", "", errors.Annotate(err, "CA certificate")
+	}
+	caKey, err := ParsePrivateKey(caKeyPEM)
+	if err != nil {
+		return "", "", errors.Annotate(err, "CA private key")
+	}
+	if _, err := tls.X509KeyPair([]byte(caCertPEM), []byte(caKeyPEM)); err != nil {
+		return "", "", errors.Annotate(err, "CA certificate does not match the CA private key")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, controllerKeyBits)
+	if err != nil {
+		return "", "", errors.Annotate(err, "generating private key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", errors.Annotate(err, "generating serial number")
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "*",
+			Organization: []string{"juju"},
+		},
+		NotBefore:   now.Add(-5 * time.Minute),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:    names,
+		IPAddresses: ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return "", "", errors.Annotate(err, "creating certificate")
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return string(certPEM), string(keyPEM), nil
+}
+
+// Verify checks that the certificate and key form a pair, and that the
+// certificate is signed by one of the CAs and valid for both server and client
+// authentication at the given time.
+func Verify(certPEM, keyPEM, caPEM string, at time.Time) error {
+	if _, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM)); err != nil {
+		return errors.Annotate(err, "certificate and key do not form a pair")
+	}
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(caPEM)) {
+		return errors.NotValidf("CA certificate")
+	}
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		if _, err := cert.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			CurrentTime: at,
+			KeyUsages:   []x509.ExtKeyUsage{usage},
+		}); err != nil {
+			return errors.Annotate(err, "verifying certificate against the CA")
+		}
+	}
+	return nil
+}
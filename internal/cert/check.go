@@ -0,0 +1,76 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// Status describes the validity of a certificate at a point in time.
+type Status struct {
+	Name      string
+	NotBefore time.Time
+	NotAfter  time.Time
+	// Problems are reasons that the certificate can not be used.
+	Problems []string
+	// Expiring is true if the certificate will expire within the warning
+	// period.
+	Expiring bool
+}
+
+// CheckControllerCerts checks the CA certificate, and the controller
+// certificate and key, reporting expiry dates, key mismatches and chain
+// problems. Certificates that expire within warnWithin of now are flagged as
+// expiring.
+func CheckControllerCerts(caPEM, certPEM, keyPEM string, now time.Time, warnWithin time.Duration) []Status {
+	ca := checkValidity("CA certificate", caPEM, now, warnWithin)
+	if caCert, err := ParseCertificate(caPEM); err == nil && !caCert.IsCA {
+		ca.Problems = append(ca.Problems, "certificate is not a CA")
+	}
+
+	controller := checkValidity("controller certificate", certPEM, now, warnWithin)
+	if keyPEM == "" {
+		controller.Problems = append(controller.Problems, "private key is missing")
+	} else if _, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM)); err != nil {
+		controller.Problems = append(controller.Problems, fmt.Sprintf("private key does not match certificate: %v", err))
+	}
+	if cert, err := ParseCertificate(certPEM); err == nil {
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM([]byte(caPEM))
+		if _, err := cert.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			CurrentTime: now,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			controller.Problems = append(controller.Problems, fmt.Sprintf("not signed by the CA: %v", err))
+		}
+	}
+	return []Status{ca, controller}
+}
+
+func checkValidity(name, certPEM string, now time.Time, warnWithin time.Duration) Status {
+	status := Status{Name: name}
+	if certPEM == "" {
+		status.Problems = append(status.Problems, "certificate is missing")
+		return status
+	}
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		status.Problems = append(status.Problems, err.Error())
+		return status
+	}
+	status.NotBefore, status.NotAfter = cert.NotBefore, cert.NotAfter
+	switch {
+	case now.Before(cert.NotBefore):
+		status.Problems = append(status.Problems, fmt.Sprintf("not valid until %s", cert.NotBefore.Format(time.RFC3339)))
+	case now.After(cert.NotAfter):
+		status.Problems = append(status.Problems, fmt.Sprintf("expired %s", cert.NotAfter.Format(time.RFC3339)))
+	case now.Add(warnWithin).After(cert.NotAfter):
+		status.Expiring = true
+	}
+	return status
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	jujuerrors "github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/fips"
+)
+
+// CheckPeerAccepts connects to the TLS service at the address using the
+// certificate and key as the client certificate, and checks that the peer
+// accepts it. The peer's own certificate is verified against the CA, and
+// must carry the controller name.
+func CheckPeerAccepts(ctx context.Context, address, certPEM, keyPEM, caPEM string) error {
+	clientCert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return jujuerrors.Annotate(err, "parsing client certificate")
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(caPEM))
+
+	dialer := &tls.Dialer{Config: fips.Restrict(&tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      roots,
+		// Peers are dialled by address, which controller certificates do
+		// not reliably carry, so the certificate is verified separately,
+		// against the controller name instead.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return jujuerrors.New("no server certificate presented")
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{Roots: roots, DNSName: ControllerName})
+			return err
+		},
+	})}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return jujuerrors.Annotatef(err, "connecting to %s", address)
+	}
+	defer conn.Close()
+
+	// With TLS 1.3 a rejected client certificate is only reported by the
+	// server after the handshake, so wait briefly for an alert. A timeout
+	// means the peer is waiting for us, having accepted the certificate.
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	return jujuerrors.Annotatef(err, "%s rejected the certificate", address)
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithms.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+	None = "none"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Compression is how an archive is compressed. A zero level uses the
+// algorithm's default.
+type Compression struct {
+	Algorithm string
+	Level     int
+}
+
+// Default is the compression of backups unless another is chosen.
+var Default = Compression{Algorithm: Gzip}
+
+// Parse parses a compression given as "gzip", "zstd" or "none", optionally
+// followed by ":<level>".
+func Parse(s string) (Compression, error) {
+	algorithm, level, hasLevel := strings.Cut(s, ":")
+	c := Compression{Algorithm: algorithm}
+	if hasLevel {
+		var err error
+		if c.Level, err = strconv.Atoi(level); err != nil {
+			return Compression{}, errors.NotValidf("compression level %q", level)
+		}
+	}
+	switch algorithm {
+	case Gzip:
+		if hasLevel && (c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression) {
+			return Compression{}, errors.NotValidf("gzip level %d, which must be from 1 to 9", c.Level)
+		}
+	case Zstd:
+		if hasLevel && (c.Level < 1 || c.Level > 22) {
+			return Compression{}, errors.NotValidf("zstd level %d, which must be from 1 to 22", c.Level)
+		}
+	case None:
+		if hasLevel {
+			return Compression{}, errors.NotValidf("a level without compression")
+		}
+	default:
+		return Compression{}, errors.NotValidf("compression %q", algorithm)
+	}
+	return c, nil
+}
+
+// String returns the compression as accepted by Parse.
+func (c Compression) String() string {
+	if c.Level == 0 {
+		return c.Algorithm
+	}
+	return c.Algorithm + ":" + strconv.Itoa(c.Level)
+}
+
+// Estimate returns the size n bytes of Dqlite data are expected to compress
+// to. Raft entries and SQLite pages usually compress to a third or less;
+// half is assumed, to leave a margin.
+func (c Compression) Estimate(n int64) int64 {
+	if c.Algorithm == None {
+		return n
+	}
+	return n / 2
+}
+
+// Extension returns the file extension of a tar archive with the
+// compression.
+func (c Compression) Extension() string {
+	switch c.Algorithm {
+	case Zstd:
+		return ".tar.zst"
+	case None:
+		return ".tar"
+	default:
+		return ".tar.gz"
+	}
+}
+
+// NewWriter returns a writer compressing to w. It must be closed to flush
+// the compressed stream, which does not close w.
+func (c Compression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.Algorithm {
+	case Gzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case Zstd:
+		level := zstd.SpeedDefault
+		if c.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	case None:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, errors.NotValidf("compression %q", c.Algorithm)
+	}
+}
+
+// Program returns the compression program to run with tar -I, for
+// compressing on a remote machine, or an empty string for none.
+func (c Compression) Program() string {
+	switch c.Algorithm {
+	case Gzip, Zstd:
+		program := c.Algorithm
+		if c.Level > 19 {
+			program += " --ultra"
+		}
+		if c.Level != 0 {
+			program += " -" + strconv.Itoa(c.Level)
+		}
+		return program
+	default:
+		return ""
+	}
+}
+
+// NewReader returns a reader decompressing r, whose compression is detected
+// from its content. Uncompressed content is read as it is.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, errors.Trace(err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
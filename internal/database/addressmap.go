@@ -0,0 +1,100 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+// AddressMap maps old node addresses to new ones, for example following a
+// subnet renumbering. Keys and values are either hosts, in which case the
+// port of the node address is retained, or host:port pairs.
+type AddressMap map[string]string
+
+// ReadAddressMap reads an address map from the YAML file at the given path.
+func ReadAddressMap(path string) (AddressMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading address map %q", path)
+	}
+	m, err := ParseAddressMap(data)
+	return m, errors.Annotatef(err, "address map %q", path)
+}
+
+// ParseAddressMap parses an address map from YAML.
+func ParseAddressMap(data []byte) (AddressMap, error) {
+	var m AddressMap
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Annotate(err, "parsing address map")
+	}
+	for from, to := range m {
+		if from == "" || to == "" {
+			return nil, errors.NotValidf("address map entry %q: %q", from, to)
+		}
+	}
+	return m, nil
+}
+
+// ParseAddressPairs parses an address map from pairs of the form old=new.
+func ParseAddressPairs(pairs []string) (AddressMap, error) {
+	m := make(AddressMap, len(pairs))
+	for _, pair := range pairs {
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok || from == "" || to == "" {
+			return nil, errors.NotValidf("address rewrite %q, expected <old>=<new>", pair)
+		}
+		m[from] = to
+	}
+	return m, nil
+}
+
+// Apply returns a copy of the nodes with their addresses rewritten according
+// to the map. An exact match of the node address takes precedence over a match
+// of its host.
+func (m AddressMap) Apply(nodes []dqlite.NodeInfo) []dqlite.NodeInfo {
+	result := make([]dqlite.NodeInfo, len(nodes))
+	for i, node := range nodes {
+		node.Address = m.Rewrite(node.Address)
+		result[i] = node
+	}
+	return result
+}
+
+// Rewrite returns the new address for the address, or the address itself if
+// the map has none.
+func (m AddressMap) Rewrite(address string) string {
+	if to, ok := m[address]; ok {
+		return to
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	to, ok := m[host]
+	if !ok {
+		return address
+	}
+	if _, _, err := net.SplitHostPort(to); err == nil {
+		return to
+	}
+	return net.JoinHostPort(to, port)
+}
+
+// Unmapped returns the nodes whose addresses are not rewritten by the map.
+func (m AddressMap) Unmapped(nodes []dqlite.NodeInfo) []dqlite.NodeInfo {
+	var unmapped []dqlite.NodeInfo
+	for _, node := range nodes {
+		if m.Rewrite(node.Address) == node.Address {
+			unmapped = append(unmapped, node)
+		}
+	}
+	return unmapped
+}
@@ -6,11 +6,30 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
+	"net"
+
 	"github.com/canonical/go-dqlite/client"
 )
 
 type Client = client.Client
 
+// File holds the content of a single database file.
+type File = client.File
+
+// New creates a client connected to the dqlite node at the address, using
+// the dial function.
+func New(ctx context.Context, address string, dial DialFunc) (*Client, error) {
+	return client.New(ctx, address, client.WithDialFunc(dial), client.WithLogFunc(Log))
+}
+
+// FindLeader returns a client connected to the current cluster leader, trying
+// each of the nodes in the store.
+func FindLeader(ctx context.Context, store NodeStore, dial DialFunc) (*Client, error) {
+	return client.FindLeader(ctx, store, client.WithDialFunc(dial), client.WithLogFunc(Log))
+}
+
 // YamlNodeStore persists a list addresses of dqlite nodes in a YAML file.
 type YamlNodeStore = client.YamlNodeStore
 
@@ -19,6 +38,24 @@ func NewYamlNodeStore(path string) (*YamlNodeStore, error) {
 	return client.NewYamlNodeStore(path)
 }
 
+// NodeStore is used by a dqlite client to get an initial list of candidate
+// dqlite nodes that it can dial in order to find a leader dqlite node to use.
+type NodeStore = client.NodeStore
+
+// DialFunc is a function that can be used to establish a network connection.
+type DialFunc = client.DialFunc
+
+// DialFuncWithTLS returns a dial function that uses TLS encryption.
+func DialFuncWithTLS(dial DialFunc, config *tls.Config) DialFunc {
+	return client.DialFuncWithTLS(dial, config)
+}
+
+// DefaultDialFunc is the default dial function, which can handle plain TCP and
+// Unix socket endpoints.
+func DefaultDialFunc(ctx context.Context, address string) (net.Conn, error) {
+	return client.DefaultDialFunc(ctx, address)
+}
+
 // LogFunc is a function that can be used for logging.
 type LogFunc = client.LogFunc
 
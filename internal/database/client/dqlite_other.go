@@ -7,8 +7,11 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 
+	"github.com/juju/errors"
+
 	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
 )
 
@@ -23,6 +26,49 @@ func (c *Client) Leader(ctx context.Context) (*dqlite.NodeInfo, error) {
 	return nil, nil
 }
 
+// Transfer leadership from the current leader to another node.
+func (c *Client) Transfer(context.Context, uint64) error {
+	return errors.NotSupportedf("dqlite client without dqlite")
+}
+
+// Assign a role to a node.
+func (c *Client) Assign(context.Context, uint64, dqlite.NodeRole) error {
+	return errors.NotSupportedf("dqlite client without dqlite")
+}
+
+// Add a node to the cluster.
+func (c *Client) Add(context.Context, dqlite.NodeInfo) error {
+	return errors.NotSupportedf("dqlite client without dqlite")
+}
+
+// File holds the content of a single database file.
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Dump the content of the database with the given name.
+func (c *Client) Dump(context.Context, string) ([]File, error) {
+	return nil, errors.NotSupportedf("dqlite client without dqlite")
+}
+
+// Close closes the client.
+func (c *Client) Close() error {
+	return nil
+}
+
+// New creates a client connected to the dqlite node at the address, using
+// the dial function.
+func New(context.Context, string, DialFunc) (*Client, error) {
+	return nil, errors.NotSupportedf("dqlite client without dqlite")
+}
+
+// FindLeader returns a client connected to the current cluster leader, trying
+// each of the nodes in the store.
+func FindLeader(context.Context, NodeStore, DialFunc) (*Client, error) {
+	return nil, errors.NotSupportedf("dqlite client without dqlite")
+}
+
 type YamlNodeStore struct {
 }
 
@@ -69,3 +115,22 @@ func (l LogLevel) String() string {
 }
 
 type DialFunc func(context.Context, string) (net.Conn, error)
+
+// NodeStore is used by a dqlite client to get an initial list of candidate
+// dqlite nodes that it can dial in order to find a leader dqlite node to use.
+type NodeStore interface {
+	Get(context.Context) ([]dqlite.NodeInfo, error)
+	Set(context.Context, []dqlite.NodeInfo) error
+}
+
+// DialFuncWithTLS returns a dial function that uses TLS encryption.
+func DialFuncWithTLS(dial DialFunc, _ *tls.Config) DialFunc {
+	return dial
+}
+
+// DefaultDialFunc is the default dial function, which can handle plain TCP and
+// Unix socket endpoints.
+func DefaultDialFunc(ctx context.Context, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", address)
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package client
+
+import "github.com/juju/loggo"
+
+// logger receives the Dqlite library's own messages.
+var logger = loggo.GetLogger("dqlite")
+
+// Log is a LogFunc that logs the Dqlite library's messages, such as
+// connection attempts and handshakes, to the dqlite logger.
+func Log(level LogLevel, format string, args ...interface{}) {
+	switch level {
+	case LogError:
+		logger.Errorf(format, args...)
+	case LogWarn:
+		logger.Warningf(format, args...)
+	case LogInfo:
+		logger.Infof(format, args...)
+	default:
+		logger.Debugf(format, args...)
+	}
+}
+
+// Trace logs a line traced by one of the Dqlite C libraries during the
+// operation, to a logger of its own under the dqlite logger, or to the
+// dqlite logger if the library is not known.
+func Trace(operation, library, line string) {
+	name := "dqlite"
+	if library != "" {
+		name += "." + library
+	}
+	loggo.GetLogger(name).Debugf("%s: %s", operation, line)
+}
@@ -0,0 +1,56 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+// AddressConflicts returns a description of each address that is used by
+// more than one node ID. Address collisions are commonly caused by cloning
+// a controller machine, along with its Dqlite data directory.
+func AddressConflicts(nodes []dqlite.NodeInfo) []string {
+	ids := make(map[string]map[uint64]bool)
+	for _, node := range nodes {
+		addr := strings.ToLower(node.Address)
+		if ids[addr] == nil {
+			ids[addr] = make(map[uint64]bool)
+		}
+		ids[addr][node.ID] = true
+	}
+
+	var conflicts []string
+	for addr, nodeIDs := range ids {
+		if len(nodeIDs) < 2 {
+			continue
+		}
+		var sorted []string
+		for id := range nodeIDs {
+			sorted = append(sorted, fmt.Sprint(id))
+		}
+		sort.Strings(sorted)
+		conflicts = append(conflicts, fmt.Sprintf("address %s is used by nodes %s", addr, strings.Join(sorted, ", ")))
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// LocalNodeConflicts returns a description of each node in the cluster that
+// has the same address as the local node, but a different ID. This happens
+// when info.yaml has been copied from another machine.
+func LocalNodeConflicts(local dqlite.NodeInfo, servers []dqlite.NodeInfo) []string {
+	var conflicts []string
+	for _, server := range servers {
+		if server.ID != local.ID && strings.EqualFold(server.Address, local.Address) {
+			conflicts = append(conflicts, fmt.Sprintf(
+				"local node %d in info.yaml has address %s, which is also used by node %d in cluster.yaml",
+				local.ID, local.Address, server.ID))
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/safeyaml"
+)
+
+// StoreCopy is the cluster.yaml and info.yaml of a single controller.
+type StoreCopy struct {
+	// Host identifies the controller the copy was read from.
+	Host string
+	// Servers is the membership in cluster.yaml.
+	Servers []dqlite.NodeInfo
+	// Info is the local node in info.yaml, if there is one.
+	Info *dqlite.NodeInfo
+}
+
+// DqliteDir returns the path of the Dqlite data directory under the data dir.
+func DqliteDir(dataDir string) string {
+	return path.Join(dataDir, dqliteDataDir)
+}
+
+// ClusterFilePath returns the path of cluster.yaml under the data dir.
+func ClusterFilePath(dataDir string) string {
+	return path.Join(DqliteDir(dataDir), dqliteClusterFileName)
+}
+
+// InfoFilePath returns the path of info.yaml under the data dir.
+func InfoFilePath(dataDir string) string {
+	return path.Join(DqliteDir(dataDir), "info.yaml")
+}
+
+// ParseStoreCopy parses the contents of cluster.yaml and info.yaml read from
+// the host. The info may be empty.
+func ParseStoreCopy(host string, cluster, info []byte) (StoreCopy, error) {
+	c := StoreCopy{Host: host}
+	if err := safeyaml.Unmarshal(cluster, &c.Servers); err != nil {
+		return c, errors.Annotatef(err, "parsing cluster.yaml from %s", host)
+	}
+	if len(info) > 0 {
+		var nodeInfo dqlite.NodeInfo
+		if err := safeyaml.Unmarshal(info, &nodeInfo); err != nil {
+			return c, errors.Annotatef(err, "parsing info.yaml from %s", host)
+		}
+		c.Info = &nodeInfo
+	}
+	return c, nil
+}
+
+// StoreDisagreements returns a description of each way in which the copies
+// disagree: different memberships, the same address with different IDs, or an
+// info.yaml that does not match the host's own cluster.yaml.
+func StoreDisagreements(copies []StoreCopy) []string {
+	var disagreements []string
+
+	hostsByMembership := make(map[string][]string)
+	for _, c := range copies {
+		key := membershipKey(c.Servers)
+		hostsByMembership[key] = append(hostsByMembership[key], c.Host)
+	}
+	if len(hostsByMembership) > 1 {
+		var groups []string
+		for key, hosts := range hostsByMembership {
+			groups = append(groups, fmt.Sprintf("%s has %s", strings.Join(hosts, ", "), key))
+		}
+		sort.Strings(groups)
+		disagreements = append(disagreements, "cluster.yaml differs: "+strings.Join(groups, "; "))
+	}
+
+	ids := make(map[string]map[uint64][]string)
+	addID := func(address string, id uint64, source string) {
+		address = strings.ToLower(address)
+		if ids[address] == nil {
+			ids[address] = make(map[uint64][]string)
+		}
+		ids[address][id] = append(ids[address][id], source)
+	}
+	for _, c := range copies {
+		for _, server := range c.Servers {
+			addID(server.Address, server.ID, c.Host+" cluster.yaml")
+		}
+		if c.Info != nil {
+			addID(c.Info.Address, c.Info.ID, c.Host+" info.yaml")
+		}
+	}
+	for address, byID := range ids {
+		if len(byID) < 2 {
+			continue
+		}
+		var parts []string
+		for id, sources := range byID {
+			parts = append(parts, fmt.Sprintf("%d in %s", id, strings.Join(sources, ", ")))
+		}
+		sort.Strings(parts)
+		disagreements = append(disagreements, fmt.Sprintf("address %s has different IDs: %s", address, strings.Join(parts, "; ")))
+	}
+
+	for _, c := range copies {
+		if c.Info == nil {
+			continue
+		}
+		if !containsNode(c.Servers, *c.Info) {
+			disagreements = append(disagreements, fmt.Sprintf(
+				"%s: info.yaml node %d at %s is not in its cluster.yaml", c.Host, c.Info.ID, c.Info.Address))
+		}
+	}
+
+	sort.Strings(disagreements)
+	return disagreements
+}
+
+// SameMembership reports whether the two memberships hold the same nodes,
+// with the same addresses and roles, in any order.
+func SameMembership(a, b []dqlite.NodeInfo) bool {
+	return len(a) == len(b) && membershipKey(a) == membershipKey(b)
+}
+
+// membershipKey returns a canonical description of the membership.
+func membershipKey(servers []dqlite.NodeInfo) string {
+	parts := make([]string, len(servers))
+	for i, server := range servers {
+		parts[i] = fmt.Sprintf("%d@%s(%s)", server.ID, strings.ToLower(server.Address), server.Role)
+	}
+	sort.Strings(parts)
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+func containsNode(servers []dqlite.NodeInfo, node dqlite.NodeInfo) bool {
+	for _, server := range servers {
+		if server.ID == node.ID && strings.EqualFold(server.Address, node.Address) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/driver"
+)
+
+const (
+	// controllerDBName is the name of the Juju controller database.
+	controllerDBName = "controller"
+)
+
+// ControllerNode is a row of the controller_node table, which holds Juju's
+// view of the Dqlite cluster membership.
+type ControllerNode struct {
+	ControllerID string `json:"controller_id"`
+	DqliteNodeID uint64 `json:"dqlite_node_id"`
+	BindAddress  string `json:"bind_address"`
+}
+
+// ReadControllerNodes returns the controller nodes recorded in the
+// controller database file at the path, which is opened read-only.
+func ReadControllerNodes(ctx context.Context, path string) ([]ControllerNode, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, errors.Trace(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, errors.Annotatef(err, "opening %q", path)
+	}
+	defer db.Close()
+	return controllerNodes(ctx, db)
+}
+
+// ClusterControllerNodes reads the controller nodes from the controller
+// database on the live Dqlite cluster, without starting the local node.
+func (m *NodeManager) ClusterControllerNodes(ctx context.Context) ([]ControllerNode, error) {
+	db, err := m.OpenClusterDB(controllerDBName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer db.Close()
+	return controllerNodes(ctx, db)
+}
+
+// controllerNodes reads the controller nodes from the controller database.
+func controllerNodes(ctx context.Context, db *sql.DB) ([]ControllerNode, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT controller_id, dqlite_node_id, bind_address
+FROM   controller_node`)
+	if err != nil {
+		return nil, errors.Annotate(err, "querying controller nodes")
+	}
+	defer rows.Close()
+
+	var nodes []ControllerNode
+	for rows.Next() {
+		var (
+			node         ControllerNode
+			nodeID, addr sql.NullString
+		)
+		if err := rows.Scan(&node.ControllerID, &nodeID, &addr); err != nil {
+			return nil, errors.Annotate(err, "reading controller node")
+		}
+		if nodeID.Valid && nodeID.String != "" {
+			if node.DqliteNodeID, err = strconv.ParseUint(nodeID.String, 10, 64); err != nil {
+				return nil, errors.Annotatef(err, "parsing dqlite node id for controller %q", node.ControllerID)
+			}
+		}
+		node.BindAddress = addr.String
+		nodes = append(nodes, node)
+	}
+	return nodes, errors.Annotate(rows.Err(), "reading controller nodes")
+}
+
+// CompareMembership compares Juju's view of the cluster, from the
+// controller_node table, against the Dqlite cluster membership from
+// cluster.yaml. A description of each disagreement is returned.
+func CompareMembership(nodes []ControllerNode, servers []dqlite.NodeInfo) []string {
+	byID := make(map[uint64]dqlite.NodeInfo, len(servers))
+	for _, server := range servers {
+		byID[server.ID] = server
+	}
+
+	var problems []string
+	seen := make(map[uint64]bool, len(nodes))
+	for _, node := range nodes {
+		if node.DqliteNodeID == 0 {
+			problems = append(problems, fmt.Sprintf("controller %q has no dqlite node id", node.ControllerID))
+			continue
+		}
+		seen[node.DqliteNodeID] = true
+
+		server, ok := byID[node.DqliteNodeID]
+		if !ok {
+			problems = append(problems, fmt.Sprintf(
+				"controller %q references dqlite node %d, which is not in cluster.yaml",
+				node.ControllerID, node.DqliteNodeID))
+			continue
+		}
+		host, _, err := net.SplitHostPort(server.Address)
+		if err != nil {
+			host = server.Address
+		}
+		if node.BindAddress != "" && node.BindAddress != host {
+			problems = append(problems, fmt.Sprintf(
+				"controller %q has bind address %q, but dqlite node %d has address %q",
+				node.ControllerID, node.BindAddress, node.DqliteNodeID, server.Address))
+		}
+	}
+	for _, server := range servers {
+		if !seen[server.ID] {
+			problems = append(problems, fmt.Sprintf(
+				"dqlite node %d (%s) in cluster.yaml is not referenced by any controller",
+				server.ID, server.Address))
+		}
+	}
+	return problems
+}
+
+// OpenClusterDB opens the named database on the live Dqlite cluster, without
+// starting the local node. Connections are made to the cluster leader, which
+// is located using the nodes in cluster.yaml.
+func (m *NodeManager) OpenClusterDB(name string) (*sql.DB, error) {
+	store, err := m.nodeClusterStore()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dial, err := m.dialFunc()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	db, err := driver.Open(store, dial, name)
+	return db, errors.Annotatef(err, "opening %q database on Dqlite cluster", name)
+}
+
+// ControllerSpaceSubnets returns the subnets of the juju-ha-space and
+// juju-mgmt-space spaces, if they are set in the controller config. The
+// controller config and the controller model are read from the live cluster,
+// so this requires the cluster to have a quorum.
+func (m *NodeManager) ControllerSpaceSubnets(ctx context.Context) ([]*net.IPNet, error) {
+	controllerDB, err := m.OpenClusterDB(controllerDBName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer controllerDB.Close()
+
+	rows, err := controllerDB.QueryContext(ctx, `
+SELECT value
+FROM   controller_config
+WHERE  key IN ('juju-ha-space', 'juju-mgmt-space')`)
+	if err != nil {
+		return nil, errors.Annotate(err, "querying controller config")
+	}
+	var spaces []string
+	for rows.Next() {
+		var space string
+		if err := rows.Scan(&space); err != nil {
+			rows.Close()
+			return nil, errors.Annotate(err, "reading controller config")
+		}
+		if space != "" {
+			spaces = append(spaces, space)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, errors.Annotate(err, "reading controller config")
+	}
+	if len(spaces) == 0 {
+		return nil, nil
+	}
+
+	// Spaces belong to the controller model, which has its own database.
+	modelDB, err := m.OpenClusterDB(m.cfg.Model().Id())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer modelDB.Close()
+
+	var subnets []*net.IPNet
+	for _, space := range spaces {
+		rows, err := modelDB.QueryContext(ctx, `
+SELECT s.cidr
+FROM   subnet AS s
+JOIN   space AS sp ON s.space_uuid = sp.uuid
+WHERE  sp.name = ?`, space)
+		if err != nil {
+			return nil, errors.Annotatef(err, "querying subnets for space %q", space)
+		}
+		for rows.Next() {
+			var cidr string
+			if err := rows.Scan(&cidr); err != nil {
+				rows.Close()
+				return nil, errors.Annotatef(err, "reading subnets for space %q", space)
+			}
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				m.logger.Warningf("ignoring invalid subnet %q in space %q", cidr, space)
+				continue
+			}
+			subnets = append(subnets, subnet)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, errors.Annotatef(err, "reading subnets for space %q", space)
+		}
+	}
+	return subnets, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"os"
+
+	"github.com/juju/errors"
+)
+
+// ReadControllerUUID returns the UUID of the controller recorded in the
+// controller database file at the path. A database that records none, such
+// as that of a Juju version without the controller table, is NotFound.
+func ReadControllerUUID(ctx context.Context, path string) (string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", errors.Trace(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return "", errors.Annotatef(err, "opening %q", path)
+	}
+	defer db.Close()
+
+	var tables int
+	err = db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'controller'").Scan(&tables)
+	if err != nil {
+		return "", errors.Annotatef(err, "reading schema of %q", path)
+	}
+	if tables == 0 {
+		return "", errors.NotFoundf("controller table in %q", path)
+	}
+
+	var uuid string
+	err = db.QueryRowContext(ctx, "SELECT uuid FROM controller LIMIT 1").Scan(&uuid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errors.NotFoundf("controller UUID in %q", path)
+	}
+	return uuid, errors.Annotatef(err, "reading controller UUID from %q", path)
+}
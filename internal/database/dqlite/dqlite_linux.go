@@ -5,13 +5,28 @@
 
 package dqlite
 
-import "github.com/canonical/go-dqlite"
+import (
+	"os"
+
+	"github.com/canonical/go-dqlite"
+	"github.com/canonical/go-dqlite/client"
+)
 
 const (
 	// Enabled is true if dqlite is enabled.
 	Enabled = true
 )
 
+// NodeRole identifies the role of a node.
+type NodeRole = client.NodeRole
+
+// Node roles.
+const (
+	Voter   = client.Voter
+	StandBy = client.StandBy
+	Spare   = client.Spare
+)
+
 // NodeInfo holds information about a single server.
 type NodeInfo = dqlite.NodeInfo
 
@@ -23,3 +38,16 @@ type NodeInfo = dqlite.NodeInfo
 func ReconfigureMembership(dir string, cluster []NodeInfo) error {
 	return dqlite.ReconfigureMembership(dir, cluster)
 }
+
+// GenerateID generates a unique ID for a new node, based on its address and
+// the current time.
+func GenerateID(address string) uint64 {
+	return dqlite.GenerateID(address)
+}
+
+// EnableTracing makes the Dqlite and Raft C libraries trace what they do,
+// including reconfiguring the membership, to stderr.
+func EnableTracing() {
+	_ = os.Setenv("LIBDQLITE_TRACE", "1")
+	_ = os.Setenv("LIBRAFT_TRACE", "1")
+}
@@ -5,6 +5,11 @@
 
 package dqlite
 
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
 const (
 	// Enabled is false if dqlite is disabled.
 	Enabled = false
@@ -12,8 +17,24 @@ const (
 
 type NodeRole int
 
-func (NodeRole) String() string {
-	return ""
+// Node roles.
+const (
+	Voter NodeRole = iota
+	StandBy
+	Spare
+)
+
+func (r NodeRole) String() string {
+	switch r {
+	case Voter:
+		return "voter"
+	case StandBy:
+		return "stand-by"
+	case Spare:
+		return "spare"
+	default:
+		return "unknown role"
+	}
 }
 
 type NodeInfo struct {
@@ -25,3 +46,17 @@ type NodeInfo struct {
 func ReconfigureMembership(string, []NodeInfo) error {
 	return nil
 }
+
+func EnableTracing() {}
+
+// CaptureTraces does nothing, as there are no C libraries to trace.
+func CaptureTraces(func(library, line string)) (func(), error) {
+	return func() {}, nil
+}
+
+// GenerateID generates a unique ID for a new node.
+func GenerateID(string) uint64 {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:]) >> 1
+}
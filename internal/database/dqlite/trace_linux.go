@@ -0,0 +1,161 @@
+//go:build dqlite && linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package dqlite
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+// traceLibraries are the prefixes of the lines traced by the C libraries,
+// by library.
+var traceLibraries = map[string]string{
+	"LIBDQLITE": "libdqlite",
+	"LIBRAFT":   "libraft",
+}
+
+// traceBacklog bounds the number of traced lines waiting to be logged. Lines
+// traced faster than they can be logged beyond it are dropped, rather than
+// stalling the C libraries writing to stderr.
+const traceBacklog = 10000
+
+// capture is the capture of stderr in progress, shared by nested captures.
+var capture struct {
+	mu    sync.Mutex
+	depth int
+	stop  func()
+}
+
+// CaptureTraces enables tracing in the Dqlite and Raft C libraries, and
+// passes each line they trace to stderr to log as it arrives, until the
+// returned function is called. Anything else written to stderr meanwhile,
+// such as the message of a failed assertion, is passed straight through.
+// The traces are logged as they come, so that those leading up to a crash in
+// the libraries are not lost with it.
+func CaptureTraces(log func(library, line string)) (func(), error) {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if capture.depth > 0 {
+		// An enclosing capture already collects the traces.
+		capture.depth++
+		return releaseCapture, nil
+	}
+
+	saved, err := syscall.Dup(syscall.Stderr)
+	if err != nil {
+		return nil, errors.Annotate(err, "duplicating stderr")
+	}
+	stderr := os.NewFile(uintptr(saved), "stderr")
+	r, w, err := os.Pipe()
+	if err != nil {
+		_ = stderr.Close()
+		return nil, errors.Annotate(err, "creating stderr pipe")
+	}
+	if err := syscall.Dup3(int(w.Fd()), syscall.Stderr, 0); err != nil {
+		_ = stderr.Close()
+		_, _ = r.Close(), w.Close()
+		return nil, errors.Annotate(err, "redirecting stderr")
+	}
+	restoreEnv := setTraceEnv()
+
+	// The lines are logged by a goroutine of their own, as the log may be
+	// written to stderr, and so to the pipe being read.
+	var (
+		lines   = make(chan string, traceBacklog)
+		dropped int
+		done    = make(chan struct{})
+		logged  = make(chan struct{})
+	)
+	go func() {
+		defer close(logged)
+		for line := range lines {
+			log(traceLibrary(line), line)
+		}
+	}()
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if traceLibrary(line) == "" {
+				_, _ = stderr.WriteString(line + "\n")
+				continue
+			}
+			select {
+			case lines <- line:
+			default:
+				dropped++
+			}
+		}
+	}()
+
+	capture.depth = 1
+	capture.stop = func() {
+		restoreEnv()
+		_ = syscall.Dup3(saved, syscall.Stderr, 0)
+		_ = w.Close()
+		<-done
+		close(lines)
+		<-logged
+		_ = r.Close()
+		_ = stderr.Close()
+		if dropped > 0 {
+			log("", fmt.Sprintf("%d traced lines were dropped, traced faster than they could be logged", dropped))
+		}
+	}
+	return releaseCapture, nil
+}
+
+// releaseCapture ends a capture, stopping it once the outermost one ends.
+func releaseCapture() {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if capture.depth--; capture.depth == 0 {
+		capture.stop()
+		capture.stop = nil
+	}
+}
+
+// traceLibrary returns the library that traced the line, or "" if the line
+// is not a trace.
+func traceLibrary(line string) string {
+	for prefix, library := range traceLibraries {
+		if strings.HasPrefix(line, prefix) {
+			return library
+		}
+	}
+	return ""
+}
+
+// setTraceEnv enables tracing in the C libraries, returning a function that
+// restores their previous setting.
+func setTraceEnv() func() {
+	previous := make(map[string]*string)
+	for _, key := range []string{"LIBDQLITE_TRACE", "LIBRAFT_TRACE"} {
+		if value, ok := os.LookupEnv(key); ok {
+			previous[key] = &value
+		} else {
+			previous[key] = nil
+		}
+		_ = os.Setenv(key, "1")
+	}
+	return func() {
+		for key, value := range previous {
+			if value == nil {
+				_ = os.Unsetenv(key)
+				continue
+			}
+			_ = os.Setenv(key, *value)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build dqlite && linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package driver
+
+import (
+	"database/sql"
+
+	"github.com/canonical/go-dqlite/driver"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/client"
+)
+
+// Open returns a handle to the named database on a live Dqlite cluster.
+// Connections are made to the cluster leader, which is located using the
+// nodes in the given store.
+func Open(store client.NodeStore, dial client.DialFunc, name string) (*sql.DB, error) {
+	drv, err := driver.New(store, driver.WithDialFunc(dial), driver.WithLogFunc(client.Log))
+	if err != nil {
+		return nil, err
+	}
+	connector, err := drv.OpenConnector(name)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
@@ -0,0 +1,21 @@
+//go:build !dqlite
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package driver
+
+import (
+	"database/sql"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/client"
+)
+
+// Open returns a handle to the named database on a live Dqlite cluster.
+// Connections are made to the cluster leader, which is located using the
+// nodes in the given store.
+func Open(client.NodeStore, client.DialFunc, string) (*sql.DB, error) {
+	return nil, errors.NotSupportedf("connecting to a live Dqlite cluster without Dqlite support")
+}
@@ -0,0 +1,249 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	// The dumped databases are plain SQLite files. Dqlite builds link the
+	// system SQLite library through the libsqlite3 build tag.
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+)
+
+// TableHash is a logical hash of the content of a table. It does not depend
+// on the order rows are stored in, so two copies of the same data hash the
+// same regardless of their page layout.
+type TableHash struct {
+	Schema string
+	Rows   int
+	Sum    string
+}
+
+// DatabaseHash holds the hash of each table in a database.
+type DatabaseHash struct {
+	Tables map[string]TableHash
+}
+
+// Sum returns a hash over all of the tables in the database.
+func (h DatabaseHash) Sum() string {
+	names := make([]string, 0, len(h.Tables))
+	for name := range h.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sum := sha256.New()
+	for _, name := range names {
+		table := h.Tables[name]
+		fmt.Fprintf(sum, "%s\x00%s\x00%s\x00", name, table.Schema, table.Sum)
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// DumpDatabase connects to the running Dqlite node at the address and dumps
+// its copy of the named database into dir, returning the path of the main
+// database file. The write-ahead log is written alongside it, so that SQLite
+// applies it when the file is opened.
+func (m *NodeManager) DumpDatabase(ctx context.Context, address, name, dir string) (string, error) {
+	dial, err := m.dialFunc()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	c, err := m.connect(ctx, address, dial)
+	if err != nil {
+		return "", failure.Wrap(failure.NodeUnreachable, errors.Annotatef(err, "connecting to %s", address))
+	}
+	defer func() { _ = c.Close() }()
+
+	files, err := c.Dump(ctx, name)
+	if err != nil {
+		return "", errors.Annotatef(err, "dumping %q database from %s", name, address)
+	}
+	for _, file := range files {
+		if file.Name != filepath.Base(file.Name) {
+			return "", errors.NotValidf("dumped file name %q", file.Name)
+		}
+		if err := os.WriteFile(filepath.Join(dir, file.Name), file.Data, 0600); err != nil {
+			return "", errors.Annotatef(err, "writing dumped file %q", file.Name)
+		}
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// HashDatabaseFile computes the logical hash of each table in the SQLite
+// database file at the path. The file is only read.
+func HashDatabaseFile(ctx context.Context, path string) (DatabaseHash, error) {
+	if _, err := os.Stat(path); err != nil {
+		return DatabaseHash{}, errors.Trace(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return DatabaseHash{}, errors.Annotatef(err, "opening %q", path)
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, `
+SELECT name, sql
+FROM   sqlite_master
+WHERE  type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return DatabaseHash{}, errors.Annotatef(err, "listing tables in %q", path)
+	}
+	schemas := make(map[string]string)
+	for rows.Next() {
+		var name, schema string
+		if err := rows.Scan(&name, &schema); err != nil {
+			rows.Close()
+			return DatabaseHash{}, errors.Annotatef(err, "listing tables in %q", path)
+		}
+		schemas[name] = schema
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return DatabaseHash{}, errors.Annotatef(err, "listing tables in %q", path)
+	}
+
+	hash := DatabaseHash{Tables: make(map[string]TableHash, len(schemas))}
+	for name, schema := range schemas {
+		table, err := hashTable(ctx, db, name)
+		if err != nil {
+			return DatabaseHash{}, errors.Annotatef(err, "hashing table %q in %q", name, path)
+		}
+		table.Schema = schema
+		hash.Tables[name] = table
+	}
+	return hash, nil
+}
+
+// hashTable hashes each row of the table, then hashes the sorted row hashes.
+func hashTable(ctx context.Context, db *sql.DB, name string) (TableHash, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM "%s"`, strings.ReplaceAll(name, `"`, `""`)))
+	if err != nil {
+		return TableHash{}, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return TableHash{}, errors.Trace(err)
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	var sums [][]byte
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return TableHash{}, errors.Trace(err)
+		}
+		row := sha256.New()
+		for _, value := range values {
+			writeValue(row, value)
+		}
+		sums = append(sums, row.Sum(nil))
+	}
+	if err := rows.Err(); err != nil {
+		return TableHash{}, errors.Trace(err)
+	}
+
+	sort.Slice(sums, func(i, j int) bool {
+		return bytes.Compare(sums[i], sums[j]) < 0
+	})
+	table := sha256.New()
+	for _, sum := range sums {
+		table.Write(sum)
+	}
+	return TableHash{
+		Rows: len(sums),
+		Sum:  hex.EncodeToString(table.Sum(nil)),
+	}, nil
+}
+
+// writeValue writes a column value to the hash, tagged with its type so that
+// for example the integer 1 and the text "1" hash differently.
+func writeValue(h interface{ Write([]byte) (int, error) }, value interface{}) {
+	var buf [8]byte
+	switch v := value.(type) {
+	case nil:
+		h.Write([]byte{'n'})
+	case int64:
+		binary.LittleEndian.PutUint64(buf[:], uint64(v))
+		h.Write([]byte{'i'})
+		h.Write(buf[:])
+	case float64:
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+		h.Write([]byte{'f'})
+		h.Write(buf[:])
+	case bool:
+		h.Write([]byte{'i'})
+		if v {
+			buf[0] = 1
+		}
+		h.Write(buf[:])
+	case []byte:
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(v)))
+		h.Write([]byte{'b'})
+		h.Write(buf[:])
+		h.Write(v)
+	default:
+		s := fmt.Sprint(v)
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(s)))
+		h.Write([]byte{'t'})
+		h.Write(buf[:])
+		h.Write([]byte(s))
+	}
+}
+
+// CompareHashes describes each table that differs between the two database
+// hashes, named a and b.
+func CompareHashes(a, b DatabaseHash, nameA, nameB string) []string {
+	names := make(map[string]bool)
+	for name := range a.Tables {
+		names[name] = true
+	}
+	for name := range b.Tables {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var differences []string
+	for _, name := range sorted {
+		ta, inA := a.Tables[name]
+		tb, inB := b.Tables[name]
+		switch {
+		case !inB:
+			differences = append(differences, fmt.Sprintf("table %q is only on %s", name, nameA))
+		case !inA:
+			differences = append(differences, fmt.Sprintf("table %q is only on %s", name, nameB))
+		case ta.Schema != tb.Schema:
+			differences = append(differences, fmt.Sprintf("table %q has a different schema", name))
+		case ta.Rows != tb.Rows:
+			differences = append(differences, fmt.Sprintf(
+				"table %q has %d rows on %s and %d rows on %s", name, ta.Rows, nameA, tb.Rows, nameB))
+		case ta.Sum != tb.Sum:
+			differences = append(differences, fmt.Sprintf("table %q has different content", name))
+		}
+	}
+	return differences
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+)
+
+// Health is the state of the running cluster, as seen from a node.
+type Health struct {
+	Leader  dqlite.NodeInfo
+	Members []dqlite.NodeInfo
+}
+
+// CheckHealth connects to the running Dqlite node and checks that it is a
+// member of a cluster with an elected leader, and that the leader answers.
+// The error describes the first check that failed.
+func (m *NodeManager) CheckHealth(ctx context.Context, node dqlite.NodeInfo) (Health, error) {
+	dial, err := m.dialFunc()
+	if err != nil {
+		return Health{}, errors.Trace(err)
+	}
+	c, err := m.connect(ctx, node.Address, dial)
+	if err != nil {
+		return Health{}, failure.Wrap(failure.NodeUnreachable, errors.Annotatef(err, "node %d at %s is not answering", node.ID, node.Address))
+	}
+	defer func() { _ = c.Close() }()
+
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		return Health{}, errors.Annotatef(err, "node %d cannot retrieve the leader", node.ID)
+	}
+	if leader == nil || leader.ID == 0 {
+		return Health{}, errors.Errorf("node %d does not know of an elected leader", node.ID)
+	}
+	members, err := c.Cluster(ctx)
+	if err != nil {
+		return Health{}, errors.Annotatef(err, "node %d cannot retrieve the cluster", node.ID)
+	}
+	health := Health{Leader: *leader, Members: members}
+
+	var member bool
+	for _, server := range members {
+		member = member || server.ID == node.ID
+	}
+	if !member {
+		return health, errors.Errorf("node %d is not a member of the cluster led by node %d", node.ID, leader.ID)
+	}
+	if leader.ID == node.ID {
+		return health, nil
+	}
+
+	lc, err := m.connect(ctx, leader.Address, dial)
+	if err != nil {
+		return health, failure.Wrap(failure.NodeUnreachable, errors.Annotatef(err, "leader %d at %s is not answering", leader.ID, leader.Address))
+	}
+	defer func() { _ = lc.Close() }()
+
+	current, err := lc.Leader(ctx)
+	if err != nil {
+		return health, errors.Annotatef(err, "leader %d cannot retrieve the leader", leader.ID)
+	}
+	if current == nil || current.ID != leader.ID {
+		return health, errors.Errorf("node %d no longer considers itself the leader", leader.ID)
+	}
+	return health, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// CheckDatabaseFile runs SQLite's integrity check against the database file
+// at the path, along with any WAL alongside it. The file should be a copy, as
+// reading the WAL may write to it.
+func CheckDatabaseFile(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return errors.Trace(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		return errors.Annotatef(err, "opening %q", path)
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return errors.Annotatef(err, "checking %q", path)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return errors.Annotatef(err, "checking %q", path)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Annotatef(err, "checking %q", path)
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"context"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/client"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/retry"
+)
+
+// LiveClusterServers connects to the running Dqlite node at the address and
+// returns the cluster membership it reports.
+func (m *NodeManager) LiveClusterServers(ctx context.Context, address string) ([]dqlite.NodeInfo, error) {
+	dial, err := m.dialFunc()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c, err := m.connect(ctx, address, dial)
+	if err != nil {
+		return nil, failure.Wrap(failure.NodeUnreachable, errors.Annotatef(err, "connecting to %s", address))
+	}
+	defer func() { _ = c.Close() }()
+
+	servers, err := c.Cluster(ctx)
+	return servers, errors.Annotatef(err, "retrieving cluster from %s", address)
+}
+
+// connect returns a client connected to the running Dqlite node at the
+// address, retrying transient failures.
+func (m *NodeManager) connect(ctx context.Context, address string, dial client.DialFunc) (*client.Client, error) {
+	var c *client.Client
+	err := m.retry.Do(ctx, "connecting to "+address, func(ctx context.Context) error {
+		var err error
+		c, err = client.New(ctx, address, dial)
+		return err
+	})
+	return c, err
+}
+
+// leaderClient returns a client connected to the leader of the running
+// cluster, found using the nodes in cluster.yaml.
+func (m *NodeManager) leaderClient(ctx context.Context) (*client.Client, error) {
+	dial, err := m.dialFunc()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	store, err := m.nodeClusterStore()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var c *client.Client
+	err = m.retry.Do(ctx, "finding cluster leader", func(ctx context.Context) error {
+		// A leader still being elected is not told apart from other
+		// failures, so every failure is retried.
+		c, err = client.FindLeader(ctx, store, dial)
+		return retry.MarkTransient(err)
+	})
+	return c, failure.Wrap(failure.NodeUnreachable, errors.Annotate(err, "finding cluster leader"))
+}
+
+// TransferLeadership moves leadership of the running cluster to the node at
+// the address, returning the previous and new leaders.
+func (m *NodeManager) TransferLeadership(ctx context.Context, address string) (dqlite.NodeInfo, dqlite.NodeInfo, error) {
+	c, err := m.leaderClient(ctx)
+	if err != nil {
+		return dqlite.NodeInfo{}, dqlite.NodeInfo{}, errors.Trace(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	leader, err := c.Leader(ctx)
+	if err != nil || leader == nil {
+		return dqlite.NodeInfo{}, dqlite.NodeInfo{}, errors.Annotate(err, "retrieving cluster leader")
+	}
+	servers, err := c.Cluster(ctx)
+	if err != nil {
+		return *leader, dqlite.NodeInfo{}, errors.Annotate(err, "retrieving cluster")
+	}
+
+	var target *dqlite.NodeInfo
+	for i, server := range servers {
+		if strings.EqualFold(server.Address, address) {
+			target = &servers[i]
+		}
+	}
+	switch {
+	case target == nil:
+		return *leader, dqlite.NodeInfo{}, errors.NotFoundf("node with address %s", address)
+	case target.ID == leader.ID:
+		return *leader, *target, errors.AlreadyExistsf("leadership on node %d", target.ID)
+	case target.Role != dqlite.Voter:
+		return *leader, *target, errors.NotValidf("transfer to %s node %d", target.Role, target.ID)
+	}
+
+	err = m.step("transfer leadership", target, func() error {
+		m.logger.Debugf("transferring leadership from node %d to node %d", leader.ID, target.ID)
+		return c.Transfer(ctx, target.ID)
+	})
+	return *leader, *target, errors.Annotatef(err, "transferring leadership to node %d", target.ID)
+}
+
+// DrainNode prepares the node at the address to be taken down, by moving
+// leadership to another voter if it is the leader, and demoting it to a
+// spare. It returns the drained node and the leader if it was moved.
+func (m *NodeManager) DrainNode(ctx context.Context, address string) (dqlite.NodeInfo, *dqlite.NodeInfo, error) {
+	c, err := m.leaderClient(ctx)
+	if err != nil {
+		return dqlite.NodeInfo{}, nil, errors.Trace(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	leader, err := c.Leader(ctx)
+	if err != nil || leader == nil {
+		return dqlite.NodeInfo{}, nil, errors.Annotate(err, "retrieving cluster leader")
+	}
+	servers, err := c.Cluster(ctx)
+	if err != nil {
+		return dqlite.NodeInfo{}, nil, errors.Annotate(err, "retrieving cluster")
+	}
+
+	var (
+		node      *dqlite.NodeInfo
+		successor *dqlite.NodeInfo
+	)
+	for i, server := range servers {
+		switch {
+		case strings.EqualFold(server.Address, address):
+			node = &servers[i]
+		case server.Role == dqlite.Voter && successor == nil:
+			successor = &servers[i]
+		}
+	}
+	if node == nil {
+		return dqlite.NodeInfo{}, nil, errors.NotFoundf("node with address %s", address)
+	}
+
+	var moved *dqlite.NodeInfo
+	if node.ID == leader.ID {
+		if successor == nil {
+			return *node, nil, errors.Errorf("node %d is the only voter, leadership cannot be moved", node.ID)
+		}
+		err := m.step("transfer leadership", successor, func() error {
+			m.logger.Debugf("transferring leadership from node %d to node %d", node.ID, successor.ID)
+			return c.Transfer(ctx, successor.ID)
+		})
+		if err != nil {
+			return *node, nil, errors.Annotatef(err, "transferring leadership to node %d", successor.ID)
+		}
+		moved = successor
+
+		// Role changes must be made on the leader, which has now moved. The
+		// client is only replaced once there is a new one, so that the
+		// deferred close has one to close.
+		next, err := m.leaderClient(ctx)
+		if err != nil {
+			return *node, moved, errors.Trace(err)
+		}
+		_ = c.Close()
+		c = next
+	}
+
+	if node.Role != dqlite.Spare {
+		err := m.step("demote node", node, func() error {
+			m.logger.Debugf("demoting node %d from %s to spare", node.ID, node.Role)
+			return c.Assign(ctx, node.ID, dqlite.Spare)
+		})
+		if err != nil {
+			return *node, moved, errors.Annotatef(err, "demoting node %d to spare", node.ID)
+		}
+	}
+	return *node, moved, nil
+}
+
+// AddNode registers the node with the running cluster as a spare, then tries
+// to promote it to a voter. Promotion only succeeds once the node is online
+// and has caught up with the leader.
+func (m *NodeManager) AddNode(ctx context.Context, node dqlite.NodeInfo) (bool, error) {
+	c, err := m.leaderClient(ctx)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	spare := node
+	spare.Role = dqlite.Spare
+	err = m.step("add node", spare, func() error {
+		m.logger.Debugf("adding node %d at %s as a spare", node.ID, node.Address)
+		return c.Add(ctx, spare)
+	})
+	if err != nil {
+		return false, errors.Annotatef(err, "adding node %d", node.ID)
+	}
+	if node.Role == dqlite.Spare {
+		return true, nil
+	}
+	err = m.step("promote node", node, func() error {
+		m.logger.Debugf("promoting node %d to %s", node.ID, node.Role)
+		return c.Assign(ctx, node.ID, node.Role)
+	})
+	if err != nil {
+		m.logger.Warningf("unable to assign %s role to node %d: %v", node.Role, node.ID, err)
+		return false, nil
+	}
+	return true, nil
+}
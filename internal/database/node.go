@@ -19,9 +19,16 @@ import (
 	"gopkg.in/yaml.v3"
 
 	"github.com/SimonRichardson/juju-dqlite-backstop/internal/agent"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/cert"
 	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/app"
 	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/client"
 	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/fips"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/fs"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/journal"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/retry"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/safeyaml"
 )
 
 const (
@@ -38,6 +45,11 @@ type NodeManager struct {
 	cfg    agent.Config
 	port   int
 	logger Logger
+	retry  retry.Strategy
+
+	// clientCert, if set, is used in place of the controller certificate
+	// for connections to the live cluster.
+	clientCert *tls.Certificate
 
 	dataDir string
 }
@@ -49,9 +61,29 @@ func NewNodeManager(cfg agent.Config, logger Logger) *NodeManager {
 		cfg:    cfg,
 		port:   dqlitePort,
 		logger: logger,
+		retry:  retry.Default,
 	}
 }
 
+// SetRetryStrategy sets how reads of the node's stores, and connections to
+// the running cluster, are retried when they fail transiently.
+func (m *NodeManager) SetRetryStrategy(strategy retry.Strategy) {
+	m.retry = strategy
+}
+
+// SetClientCert sets the certificate and key used in place of the controller
+// certificate for connections to the live cluster, so that a machine without
+// the controller's serving info can connect using exported certificates. It
+// is not used to start the local node.
+func (m *NodeManager) SetClientCert(certPEM, keyPEM string) error {
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return errors.Annotate(err, "parsing client certificate")
+	}
+	m.clientCert = &cert
+	return nil
+}
+
 // IsBootstrappedNode returns true if this machine or container was where we
 // first bootstrapped Dqlite, and it hasn't been reconfigured since.
 // Specifically, whether we are a cluster of one, and bound to the loopback
@@ -102,14 +134,28 @@ func (m *NodeManager) IsExistingNode() (bool, error) {
 }
 
 // EnsureDataDir ensures that a directory for Dqlite data exists at
-// a path determined by the agent config, then returns that path.
+// a path determined by the agent config, then returns that path with any
+// symlinks resolved, so that the directory itself, rather than a link to
+// it, is archived and replaced. A link to a directory that does not exist is
+// refused, rather than the directory created where the volume should be.
 func (m *NodeManager) EnsureDataDir() (string, error) {
 	if m.dataDir == "" {
 		dir := filepath.Join(m.cfg.DataDir(), dqliteDataDir)
+		if link, target, ok := fs.DanglingSymlink(dir); ok {
+			return "", failure.Wrap(failure.DataDirUnusable, errors.Errorf(
+				"%s is a symlink to %s, which does not exist: is its volume mounted?", link, target))
+		}
 		if err := os.MkdirAll(dir, 0700); err != nil {
-			return "", errors.Annotatef(err, "creating directory for Dqlite data")
+			return "", failure.Wrap(failure.DataDirUnusable, errors.Annotatef(err, "creating directory for Dqlite data"))
+		}
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return "", failure.Wrap(failure.DataDirUnusable, errors.Annotatef(err, "resolving Dqlite data directory"))
 		}
-		m.dataDir = dir
+		if resolved != dir {
+			m.logger.Debugf("Dqlite data directory %s resolves to %s", dir, resolved)
+		}
+		m.dataDir = resolved
 	}
 	return m.dataDir, nil
 }
@@ -121,35 +167,48 @@ func (m *NodeManager) ClusterServers(ctx context.Context) ([]dqlite.NodeInfo, er
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	servers, err := store.Get(ctx)
-	return servers, errors.Annotate(err, "retrieving servers from Dqlite node store")
+	var servers []dqlite.NodeInfo
+	err = m.retry.Do(ctx, "reading cluster.yaml", func(ctx context.Context) error {
+		servers, err = store.Get(ctx)
+		return err
+	})
+	return servers, failure.Wrap(failure.StoreUnreadable, errors.Annotate(err, "retrieving servers from Dqlite node store"))
 }
 
 // SetClusterServers reconfigures the Dqlite cluster by writing the
 // input servers to Dqlite's Raft log and the local node YAML store.
 // This should only be called on a stopped Dqlite node.
 func (m *NodeManager) SetClusterServers(ctx context.Context, servers []dqlite.NodeInfo) error {
-	store, err := m.nodeClusterStore()
-	if err != nil {
+	if _, err := m.nodeClusterStore(); err != nil {
 		return errors.Trace(err)
 	}
-
-	if err := dqlite.ReconfigureMembership(m.dataDir, servers); err != nil {
-		return errors.Annotate(err, "reconfiguring Dqlite cluster membership")
+	if err := m.ReconfigureMembership(servers); err != nil {
+		return errors.Trace(err)
 	}
+	return errors.Trace(m.WriteClusterServers(ctx, servers))
+}
 
-	return errors.Annotate(store.Set(ctx, servers), "writing servers to Dqlite node store")
+// ReconfigureMembership writes the input servers to Dqlite's Raft log only,
+// leaving the local node YAML store untouched.
+// This should only be called on a stopped Dqlite node.
+func (m *NodeManager) ReconfigureMembership(servers []dqlite.NodeInfo) error {
+	return m.step("reconfigure membership", servers, func() error {
+		defer m.captureTraces("reconfigure membership")()
+		m.logger.Debugf("appending membership %v to the raft log in %s", servers, m.dataDir)
+		return failure.Wrap(failure.MembershipWriteFailed, errors.Annotatef(dqlite.ReconfigureMembership(m.dataDir, servers),
+			"reconfiguring Dqlite cluster membership in %s to %v", m.dataDir, servers))
+	})
 }
 
 // NodeInfo returns the node information for the local Dqlite node.
 func (m *NodeManager) NodeInfo() (dqlite.NodeInfo, error) {
 	name := path.Join(m.dataDir, "info.yaml")
-	data, err := os.ReadFile(name)
+	data, err := safeyaml.ReadFile(name)
 	if err != nil {
 		return dqlite.NodeInfo{}, errors.Annotatef(err, "reading %s", name)
 	}
 	var nodeInfo dqlite.NodeInfo
-	err = yaml.Unmarshal(data, &nodeInfo)
+	err = safeyaml.Unmarshal(data, &nodeInfo)
 	return nodeInfo, errors.Annotatef(err, "unmarshalling %s", name)
 }
 
@@ -161,8 +220,75 @@ func (m *NodeManager) SetNodeInfo(server dqlite.NodeInfo) error {
 	if err != nil {
 		return errors.Annotatef(err, "marshalling NodeInfo %#v", server)
 	}
-	return errors.Annotatef(
-		os.WriteFile(path.Join(m.dataDir, "info.yaml"), data, 0600), "writing info.yaml to %s", m.dataDir)
+	return m.step("write info.yaml", server, func() error {
+		return errors.Annotatef(
+			os.WriteFile(path.Join(m.dataDir, "info.yaml"), data, 0600), "writing info.yaml to %s", m.dataDir)
+	})
+}
+
+// WriteClusterServers writes the servers to the local node YAML store only,
+// leaving the Raft log untouched. It is used to point a node with no data at
+// an existing cluster.
+func (m *NodeManager) WriteClusterServers(ctx context.Context, servers []dqlite.NodeInfo) error {
+	store, err := m.nodeClusterStore()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return m.step("write cluster.yaml", servers, func() error {
+		return failure.Wrap(failure.MembershipWriteFailed, errors.Annotate(store.Set(ctx, servers), "writing servers to Dqlite node store"))
+	})
+}
+
+// ArchiveDataDir moves the Dqlite data directory aside and creates a new,
+// empty one in its place, returning the path of the archive. The named files
+// are moved into the new directory rather than archived, along with the
+// journal.
+// This should only be called on a stopped Dqlite node.
+func (m *NodeManager) ArchiveDataDir(suffix string, keep ...string) (string, error) {
+	dir, err := m.EnsureDataDir()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	archive := dir + "." + suffix
+	err = m.step("archive data dir", map[string]string{"archive": archive}, func() error {
+		if err := os.Rename(dir, archive); err != nil {
+			return errors.Annotatef(err, "archiving Dqlite data directory")
+		}
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return errors.Annotatef(err, "creating directory for Dqlite data")
+		}
+		for _, name := range append(keep, journal.FileName) {
+			err := os.Rename(filepath.Join(archive, name), filepath.Join(dir, name))
+			if err != nil && !os.IsNotExist(err) {
+				return errors.Annotatef(err, "restoring %s", name)
+			}
+		}
+		return nil
+	})
+	return archive, err
+}
+
+// step journals a mutating step in the Dqlite data directory, before and
+// after taking it.
+func (m *NodeManager) step(name string, params interface{}, fn func() error) error {
+	dir, err := m.EnsureDataDir()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return journal.New(dir, m.logger).Step(name, params, fn)
+}
+
+// captureTraces collects what the Dqlite C libraries trace during the
+// operation into the log, returning a function that ends the capture.
+func (m *NodeManager) captureTraces(operation string) func() {
+	stop, err := dqlite.CaptureTraces(func(library, line string) {
+		client.Trace(operation, library, line)
+	})
+	if err != nil {
+		m.logger.Warningf("unable to capture Dqlite traces: %v", err)
+		return func() {}
+	}
+	return stop
 }
 
 // WithLoopbackAddressOption returns a Dqlite application
@@ -180,33 +306,131 @@ func (m *NodeManager) WithAddressOption(ip string) app.Option {
 // WithTLSOption returns a Dqlite application Option for TLS encryption
 // of traffic between clients and clustered application nodes.
 func (m *NodeManager) WithTLSOption() (app.Option, error) {
+	listen, dial, err := m.tlsConfigs()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return app.WithTLS(listen, dial), nil
+}
+
+// tlsConfigs returns the TLS configurations for accepting and establishing
+// connections between clustered application nodes, using the controller
+// certificate from the agent config.
+func (m *NodeManager) tlsConfigs() (*tls.Config, *tls.Config, error) {
 	stateInfo, ok := m.cfg.StateServingInfo()
 	if !ok {
-		return nil, errors.NotSupportedf("Dqlite node initialisation on non-controller machine/container")
+		return nil, nil, errors.NotSupportedf("Dqlite node initialisation on non-controller machine/container")
 	}
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM([]byte(m.cfg.CACert()))
+	caCertPool, err := m.caCertPool()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
 
 	controllerCert, err := tls.X509KeyPair([]byte(stateInfo.Cert), []byte(stateInfo.PrivateKey))
 	if err != nil {
-		return nil, errors.Annotate(err, "parsing controller certificate")
+		return nil, nil, errors.Annotate(err, "parsing controller certificate")
 	}
 
-	listen := &tls.Config{
+	listen := fips.Restrict(&tls.Config{
 		ClientCAs:    caCertPool,
 		Certificates: []tls.Certificate{controllerCert},
+	})
+
+	return listen, dialTLSConfig(caCertPool, controllerCert), nil
+}
+
+// clientTLSConfig returns the TLS configuration for connecting to the Dqlite
+// nodes of the live cluster, using the client certificate if one was set,
+// and the controller certificate otherwise.
+func (m *NodeManager) clientTLSConfig() (*tls.Config, error) {
+	if m.clientCert == nil {
+		_, dial, err := m.tlsConfigs()
+		return dial, errors.Trace(err)
+	}
+	caCertPool, err := m.caCertPool()
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
+	return dialTLSConfig(caCertPool, *m.clientCert), nil
+}
+
+// caCertPool returns a pool holding the controller CA.
+func (m *NodeManager) caCertPool() (*x509.CertPool, error) {
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM([]byte(m.cfg.CACert())) {
+		return nil, errors.NotValidf("CA certificate")
+	}
+	return caCertPool, nil
+}
 
-	dial := &tls.Config{
+// dialTLSConfig returns the TLS configuration for dialling Dqlite nodes with
+// the certificate, verifying them against the CA pool.
+func dialTLSConfig(caCertPool *x509.CertPool, cert tls.Certificate) *tls.Config {
+	return fips.Restrict(&tls.Config{
 		RootCAs:      caCertPool,
-		Certificates: []tls.Certificate{controllerCert},
-		// We cannot provide a ServerName value here, so we rely on the
-		// server validating the controller's client certificate.
-		InsecureSkipVerify: true,
+		Certificates: []tls.Certificate{cert},
+		// We cannot provide a ServerName value here, as nodes are dialled
+		// by address, which controller certificates do not reliably carry.
+		// Instead of the standard verification, the server certificate is
+		// verified against the controller CA and the controller name.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeerCertificate(caCertPool),
+	})
+}
+
+// verifyPeerCertificate returns a function that verifies that the server
+// certificate chain is signed by one of the roots, and that the certificate
+// carries the fixed name Juju puts in every controller certificate.
+func verifyPeerCertificate(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no server certificate presented")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			c, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return errors.Annotate(err, "parsing server certificate")
+			}
+			certs[i] = c
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			DNSName:       cert.ControllerName,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		return errors.Annotate(err, "verifying server certificate against the controller CA")
 	}
+}
 
-	return app.WithTLS(listen, dial), nil
+// Port returns the port that Dqlite nodes listen on.
+func (m *NodeManager) Port() int {
+	return m.port
+}
+
+// ClientTLSConfig returns the TLS configuration for connecting to the Dqlite
+// nodes of the cluster, using the client certificate if one was set, and
+// the controller certificate otherwise. The server certificate is verified
+// against the controller CA.
+func (m *NodeManager) ClientTLSConfig() (*tls.Config, error) {
+	return m.clientTLSConfig()
+}
+
+// dialFunc returns a TLS dial function for connecting to the Dqlite nodes of
+// a live cluster.
+func (m *NodeManager) dialFunc() (client.DialFunc, error) {
+	dial, err := m.clientTLSConfig()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return client.DialFuncWithTLS(client.DefaultDialFunc, dial), nil
 }
 
 // WithClusterOption returns a Dqlite application Option for initialising
@@ -222,7 +446,27 @@ func (m *NodeManager) WithClusterOption(addrs []string) app.Option {
 
 // nodeClusterStore returns a YamlNodeStore instance based
 // on the cluster.yaml file in the Dqlite data directory.
+// cluster.yaml is checked first, as the store reads it whole, and a corrupt
+// or hostile file would otherwise exhaust memory or panic.
 func (m *NodeManager) nodeClusterStore() (*client.YamlNodeStore, error) {
-	store, err := client.NewYamlNodeStore(path.Join(m.dataDir, dqliteClusterFileName))
+	name := path.Join(m.dataDir, dqliteClusterFileName)
+	if err := checkClusterFile(name); err != nil {
+		return nil, failure.Wrap(failure.StoreUnreadable, errors.Annotatef(err, "checking %s", name))
+	}
+	store, err := client.NewYamlNodeStore(name)
 	return store, errors.Annotate(err, "opening Dqlite cluster node store")
 }
+
+// checkClusterFile returns an error if the cluster.yaml at the path is not a
+// list of nodes within the limits of safeyaml. A missing file is left to the
+// store.
+func checkClusterFile(name string) error {
+	data, err := safeyaml.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	var servers []dqlite.NodeInfo
+	return errors.Trace(safeyaml.Unmarshal(data, &servers))
+}
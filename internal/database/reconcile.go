@@ -0,0 +1,135 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+// ReconcileStrategy decides which nodes are kept when the copies of
+// cluster.yaml do not all contain the same nodes.
+type ReconcileStrategy string
+
+const (
+	// ReconcileUnion keeps every node found in any copy.
+	ReconcileUnion ReconcileStrategy = "union"
+	// ReconcileIntersection keeps only the nodes found in every copy.
+	ReconcileIntersection ReconcileStrategy = "intersection"
+)
+
+// NodeVariant is one version of a node, along with the hosts whose
+// cluster.yaml contains it.
+type NodeVariant struct {
+	Node  dqlite.NodeInfo
+	Hosts []string
+}
+
+// CandidateNode is a node ID found in at least one copy of cluster.yaml,
+// with each differing version of it and the hosts that do not have it.
+type CandidateNode struct {
+	ID       uint64
+	Variants []NodeVariant
+	Missing  []string
+}
+
+// CandidateNodes groups the nodes in each copy of cluster.yaml by ID, in ID
+// order.
+func CandidateNodes(copies []StoreCopy) []CandidateNode {
+	byID := make(map[uint64]*CandidateNode)
+	for _, c := range copies {
+		for _, server := range c.Servers {
+			candidate, ok := byID[server.ID]
+			if !ok {
+				candidate = &CandidateNode{ID: server.ID}
+				byID[server.ID] = candidate
+			}
+			candidate.add(server, c.Host)
+		}
+	}
+
+	candidates := make([]CandidateNode, 0, len(byID))
+	for _, candidate := range byID {
+		for _, c := range copies {
+			if !candidate.has(c.Host) {
+				candidate.Missing = append(candidate.Missing, c.Host)
+			}
+		}
+		candidates = append(candidates, *candidate)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ID < candidates[j].ID
+	})
+	return candidates
+}
+
+func (c *CandidateNode) add(node dqlite.NodeInfo, host string) {
+	for i, variant := range c.Variants {
+		if strings.EqualFold(variant.Node.Address, node.Address) && variant.Node.Role == node.Role {
+			c.Variants[i].Hosts = append(c.Variants[i].Hosts, host)
+			return
+		}
+	}
+	c.Variants = append(c.Variants, NodeVariant{Node: node, Hosts: []string{host}})
+}
+
+func (c *CandidateNode) has(host string) bool {
+	for _, variant := range c.Variants {
+		for _, h := range variant.Hosts {
+			if h == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReconcileMembership builds a single membership from the candidate nodes
+// according to the strategy. Where the copies disagree about a node's address
+// or role, choose is called to pick one of its variants.
+func ReconcileMembership(
+	candidates []CandidateNode, strategy ReconcileStrategy, choose func(CandidateNode) (NodeVariant, error),
+) ([]dqlite.NodeInfo, error) {
+	if strategy != ReconcileUnion && strategy != ReconcileIntersection {
+		return nil, errors.NotValidf("reconcile strategy %q", strategy)
+	}
+
+	var membership []dqlite.NodeInfo
+	for _, candidate := range candidates {
+		if strategy == ReconcileIntersection && len(candidate.Missing) > 0 {
+			continue
+		}
+		variant := candidate.Variants[0]
+		if len(candidate.Variants) > 1 {
+			var err error
+			if variant, err = choose(candidate); err != nil {
+				return nil, errors.Annotatef(err, "choosing node %d", candidate.ID)
+			}
+		}
+		membership = append(membership, variant.Node)
+	}
+	return membership, errors.Trace(ValidateMembership(membership))
+}
+
+// ValidateMembership checks that the membership can form a working cluster:
+// it has a voter, and no address is used by more than one node.
+func ValidateMembership(membership []dqlite.NodeInfo) error {
+	var voters int
+	for _, node := range membership {
+		if node.Role == dqlite.Voter {
+			voters++
+		}
+	}
+	if voters == 0 {
+		return errors.NotValidf("membership without a voter")
+	}
+	if conflicts := AddressConflicts(membership); len(conflicts) > 0 {
+		return errors.NotValidf("membership where %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
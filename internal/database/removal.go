@@ -0,0 +1,78 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+// Removal describes the membership of a cluster before and after a node is
+// removed from it.
+type Removal struct {
+	// Node is the node removed.
+	Node dqlite.NodeInfo
+	// Before is the membership before the node is removed, and After the
+	// remaining nodes, with their roles as they were: removing a node does
+	// not change the roles of the others.
+	Before, After []dqlite.NodeInfo
+	// Rebalanced is the remaining nodes with their roles rebalanced, as a
+	// recovery would assign them, and Promoted those of them that would
+	// become voters.
+	Rebalanced, Promoted []dqlite.NodeInfo
+}
+
+// AnalyzeRemoval returns the membership of the cluster once the node with
+// the ID is removed from the servers, and as it would be were the roles of
+// the rest then rebalanced.
+func AnalyzeRemoval(servers []dqlite.NodeInfo, id uint64) (Removal, error) {
+	r := Removal{Before: servers}
+	var found bool
+	var remaining []dqlite.NodeInfo
+	for _, server := range servers {
+		if server.ID == id {
+			r.Node, found = server, true
+			continue
+		}
+		remaining = append(remaining, server)
+	}
+	if !found {
+		return r, errors.NotFoundf("node %d in the membership", id)
+	}
+	r.After = remaining
+	r.Rebalanced = AssignRoles(remaining)
+	for i, node := range r.Rebalanced {
+		if node.Role == dqlite.Voter && remaining[i].Role != dqlite.Voter {
+			r.Promoted = append(r.Promoted, node)
+		}
+	}
+	return r, nil
+}
+
+// Voters returns the number of voters among the nodes.
+func Voters(nodes []dqlite.NodeInfo) int {
+	var voters int
+	for _, node := range nodes {
+		if node.Role == dqlite.Voter {
+			voters++
+		}
+	}
+	return voters
+}
+
+// Quorum returns the number of voters that must be up for a leader to be
+// elected, and so for the cluster to make progress.
+func Quorum(voters int) int {
+	return voters/2 + 1
+}
+
+// FaultTolerance returns the number of voters that can be lost without
+// losing quorum.
+func FaultTolerance(voters int) int {
+	if voters == 0 {
+		return 0
+	}
+	return voters - Quorum(voters)
+}
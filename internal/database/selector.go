@@ -0,0 +1,95 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+// NodeSelector matches nodes by ID, by address, or by a regular expression
+// of their address.
+type NodeSelector struct {
+	id      *uint64
+	address string
+	pattern *regexp.Regexp
+	raw     string
+}
+
+// ParseNodeSelector parses a node selector. A number selects the node with
+// that ID, a value enclosed in slashes is a regular expression matched
+// against node addresses, and anything else selects the node with that
+// address or host.
+func ParseNodeSelector(value string) (NodeSelector, error) {
+	s := NodeSelector{raw: value}
+	switch {
+	case value == "":
+		return s, errors.NotValidf("empty node selector")
+	case len(value) > 2 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/"):
+		pattern, err := regexp.Compile(value[1 : len(value)-1])
+		if err != nil {
+			return s, errors.Annotatef(err, "node selector %q", value)
+		}
+		s.pattern = pattern
+	default:
+		if id, err := strconv.ParseUint(value, 10, 64); err == nil {
+			s.id = &id
+		} else {
+			s.address = value
+		}
+	}
+	return s, nil
+}
+
+// String returns the selector as it was given.
+func (s NodeSelector) String() string {
+	return s.raw
+}
+
+// Matches reports whether the node is selected.
+func (s NodeSelector) Matches(node dqlite.NodeInfo) bool {
+	switch {
+	case s.id != nil:
+		return node.ID == *s.id
+	case s.pattern != nil:
+		return s.pattern.MatchString(node.Address)
+	}
+	if node.Address == s.address {
+		return true
+	}
+	host, _, err := net.SplitHostPort(node.Address)
+	return err == nil && host == s.address
+}
+
+// MatchNodes returns the IDs of the servers matched by any of the selectors,
+// in the order of the servers. Every selector must match at least one node,
+// so that a mistyped selector does not silently remove a node.
+func MatchNodes(servers []dqlite.NodeInfo, selectors []NodeSelector) ([]uint64, error) {
+	var ids []uint64
+	matched := make([]bool, len(selectors))
+	for _, server := range servers {
+		var selected bool
+		for i, s := range selectors {
+			if s.Matches(server) {
+				matched[i] = true
+				selected = true
+			}
+		}
+		if selected {
+			ids = append(ids, server.ID)
+		}
+	}
+	for i, ok := range matched {
+		if !ok {
+			return nil, errors.NotFoundf("node matching %q in cluster.yaml", selectors[i])
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// DumpSQL writes the schema and content of the SQLite database file at the
+// path to w as plain-text SQL, in the form of the sqlite3 shell's .dump, that
+// recreates the database when run against an empty one. Tables are written
+// in name order and rows in rowid or primary key order, so that dumps of the
+// same data are identical and can be diffed. The file is only read.
+func DumpSQL(ctx context.Context, path string, w io.Writer) error {
+	if _, err := os.Stat(path); err != nil {
+		return errors.Trace(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return errors.Annotatef(err, "opening %q", path)
+	}
+	defer db.Close()
+
+	objects, err := schemaObjects(ctx, db)
+	if err != nil {
+		return errors.Annotatef(err, "reading schema of %q", path)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "PRAGMA foreign_keys=OFF;")
+	fmt.Fprintln(bw, "BEGIN TRANSACTION;")
+	for _, object := range objects {
+		if object.typ != "table" {
+			continue
+		}
+		if object.name == "sqlite_sequence" {
+			fmt.Fprintln(bw, "DELETE FROM sqlite_sequence;")
+		} else {
+			fmt.Fprintf(bw, "%s;\n", object.sql)
+		}
+		if err := dumpRows(ctx, db, bw, object); err != nil {
+			return errors.Annotatef(err, "dumping table %q in %q", object.name, path)
+		}
+	}
+	// Indexes, triggers and views follow the data, as SQLite's own dump
+	// does, so that the rows load quickly and fire no triggers.
+	for _, object := range objects {
+		if object.typ != "table" {
+			fmt.Fprintf(bw, "%s;\n", object.sql)
+		}
+	}
+	fmt.Fprintln(bw, "COMMIT;")
+	return errors.Trace(bw.Flush())
+}
+
+// schemaObject is an entry in sqlite_master.
+type schemaObject struct {
+	typ  string
+	name string
+	sql  string
+}
+
+// schemaObjects returns the tables, then the indexes, triggers and views, of
+// the database, each in name order. Internal tables other than
+// sqlite_sequence, and the automatic indexes, which have no SQL, are left
+// out.
+func schemaObjects(ctx context.Context, db *sql.DB) ([]schemaObject, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT   type, name, sql
+FROM     sqlite_master
+WHERE    sql IS NOT NULL AND (name NOT LIKE 'sqlite_%' OR name = 'sqlite_sequence')
+ORDER BY type <> 'table', type, name`)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	var objects []schemaObject
+	for rows.Next() {
+		var object schemaObject
+		if err := rows.Scan(&object.typ, &object.name, &object.sql); err != nil {
+			return nil, errors.Trace(err)
+		}
+		objects = append(objects, object)
+	}
+	return objects, errors.Trace(rows.Err())
+}
+
+// dumpRows writes an INSERT statement for each row of the table. SQLite's
+// quote() renders each value as an SQL literal of its stored type.
+func dumpRows(ctx context.Context, db *sql.DB, w io.Writer, table schemaObject) error {
+	name := quoteIdentifier(table.name)
+	columns, err := tableColumns(ctx, db, table.name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(columns))
+	literals := make([]string, len(columns))
+	order := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
+		literals[i] = "quote(" + quoted[i] + ")"
+		order[i] = fmt.Sprint(i + 1)
+	}
+	orderBy := "rowid"
+	if strings.Contains(strings.ToUpper(table.sql), "WITHOUT ROWID") {
+		orderBy = strings.Join(order, ", ")
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT %s FROM %s ORDER BY %s`,
+		strings.Join(literals, ", "), name, orderBy))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+
+	prefix := fmt.Sprintf("INSERT INTO %s(%s) VALUES(", name, strings.Join(quoted, ","))
+	values := make([]string, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := fmt.Fprintf(w, "%s%s);\n", prefix, strings.Join(values, ",")); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(rows.Err())
+}
+
+// tableColumns returns the names of the columns of the table, in order.
+func tableColumns(ctx context.Context, db *sql.DB, table string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT name FROM pragma_table_info(%s)`, quoteLiteral(table)))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, errors.Trace(err)
+		}
+		columns = append(columns, column)
+	}
+	return columns, errors.Trace(rows.Err())
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteLiteral(value string) string {
+	return `'` + strings.ReplaceAll(value, `'`, `''`) + `'`
+}
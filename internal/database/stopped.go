@@ -0,0 +1,75 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/failure"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/fs"
+)
+
+// stoppedDialTimeout bounds how long the node's address is dialled for,
+// when it is not a local address.
+const stoppedDialTimeout = time.Second
+
+// CheckStopped checks that the local Dqlite node is not serving: that
+// nothing is bound to its address, and that no other process holds its data
+// files open. Unlike checking for the jujud service, this also catches a node
+// running in a container or under a renamed service.
+func (m *NodeManager) CheckStopped() error {
+	var problems []string
+	if info, err := m.NodeInfo(); err == nil {
+		if problem := addressInUse(info.Address); problem != "" {
+			problems = append(problems, problem)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		m.logger.Warningf("unable to read the node's address to check it is not listening: %v", err)
+	}
+
+	dir, err := m.EnsureDataDir()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	processes, err := fs.OpenedBy(dir)
+	if err != nil {
+		m.logger.Warningf("unable to check for processes using the Dqlite data: %v", err)
+	}
+	for _, p := range processes {
+		problems = append(problems, fmt.Sprintf("%s (pid %d) has files in %s open", p.Command, p.PID, dir))
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return failure.Wrap(failure.NodeRunning, errors.Errorf(
+		"the Dqlite node appears to be running: %s", strings.Join(problems, "; ")))
+}
+
+// addressInUse describes what is using the node's address, or returns "" if
+// it is free. A local address is checked by binding to it; any other, such as
+// that of a container on this machine, by dialling it.
+func addressInUse(address string) string {
+	l, err := net.Listen("tcp", address)
+	if err == nil {
+		_ = l.Close()
+		return ""
+	}
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Sprintf("something is listening on %s", address)
+	}
+	conn, err := net.DialTimeout("tcp", address, stoppedDialTimeout)
+	if err != nil {
+		return ""
+	}
+	_ = conn.Close()
+	return fmt.Sprintf("something is answering on %s", address)
+}
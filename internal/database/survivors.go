@@ -0,0 +1,123 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package database
+
+import (
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/database/dqlite"
+)
+
+// SelectNodes returns the servers with the given IDs, in the order of the
+// servers and with their IDs and roles preserved. At least one of them must
+// be a voter, otherwise the cluster could never elect a leader.
+func SelectNodes(servers []dqlite.NodeInfo, ids []uint64) ([]dqlite.NodeInfo, error) {
+	wanted := make(map[uint64]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	var (
+		selected []dqlite.NodeInfo
+		voters   int
+	)
+	for _, server := range servers {
+		if !wanted[server.ID] {
+			continue
+		}
+		delete(wanted, server.ID)
+		selected = append(selected, server)
+		if server.Role == dqlite.Voter {
+			voters++
+		}
+	}
+	for id := range wanted {
+		return nil, errors.NotFoundf("node %d in cluster.yaml", id)
+	}
+	if voters == 0 {
+		return nil, errors.NotValidf("membership without a voter")
+	}
+	return selected, nil
+}
+
+// IsMajority reports whether the selected nodes hold a majority of the voters
+// in servers, in which case the cluster keeps its quorum without them.
+func IsMajority(servers, selected []dqlite.NodeInfo) bool {
+	var total, kept int
+	for _, server := range servers {
+		if server.Role == dqlite.Voter {
+			total++
+		}
+	}
+	for _, server := range selected {
+		if server.Role == dqlite.Voter {
+			kept++
+		}
+	}
+	return kept*2 > total
+}
+
+// MaxVoters is the number of voters dqlite aims for in a cluster. Any more
+// nodes are kept as stand-bys.
+const MaxVoters = 3
+
+// ChooseNodes returns count of the servers, starting with the local node and
+// then preferring voters over stand-bys over spares, in cluster.yaml order.
+func ChooseNodes(servers []dqlite.NodeInfo, localID uint64, count int) ([]dqlite.NodeInfo, error) {
+	if count < 1 || count > len(servers) {
+		return nil, errors.NotValidf("keeping %d of %d nodes", count, len(servers))
+	}
+
+	var local []dqlite.NodeInfo
+	byRole := make(map[dqlite.NodeRole][]dqlite.NodeInfo)
+	for _, server := range servers {
+		if server.ID == localID {
+			local = append(local, server)
+			continue
+		}
+		byRole[server.Role] = append(byRole[server.Role], server)
+	}
+	if len(local) == 0 {
+		return nil, errors.NotFoundf("local node %d in cluster.yaml", localID)
+	}
+
+	chosen := local
+	for _, role := range []dqlite.NodeRole{dqlite.Voter, dqlite.StandBy, dqlite.Spare} {
+		chosen = append(chosen, byRole[role]...)
+	}
+	return chosen[:count], nil
+}
+
+// AssignRoles returns the nodes with their roles rebalanced so that an odd
+// number of them, up to MaxVoters, are voters and the rest are stand-bys. An
+// even number of voters tolerates no more failures than one fewer, so it only
+// makes losing quorum more likely. Existing voters keep their role first.
+func AssignRoles(nodes []dqlite.NodeInfo) []dqlite.NodeInfo {
+	voters := len(nodes)
+	if voters > MaxVoters {
+		voters = MaxVoters
+	}
+	if voters%2 == 0 {
+		voters--
+	}
+
+	assigned := make([]dqlite.NodeInfo, len(nodes))
+	copy(assigned, nodes)
+
+	var promoted int
+	for _, role := range []dqlite.NodeRole{dqlite.Voter, dqlite.StandBy, dqlite.Spare} {
+		for i, node := range nodes {
+			if node.Role != role {
+				continue
+			}
+			if promoted < voters {
+				assigned[i].Role = dqlite.Voter
+				promoted++
+			} else {
+				assigned[i].Role = dqlite.StandBy
+			}
+		}
+	}
+	return assigned
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Severity is the severity of a finding.
+type Severity int
+
+const (
+	// OK reports a check that passed.
+	OK Severity = iota
+	// Warning reports something that is likely to cause a problem soon.
+	Warning
+	// Error reports something that is broken.
+	Error
+)
+
+// String returns the severity as shown in a report.
+func (s Severity) String() string {
+	switch s {
+	case OK:
+		return "ok"
+	case Warning:
+		return "WARNING"
+	case Error:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// MarshalText returns the severity in lower case, for machine readable
+// reports.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(strings.ToLower(s.String())), nil
+}
+
+// Finding is a single result of a check.
+type Finding struct {
+	Check    string   `json:"check"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// Report holds the findings of all the checks that were run.
+type Report struct {
+	Findings []Finding `json:"findings"`
+}
+
+// Add adds a finding for the check to the report.
+func (r *Report) Add(check string, severity Severity, format string, args ...interface{}) {
+	r.Findings = append(r.Findings, Finding{
+		Check:    check,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Worst returns the most severe finding in the report.
+func (r *Report) Worst() Severity {
+	worst := OK
+	for _, f := range r.Findings {
+		if f.Severity > worst {
+			worst = f.Severity
+		}
+	}
+	return worst
+}
+
+// Write writes the report in a human readable form.
+func (r *Report) Write(w io.Writer) {
+	for _, f := range r.Findings {
+		fmt.Fprintf(w, "[%s] %s: %s\n", f.Severity, f.Check, f.Message)
+	}
+}
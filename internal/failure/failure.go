@@ -0,0 +1,126 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package failure classifies the errors that stop a run into kinds, each
+// with a short hint of what the operator can do about it.
+package failure
+
+import "github.com/juju/errors"
+
+// Kind is a kind of failure.
+type Kind string
+
+// Kinds of failure.
+const (
+	// ConfigUnreadable is an agent config that cannot be read.
+	ConfigUnreadable Kind = "config-unreadable"
+	// DataDirUnusable is a Dqlite data directory that cannot be used.
+	DataDirUnusable Kind = "data-dir-unusable"
+	// StoreUnreadable is a cluster.yaml that cannot be read.
+	StoreUnreadable Kind = "store-unreadable"
+	// StoreEmpty is a cluster.yaml that lists no nodes.
+	StoreEmpty Kind = "store-empty"
+	// NodeRunning is a local machine agent that is still running.
+	NodeRunning Kind = "node-running"
+	// PeersRunning is a machine agent still running on another controller.
+	PeersRunning Kind = "peers-running"
+	// NoLeaderCandidate is a surviving node that cannot be found.
+	NoLeaderCandidate Kind = "no-leader-candidate"
+	// HeuristicUnconfirmed is a surviving node, chosen by matching
+	// addresses, that has not been confirmed.
+	HeuristicUnconfirmed Kind = "heuristic-unconfirmed"
+	// AddressConflict is a membership with nodes sharing an address.
+	AddressConflict Kind = "address-conflict"
+	// MembershipWriteFailed is a membership that could not be written to
+	// the raft log or cluster.yaml.
+	MembershipWriteFailed Kind = "membership-write-failed"
+	// BackupUnreadable is a backup that cannot be read.
+	BackupUnreadable Kind = "backup-unreadable"
+	// NodeUnreachable is a live node that cannot be connected to.
+	NodeUnreachable Kind = "node-unreachable"
+	// ControllerMismatch is Dqlite data of another controller than the
+	// agent config's.
+	ControllerMismatch Kind = "controller-mismatch"
+	// SurvivorNotVoter is a kept node that may not have all of the
+	// committed data.
+	SurvivorNotVoter Kind = "survivor-not-voter"
+	// AddressNotLocal is a local node kept at an address the machine does
+	// not have.
+	AddressNotLocal Kind = "address-not-local"
+	// StrictWarnings is a check that warned, in strict mode.
+	StrictWarnings Kind = "strict-warnings"
+	// NotInteractive is a prompt that cannot be answered, as stdin is not a
+	// terminal.
+	NotInteractive Kind = "not-interactive"
+	// HookFailed is a pre hook that failed, so the change was not made.
+	HookFailed Kind = "hook-failed"
+	// InsufficientSpace is a destination without the free space an
+	// operation needs.
+	InsufficientSpace Kind = "insufficient-space"
+	// UnsupportedVersion is a Juju version whose Dqlite layout the backstop
+	// does not understand.
+	UnsupportedVersion Kind = "unsupported-juju-version"
+)
+
+// hints are what the operator can do about each kind of failure.
+var hints = map[Kind]string{
+	ConfigUnreadable:      "check the machine tag and --path; the agent config is read from <path>/agents/<tag>/agent.conf",
+	DataDirUnusable:       "check the Dqlite data directory exists under the agent's data directory and is writable, and that the disk is not full",
+	StoreUnreadable:       "cluster.yaml is missing or corrupt; rebuild it from a healthy peer with reconcile, or restore the node from a backup",
+	StoreEmpty:            "cluster.yaml lists no nodes; rebuild it from the raft log with check-raft-membership, or from a healthy peer with reconcile",
+	NodeRunning:           "stop the machine agent with 'systemctl stop jujud-<tag>.service', or '/charm/bin/pebble stop jujud' on Kubernetes, or whatever else runs the node, before changing it",
+	PeersRunning:          "stop jujud on the other controllers, or use --ignore-running-peers if they are known to be cut off",
+	NoLeaderCandidate:     "give the nodes to keep with --survivors or --keep, or narrow the local addresses with --interface or --cidr",
+	HeuristicUnconfirmed:  "check the node chosen, then run again with --accept-heuristic, or give it with --survivors",
+	AddressConflict:       "give each node a unique address and ID, with --address-map or reip; the machine may have been cloned",
+	MembershipWriteFailed: "check the disk is writable and not full; the journal command shows how far the change got",
+	BackupUnreadable:      "check the backup's location and credentials, and that it is intact with backup verify",
+	NodeUnreachable:       "check the node is running and reachable, with probe, and that its certificates are current",
+	ControllerMismatch:    "check this is the right machine and --path; the machine may have been reused from another controller without its data being removed",
+	SurvivorNotVoter:      "keep a node that was a voter if any survived, with --survivors or --keep; otherwise check the node's data is current and use --accept-non-voter",
+	AddressNotLocal:       "configure the address on this machine first, or rewrite it with --address-map; use --allow-non-local-address if it will be configured before the agent restarts",
+	StrictWarnings:        "resolve the warnings above, or run without --strict to be asked about them instead",
+	NotInteractive:        "check what the command will do by running it on a terminal, then give --yes, and any --accept flags it asks for, to run it from a script",
+	HookFailed:            "fix the hook named above and run again; nothing was changed, but the post hooks were run",
+	InsufficientSpace:     "free space on the filesystem named, or give the command a destination on another one, such as with --output or TMPDIR",
+	UnsupportedVersion:    "the Juju versions supported are shown by --version; use a backstop built for this one, or run again with --ignore-juju-version only if its Dqlite layout is known to be unchanged",
+}
+
+// Hint returns what the operator can do about the kind of failure.
+func (k Kind) Hint() string {
+	return hints[k]
+}
+
+// Error is an error of a known kind.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error classified.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap classifies the error as the kind of failure, or returns nil if the
+// error is nil.
+func Wrap(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// KindOf returns the kind of the failure, or "" if it is not classified.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package failure
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Guidance explains a well-known failure to an operator who may not know
+// Dqlite: what it means, its likely causes, and the command to run next.
+type Guidance struct {
+	Explanation string
+	Causes      []string
+	Next        string
+	// Then is what to do with the output of the next command.
+	Then string
+}
+
+// GuidanceFor returns the guidance for the error, if it is a well-known
+// failure. Commands in the guidance use <tag> for the machine tag.
+func GuidanceFor(err error) (Guidance, bool) {
+	switch kind := KindOf(err); {
+	case kind == ConfigUnreadable && errors.Is(err, os.ErrNotExist):
+		return Guidance{
+			Explanation: "there is no agent.conf for the machine tag at the path given",
+			Causes: []string{
+				"the tag names another machine: the controller's own is the directory under <path>/agents starting with machine-",
+				"this machine is not a controller, or the agent data is not under /var/lib/juju; give its location with --path",
+				"the agent data directory is on a volume that is not mounted",
+			},
+			Next: "ls /var/lib/juju/agents",
+			Then: "run again with the controller's machine tag, and --path if the agent data is elsewhere",
+		}, true
+	case kind == StoreEmpty:
+		return Guidance{
+			Explanation: "cluster.yaml lists no nodes, so there is no membership to repair",
+			Causes: []string{
+				"the disk filled up, or the machine lost power, while cluster.yaml was being written",
+				"cluster.yaml was edited or replaced by hand",
+			},
+			Next: "juju-dqlite-backstop check-raft-membership <tag>",
+			Then: "rebuild cluster.yaml from the raft log with --rewrite cluster.yaml, or take it from a peer with reconcile",
+		}, true
+	case kind == NoLeaderCandidate:
+		return Guidance{
+			Explanation: "none of this machine's addresses match a node in cluster.yaml, so the node to keep cannot be told",
+			Causes: []string{
+				"the machine's address has changed since the cluster was formed, such as after a move or DHCP renewal",
+				"the matching address is on an interface that is excluded, such as a bridge or VPN",
+				"this machine's node was removed from the cluster",
+			},
+			Next: "juju-dqlite-backstop compare-stores <tag>",
+			Then: "give the node to keep with --survivors <id>, or its new address with --address-map",
+		}, true
+	case isTLSFailure(err):
+		return Guidance{
+			Explanation: "a TLS handshake with a Dqlite node failed, so the certificates do not match or have expired",
+			Causes: []string{
+				"the controller certificate or CA has expired, or was rotated on some controllers only",
+				"the clock on this machine or the node is wrong",
+				"the address belongs to another controller or service",
+			},
+			Next: "juju-dqlite-backstop doctor <tag>",
+			Then: "rotate the certificate with rotate-cert if it has expired, or correct the clock",
+		}, true
+	}
+	return Guidance{}, false
+}
+
+// isTLSFailure returns whether the error is from a failed TLS handshake.
+func isTLSFailure(err error) bool {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		invalidErr   x509.CertificateInvalidError
+		hostnameErr  x509.HostnameError
+		recordErr    tls.RecordHeaderError
+	)
+	switch {
+	case errors.As(err, &verifyErr), errors.As(err, &authorityErr), errors.As(err, &invalidErr),
+		errors.As(err, &hostnameErr), errors.As(err, &recordErr):
+		return true
+	}
+	// Alerts from the other side are only told apart by their message.
+	return err != nil && strings.Contains(err.Error(), "tls: ")
+}
@@ -0,0 +1,13 @@
+//go:build boringcrypto
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fips
+
+// Importing fipsonly restricts crypto/tls to FIPS-approved settings for every
+// connection, including those made by go-dqlite.
+import _ "crypto/tls/fipsonly"
+
+// Backend is true if the binary is linked against a FIPS crypto backend.
+const Backend = true
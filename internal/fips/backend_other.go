@@ -0,0 +1,9 @@
+//go:build !boringcrypto
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fips
+
+// Backend is true if the binary is linked against a FIPS crypto backend.
+const Backend = false
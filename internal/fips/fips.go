@@ -0,0 +1,39 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fips
+
+import (
+	"crypto/tls"
+	"os"
+)
+
+// EnvKey is the environment variable that enables FIPS mode at runtime, in a
+// binary that is not built against a FIPS crypto backend.
+const EnvKey = "JUJU_DQLITE_BACKSTOP_FIPS"
+
+// Enabled reports whether TLS configuration is restricted to FIPS-approved
+// algorithms. It is always the case when built against the BoringCrypto
+// backend.
+func Enabled() bool {
+	return Backend || os.Getenv(EnvKey) == "1"
+}
+
+// Restrict limits the TLS configuration to FIPS-approved versions, cipher
+// suites and curves if FIPS mode is enabled. TLS 1.3 is excluded, as its
+// cipher suites cannot be configured.
+func Restrict(cfg *tls.Config) *tls.Config {
+	if !Enabled() {
+		return cfg
+	}
+	cfg.MinVersion = tls.VersionTLS12
+	cfg.MaxVersion = tls.VersionTLS12
+	cfg.CipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+	cfg.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+	return cfg
+}
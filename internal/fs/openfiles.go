@@ -0,0 +1,10 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fs
+
+// Process is a process holding files open.
+type Process struct {
+	PID     int
+	Command string
+}
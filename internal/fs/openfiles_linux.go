@@ -0,0 +1,51 @@
+//go:build linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// OpenedBy returns the other processes holding files in the directory open,
+// found from their file descriptors in /proc. Processes whose descriptors
+// cannot be read, as they belong to another user, are skipped.
+func OpenedBy(dir string) ([]Process, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var processes []Process
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		fdDir := filepath.Join("/proc", entry.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || (target != dir && !strings.HasPrefix(target, dir+"/")) {
+				continue
+			}
+			comm, _ := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+			processes = append(processes, Process{PID: pid, Command: strings.TrimSpace(string(comm))})
+			break
+		}
+	}
+	return processes, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fs
+
+import "github.com/juju/errors"
+
+// OpenedBy returns the other processes holding files in the directory open.
+func OpenedBy(string) ([]Process, error) {
+	return nil, errors.NotSupportedf("finding open files on this platform")
+}
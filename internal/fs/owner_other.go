@@ -0,0 +1,12 @@
+//go:build !linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fs
+
+import "os"
+
+func fileOwner(os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
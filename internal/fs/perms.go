@@ -0,0 +1,98 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// DirMode is the mode jujud expects for its private directories.
+	DirMode os.FileMode = 0700
+	// FileMode is the mode jujud expects for its private files.
+	FileMode os.FileMode = 0600
+)
+
+// Owner is the expected owner of a file.
+type Owner struct {
+	UID int
+	GID int
+}
+
+// RootOwner is the root user and group.
+var RootOwner = Owner{UID: 0, GID: 0}
+
+// Problem is a file whose mode or ownership is not what jujud expects.
+type Problem struct {
+	Path    string
+	Problem string
+
+	mode  os.FileMode
+	owner *Owner
+}
+
+// String returns a description of the problem.
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Problem)
+}
+
+// Fix repairs the mode or ownership of the file.
+func (p Problem) Fix() error {
+	if p.owner != nil {
+		return errors.Annotatef(os.Lchown(p.Path, p.owner.UID, p.owner.GID), "changing owner of %q", p.Path)
+	}
+	return errors.Annotatef(os.Chmod(p.Path, p.mode), "changing mode of %q", p.Path)
+}
+
+// CheckTree checks that the directory, and everything below it, have the
+// expected modes and owner. Symbolic links are not followed.
+func CheckTree(root string, owner Owner) ([]Problem, error) {
+	var problems []Problem
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		mode := FileMode
+		if d.IsDir() {
+			mode = DirMode
+		}
+		fileProblems, err := CheckFile(path, mode, owner)
+		problems = append(problems, fileProblems...)
+		return err
+	})
+	return problems, errors.Annotatef(err, "checking %q", root)
+}
+
+// CheckFile checks that the file has the expected mode and owner.
+func CheckFile(path string, mode os.FileMode, owner Owner) ([]Problem, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var problems []Problem
+	if uid, gid, ok := fileOwner(info); ok && (uid != owner.UID || gid != owner.GID) {
+		problems = append(problems, Problem{
+			Path:    path,
+			Problem: fmt.Sprintf("owned by %d:%d, expected %d:%d", uid, gid, owner.UID, owner.GID),
+			owner:   &owner,
+		})
+	}
+	if perm := info.Mode().Perm(); perm != mode {
+		problems = append(problems, Problem{
+			Path:    path,
+			Problem: fmt.Sprintf("mode %04o, expected %04o", perm, mode),
+			mode:    mode,
+		})
+	}
+	return problems, nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fs
+
+import (
+	"os"
+
+	"github.com/juju/errors"
+)
+
+// PathOwner returns the owner of the given path.
+func PathOwner(path string) (Owner, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Owner{}, errors.Trace(err)
+	}
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		return Owner{}, errors.NotSupportedf("file ownership on this platform")
+	}
+	return Owner{UID: uid, GID: gid}, nil
+}
+
+// DropPrivileges switches the process to the given owner, so that any files
+// written afterwards are created with that ownership. It is a no-op unless the
+// process is running as root and the owner is not root. The returned function
+// switches the process back to root.
+func DropPrivileges(owner Owner) (func() error, error) {
+	if os.Geteuid() != 0 || owner == RootOwner {
+		return func() error { return nil }, nil
+	}
+	regain, err := setOwner(owner)
+	if err != nil {
+		return nil, errors.Annotatef(err, "dropping privileges to %d:%d", owner.UID, owner.GID)
+	}
+	return func() error {
+		return errors.Annotate(regain(), "switching back to root")
+	}, nil
+}
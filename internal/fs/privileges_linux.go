@@ -0,0 +1,39 @@
+//go:build linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fs
+
+import "syscall"
+
+func setOwner(owner Owner) (func() error, error) {
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		return nil, err
+	}
+	gid := syscall.Getegid()
+
+	// Only the effective IDs are changed, keeping root as the real and saved
+	// IDs to switch back to. The groups must be changed first, as we lose
+	// the right to do so once the user has changed. Since Go 1.16 these
+	// apply to every thread.
+	if err := syscall.Setgroups([]int{owner.GID}); err != nil {
+		return nil, err
+	}
+	if err := syscall.Setresgid(-1, owner.GID, -1); err != nil {
+		return nil, err
+	}
+	if err := syscall.Setresuid(-1, owner.UID, -1); err != nil {
+		return nil, err
+	}
+	return func() error {
+		if err := syscall.Setresuid(-1, 0, -1); err != nil {
+			return err
+		}
+		if err := syscall.Setresgid(-1, gid, -1); err != nil {
+			return err
+		}
+		return syscall.Setgroups(groups)
+	}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fs
+
+import "github.com/juju/errors"
+
+func setOwner(Owner) (func() error, error) {
+	return nil, errors.NotSupportedf("dropping privileges on this platform")
+}
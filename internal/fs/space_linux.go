@@ -0,0 +1,41 @@
+//go:build linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+// FreeSpace returns the bytes available to this user on the filesystem that
+// holds the path, or would hold it once created.
+func FreeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(existingDir(path), &stat); err != nil {
+		return 0, errors.Annotatef(err, "reading filesystem of %q", path)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// existingDir returns the path, or the nearest directory above it that
+// exists, as a destination is often created by the operation that needs the
+// space.
+func existingDir(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
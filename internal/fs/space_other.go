@@ -0,0 +1,14 @@
+//go:build !linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fs
+
+import "github.com/juju/errors"
+
+// FreeSpace returns the bytes available to this user on the filesystem that
+// holds the path, or would hold it once created.
+func FreeSpace(string) (int64, error) {
+	return 0, errors.NotSupportedf("reading free space on this platform")
+}
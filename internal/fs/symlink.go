@@ -0,0 +1,26 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// DanglingSymlink returns the first of the path and its parents that is a
+// symlink to something that does not exist, such as a directory on a volume
+// that is not mounted, along with the link's target.
+func DanglingSymlink(path string) (link, target string, ok bool) {
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if info, err := os.Lstat(p); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if _, err := os.Stat(p); os.IsNotExist(err) {
+				target, _ := os.Readlink(p)
+				return p, target, true
+			}
+		}
+		if parent := filepath.Dir(p); parent == p {
+			return "", "", false
+		}
+	}
+}
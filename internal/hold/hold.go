@@ -0,0 +1,134 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package hold stops systemd starting the Juju agents while a node is being
+// repaired, whether at boot, by a watchdog or by an operator, until the hold
+// is released.
+package hold
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// DefaultUnitDir is where the drop-ins holding units are installed, and
+	// where masked units are linked.
+	DefaultUnitDir = "/etc/systemd/system"
+
+	// DropInName is the name of the drop-in holding a unit.
+	DropInName = "juju-dqlite-backstop-hold.conf"
+
+	// neverPath is a path that cannot exist, so that the condition on it in
+	// the drop-in always fails and systemd skips starting the unit.
+	neverPath = "/dev/null/juju-dqlite-backstop-hold"
+)
+
+// Method is how a unit is held.
+type Method string
+
+const (
+	// DropIn holds a unit with a drop-in that adds a condition that always
+	// fails, so starting the unit is skipped.
+	DropIn Method = "drop-in"
+	// Mask holds a unit by masking it, so starting it fails.
+	Mask Method = "mask"
+)
+
+var dropIn = `
+# Installed by juju-dqlite-backstop hold-agents, while the Dqlite data is being
+# repaired. Starting the agent is skipped until this file is removed with
+# juju-dqlite-backstop release-agents.
+[Unit]
+ConditionPathExists=%s
+`[1:]
+
+// systemctl runs systemctl with the arguments.
+func systemctl(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, "systemctl", args...).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Unit returns the name of the systemd unit of the agent with the tag.
+func Unit(tag string) string {
+	return fmt.Sprintf("jujud-%s.service", tag)
+}
+
+// DropInPath returns the path of the drop-in holding the unit.
+func DropInPath(unitDir, unit string) string {
+	return filepath.Join(unitDir, unit+".d", DropInName)
+}
+
+// Held returns how the unit is held, or "" if it is not.
+func Held(unitDir, unit string) (Method, error) {
+	if _, err := os.Stat(DropInPath(unitDir, unit)); err == nil {
+		return DropIn, nil
+	} else if !os.IsNotExist(err) {
+		return "", errors.Trace(err)
+	}
+	if target, err := os.Readlink(filepath.Join(unitDir, unit)); err == nil && target == "/dev/null" {
+		return Mask, nil
+	}
+	return "", nil
+}
+
+// Hold stops systemd starting the unit, by the method given, and reloads
+// systemd so that it takes effect. It does not stop the unit if it is
+// running.
+func Hold(ctx context.Context, unitDir, unit string, method Method) error {
+	switch method {
+	case DropIn:
+		path := DropInPath(unitDir, unit)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.Trace(err)
+		}
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(dropIn, neverPath)), 0644); err != nil {
+			return errors.Annotatef(err, "writing %s", path)
+		}
+		return errors.Trace(systemctl(ctx, "daemon-reload"))
+	case Mask:
+		return errors.Trace(systemctl(ctx, "mask", unit))
+	}
+	return errors.NotValidf("hold method %q", method)
+}
+
+// Release removes the hold on the unit, however it is held, and reloads
+// systemd. It returns how the unit was held, or "" if it was not.
+func Release(ctx context.Context, unitDir, unit string) (Method, error) {
+	method, err := Held(unitDir, unit)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	switch method {
+	case DropIn:
+		path := DropInPath(unitDir, unit)
+		if err := os.Remove(path); err != nil {
+			return method, errors.Annotatef(err, "removing %s", path)
+		}
+		// The drop-in directory is only removed if nothing else is in it.
+		_ = os.Remove(filepath.Dir(path))
+		return method, errors.Trace(systemctl(ctx, "daemon-reload"))
+	case Mask:
+		return method, errors.Trace(systemctl(ctx, "unmask", unit))
+	}
+	return "", nil
+}
+
+// Stop stops the unit.
+func Stop(ctx context.Context, unit string) error {
+	return errors.Trace(systemctl(ctx, "stop", unit))
+}
+
+// Start starts the unit.
+func Start(ctx context.Context, unit string) error {
+	return errors.Trace(systemctl(ctx, "start", unit))
+}
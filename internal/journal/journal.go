@@ -0,0 +1,260 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package journal keeps an append-only journal of each mutating step taken
+// on a node, written before and after the step, so that an interrupted
+// recovery can be reconstructed.
+package journal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// FileName is the name of the journal in the dqlite data dir.
+const FileName = "backstop-journal.log"
+
+// Entry phases.
+const (
+	// PhaseRun starts the entries of a run, recording its arguments.
+	PhaseRun = "run"
+	// PhaseBegin is written before a step is taken.
+	PhaseBegin = "begin"
+	// PhaseEnd is written after a step is taken, with its outcome.
+	PhaseEnd = "end"
+	// PhaseInterrupted is written when the run is stopped by a signal.
+	PhaseInterrupted = "interrupted"
+)
+
+// Entry is a single line of the journal.
+type Entry struct {
+	Time  time.Time `json:"time"`
+	Run   string    `json:"run"`
+	Phase string    `json:"phase"`
+	// Operation and Args are those of the run, on its run entry.
+	Operation string   `json:"operation,omitempty"`
+	Args      []string `json:"args,omitempty"`
+	// Controller is the UUID of the controller the run was for, on its
+	// run entry.
+	Controller string `json:"controller,omitempty"`
+	// Step and Params are those of the step, on its begin entry.
+	Step   string          `json:"step,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	// Error is the outcome of a failed step, on its end entry, or the
+	// signal the run was stopped by, on its interrupted entry.
+	Error string `json:"error,omitempty"`
+}
+
+// Logger is used to report a journal that cannot be written.
+type Logger interface {
+	Warningf(string, ...interface{})
+}
+
+// run describes this run of the tool, which every entry is written for.
+var run struct {
+	mu         sync.Mutex
+	id         string
+	operation  string
+	args       []string
+	controller string
+	// started are the journals the run entry has been written to.
+	started map[string]bool
+}
+
+// StartRun records the operation and arguments of this run, written to each
+// journal before its first step.
+func StartRun(operation string, args []string) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.operation, run.args = operation, args
+}
+
+// SetController records the UUID of the controller the run is for, written
+// with the operation.
+func SetController(uuid string) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.controller = uuid
+}
+
+// Journal is the journal in a Dqlite data directory.
+type Journal struct {
+	path   string
+	logger Logger
+}
+
+// New returns the journal in the Dqlite data directory.
+func New(dataDir string, logger Logger) *Journal {
+	return &Journal{path: Path(dataDir), logger: logger}
+}
+
+// Path returns the path of the journal in the given data dir.
+func Path(dataDir string) string {
+	return filepath.Join(dataDir, FileName)
+}
+
+// Step journals the step, described by its parameters, before and after
+// taking it. A journal that cannot be written is reported, but does not stop
+// the step being taken, as the recovery matters more than its record.
+func (j *Journal) Step(name string, params interface{}, fn func() error) error {
+	begin := Entry{Phase: PhaseBegin, Step: name}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return errors.Annotatef(err, "journaling %s", name)
+		}
+		begin.Params = data
+	}
+	j.append(begin)
+
+	err := fn()
+	end := Entry{Phase: PhaseEnd, Step: name}
+	if err != nil {
+		end.Error = err.Error()
+	}
+	j.append(end)
+	return err
+}
+
+// Interrupted records that the run was stopped by the signal, in each
+// journal it has written steps to.
+func Interrupted(signal string, logger Logger) {
+	run.mu.Lock()
+	var paths []string
+	for path := range run.started {
+		paths = append(paths, path)
+	}
+	run.mu.Unlock()
+
+	sort.Strings(paths)
+	for _, path := range paths {
+		j := &Journal{path: path, logger: logger}
+		j.append(Entry{Phase: PhaseInterrupted, Error: signal})
+	}
+}
+
+func (j *Journal) append(entry Entry) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if run.id == "" {
+		run.id = newRunID()
+	}
+
+	var entries []Entry
+	if !run.started[j.path] {
+		entries = append(entries, Entry{
+			Phase:      PhaseRun,
+			Operation:  run.operation,
+			Args:       run.args,
+			Controller: run.controller,
+		})
+	}
+	entries = append(entries, entry)
+	now := time.Now().UTC()
+	for i := range entries {
+		entries[i].Time, entries[i].Run = now, run.id
+	}
+	if err := appendEntries(j.path, entries); err != nil {
+		j.logger.Warningf("unable to write %s to the journal: %v", entry.Phase+" "+entry.Step, err)
+		return
+	}
+	if run.started == nil {
+		run.started = make(map[string]bool)
+	}
+	run.started[j.path] = true
+}
+
+// appendEntries appends the entries to the journal, and syncs it so that
+// they survive the machine going down.
+func appendEntries(path string, entries []Entry) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			_ = f.Close()
+			return errors.Trace(err)
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			_ = f.Close()
+			return errors.Trace(err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Close())
+}
+
+// Read reads the journal at the path.
+func Read(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var (
+		entries []Entry
+		torn    error
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if torn != nil {
+			return entries, torn
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Only the last line can be torn, by a crash mid-write.
+			torn = errors.Annotatef(err, "line %d", line)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, errors.Trace(scanner.Err())
+}
+
+// Unfinished returns the indices of the begin entries of the steps that never
+// ended, as the run was interrupted while taking them.
+func Unfinished(entries []Entry) []int {
+	type key struct{ run, step string }
+	open := make(map[key][]int)
+	for i, entry := range entries {
+		k := key{entry.Run, entry.Step}
+		switch entry.Phase {
+		case PhaseBegin:
+			open[k] = append(open[k], i)
+		case PhaseEnd:
+			if n := len(open[k]); n > 0 {
+				open[k] = open[k][:n-1]
+			}
+		}
+	}
+	var unfinished []int
+	for _, indices := range open {
+		unfinished = append(unfinished, indices...)
+	}
+	sort.Ints(unfinished)
+	return unfinished
+}
+
+func newRunID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
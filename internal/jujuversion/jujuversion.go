@@ -0,0 +1,128 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package jujuversion holds the Juju versions whose Dqlite layout the
+// backstop understands, so that it refuses to change the data of a
+// controller it was not built for.
+package jujuversion
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Version is the major and minor number of a Juju version, which is all
+// that the Dqlite layout depends on.
+type Version struct {
+	Major, Minor int
+}
+
+// String returns the version as major.minor.
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// Less reports whether the version is older than the other.
+func (v Version) Less(other Version) bool {
+	return v.Major < other.Major || v.Major == other.Major && v.Minor < other.Minor
+}
+
+// Parse returns the major and minor numbers of a Juju version, such as
+// 3.1.6, 2.9.42.1 or 3.2-beta1.
+func Parse(version string) (Version, error) {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return Version{}, errors.NotValidf("juju version %q", version)
+	}
+	minor, _, _ := strings.Cut(parts[1], "-")
+	var (
+		v   Version
+		err error
+	)
+	if v.Major, err = strconv.Atoi(parts[0]); err != nil {
+		return Version{}, errors.NotValidf("juju version %q", version)
+	}
+	if v.Minor, err = strconv.Atoi(minor); err != nil {
+		return Version{}, errors.NotValidf("juju version %q", version)
+	}
+	return v, nil
+}
+
+// Support is how well the backstop knows the Dqlite layout of a version.
+type Support string
+
+const (
+	// Supported versions have the layout the backstop was built for.
+	Supported Support = "supported"
+	// Untested versions are newer minor versions of a supported major
+	// version, whose layout is expected to be unchanged.
+	Untested Support = "untested"
+	// Unsupported versions have no Dqlite controller database, or one the
+	// backstop does not understand.
+	Unsupported Support = "unsupported"
+)
+
+// Release is an entry in the compatibility matrix.
+type Release struct {
+	Version Version
+	Support Support
+	Note    string
+}
+
+// Matrix is the compatibility matrix, oldest release first.
+var Matrix = []Release{
+	{Version: Version{2, 9}, Support: Unsupported, Note: "controllers keep their data in MongoDB, not Dqlite"},
+	{Version: Version{3, 0}, Support: Unsupported, Note: "controllers keep their data in MongoDB, not Dqlite"},
+	{Version: Version{3, 1}, Support: Supported},
+	{Version: Version{3, 2}, Support: Supported},
+	{Version: Version{3, 3}, Support: Supported},
+	{Version: Version{3, 4}, Support: Supported},
+	{Version: Version{3, 5}, Support: Supported},
+	{Version: Version{3, 6}, Support: Supported},
+}
+
+// Supports returns the supported versions as a range, for display.
+func Supports() string {
+	var first, last Version
+	for _, r := range Matrix {
+		if r.Support != Supported {
+			continue
+		}
+		if first == (Version{}) {
+			first = r.Version
+		}
+		last = r.Version
+	}
+	return fmt.Sprintf("Juju %s to %s", first, last)
+}
+
+// Check returns how well the backstop knows the Dqlite layout of the Juju
+// version, and why, for versions that are not supported. A newer minor
+// version of the latest major version known is untested, and any other
+// version not in the matrix is unsupported.
+func Check(version string) (Support, string, error) {
+	v, err := Parse(version)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	for _, r := range Matrix {
+		if r.Version == v {
+			if r.Support == Supported {
+				return Supported, "", nil
+			}
+			return r.Support, fmt.Sprintf("Juju %s is %s: %s", version, r.Support, r.Note), nil
+		}
+	}
+
+	oldest, latest := Matrix[0].Version, Matrix[len(Matrix)-1].Version
+	switch {
+	case v.Less(oldest):
+		return Unsupported, fmt.Sprintf("Juju %s is older than any the backstop knows, and keeps its data in MongoDB", version), nil
+	case v.Major == latest.Major:
+		return Untested, fmt.Sprintf("Juju %s is newer than %s, the latest the backstop was built for; its Dqlite layout is assumed unchanged", version, latest), nil
+	}
+	return Unsupported, fmt.Sprintf("Juju %s is newer than the backstop understands, which supports %s; its Dqlite layout may differ", version, Supports()), nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package metrics writes metrics for the node exporter's textfile collector.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Gauge is a sample of a gauge metric.
+type Gauge struct {
+	Name   string
+	Help   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Write writes the gauges in the Prometheus text format. Gauges of the same
+// name must be given together.
+func Write(w io.Writer, gauges []Gauge) error {
+	var buf bytes.Buffer
+	for i, g := range gauges {
+		if i == 0 || gauges[i-1].Name != g.Name {
+			fmt.Fprintf(&buf, "# HELP %s %s\n", g.Name, escapeHelp(g.Help))
+			fmt.Fprintf(&buf, "# TYPE %s gauge\n", g.Name)
+		}
+		buf.WriteString(g.Name)
+		if len(g.Labels) > 0 {
+			names := make([]string, 0, len(g.Labels))
+			for name := range g.Labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			labels := make([]string, len(names))
+			for j, name := range names {
+				labels[j] = name + `="` + escapeLabel(g.Labels[name]) + `"`
+			}
+			buf.WriteString("{" + strings.Join(labels, ",") + "}")
+		}
+		buf.WriteString(" " + strconv.FormatFloat(g.Value, 'g', -1, 64) + "\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return errors.Trace(err)
+}
+
+// WriteTextfile writes the gauges to <name>.prom in the directory. The file
+// is written alongside and renamed into place, so that the node exporter
+// never reads a partial file.
+func WriteTextfile(dir, name string, gauges []Gauge) error {
+	tmp, err := os.CreateTemp(dir, "."+name+".*")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if err := Write(tmp, gauges); err != nil {
+		_ = tmp.Close()
+		return errors.Trace(err)
+	}
+	// The node exporter usually runs unprivileged.
+	if err := tmp.Chmod(0644); err != nil {
+		_ = tmp.Close()
+		return errors.Trace(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp.Name(), filepath.Join(dir, name+".prom")))
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// MaxDiscoverHosts is the largest number of hosts that Discover will scan,
+// to avoid accidentally scanning a very large network.
+const MaxDiscoverHosts = 4096
+
+// Discover scans the hosts of the subnets for a TLS service on the given
+// port, whose certificate is signed by one of the root CAs in the config.
+// The addresses (host:port) of the services found are returned in order.
+func Discover(ctx context.Context, subnets []*net.IPNet, port int, config *tls.Config, concurrency int) ([]string, error) {
+	var hosts []net.IP
+	for _, subnet := range subnets {
+		subnetHosts, err := subnetHosts(subnet)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		hosts = append(hosts, subnetHosts...)
+		if len(hosts) > MaxDiscoverHosts {
+			return nil, errors.NotValidf("scanning more than %d hosts", MaxDiscoverHosts)
+		}
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu    sync.Mutex
+		found []string
+		wg    sync.WaitGroup
+		sem   = make(chan struct{}, concurrency)
+	)
+	for _, host := range hosts {
+		address := net.JoinHostPort(host.String(), strconv.Itoa(port))
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if verifyService(ctx, address, config) {
+				mu.Lock()
+				found = append(found, address)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(found, func(i, j int) bool {
+		a, _, _ := net.SplitHostPort(found[i])
+		b, _, _ := net.SplitHostPort(found[j])
+		return binary.BigEndian.Uint32(net.ParseIP(a).To4()) < binary.BigEndian.Uint32(net.ParseIP(b).To4())
+	})
+	return found, ctx.Err()
+}
+
+// verifyService returns true if the address answers a TLS handshake with a
+// certificate signed by the root CAs in the config.
+func verifyService(ctx context.Context, address string, config *tls.Config) bool {
+	dialer := &tls.Dialer{Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         config.RootCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
+
+// subnetHosts returns the host addresses of the IPv4 subnet, excluding the
+// network and broadcast addresses.
+func subnetHosts(subnet *net.IPNet) ([]net.IP, error) {
+	ip := subnet.IP.To4()
+	if ip == nil {
+		return nil, errors.NotSupportedf("discovery on IPv6 subnet %s", subnet)
+	}
+	ones, bits := subnet.Mask.Size()
+	size := uint64(1) << uint(bits-ones)
+	if size > MaxDiscoverHosts {
+		return nil, errors.NotValidf("subnet %s larger than %d hosts", subnet, MaxDiscoverHosts)
+	}
+
+	start := binary.BigEndian.Uint32(ip)
+	var hosts []net.IP
+	for i := uint64(0); i < size; i++ {
+		if size > 2 && (i == 0 || i == size-1) {
+			continue // network and broadcast addresses
+		}
+		host := make(net.IP, 4)
+		binary.BigEndian.PutUint32(host, start+uint32(i))
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
@@ -6,19 +6,203 @@ package net
 import (
 	"fmt"
 	"net"
+	"path"
+	"syscall"
 
 	"github.com/juju/collections/set"
 	"github.com/juju/errors"
 )
 
+// Option can be used to constrain the addresses returned by ExternalIPs.
+type Option func(*options)
+
+type options struct {
+	interfaces       set.Strings
+	subnets          []*net.IPNet
+	excluded         []string
+	excludeLinkLocal bool
+}
+
+// DefaultExcludedInterfaces are the name patterns of bridge and VPN
+// interfaces, whose addresses are never suitable for a Dqlite node.
+var DefaultExcludedInterfaces = []string{
+	"lxdbr*",
+	"docker*",
+	"virbr*",
+	"tailscale*",
+}
+
+// WithExcludedInterface excludes interfaces whose names match the pattern,
+// using the syntax of path.Match. It can be supplied multiple times.
+func WithExcludedInterface(pattern string) Option {
+	return func(o *options) {
+		o.excluded = append(o.excluded, pattern)
+	}
+}
+
+// WithoutLinkLocal excludes link-local addresses (169.254.0.0/16).
+func WithoutLinkLocal() Option {
+	return func(o *options) {
+		o.excludeLinkLocal = true
+	}
+}
+
+// ValidatePatterns checks that the interface name patterns are well formed.
+func ValidatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.NotValidf("interface pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func (o *options) isExcluded(name string) bool {
+	for _, pattern := range o.excluded {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WithInterface limits address discovery to the named network interface.
+// It can be supplied multiple times to allow several interfaces.
+func WithInterface(name string) Option {
+	return func(o *options) {
+		o.interfaces.Add(name)
+	}
+}
+
+// WithSubnet limits address discovery to addresses within the given subnet.
+// It can be supplied multiple times, in which case an address within any of
+// the subnets is accepted.
+func WithSubnet(subnet *net.IPNet) Option {
+	return func(o *options) {
+		o.subnets = append(o.subnets, subnet)
+	}
+}
+
+// ParseSubnets parses the CIDRs into subnets suitable for WithSubnet.
+func ParseSubnets(cidrs []string) ([]*net.IPNet, error) {
+	subnets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.NotValidf("cidr %q", cidr)
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// String describes the constraints, for use in error messages.
+func (o *options) String() string {
+	var desc string
+	if !o.interfaces.IsEmpty() {
+		desc += fmt.Sprintf(" on interfaces %v", o.interfaces.SortedValues())
+	}
+	if len(o.subnets) > 0 {
+		desc += fmt.Sprintf(" in subnets %v", o.subnets)
+	}
+	if len(o.excluded) > 0 {
+		desc += fmt.Sprintf(" excluding interfaces %v", o.excluded)
+	}
+	return desc
+}
+
+func (o *options) inSubnets(ip net.IP) bool {
+	if len(o.subnets) == 0 {
+		return true
+	}
+	for _, subnet := range o.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Address is a local IP address, along with the name of the network
+// interface that it is on.
+type Address struct {
+	IP        string
+	Interface string
+	// Network is the subnet of the address, as configured on the
+	// interface.
+	Network *net.IPNet
+}
+
+// String returns the address in the form "10.0.0.5 on eth0".
+func (a Address) String() string {
+	return fmt.Sprintf("%s on %s", a.IP, a.Interface)
+}
+
 // ExternalIPs returns a list of non-loopback IP addresses
-func ExternalIPs() (set.Strings, error) {
-	ifaces, err := net.Interfaces()
+func ExternalIPs(opts ...Option) (set.Strings, error) {
+	addrs, err := LocalAddresses(opts...)
 	if err != nil {
 		return nil, err
 	}
 	addresses := set.NewStrings()
+	for _, addr := range addrs {
+		addresses.Add(addr.IP)
+	}
+	return addresses, nil
+}
+
+// DescribeIP returns the IP along with the interface that it is on, if it is
+// a local address. Otherwise the IP is returned unchanged.
+func DescribeIP(ip string) string {
+	addrs, err := LocalAddresses()
+	if err != nil {
+		return ip
+	}
+	for _, addr := range addrs {
+		if addr.IP == ip {
+			return addr.String()
+		}
+	}
+	return ip
+}
+
+// IsAssigned reports whether the IP is assigned to this machine, by binding
+// to it as the Dqlite node will. Unlike LocalAddresses, this includes
+// loopback addresses.
+func IsAssigned(ip net.IP) (bool, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err == nil {
+		_ = l.Close()
+		return true, nil
+	}
+	if errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return false, nil
+	}
+	return false, errors.Trace(err)
+}
+
+// LocalAddresses returns the non-loopback IPv4 addresses of the machine,
+// along with the interfaces they are on.
+func LocalAddresses(opts ...Option) ([]Address, error) {
+	o := &options{
+		interfaces: set.NewStrings(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var addresses []Address
 	for _, iface := range ifaces {
+		if !o.interfaces.IsEmpty() && !o.interfaces.Contains(iface.Name) {
+			continue // not a requested interface
+		}
+		if o.isExcluded(iface.Name) {
+			continue // excluded interface
+		}
 		if iface.Flags&net.FlagUp == 0 {
 			continue // interface down
 		}
@@ -30,10 +214,14 @@ func ExternalIPs() (set.Strings, error) {
 			return nil, err
 		}
 		for _, addr := range addrs {
-			var ip net.IP
+			var (
+				ip      net.IP
+				network *net.IPNet
+			)
 			switch v := addr.(type) {
 			case *net.IPNet:
 				ip = v.IP
+				network = &net.IPNet{IP: v.IP.Mask(v.Mask), Mask: v.Mask}
 			case *net.IPAddr:
 				ip = v.IP
 			}
@@ -44,11 +232,21 @@ func ExternalIPs() (set.Strings, error) {
 			if ip == nil {
 				continue // not an ipv4 address
 			}
-			addresses.Add(ip.String())
+			if o.excludeLinkLocal && ip.IsLinkLocalUnicast() {
+				continue // link-local address
+			}
+			if !o.inSubnets(ip) {
+				continue // outside of the requested subnets
+			}
+			addresses = append(addresses, Address{
+				IP:        ip.String(),
+				Interface: iface.Name,
+				Network:   network,
+			})
 		}
 	}
-	if addresses.Size() == 0 {
-		return nil, fmt.Errorf("ip addresses %w", errors.NotFound)
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("ip addresses%s %w", o.String(), errors.NotFound)
 	}
 	return addresses, nil
 }
@@ -0,0 +1,33 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package net
+
+import (
+	"fmt"
+	"time"
+)
+
+// AddressLifetime describes how long a local address is valid for, as
+// reported by the kernel. Addresses assigned by DHCP or SLAAC are not
+// permanent, and may change when the lease expires.
+type AddressLifetime struct {
+	Permanent bool
+	Valid     time.Duration
+	Preferred time.Duration
+}
+
+// String returns a description of the lifetime, for example
+// "dynamic, valid for 23h59m0s".
+func (l AddressLifetime) String() string {
+	if l.Permanent {
+		return "permanent"
+	}
+	if l.Valid == Forever {
+		return "dynamic, valid forever"
+	}
+	return fmt.Sprintf("dynamic, valid for %v", l.Valid)
+}
+
+// Forever is the lifetime reported for an address that does not expire.
+const Forever = time.Duration(1<<63 - 1)
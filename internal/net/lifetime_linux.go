@@ -0,0 +1,98 @@
+//go:build linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package net
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// ifaFlagPermanent is IFA_F_PERMANENT from linux/if_addr.h.
+	ifaFlagPermanent = 0x80
+	// ifaFlags is IFA_FLAGS from linux/if_addr.h, holding the full 32 bit
+	// flags when present.
+	ifaFlags = 8
+	// infinityLifeTime is INFINITY_LIFE_TIME from linux/if_addr.h.
+	infinityLifeTime = 0xffffffff
+)
+
+// nativeEndian is the byte order of the host, which netlink messages are
+// encoded in. binary.NativeEndian needs Go 1.21.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// AddressLifetimes returns the lifetime of each local address, keyed by IP,
+// using the kernel's netlink route information.
+func AddressLifetimes() (map[string]AddressLifetime, error) {
+	data, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, errors.Annotate(err, "requesting addresses over netlink")
+	}
+	msgs, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return nil, errors.Annotate(err, "parsing netlink messages")
+	}
+
+	lifetimes := make(map[string]AddressLifetime)
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWADDR || len(msg.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		flags := uint32(msg.Data[2])
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			return nil, errors.Annotate(err, "parsing netlink address attributes")
+		}
+
+		var (
+			ip       net.IP
+			lifetime = AddressLifetime{Valid: Forever, Preferred: Forever}
+		)
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.IFA_LOCAL:
+				ip = net.IP(attr.Value)
+			case syscall.IFA_ADDRESS:
+				if ip == nil {
+					ip = net.IP(attr.Value)
+				}
+			case ifaFlags:
+				if len(attr.Value) >= 4 {
+					flags = nativeEndian.Uint32(attr.Value)
+				}
+			case syscall.IFA_CACHEINFO:
+				if len(attr.Value) >= 8 {
+					lifetime.Preferred = lifetimeSeconds(nativeEndian.Uint32(attr.Value[0:4]))
+					lifetime.Valid = lifetimeSeconds(nativeEndian.Uint32(attr.Value[4:8]))
+				}
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		lifetime.Permanent = flags&ifaFlagPermanent != 0
+		lifetimes[ip.String()] = lifetime
+	}
+	return lifetimes, nil
+}
+
+func lifetimeSeconds(seconds uint32) time.Duration {
+	if seconds == infinityLifeTime {
+		return Forever
+	}
+	return time.Duration(seconds) * time.Second
+}
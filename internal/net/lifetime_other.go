@@ -0,0 +1,14 @@
+//go:build !linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package net
+
+import "github.com/juju/errors"
+
+// AddressLifetimes returns the lifetime of each local address, keyed by IP,
+// using the kernel's netlink route information.
+func AddressLifetimes() (map[string]AddressLifetime, error) {
+	return nil, errors.NotSupportedf("address lifetimes")
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package net
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// NetplanDir is where netplan's own configuration is read from.
+const NetplanDir = "/etc/netplan"
+
+// netplanConfig holds the device types of a netplan file, such as
+// ethernets and bonds, by name, along with its version and renderer.
+type netplanConfig struct {
+	Network map[string]yaml.Node `yaml:"network"`
+}
+
+type netplanDevice struct {
+	// Addresses are given as "<ip>/<prefix>", or as a mapping from it to
+	// options such as a label.
+	Addresses []yaml.Node `yaml:"addresses"`
+}
+
+// PlannedAddresses returns the static addresses netplan configures from the
+// files in the directory, by IP, with the interface each is configured on.
+// They are the addresses a machine will have once netplan is applied, which
+// may not be the ones it has now.
+func PlannedAddresses(dir string) (map[string]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(paths)
+
+	planned := make(map[string]string)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		var config netplanConfig
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return nil, errors.Annotatef(err, "parsing %s", path)
+		}
+		for kind, node := range config.Network {
+			if node.Kind != yaml.MappingNode {
+				continue // version or renderer
+			}
+			var devices map[string]netplanDevice
+			if err := node.Decode(&devices); err != nil {
+				return nil, errors.Annotatef(err, "parsing %s in %s", kind, path)
+			}
+			for name, device := range devices {
+				for _, address := range device.Addresses {
+					cidr := address.Value
+					if address.Kind == yaml.MappingNode && len(address.Content) > 0 {
+						cidr = address.Content[0].Value
+					}
+					if ip, _, err := net.ParseCIDR(cidr); err == nil {
+						planned[ip.String()] = name
+					}
+				}
+			}
+		}
+	}
+	return planned, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package net
+
+import (
+	"context"
+	"math"
+	"net"
+	"time"
+)
+
+// ProbeResult holds the round-trip latency measured to a single address.
+type ProbeResult struct {
+	Address  string
+	Samples  int
+	Failures int
+	Min      time.Duration
+	Max      time.Duration
+	Mean     time.Duration
+	// Jitter is the standard deviation of the successful samples.
+	Jitter time.Duration
+	// Err is the last error encountered, if any.
+	Err error
+}
+
+// Reachable returns true if at least one sample succeeded.
+func (r ProbeResult) Reachable() bool {
+	return r.Samples > r.Failures
+}
+
+// Probe measures the round-trip latency to the address, by timing the TCP
+// handshake over the given number of samples, waiting interval between each.
+func Probe(ctx context.Context, address string, samples int, interval time.Duration) ProbeResult {
+	result := ProbeResult{Address: address}
+	var rtts []time.Duration
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				result.Err = ctx.Err()
+				return summarise(result, rtts)
+			case <-time.After(interval):
+			}
+		}
+
+		result.Samples++
+		rtt, err := dialRTT(ctx, address)
+		if err != nil {
+			result.Failures++
+			result.Err = err
+			continue
+		}
+		rtts = append(rtts, rtt)
+	}
+	return summarise(result, rtts)
+}
+
+func dialRTT(ctx context.Context, address string) (time.Duration, error) {
+	var dialer net.Dialer
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	_ = conn.Close()
+	return rtt, nil
+}
+
+func summarise(result ProbeResult, rtts []time.Duration) ProbeResult {
+	if len(rtts) == 0 {
+		return result
+	}
+	var sum time.Duration
+	result.Min = rtts[0]
+	for _, rtt := range rtts {
+		sum += rtt
+		if rtt < result.Min {
+			result.Min = rtt
+		}
+		if rtt > result.Max {
+			result.Max = rtt
+		}
+	}
+	result.Mean = sum / time.Duration(len(rtts))
+
+	var variance float64
+	for _, rtt := range rtts {
+		d := float64(rtt - result.Mean)
+		variance += d * d
+	}
+	result.Jitter = time.Duration(math.Sqrt(variance / float64(len(rtts))))
+	return result
+}
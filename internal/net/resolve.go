@@ -0,0 +1,76 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package net
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/collections/set"
+	"github.com/juju/errors"
+)
+
+// SplitHost returns the host part of the address, which may or may not
+// include a port.
+func SplitHost(addr string) (string, error) {
+	if !strings.Contains(addr, ":") {
+		return addr, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// An IPv6 address without a port.
+		if ip := net.ParseIP(addr); ip != nil {
+			return addr, nil
+		}
+		return "", errors.Trace(err)
+	}
+	return host, nil
+}
+
+// ResolveHosts resolves each of the hosts to the set of IP addresses they
+// refer to. Hosts that are already IP addresses are returned unchanged. The
+// hosts are resolved concurrently, each allowed the timeout, so that one
+// lookup that hangs does not use up the time of the others. Resolved
+// addresses are returned even if some of the hosts could not be resolved, in
+// which case an error describing the failures is also returned.
+func ResolveHosts(ctx context.Context, hosts []string, timeout time.Duration) (set.Strings, error) {
+	results := make([][]string, len(hosts))
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			results[i] = []string{ip.String()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+
+			hostCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			results[i], errs[i] = net.DefaultResolver.LookupHost(hostCtx, host)
+		}(i, host)
+	}
+	wg.Wait()
+
+	resolved := set.NewStrings()
+	var failed []string
+	for i := range hosts {
+		if errs[i] != nil {
+			failed = append(failed, errs[i].Error())
+			continue
+		}
+		for _, ip := range results[i] {
+			resolved.Add(ip)
+		}
+	}
+	if len(failed) > 0 {
+		return resolved, errors.Errorf("resolving hosts: %s", strings.Join(failed, "; "))
+	}
+	return resolved, nil
+}
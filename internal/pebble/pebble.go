@@ -0,0 +1,202 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package pebble manages the services of a controller container on
+// Kubernetes, where Pebble rather than systemd runs jujud, through the Pebble
+// API on its unix socket.
+package pebble
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// JujudService is the name of the Pebble service running jujud in the
+	// controller container.
+	JujudService = "jujud"
+
+	// CLI is the path of the Pebble command in the controller container.
+	CLI = "/charm/bin/pebble"
+
+	// defaultDir is the Pebble directory of the controller container, which
+	// holds its socket.
+	defaultDir = "/charm/container"
+)
+
+// SocketPath returns the path of the Pebble socket of the container the tool
+// is running in: that in $PEBBLE_SOCKET, or in the $PEBBLE directory, or in
+// the controller container's Pebble directory.
+func SocketPath() string {
+	if socket := os.Getenv("PEBBLE_SOCKET"); socket != "" {
+		return socket
+	}
+	dir := os.Getenv("PEBBLE")
+	if dir == "" {
+		dir = defaultDir
+	}
+	return filepath.Join(dir, "pebble.socket")
+}
+
+// Service is the state of a Pebble service.
+type Service struct {
+	Name    string `json:"name"`
+	Startup string `json:"startup"`
+	// Current is active, inactive, backoff or error.
+	Current string `json:"current"`
+}
+
+// Active reports whether the service is running, or is being restarted.
+func (s Service) Active() bool {
+	return s.Current == "active" || s.Current == "backoff"
+}
+
+// Client talks to Pebble over its unix socket.
+type Client struct {
+	socket string
+	http   *http.Client
+}
+
+// NewClient returns a client for the Pebble socket at the path.
+func NewClient(socket string) *Client {
+	return &Client{
+		socket: socket,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// response is the envelope of every Pebble API response.
+type response struct {
+	Type       string          `json:"type"`
+	StatusCode int             `json:"status-code"`
+	Result     json.RawMessage `json:"result"`
+	Change     string          `json:"change"`
+}
+
+// do makes the request, and returns the response, or the error Pebble
+// reports.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body interface{}) (response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return response{}, errors.Trace(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	u := url.URL{Scheme: "http", Host: "pebble", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return response{}, errors.Trace(err)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return response{}, errors.Annotatef(err, "connecting to Pebble at %s", c.socket)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return response{}, errors.Annotatef(err, "reading the Pebble response to %s %s", method, path)
+	}
+	if r.Type == "error" {
+		var e struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(r.Result, &e)
+		return r, errors.Errorf("pebble: %s", e.Message)
+	}
+	return r, nil
+}
+
+// Services returns the state of the named services, or of all of them if
+// none are named.
+func (c *Client) Services(ctx context.Context, names ...string) ([]Service, error) {
+	query := url.Values{}
+	if len(names) > 0 {
+		query.Set("names", strings.Join(names, ","))
+	}
+	r, err := c.do(ctx, http.MethodGet, "/v1/services", query, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var services []Service
+	return services, errors.Trace(json.Unmarshal(r.Result, &services))
+}
+
+// Stop stops the services, waiting until they have stopped.
+func (c *Client) Stop(ctx context.Context, names ...string) error {
+	return c.serviceAction(ctx, "stop", names)
+}
+
+// Start starts the services, waiting until they have started.
+func (c *Client) Start(ctx context.Context, names ...string) error {
+	return c.serviceAction(ctx, "start", names)
+}
+
+// Restart restarts the services, waiting until they have started again.
+func (c *Client) Restart(ctx context.Context, names ...string) error {
+	return c.serviceAction(ctx, "restart", names)
+}
+
+// serviceAction asks Pebble to take the action on the services, and waits
+// for the change it makes to finish.
+func (c *Client) serviceAction(ctx context.Context, action string, names []string) error {
+	r, err := c.do(ctx, http.MethodPost, "/v1/services", nil, map[string]interface{}{
+		"action":   action,
+		"services": names,
+	})
+	if err != nil {
+		return errors.Annotatef(err, "%s %s", action, strings.Join(names, ", "))
+	}
+	if r.Change == "" {
+		return nil
+	}
+	return errors.Annotatef(c.wait(ctx, r.Change), "%s %s", action, strings.Join(names, ", "))
+}
+
+// wait waits for the change to finish, and returns its error, if it failed.
+func (c *Client) wait(ctx context.Context, id string) error {
+	query := url.Values{}
+	if deadline, ok := ctx.Deadline(); ok {
+		query.Set("timeout", time.Until(deadline).Round(time.Second).String())
+	}
+	r, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/v1/changes/%s/wait", id), query, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var change struct {
+		Status string `json:"status"`
+		Ready  bool   `json:"ready"`
+		Err    string `json:"err"`
+	}
+	if err := json.Unmarshal(r.Result, &change); err != nil {
+		return errors.Trace(err)
+	}
+	switch {
+	case change.Err != "":
+		return errors.New(change.Err)
+	case !change.Ready:
+		return errors.Errorf("change %s is still %s", id, change.Status)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package progress shows the progress of long-running byte-level work, so
+// that a multi-gigabyte copy is not mistaken for a hung one.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Output is where progress is shown.
+	Output io.Writer = os.Stderr
+	// Interactive is whether Output is a terminal, on which a progress bar
+	// is redrawn in place. Otherwise, a progress line is written
+	// periodically.
+	Interactive = false
+)
+
+const (
+	// redrawInterval is how often a progress bar is redrawn.
+	redrawInterval = 200 * time.Millisecond
+	// lineInterval is how often a progress line is written when not
+	// interactive.
+	lineInterval = 10 * time.Second
+	// barWidth is the width of a progress bar, in characters.
+	barWidth = 30
+)
+
+// Meter measures the progress of a piece of work. A nil Meter does nothing,
+// so that the work can be done without measuring it.
+type Meter struct {
+	label string
+	total int64
+
+	mu       sync.Mutex
+	done     int64
+	started  time.Time
+	lastShow time.Time
+	drawn    bool
+}
+
+// New returns a meter for the labelled work of the total number of bytes, or
+// of an unknown number if total is not positive.
+func New(label string, total int64) *Meter {
+	now := time.Now()
+	return &Meter{label: label, total: total, started: now, lastShow: now}
+}
+
+// Add records that n more bytes have been processed.
+func (m *Meter) Add(n int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.done += n
+	now := time.Now()
+	interval := lineInterval
+	if Interactive {
+		interval = redrawInterval
+	}
+	if now.Sub(m.lastShow) < interval {
+		return
+	}
+	m.lastShow = now
+	m.show(now, false)
+}
+
+// Done shows the final progress of the work.
+func (m *Meter) Done() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Work that finished without ever showing progress is not worth
+	// reporting.
+	if !m.drawn && !Interactive {
+		return
+	}
+	m.show(time.Now(), true)
+}
+
+// Writer returns a writer that records the bytes written to w.
+func (m *Meter) Writer(w io.Writer) io.Writer {
+	if m == nil {
+		return w
+	}
+	return meterWriter{w: w, m: m}
+}
+
+// Reader returns a reader that records the bytes read from r.
+func (m *Meter) Reader(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return meterReader{r: r, m: m}
+}
+
+func (m *Meter) show(now time.Time, final bool) {
+	elapsed := now.Sub(m.started)
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(m.done) / elapsed.Seconds()
+	}
+
+	var b strings.Builder
+	b.WriteString(m.label + ": ")
+	if m.total > 0 {
+		fraction := float64(m.done) / float64(m.total)
+		if fraction > 1 {
+			fraction = 1
+		}
+		if Interactive {
+			filled := int(fraction * barWidth)
+			b.WriteString("[" + strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled) + "] ")
+		}
+		fmt.Fprintf(&b, "%s of %s (%.0f%%)", FormatBytes(m.done), FormatBytes(m.total), fraction*100)
+	} else {
+		b.WriteString(FormatBytes(m.done))
+	}
+	fmt.Fprintf(&b, ", %s/s", FormatBytes(int64(rate)))
+	switch {
+	case final:
+		fmt.Fprintf(&b, ", took %s", elapsed.Round(time.Second))
+	case m.total > m.done && rate > 0:
+		eta := time.Duration(float64(m.total-m.done) / rate * float64(time.Second))
+		fmt.Fprintf(&b, ", ETA %s", eta.Round(time.Second))
+	}
+
+	if !Interactive {
+		fmt.Fprintln(Output, b.String())
+		m.drawn = true
+		return
+	}
+	// Clear the rest of the line, which may hold a longer previous draw.
+	fmt.Fprintf(Output, "\r%s\x1b[K", b.String())
+	if final {
+		fmt.Fprintln(Output)
+	}
+	m.drawn = true
+}
+
+type meterWriter struct {
+	w io.Writer
+	m *Meter
+}
+
+func (w meterWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.m.Add(int64(n))
+	return n, err
+}
+
+type meterReader struct {
+	r io.Reader
+	m *Meter
+}
+
+func (r meterReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.m.Add(int64(n))
+	return n, err
+}
+
+// FormatBytes formats the number of bytes in binary units.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
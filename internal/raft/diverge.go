@@ -0,0 +1,67 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package raft
+
+// Divergence describes how two histories relate to each other.
+type Divergence struct {
+	// Known is false if the histories do not overlap, so the point at which
+	// they part cannot be determined.
+	Known bool
+	// Common is the last position both histories agree on.
+	Common Position
+	// AOnly and BOnly are the number of entries in each history after the
+	// common position.
+	AOnly, BOnly uint64
+}
+
+// Diverged reports whether both histories have entries the other does not,
+// which happens when nodes commit independently after losing contact.
+func (d Divergence) Diverged() bool {
+	return d.Known && d.AOnly > 0 && d.BOnly > 0
+}
+
+// Diverge compares two histories. By the raft log matching property, if both
+// have an entry with the same index and term, all the entries before it are
+// identical too.
+func Diverge(a, b History) Divergence {
+	lastA, lastB := a.Last(), b.Last()
+	top := lastA.Index
+	if lastB.Index < top {
+		top = lastB.Index
+	}
+
+	bottom := a.earliest()
+	if b.earliest() > bottom {
+		bottom = b.earliest()
+	}
+
+	for index := top; index >= bottom && index > 0; index-- {
+		termA, okA := a.Term(index)
+		termB, okB := b.Term(index)
+		if okA && okB && termA == termB {
+			common := Position{Index: index, Term: termA}
+			return Divergence{
+				Known:  true,
+				Common: common,
+				AOnly:  lastA.Index - index,
+				BOnly:  lastB.Index - index,
+			}
+		}
+	}
+	return Divergence{}
+}
+
+// Freshest returns the index of the history with the most recent last entry,
+// by term and then by index, or -1 if there are none.
+func Freshest(histories []History) int {
+	best := -1
+	var bestLast Position
+	for i, h := range histories {
+		last := h.Last()
+		if best == -1 || last.Term > bestLast.Term || last.Term == bestLast.Term && last.Index > bestLast.Index {
+			best, bestLast = i, last
+		}
+	}
+	return best
+}
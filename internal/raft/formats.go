@@ -0,0 +1,79 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package raft
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+)
+
+// diskFormat is the only on-disk format version of raft's snapshot
+// metadata files.
+const diskFormat = 1
+
+// Formats are the on-disk format versions of the raft data in a Dqlite data
+// directory. A zero version means there is no such file.
+type Formats struct {
+	Segment  uint64 `json:"segment,omitempty"`
+	Snapshot uint64 `json:"snapshot,omitempty"`
+}
+
+// ReadFormats returns the format versions of the first segment and
+// the latest snapshot's metadata in the Dqlite data directory.
+func ReadFormats(dir string) (Formats, error) {
+	segs, err := listSegments(dir)
+	if err != nil {
+		return Formats{}, errors.Trace(err)
+	}
+	var formats Formats
+	if all := append(segs.closed, segs.open...); len(all) > 0 {
+		if formats.Segment, err = readFormat(filepath.Join(dir, all[0].name)); err != nil {
+			return Formats{}, errors.Annotatef(err, "segment %s", all[0].name)
+		}
+	}
+	latest, err := LatestSnapshot(dir)
+	if err != nil {
+		return Formats{}, errors.Trace(err)
+	}
+	if latest != "" {
+		if formats.Snapshot, err = readFormat(latest + ".meta"); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return Formats{}, errors.Annotatef(err, "snapshot %s", filepath.Base(latest))
+		}
+	}
+	return formats, nil
+}
+
+// Check returns an error if any of the formats is not one this tool, and the
+// Dqlite it supports, can read.
+func (f Formats) Check() error {
+	if f.Segment != 0 && f.Segment != segmentFormat {
+		return errors.NotSupportedf("raft segment format %d", f.Segment)
+	}
+	if f.Snapshot != 0 && f.Snapshot != diskFormat {
+		return errors.NotSupportedf("raft snapshot format %d", f.Snapshot)
+	}
+	return nil
+}
+
+// readFormat reads the format version at the start of a raft file, or zero
+// if the file is too short to hold one.
+func readFormat(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var format uint64
+	if err := binary.Read(f, binary.LittleEndian, &format); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return format, nil
+}
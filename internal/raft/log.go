@@ -0,0 +1,315 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// segmentFormat is the only on-disk format version of raft segments.
+const segmentFormat = 1
+
+// Position identifies an entry in the log.
+type Position struct {
+	Index uint64
+	Term  uint64
+}
+
+// History is the raft log of a single node, as found in its data directory.
+type History struct {
+	// Snapshot is the position of the most recent snapshot, if any. Entries
+	// up to it may have been removed from the log.
+	Snapshot *Position
+	// First is the index of the first entry in Terms.
+	First uint64
+	// Terms holds the term of each entry in the log, from First.
+	Terms []uint64
+}
+
+// Last returns the position of the last entry in the history.
+func (h History) Last() Position {
+	if len(h.Terms) > 0 {
+		return Position{Index: h.First + uint64(len(h.Terms)) - 1, Term: h.Terms[len(h.Terms)-1]}
+	}
+	if h.Snapshot != nil {
+		return *h.Snapshot
+	}
+	return Position{}
+}
+
+// Term returns the term of the entry at the index, if it is known.
+func (h History) Term(index uint64) (uint64, bool) {
+	if len(h.Terms) > 0 && index >= h.First && index < h.First+uint64(len(h.Terms)) {
+		return h.Terms[index-h.First], true
+	}
+	if h.Snapshot != nil && h.Snapshot.Index == index {
+		return h.Snapshot.Term, true
+	}
+	return 0, false
+}
+
+// earliest returns the lowest index whose term is known.
+func (h History) earliest() uint64 {
+	if h.Snapshot != nil && (len(h.Terms) == 0 || h.Snapshot.Index < h.First) {
+		return h.Snapshot.Index
+	}
+	return h.First
+}
+
+type segment struct {
+	name  string
+	first uint64
+	open  uint64
+}
+
+// segments lists the raft files in a Dqlite data directory.
+type segments struct {
+	snapshot *Position
+	closed   []segment
+	open     []segment
+	// lastEnd is the index of the last entry in a closed segment.
+	lastEnd uint64
+}
+
+func listSegments(dir string) (segments, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return segments{}, errors.Trace(err)
+	}
+
+	var segs segments
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasPrefix(name, "snapshot-"):
+			// The metadata file alone is enough, so that the snapshot
+			// data does not need to be copied from other nodes.
+			var term, index, timestamp uint64
+			if _, err := fmt.Sscanf(name, "snapshot-%d-%d-%d", &term, &index, &timestamp); err != nil {
+				continue
+			}
+			if segs.snapshot == nil || index > segs.snapshot.Index {
+				segs.snapshot = &Position{Index: index, Term: term}
+			}
+		case strings.HasPrefix(name, "open-"):
+			counter, err := strconv.ParseUint(strings.TrimPrefix(name, "open-"), 10, 64)
+			if err == nil {
+				segs.open = append(segs.open, segment{name: name, open: counter})
+			}
+		default:
+			var first, end uint64
+			if _, err := fmt.Sscanf(name, "%016d-%016d", &first, &end); err == nil {
+				segs.closed = append(segs.closed, segment{name: name, first: first})
+				if end > segs.lastEnd {
+					segs.lastEnd = end
+				}
+			}
+		}
+	}
+	sort.Slice(segs.closed, func(i, j int) bool { return segs.closed[i].first < segs.closed[j].first })
+	sort.Slice(segs.open, func(i, j int) bool { return segs.open[i].open < segs.open[j].open })
+	return segs, nil
+}
+
+// ReadHistory reads the raft log in the Dqlite data directory.
+func ReadHistory(dir string) (History, error) {
+	segs, err := listSegments(dir)
+	if err != nil {
+		return History{}, errors.Trace(err)
+	}
+
+	history := History{Snapshot: segs.snapshot}
+	err = walkEntries(dir, segs, false, func(_ string, first uint64, entries []entry) error {
+		if len(history.Terms) == 0 || first != history.First+uint64(len(history.Terms)) {
+			// A gap means older segments were removed after a snapshot,
+			// so only the most recent contiguous run is kept.
+			history.First, history.Terms = first, nil
+		}
+		for _, e := range entries {
+			history.Terms = append(history.Terms, e.term)
+		}
+		return nil
+	})
+	return history, errors.Trace(err)
+}
+
+// walkEntries calls fn with the name of each segment holding entries, in
+// order, along with the index of its first entry and the entries it holds.
+func walkEntries(
+	dir string, segs segments, withData bool, fn func(name string, first uint64, entries []entry) error,
+) error {
+	next, hasEntry := uint64(0), false
+	for _, seg := range segs.closed {
+		entries, err := readEntries(filepath.Join(dir, seg.name), false, false, withData)
+		if err != nil {
+			return errors.Annotatef(err, "reading segment %s", seg.name)
+		}
+		if len(entries) > 0 {
+			if err := fn(seg.name, seg.first, entries); err != nil {
+				return errors.Trace(err)
+			}
+			next, hasEntry = seg.first+uint64(len(entries)), true
+		}
+	}
+
+	// Open segments carry on from the last closed segment, or the snapshot.
+	if !hasEntry {
+		next = segs.lastEnd + 1
+		if segs.snapshot != nil && segs.snapshot.Index >= next {
+			next = segs.snapshot.Index + 1
+		}
+	}
+	for _, seg := range segs.open {
+		entries, err := readEntries(filepath.Join(dir, seg.name), false, true, withData)
+		if err != nil {
+			return errors.Annotatef(err, "reading segment %s", seg.name)
+		}
+		if len(entries) > 0 {
+			if err := fn(seg.name, next, entries); err != nil {
+				return errors.Trace(err)
+			}
+			next += uint64(len(entries))
+		}
+	}
+	return nil
+}
+
+// entry is a raft log entry. Its data is only read when asked for.
+type entry struct {
+	term uint64
+	typ  uint8
+	data []byte
+}
+
+// readEntries returns the entries in the segment file. Open segments are
+// preallocated, so reading stops at the first empty batch. When verifying,
+// the checksums of each batch are checked, and a batch cut short is only
+// tolerated at the end of an open segment, where it is a torn write.
+func readEntries(path string, verify, open, withData bool) ([]entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer func() { _ = f.Close() }()
+	r := bufio.NewReader(f)
+
+	var format uint64
+	if err := binary.Read(r, binary.LittleEndian, &format); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if format == 0 {
+		return nil, nil
+	}
+	if format != segmentFormat {
+		return nil, errors.NotSupportedf("segment format %d", format)
+	}
+
+	torn := func(entries []entry, batch int, what string) ([]entry, error) {
+		if verify && !open {
+			return entries, errors.NotValidf("batch %d with %s", batch, what)
+		}
+		return entries, nil
+	}
+
+	var entries []entry
+	for batch := 0; ; batch++ {
+		// Each batch starts with the checksums of its header and data,
+		// followed by the header: the number of entries, then a header
+		// for each entry.
+		var preamble [16]byte
+		if _, err := io.ReadFull(r, preamble[:]); err == io.EOF {
+			return entries, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return torn(entries, batch, "a truncated preamble")
+		} else if err != nil {
+			return entries, errors.Trace(err)
+		}
+		headerSum := binary.LittleEndian.Uint32(preamble[0:])
+		dataSum := binary.LittleEndian.Uint32(preamble[4:])
+		n := binary.LittleEndian.Uint64(preamble[8:])
+		if n == 0 {
+			return entries, nil
+		}
+		if n > 1<<20 {
+			return torn(entries, batch, fmt.Sprintf("%d entries", n))
+		}
+
+		headers := make([]byte, 16*n)
+		if _, err := io.ReadFull(r, headers); err != nil {
+			// A torn write at the end of an open segment.
+			return torn(entries, batch, "truncated entry headers")
+		}
+		if verify {
+			sum := crc32.Update(crc32.ChecksumIEEE(preamble[8:]), crc32.IEEETable, headers)
+			if sum != headerSum {
+				return entries, errors.NotValidf("batch %d header checksum", batch)
+			}
+		}
+
+		var size uint64
+		batchEntries := make([]entry, n)
+		sizes := make([]uint64, n)
+		for i := uint64(0); i < n; i++ {
+			header := headers[16*i:]
+			batchEntries[i] = entry{term: binary.LittleEndian.Uint64(header), typ: header[8]}
+			sizes[i] = uint64(binary.LittleEndian.Uint32(header[12:]))
+			size += (sizes[i] + 7) &^ 7
+		}
+
+		if !verify && !withData {
+			if _, err := r.Discard(int(size)); err != nil {
+				// Drop the entries of a batch whose data was not written.
+				return entries, nil
+			}
+		} else {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return torn(entries, batch, "truncated data")
+			}
+			if verify && crc32.ChecksumIEEE(data) != dataSum {
+				return entries, errors.NotValidf("batch %d data checksum", batch)
+			}
+			if withData {
+				for i := range batchEntries {
+					batchEntries[i].data = data[:sizes[i]]
+					data = data[(sizes[i]+7)&^7:]
+				}
+			}
+		}
+		entries = append(entries, batchEntries...)
+	}
+}
+
+// writeSegment writes the entries to a new closed segment file, one batch
+// per entry.
+func writeSegment(path string, entries []entry) error {
+	buf := binary.LittleEndian.AppendUint64(nil, segmentFormat)
+	for _, e := range entries {
+		header := binary.LittleEndian.AppendUint64(nil, 1)
+		header = binary.LittleEndian.AppendUint64(header, e.term)
+		header = append(header, e.typ, 0, 0, 0)
+		header = binary.LittleEndian.AppendUint32(header, uint32(len(e.data)))
+		data := make([]byte, (len(e.data)+7)&^7)
+		copy(data, e.data)
+
+		buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(header))
+		buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(data))
+		buf = append(buf, header...)
+		buf = append(buf, data...)
+	}
+	return errors.Trace(os.WriteFile(path, buf, 0600))
+}
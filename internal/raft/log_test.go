@@ -0,0 +1,195 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEntries returns n entries starting at the index, in the term, each
+// holding data naming its index so that entries moved between segments can
+// be told apart.
+func testEntries(first uint64, n int, term uint64) []entry {
+	entries := make([]entry, n)
+	for i := range entries {
+		index := first + uint64(i)
+		entries[i] = entry{term: term, typ: 1, data: bytes.Repeat([]byte{byte(index)}, int(index%11))}
+	}
+	return entries
+}
+
+// testSegment is a segment file to write: a closed segment holding the
+// entries from first, or the open segment with the counter.
+type testSegment struct {
+	first   uint64
+	open    uint64
+	entries []entry
+}
+
+// writeTestSegments writes the segments to the directory. Open segments are
+// followed by the zeroes of the space raft preallocates.
+func writeTestSegments(t *testing.T, dir string, segs []testSegment) {
+	t.Helper()
+	for _, seg := range segs {
+		name := fmt.Sprintf("open-%d", seg.open)
+		if seg.open == 0 {
+			name = fmt.Sprintf("%016d-%016d", seg.first, seg.first+uint64(len(seg.entries))-1)
+		}
+		path := filepath.Join(dir, name)
+		if err := writeSegment(path, seg.entries); err != nil {
+			t.Fatal(err)
+		}
+		if seg.open == 0 {
+			continue
+		}
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write(make([]byte, 4096))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertEntries(t *testing.T, got, want []entry) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].term != want[i].term || got[i].typ != want[i].typ || !bytes.Equal(got[i].data, want[i].data) {
+			t.Fatalf("entry %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWriteSegmentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []entry
+	}{{
+		name: "no entries",
+	}, {
+		name:    "empty data",
+		entries: []entry{{term: 1, typ: 1}},
+	}, {
+		name:    "data padded to eight bytes",
+		entries: []entry{{term: 1, typ: 1, data: []byte("a")}, {term: 2, typ: 2, data: []byte("12345678")}, {term: 2, typ: 1, data: []byte("123456789")}},
+	}, {
+		name:    "many entries",
+		entries: testEntries(1, 100, 3),
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "0000000000000001-0000000000000001")
+			if err := writeSegment(path, test.entries); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readEntries(path, true, false, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEntries(t, got, test.entries)
+		})
+	}
+}
+
+func TestReadEntriesDamaged(t *testing.T) {
+	entries := testEntries(1, 3, 1)
+	// The offsets into a segment of the test entries: the format, then a
+	// batch per entry of 16 bytes of preamble, 16 of entry header, and 8 of
+	// padded data.
+	const (
+		firstHeader = 8 + 16
+		firstData   = firstHeader + 16
+		lastBatch   = 8 + (32 + 8) + (32 + 8)
+	)
+	tests := []struct {
+		name   string
+		damage func([]byte) []byte
+		open   bool
+		// want is the number of entries read, and err the error when
+		// verifying, if any.
+		want int
+		err  string
+	}{{
+		name:   "header checksum",
+		damage: func(b []byte) []byte { b[firstHeader] ^= 0xff; return b },
+		want:   0,
+		err:    "batch 0 header checksum not valid",
+	}, {
+		name:   "data checksum",
+		damage: func(b []byte) []byte { b[firstData] ^= 0xff; return b },
+		want:   0,
+		err:    "batch 0 data checksum not valid",
+	}, {
+		name:   "closed segment cut short",
+		damage: func(b []byte) []byte { return b[:lastBatch+20] },
+		want:   2,
+		err:    "batch 2 with truncated entry headers not valid",
+	}, {
+		name:   "open segment torn write",
+		damage: func(b []byte) []byte { return b[:lastBatch+20] },
+		open:   true,
+		want:   2,
+	}, {
+		name:   "open segment preallocated",
+		damage: func(b []byte) []byte { return append(b, make([]byte, 4096)...) },
+		open:   true,
+		want:   3,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "segment")
+			if err := writeSegment(path, entries); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, test.damage(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readEntries(path, true, test.open, true)
+			switch {
+			case test.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Fatalf("got error %v, want %q", err, test.err)
+			}
+			assertEntries(t, got, entries[:test.want])
+		})
+	}
+}
+
+func TestReadHistory(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSegments(t, dir, []testSegment{
+		{first: 1, entries: testEntries(1, 3, 1)},
+		{first: 4, entries: testEntries(4, 2, 2)},
+		{open: 1, entries: testEntries(6, 2, 3)},
+	})
+	history, err := ReadHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.First != 1 || len(history.Terms) != 7 {
+		t.Fatalf("got entries %d to %d, want 1 to 7", history.First, history.Last().Index)
+	}
+	if last := history.Last(); last != (Position{Index: 7, Term: 3}) {
+		t.Fatalf("got last entry %+v, want 7 in term 3", last)
+	}
+}
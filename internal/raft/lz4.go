@@ -0,0 +1,158 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package raft
+
+import (
+	"encoding/binary"
+
+	"github.com/juju/errors"
+)
+
+// lz4Magic starts an LZ4 frame. Raft compresses snapshots with LZ4 when it
+// is built with LZ4 support.
+const lz4Magic = 0x184D2204
+
+// isLZ4 reports whether the data is an LZ4 frame.
+func isLZ4(data []byte) bool {
+	return len(data) >= 4 && binary.LittleEndian.Uint32(data) == lz4Magic
+}
+
+// decompressLZ4 decodes a sequence of LZ4 frames. Checksums are not verified.
+func decompressLZ4(data []byte) ([]byte, error) {
+	var out []byte
+	for len(data) > 0 {
+		if !isLZ4(data) {
+			return nil, errors.NotValidf("LZ4 frame magic")
+		}
+		data = data[4:]
+		if len(data) < 3 {
+			return nil, errors.NotValidf("truncated LZ4 frame descriptor")
+		}
+		flags := data[0]
+		if flags>>6 != 1 {
+			return nil, errors.NotSupportedf("LZ4 frame version %d", flags>>6)
+		}
+		blockChecksum := flags&0x10 != 0
+		contentSize := flags&0x08 != 0
+		contentChecksum := flags&0x04 != 0
+		dictID := flags&0x01 != 0
+
+		// Flags, block descriptor, optional fields, then the header checksum.
+		skip := 2
+		if contentSize {
+			skip += 8
+		}
+		if dictID {
+			skip += 4
+		}
+		skip++
+		if len(data) < skip {
+			return nil, errors.NotValidf("truncated LZ4 frame descriptor")
+		}
+		data = data[skip:]
+
+		for {
+			if len(data) < 4 {
+				return nil, errors.NotValidf("truncated LZ4 block")
+			}
+			size := binary.LittleEndian.Uint32(data)
+			data = data[4:]
+			if size == 0 {
+				break
+			}
+			uncompressed := size&0x80000000 != 0
+			size &^= 0x80000000
+			if uint64(len(data)) < uint64(size) {
+				return nil, errors.NotValidf("truncated LZ4 block")
+			}
+			block := data[:size]
+			data = data[size:]
+			if blockChecksum {
+				if len(data) < 4 {
+					return nil, errors.NotValidf("truncated LZ4 block checksum")
+				}
+				data = data[4:]
+			}
+
+			if uncompressed {
+				out = append(out, block...)
+				continue
+			}
+			var err error
+			if out, err = decodeLZ4Block(out, block); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		if contentChecksum {
+			if len(data) < 4 {
+				return nil, errors.NotValidf("truncated LZ4 content checksum")
+			}
+			data = data[4:]
+		}
+	}
+	return out, nil
+}
+
+// decodeLZ4Block appends the decoded LZ4 block to out. Matches may refer
+// back into earlier blocks, as raft writes linked blocks.
+func decodeLZ4Block(out, block []byte) ([]byte, error) {
+	for i := 0; i < len(block); {
+		token := block[i]
+		i++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			for {
+				if i >= len(block) {
+					return nil, errors.NotValidf("truncated LZ4 literal length")
+				}
+				b := block[i]
+				i++
+				literals += int(b)
+				if b != 255 {
+					break
+				}
+			}
+		}
+		if i+literals > len(block) {
+			return nil, errors.NotValidf("truncated LZ4 literals")
+		}
+		out = append(out, block[i:i+literals]...)
+		i += literals
+		if i == len(block) {
+			// The last sequence has only literals.
+			break
+		}
+
+		if i+2 > len(block) {
+			return nil, errors.NotValidf("truncated LZ4 match offset")
+		}
+		offset := int(binary.LittleEndian.Uint16(block[i:]))
+		i += 2
+		if offset == 0 || offset > len(out) {
+			return nil, errors.NotValidf("LZ4 match offset %d", offset)
+		}
+
+		match := int(token&0x0f) + 4
+		if token&0x0f == 15 {
+			for {
+				if i >= len(block) {
+					return nil, errors.NotValidf("truncated LZ4 match length")
+				}
+				b := block[i]
+				i++
+				match += int(b)
+				if b != 255 {
+					break
+				}
+			}
+		}
+		// Matches may overlap the bytes being written, so copy bytewise.
+		start := len(out) - offset
+		for j := 0; j < match; j++ {
+			out = append(out, out[start+j])
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// changeEntry is the type of a log entry holding a configuration.
+	changeEntry = 3
+	// configurationFormat is the only encoding version of configurations.
+	configurationFormat = 1
+	// metaFormat is the only format version of snapshot metadata files.
+	metaFormat = 1
+)
+
+// Role is the role of a server in a raft configuration. Raft numbers them
+// differently to Dqlite.
+type Role uint8
+
+// Raft roles.
+const (
+	StandBy Role = 0
+	Voter   Role = 1
+	Spare   Role = 2
+)
+
+// Server is a server in a raft configuration.
+type Server struct {
+	ID      uint64
+	Address string
+	Role    Role
+}
+
+// Membership is the configuration raft starts with: that of the last
+// configuration change in the log or, failing that, of the latest snapshot.
+type Membership struct {
+	// Index is the index of the entry the configuration was taken from.
+	Index uint64
+	// FromSnapshot is whether the configuration was taken from the latest
+	// snapshot's metadata rather than from a log entry.
+	FromSnapshot bool
+	Servers      []Server
+}
+
+// ReadMembership reads the membership raft will start with from the log
+// and snapshots in the Dqlite data directory.
+func ReadMembership(dir string) (Membership, error) {
+	segs, err := listSegments(dir)
+	if err != nil {
+		return Membership{}, errors.Trace(err)
+	}
+
+	var (
+		latest []byte
+		index  uint64
+	)
+	err = walkEntries(dir, segs, true, func(_ string, first uint64, entries []entry) error {
+		for i, e := range entries {
+			if e.typ == changeEntry {
+				latest, index = e.data, first+uint64(i)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Membership{}, errors.Trace(err)
+	}
+	if latest != nil {
+		servers, err := decodeConfiguration(latest)
+		if err != nil {
+			return Membership{}, errors.Annotatef(err, "decoding configuration at index %d", index)
+		}
+		return Membership{Index: index, Servers: servers}, nil
+	}
+
+	if segs.snapshot == nil {
+		return Membership{}, errors.NotFoundf("configuration in the raft log or a snapshot")
+	}
+	path, err := LatestSnapshot(dir)
+	if err != nil {
+		return Membership{}, errors.Trace(err)
+	}
+	if path == "" {
+		return Membership{}, errors.NotFoundf("snapshot metadata")
+	}
+	servers, index, err := readSnapshotConfiguration(path + ".meta")
+	if err != nil {
+		return Membership{}, errors.Annotatef(err, "reading %s.meta", path)
+	}
+	return Membership{Index: index, FromSnapshot: true, Servers: servers}, nil
+}
+
+// readSnapshotConfiguration reads the configuration held in a snapshot's
+// metadata file, along with the index it was taken at.
+func readSnapshotConfiguration(path string) ([]Server, uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	// The header holds the format, a checksum of the rest, the
+	// configuration's index and its length.
+	if len(data) < 32 {
+		return nil, 0, errors.NotValidf("truncated snapshot metadata")
+	}
+	if format := binary.LittleEndian.Uint64(data); format != metaFormat {
+		return nil, 0, errors.NotSupportedf("snapshot metadata format %d", format)
+	}
+	sum := binary.LittleEndian.Uint64(data[8:])
+	index := binary.LittleEndian.Uint64(data[16:])
+	size := binary.LittleEndian.Uint64(data[24:])
+	if size > uint64(len(data)-32) {
+		return nil, 0, errors.NotValidf("truncated snapshot configuration")
+	}
+	if uint64(crc32.ChecksumIEEE(data[16:32+size])) != sum {
+		return nil, 0, errors.NotValidf("snapshot metadata checksum")
+	}
+	servers, err := decodeConfiguration(data[32 : 32+size])
+	return servers, index, errors.Trace(err)
+}
+
+// decodeConfiguration decodes a configuration: its format, the number of
+// servers, then the ID, nul-terminated address and role of each.
+func decodeConfiguration(data []byte) ([]Server, error) {
+	if len(data) < 9 || data[0] != configurationFormat {
+		return nil, errors.NotValidf("configuration")
+	}
+	n := binary.LittleEndian.Uint64(data[1:])
+	data = data[9:]
+	if n > uint64(len(data)) {
+		return nil, errors.NotValidf("configuration of %d servers", n)
+	}
+
+	servers := make([]Server, n)
+	for i := range servers {
+		if len(data) < 8 {
+			return nil, errors.NotValidf("truncated configuration")
+		}
+		servers[i].ID = binary.LittleEndian.Uint64(data)
+		data = data[8:]
+		end := bytes.IndexByte(data, 0)
+		if end < 0 || end+1 >= len(data) {
+			return nil, errors.NotValidf("truncated configuration")
+		}
+		servers[i].Address = string(data[:end])
+		servers[i].Role = Role(data[end+1])
+		data = data[end+2:]
+	}
+	return servers, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// snapshotFormat is the only format version of Dqlite FSM snapshots.
+const snapshotFormat = 1
+
+// SnapshotDatabase is a database held in a Dqlite snapshot.
+type SnapshotDatabase struct {
+	Name string
+	Main []byte
+	WAL  []byte
+}
+
+// LatestSnapshot returns the path of the most recent snapshot data file in the
+// Dqlite data directory, or an empty string if there is none.
+func LatestSnapshot(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	var (
+		latest string
+		last   uint64
+	)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "snapshot-") || strings.HasSuffix(name, ".meta") {
+			continue
+		}
+		var term, index, timestamp uint64
+		if _, err := fmt.Sscanf(name, "snapshot-%d-%d-%d", &term, &index, &timestamp); err != nil {
+			continue
+		}
+		if latest == "" || index > last {
+			latest, last = filepath.Join(dir, name), index
+		}
+	}
+	return latest, nil
+}
+
+// LatestSnapshotTaken returns the index of the most recent snapshot in the
+// Dqlite data directory, and when it was taken, or a zero index if there is
+// none.
+func LatestSnapshotTaken(dir string) (uint64, time.Time, error) {
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return 0, time.Time{}, errors.Trace(err)
+	}
+	var latest snapshotFiles
+	for _, snapshot := range snapshots {
+		if snapshot.index > latest.index {
+			latest = snapshot
+		}
+	}
+	return latest.index, latest.taken, nil
+}
+
+// ReadSnapshotDatabases decodes the databases held in a Dqlite snapshot data
+// file, decompressing it first if raft wrote it with LZ4.
+func ReadSnapshotDatabases(path string) ([]SnapshotDatabase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if isLZ4(data) {
+		if data, err = decompressLZ4(data); err != nil {
+			return nil, errors.Annotate(err, "decompressing snapshot")
+		}
+	}
+
+	r := snapshotReader{data: data}
+	format, n := r.uint64(), r.uint64()
+	if r.err != nil {
+		return nil, errors.Annotate(r.err, "reading snapshot header")
+	}
+	if format != snapshotFormat {
+		return nil, errors.NotSupportedf("snapshot format %d", format)
+	}
+
+	var databases []SnapshotDatabase
+	for i := uint64(0); i < n; i++ {
+		name := r.text()
+		mainSize, walSize := r.uint64(), r.uint64()
+		db := SnapshotDatabase{Name: name}
+		db.Main = r.bytes(mainSize)
+		db.WAL = r.bytes(walSize)
+		if r.err != nil {
+			return nil, errors.Annotatef(r.err, "reading database %d", i)
+		}
+		databases = append(databases, db)
+	}
+	return databases, nil
+}
+
+// snapshotReader decodes the fields of a snapshot, remembering the first
+// error so that it only needs checking once per record.
+type snapshotReader struct {
+	data []byte
+	err  error
+}
+
+func (r *snapshotReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.err = errors.NotValidf("truncated snapshot")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *snapshotReader) uint64() uint64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// text reads a nul-terminated string padded to a multiple of 8 bytes.
+func (r *snapshotReader) text() string {
+	if r.err != nil {
+		return ""
+	}
+	end := bytes.IndexByte(r.data, 0)
+	if end < 0 {
+		r.err = errors.NotValidf("unterminated snapshot string")
+		return ""
+	}
+	s := string(r.data[:end])
+	r.bytes((uint64(end) + 8) &^ 7)
+	return s
+}
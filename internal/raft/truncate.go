@@ -0,0 +1,173 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package raft
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// TruncateLog removes the entries after the index from the raft log in the
+// Dqlite data directory, along with any snapshots taken after it, so that the
+// node only replays the log up to the index when it next starts. It returns
+// the number of entries removed.
+func TruncateLog(dir string, index uint64) (int, error) {
+	history, err := ReadHistory(dir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// The state at the index is rebuilt from the latest snapshot before it,
+	// or from the start of the log, followed by the entries up to it.
+	var base uint64
+	for _, snapshot := range snapshots {
+		if snapshot.index <= index && snapshot.index > base {
+			base = snapshot.index
+		}
+	}
+	last := history.Last().Index
+	switch {
+	case index > last:
+		return 0, errors.Errorf("index %d is after the last entry, %d", index, last)
+	case index > base && (len(history.Terms) == 0 || history.First > base+1):
+		return 0, errors.Errorf("the entries before index %d are no longer in the log, restore an older backup", index)
+	}
+
+	segs, err := listSegments(dir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	var removed int
+	err = walkEntries(dir, segs, true, func(name string, first uint64, entries []entry) error {
+		end := first + uint64(len(entries)) - 1
+		if end <= index {
+			return nil
+		}
+		path := filepath.Join(dir, name)
+		if first <= index {
+			kept := entries[:index-first+1]
+			replacement := filepath.Join(dir, fmt.Sprintf("%016d-%016d", first, index))
+			if err := writeSegment(replacement, kept); err != nil {
+				return errors.Trace(err)
+			}
+			entries = entries[len(kept):]
+		}
+		removed += len(entries)
+		return errors.Trace(os.Remove(path))
+	})
+	if err != nil {
+		return removed, errors.Trace(err)
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.index <= index {
+			continue
+		}
+		for _, name := range snapshot.files {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return removed, errors.Trace(err)
+			}
+		}
+	}
+	return removed, nil
+}
+
+// IndexAt returns the index of the last entry known to have been written at
+// or before the time. Entries carry no timestamps, so this relies on the times
+// snapshots were taken and the modification times of the segments, and may be
+// earlier than the last entry actually written by then.
+func IndexAt(dir string, t time.Time) (uint64, error) {
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	var (
+		index uint64
+		found bool
+	)
+	consider := func(i uint64, written time.Time) {
+		if !written.After(t) && (!found || i > index) {
+			index, found = i, true
+		}
+	}
+	for _, snapshot := range snapshots {
+		consider(snapshot.index, snapshot.taken)
+	}
+
+	segs, err := listSegments(dir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	err = walkEntries(dir, segs, false, func(name string, first uint64, entries []entry) error {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		consider(first+uint64(len(entries))-1, info.ModTime())
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if !found {
+		return 0, errors.NotFoundf("raft log entries written before %s", t.Format(time.RFC3339))
+	}
+	return index, nil
+}
+
+type snapshotFiles struct {
+	index uint64
+	taken time.Time
+	files []string
+}
+
+// listSnapshots returns the snapshots in the Dqlite data directory, with the
+// data and metadata files of each. The timestamp in a snapshot's name is
+// libuv's loop time, which is monotonic rather than the time of day, so when
+// a snapshot was taken comes from the modification time of its metadata
+// file, which raft writes last, or of its data file without one.
+func listSnapshots(dir string) ([]snapshotFiles, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	byName := make(map[string]*snapshotFiles)
+	var snapshots []*snapshotFiles
+	for _, entry := range entries {
+		name := entry.Name()
+		var term, index, timestamp uint64
+		if _, err := fmt.Sscanf(name, "snapshot-%d-%d-%d", &term, &index, &timestamp); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		key := strings.TrimSuffix(name, ".meta")
+		snapshot, ok := byName[key]
+		if !ok {
+			snapshot = &snapshotFiles{index: index}
+			byName[key] = snapshot
+			snapshots = append(snapshots, snapshot)
+		}
+		snapshot.files = append(snapshot.files, name)
+		if name != key || snapshot.taken.IsZero() {
+			snapshot.taken = info.ModTime()
+		}
+	}
+	result := make([]snapshotFiles, len(snapshots))
+	for i, snapshot := range snapshots {
+		result[i] = *snapshot
+	}
+	return result, nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package raft
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncateLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		segments  []testSegment
+		snapshots []Position
+		index     uint64
+		// err is the error expected, if any, in which case nothing must
+		// have changed.
+		err string
+		// removed is the number of entries removed, and files the files
+		// left behind.
+		removed int
+		files   []string
+	}{{
+		name: "within a closed segment",
+		segments: []testSegment{
+			{first: 1, entries: testEntries(1, 3, 1)},
+			{first: 4, entries: testEntries(4, 3, 2)},
+		},
+		index:   5,
+		removed: 1,
+		files:   []string{"0000000000000001-0000000000000003", "0000000000000004-0000000000000005"},
+	}, {
+		name: "at the end of a closed segment",
+		segments: []testSegment{
+			{first: 1, entries: testEntries(1, 3, 1)},
+			{first: 4, entries: testEntries(4, 3, 2)},
+		},
+		index:   3,
+		removed: 3,
+		files:   []string{"0000000000000001-0000000000000003"},
+	}, {
+		name: "at the last entry",
+		segments: []testSegment{
+			{first: 1, entries: testEntries(1, 3, 1)},
+		},
+		index: 3,
+		files: []string{"0000000000000001-0000000000000003"},
+	}, {
+		name: "within an open segment",
+		segments: []testSegment{
+			{first: 1, entries: testEntries(1, 3, 1)},
+			{open: 1, entries: testEntries(4, 3, 2)},
+		},
+		index:   5,
+		removed: 1,
+		files:   []string{"0000000000000001-0000000000000003", "0000000000000004-0000000000000005"},
+	}, {
+		name: "within an open segment after a snapshot",
+		segments: []testSegment{
+			{open: 1, entries: testEntries(11, 4, 2)},
+			{open: 2, entries: testEntries(15, 2, 3)},
+		},
+		snapshots: []Position{{Index: 10, Term: 1}},
+		index:     12,
+		removed:   4,
+		files:     []string{"0000000000000011-0000000000000012", "snapshot-1-10-100", "snapshot-1-10-100.meta"},
+	}, {
+		name: "removes later snapshots",
+		segments: []testSegment{
+			{first: 1, entries: testEntries(1, 3, 1)},
+			{first: 4, entries: testEntries(4, 3, 2)},
+		},
+		snapshots: []Position{{Index: 2, Term: 1}, {Index: 6, Term: 2}},
+		index:     4,
+		removed:   2,
+		files:     []string{"0000000000000001-0000000000000003", "0000000000000004-0000000000000004", "snapshot-1-2-100", "snapshot-1-2-100.meta"},
+	}, {
+		name: "back to a snapshot with the entries before it removed",
+		segments: []testSegment{
+			{first: 11, entries: testEntries(11, 3, 2)},
+		},
+		snapshots: []Position{{Index: 10, Term: 1}},
+		index:     10,
+		removed:   3,
+		files:     []string{"snapshot-1-10-100", "snapshot-1-10-100.meta"},
+	}, {
+		name: "entries before the index removed",
+		segments: []testSegment{
+			{first: 20, entries: testEntries(20, 5, 2)},
+		},
+		snapshots: []Position{{Index: 10, Term: 1}, {Index: 22, Term: 2}},
+		index:     15,
+		err:       "the entries before index 15 are no longer in the log",
+	}, {
+		name: "entries before the first snapshot removed",
+		segments: []testSegment{
+			{first: 20, entries: testEntries(20, 5, 2)},
+		},
+		snapshots: []Position{{Index: 22, Term: 2}},
+		index:     21,
+		err:       "the entries before index 21 are no longer in the log",
+	}, {
+		name: "after the last entry",
+		segments: []testSegment{
+			{first: 1, entries: testEntries(1, 3, 1)},
+			{open: 1, entries: testEntries(4, 2, 1)},
+		},
+		index: 6,
+		err:   "index 6 is after the last entry, 5",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestSegments(t, dir, test.segments)
+			for _, snapshot := range test.snapshots {
+				name := fmt.Sprintf("snapshot-%d-%d-100", snapshot.Term, snapshot.Index)
+				for _, name := range []string{name, name + ".meta"} {
+					if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			before := readTestLog(t, dir)
+
+			removed, err := TruncateLog(dir, test.index)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				if after := readTestLog(t, dir); fmt.Sprint(after) != fmt.Sprint(before) {
+					t.Fatalf("the log changed after an error: %v, was %v", after, before)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != test.removed {
+				t.Errorf("removed %d entries, want %d", removed, test.removed)
+			}
+
+			var files []string
+			dirEntries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, dirEntry := range dirEntries {
+				files = append(files, dirEntry.Name())
+			}
+			if fmt.Sprint(files) != fmt.Sprint(test.files) {
+				t.Fatalf("got files %v, want %v", files, test.files)
+			}
+
+			// The entries kept are unchanged, and every segment left is
+			// still valid.
+			after := readTestLog(t, dir)
+			want := map[uint64]entry{}
+			for index, e := range before {
+				if index <= test.index {
+					want[index] = e
+				}
+			}
+			if fmt.Sprint(after) != fmt.Sprint(want) {
+				t.Fatalf("got entries %v, want %v", after, want)
+			}
+		})
+	}
+}
+
+// readTestLog returns the entries in the raft log in the directory, by index,
+// verifying each segment.
+func readTestLog(t *testing.T, dir string) map[uint64]entry {
+	t.Helper()
+	segs, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := map[uint64]entry{}
+	err = walkEntries(dir, segs, true, func(name string, first uint64, entries []entry) error {
+		open := strings.HasPrefix(name, "open-")
+		verified, err := readEntries(filepath.Join(dir, name), true, open, true)
+		if err != nil {
+			return err
+		}
+		assertEntries(t, verified, entries)
+		for i, e := range entries {
+			log[first+uint64(i)] = e
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return log
+}
+
+func TestIndexAt(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSegments(t, dir, []testSegment{
+		{first: 1, entries: testEntries(1, 3, 1)},
+		{first: 4, entries: testEntries(4, 3, 2)},
+	})
+
+	if err := os.WriteFile(filepath.Join(dir, "snapshot-1-2-100.meta"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot, then each segment, written an hour apart.
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, name := range []string{"snapshot-1-2-100.meta", "0000000000000001-0000000000000003", "0000000000000004-0000000000000006"} {
+		path := filepath.Join(dir, name)
+		written := start.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path, written, written); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		after time.Duration
+		index uint64
+		err   string
+	}{
+		{after: -time.Minute, err: "not found"},
+		{after: 0, index: 2},
+		{after: 90 * time.Minute, index: 3},
+		{after: 3 * time.Hour, index: 6},
+	}
+	for _, test := range tests {
+		index, err := IndexAt(dir, start.Add(test.after))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("at %v got error %v, want %q", test.after, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("at %v: %v", test.after, err)
+		} else if index != test.index {
+			t.Errorf("at %v got index %d, want %d", test.after, index, test.index)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Usage summarises what the Dqlite data directory holds.
+type Usage struct {
+	// Bytes is the size of all the files in the directory.
+	Bytes int64
+	// Segments is the number of closed and open segments.
+	Segments int
+	// Snapshots is the number of snapshots, and LatestSnapshot when the
+	// latest, that at the highest index, was taken: the modification time
+	// of its metadata file, as the time in its name is not the time of day.
+	Snapshots      int
+	LatestSnapshot time.Time
+}
+
+// ReadUsage summarises the Dqlite data directory.
+func ReadUsage(dir string) (Usage, error) {
+	var usage Usage
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			usage.Bytes += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		return Usage{}, errors.Trace(err)
+	}
+
+	segs, err := listSegments(dir)
+	if err != nil {
+		return Usage{}, errors.Trace(err)
+	}
+	usage.Segments = len(segs.closed) + len(segs.open)
+
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return Usage{}, errors.Trace(err)
+	}
+	usage.Snapshots = len(snapshots)
+	var latest uint64
+	for _, snapshot := range snapshots {
+		if usage.LatestSnapshot.IsZero() || snapshot.index > latest {
+			latest, usage.LatestSnapshot = snapshot.index, snapshot.taken
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package raft
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/progress"
+)
+
+// VerifyLog checks the checksums of every batch in the raft segments of the
+// Dqlite data directory, returning the number of entries found.
+func VerifyLog(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	type segment struct {
+		name       string
+		first, end uint64
+		open       bool
+		size       int64
+	}
+	var (
+		segments []segment
+		total    int64
+	)
+	for _, entry := range entries {
+		seg := segment{name: entry.Name(), open: strings.HasPrefix(entry.Name(), "open-")}
+		if !seg.open {
+			if _, err := fmt.Sscanf(seg.name, "%016d-%016d", &seg.first, &seg.end); err != nil {
+				continue
+			}
+		}
+		if info, err := entry.Info(); err == nil {
+			seg.size = info.Size()
+		}
+		total += seg.size
+		segments = append(segments, seg)
+	}
+	meter := progress.New("verifying the raft log", total)
+
+	var count int
+	for _, seg := range segments {
+		entries, err := readEntries(filepath.Join(dir, seg.name), true, seg.open, false)
+		if err != nil {
+			return count, errors.Annotatef(err, "segment %s", seg.name)
+		}
+		if !seg.open && uint64(len(entries)) != seg.end-seg.first+1 {
+			return count, errors.NotValidf("segment %s with %d entries", seg.name, len(entries))
+		}
+		count += len(entries)
+		meter.Add(seg.size)
+	}
+	meter.Done()
+	return count, nil
+}
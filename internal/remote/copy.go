@@ -0,0 +1,85 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package remote
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/compress"
+)
+
+// CopyDir is part of the Transport interface.
+func (c SSHConfig) CopyDir(ctx context.Context, host, dir, dest string, exclude ...string) error {
+	cmd, _ := c.Command(ctx, host, tarCommand(dir, c.Compression, exclude, shellQuote)...)
+	return copyFrom(cmd, host, dir, dest)
+}
+
+// tarCommand returns the command writing an archive of the directory to
+// stdout, with each argument quoted by quote. The compression program is run
+// by tar, so that its failure fails the command. Symlinks are followed, so
+// that the files they point to are copied, as backups store them.
+func tarCommand(dir string, compression compress.Compression, exclude []string, quote func(string) string) []string {
+	command := []string{"tar", "--dereference", "-C", quote(dir)}
+	if program := compression.Program(); program != "" {
+		command = append(command, "-I", quote(program))
+	}
+	for _, name := range exclude {
+		command = append(command, quote("--exclude=./"+name))
+	}
+	return append(command, "-cf", "-", ".")
+}
+
+// extractTar extracts the regular files and directories in the archive into
+// the destination, refusing any entry that would be written outside it.
+func extractTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return errors.NotValidf("archive entry %q", hdr.Name)
+		}
+		target := filepath.Join(dest, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return errors.Trace(err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return errors.Trace(err)
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				_ = f.Close()
+				return errors.Trace(err)
+			}
+			if err := f.Close(); err != nil {
+				return errors.Trace(err)
+			}
+		default:
+			return errors.NotSupportedf("archive entry %q of type %c", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package remote
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/compress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/retry"
+)
+
+const (
+	// DefaultControllerContainer is the container jujud runs in, in
+	// controller pods.
+	DefaultControllerContainer = "api-server"
+	// DefaultControllerStatefulSet is the stateful set of the controller
+	// pods.
+	DefaultControllerStatefulSet = "controller"
+
+	namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// KubernetesConfig describes how to reach controller pods using kubectl, for
+// controllers running on Kubernetes. Hosts are pod names or pod IPs.
+type KubernetesConfig struct {
+	// Namespace is the namespace of the controller pods.
+	Namespace string
+	// Container is the container to exec into.
+	Container string
+	// Context is the kubeconfig context to use, if not the current one.
+	Context string
+	// Kubeconfig is the path of the kubeconfig file, if not the default.
+	Kubeconfig string
+	// Compression is how directories are compressed while they are copied.
+	Compression compress.Compression
+	// Retry is how commands are retried when the cluster or pod cannot be
+	// reached.
+	Retry retry.Strategy
+}
+
+var _ Transport = KubernetesConfig{}
+
+// InClusterNamespace returns the namespace of the pod the tool is running in,
+// or an empty string if it is not running in a pod.
+func InClusterNamespace() string {
+	data, err := os.ReadFile(namespaceFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Validate checks that the config can be used.
+func (c KubernetesConfig) Validate() error {
+	if c.Namespace == "" {
+		return errors.NotValidf("kubernetes transport without a namespace")
+	}
+	return nil
+}
+
+// kubectl returns a kubectl command with the global flags of the config.
+func (c KubernetesConfig) kubectl(ctx context.Context, args ...string) *exec.Cmd {
+	var global []string
+	if c.Kubeconfig != "" {
+		global = append(global, "--kubeconfig", c.Kubeconfig)
+	}
+	if c.Context != "" {
+		global = append(global, "--context", c.Context)
+	}
+	global = append(global, "--namespace", c.Namespace)
+	return exec.CommandContext(ctx, "kubectl", append(global, args...)...)
+}
+
+// pod returns the name of the pod for the host, looking it up by IP if the
+// host is a pod IP, as it is in cluster.yaml.
+func (c KubernetesConfig) pod(ctx context.Context, host string) (string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) == nil {
+		return host, nil
+	}
+	cmd := c.kubectl(ctx, "get", "pods",
+		"--field-selector", "status.podIP="+host,
+		"--output", "jsonpath={.items[*].metadata.name}")
+	out, err := output(cmd, host, cmd.Args)
+	if err != nil {
+		return "", errors.Annotatef(err, "finding the pod with IP %s", host)
+	}
+	pods := strings.Fields(string(out))
+	if len(pods) != 1 {
+		return "", errors.NotFoundf("a single pod with IP %s, found %d", host, len(pods))
+	}
+	return pods[0], nil
+}
+
+// Command is part of the Transport interface. The command is run directly,
+// as the container user, so arguments are not quoted.
+func (c KubernetesConfig) Command(ctx context.Context, host string, command ...string) (*exec.Cmd, error) {
+	pod, err := c.pod(ctx, host)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	args := []string{"exec", "--stdin", pod}
+	if c.Container != "" {
+		args = append(args, "--container", c.Container)
+	}
+	args = append(args, "--")
+	return c.kubectl(ctx, append(args, command...)...), nil
+}
+
+// Output is part of the Transport interface.
+func (c KubernetesConfig) Output(ctx context.Context, host string, command ...string) ([]byte, error) {
+	return retriedOutput(ctx, c.Retry, host, command, func(ctx context.Context) (*exec.Cmd, error) {
+		return c.Command(ctx, host, command...)
+	}, kubectlUnreachable)
+}
+
+// Quote is part of the Transport interface. kubectl exec runs the command
+// without a shell, so its arguments are passed as given.
+func (c KubernetesConfig) Quote(arg string) string {
+	return arg
+}
+
+// kubectlUnreachable returns whether kubectl failed to reach the API server
+// or the pod, which it only reports in its error messages.
+func kubectlUnreachable(err error) bool {
+	for _, message := range []string{
+		"Unable to connect to the server", "error dialing backend", "connection refused", "i/o timeout",
+	} {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadFile is part of the Transport interface.
+func (c KubernetesConfig) ReadFile(ctx context.Context, host, path string) ([]byte, error) {
+	return c.Output(ctx, host, "cat", path)
+}
+
+// ActiveJujudServices is part of the Transport interface. Controller pods
+// have no systemd, so the jujud process is looked for instead.
+func (c KubernetesConfig) ActiveJujudServices(ctx context.Context, host string) ([]string, error) {
+	out, err := c.Output(ctx, host, "sh", "-c", "grep -lx jujud /proc/[0-9]*/comm || true")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if strings.TrimSpace(string(out)) == "" {
+		return nil, nil
+	}
+	return []string{"jujud"}, nil
+}
+
+// CopyDir is part of the Transport interface.
+func (c KubernetesConfig) CopyDir(ctx context.Context, host, dir, dest string, exclude ...string) error {
+	cmd, err := c.Command(ctx, host, tarCommand(dir, c.Compression, exclude, c.Quote)...)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return copyFrom(cmd, host, dir, dest)
+}
+
+// ScaleStatefulSet sets the number of replicas of the stateful set, for
+// example to stop the other controllers before the backstop is run.
+func (c KubernetesConfig) ScaleStatefulSet(ctx context.Context, name string, replicas int) error {
+	cmd := c.kubectl(ctx, "scale", "statefulset", name, "--replicas", strconv.Itoa(replicas))
+	_, err := output(cmd, name, cmd.Args)
+	return errors.Annotatef(err, "scaling stateful set %s", name)
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ActiveJujudServices is part of the Transport interface.
+func (c SSHConfig) ActiveJujudServices(ctx context.Context, host string) ([]string, error) {
+	out, err := c.Output(ctx, host,
+		"systemctl", "list-units", "--type=service", "--state=active", "--no-legend", "--plain", shellQuote("jujud-*"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseUnits(out), nil
+}
+
+// parseUnits returns the unit names from the output of systemctl list-units.
+func parseUnits(out []byte) []string {
+	var units []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			units = append(units, fields[0])
+		}
+	}
+	return units
+}
+
+// LocalActiveJujudServices returns the names of the jujud services that are
+// active on this machine.
+func LocalActiveJujudServices(ctx context.Context) ([]string, error) {
+	out, err := exec.CommandContext(ctx,
+		"systemctl", "list-units", "--type=service", "--state=active", "--no-legend", "--plain", "jujud-*").Output()
+	if err != nil {
+		return nil, errors.Annotate(err, "listing jujud services")
+	}
+	return parseUnits(out), nil
+}
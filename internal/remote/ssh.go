@@ -0,0 +1,111 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/compress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/retry"
+)
+
+// SSHConfig describes how to reach remote machines over SSH. Controllers are
+// rarely reachable directly, so connections can be made via jump hosts or a
+// SOCKS proxy. The system ssh client is used, so ~/.ssh/config is honoured.
+type SSHConfig struct {
+	// User is the remote user, if not given in the host.
+	User string
+	// JumpHosts are the bastions to connect through, in order, as passed
+	// to ssh -J.
+	JumpHosts []string
+	// SOCKSProxy is the host:port of a SOCKS5 proxy to connect through.
+	SOCKSProxy string
+	// Options are additional ssh -o options.
+	Options []string
+	// Compression is how directories are compressed while they are copied.
+	Compression compress.Compression
+	// Retry is how commands are retried when the host cannot be reached.
+	Retry retry.Strategy
+}
+
+// Validate checks that the config can be used.
+func (c SSHConfig) Validate() error {
+	if c.SOCKSProxy != "" && len(c.JumpHosts) > 0 {
+		return errors.NotValidf("using both a SOCKS proxy and jump hosts")
+	}
+	return nil
+}
+
+var _ Transport = SSHConfig{}
+
+// Command is part of the Transport interface. The command is run with sudo.
+// The remote command line is interpreted by the remote shell, so arguments
+// must be quoted.
+func (c SSHConfig) Command(ctx context.Context, host string, command ...string) (*exec.Cmd, error) {
+	args := append(c.args(host), "sudo")
+	return exec.CommandContext(ctx, "ssh", append(args, command...)...), nil
+}
+
+// Output is part of the Transport interface.
+func (c SSHConfig) Output(ctx context.Context, host string, command ...string) ([]byte, error) {
+	return retriedOutput(ctx, c.Retry, host, command, func(ctx context.Context) (*exec.Cmd, error) {
+		return c.Command(ctx, host, command...)
+	}, sshUnreachable)
+}
+
+// Quote is part of the Transport interface.
+func (c SSHConfig) Quote(arg string) string {
+	return shellQuote(arg)
+}
+
+// sshUnreachable returns whether ssh failed to reach the host, which it
+// reports by exiting with 255.
+func sshUnreachable(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == 255
+}
+
+// ReadFile is part of the Transport interface.
+func (c SSHConfig) ReadFile(ctx context.Context, host, path string) ([]byte, error) {
+	return c.Output(ctx, host, "cat", shellQuote(path))
+}
+
+func (c SSHConfig) args(host string) []string {
+	// Never prompt, as the tool is often run from automation.
+	args := []string{"-o", "BatchMode=yes"}
+	if c.User != "" && !strings.Contains(host, "@") {
+		args = append(args, "-l", c.User)
+	}
+	if len(c.JumpHosts) > 0 {
+		args = append(args, "-J", strings.Join(c.JumpHosts, ","))
+	}
+	if c.SOCKSProxy != "" {
+		args = append(args, "-o", fmt.Sprintf("ProxyCommand=nc -X 5 -x %s %%h %%p", c.SOCKSProxy))
+	}
+	for _, opt := range c.Options {
+		args = append(args, "-o", opt)
+	}
+	return append(args, host, "--")
+}
+
+// SplitPath splits a remote path of the form [user@]host:/path into the host
+// and path. If the path is not remote, ok is false.
+func SplitPath(remotePath string) (host, path string, ok bool) {
+	i := strings.Index(remotePath, ":")
+	if i <= 0 || strings.Contains(remotePath[:i], "/") {
+		return "", "", false
+	}
+	return remotePath[:i], remotePath[i+1:], true
+}
+
+// shellQuote quotes the argument for the remote shell, which ssh passes the
+// command line to.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/compress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/progress"
+	"github.com/SimonRichardson/juju-dqlite-backstop/internal/retry"
+)
+
+// Transport runs commands on the other controllers. Hosts are the addresses
+// or names the transport uses to reach them.
+type Transport interface {
+	// Command returns a command that runs the remote command on the host.
+	// The command is run with the privileges needed to read the agent
+	// data directory.
+	Command(ctx context.Context, host string, command ...string) (*exec.Cmd, error)
+
+	// Output runs the remote command on the host, returning its output.
+	Output(ctx context.Context, host string, command ...string) ([]byte, error)
+
+	// Quote quotes an argument of a remote command, if the transport passes
+	// the command through a shell, so that it reaches the command as given.
+	Quote(arg string) string
+
+	// ReadFile reads the file at the given path on the host.
+	ReadFile(ctx context.Context, host, path string) ([]byte, error)
+
+	// ActiveJujudServices returns the names of the jujud services or
+	// processes that are running on the host.
+	ActiveJujudServices(ctx context.Context, host string) ([]string, error)
+
+	// CopyDir copies the contents of the directory on the host into the
+	// local destination directory, which must exist. Entries matching the
+	// excluded patterns at the top level of the directory are not copied.
+	// Directories are created with mode 0700 and files with 0600.
+	CopyDir(ctx context.Context, host, dir, dest string, exclude ...string) error
+}
+
+// output runs the command, returning its output, or an error including its
+// stderr.
+func output(cmd *exec.Cmd, host string, command []string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Annotatef(err, "running %q on %s: %s",
+			strings.Join(command, " "), host, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// retriedOutput builds and runs a command, returning its output, and runs it
+// again while unreachable reports that it failed to reach the host.
+func retriedOutput(ctx context.Context, strategy retry.Strategy, host string, command []string,
+	build func(context.Context) (*exec.Cmd, error), unreachable func(error) bool) ([]byte, error) {
+	var out []byte
+	err := strategy.Do(ctx, "reaching "+host, func(ctx context.Context) error {
+		cmd, err := build(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if out, err = output(cmd, host, command); err != nil && unreachable(err) {
+			return retry.MarkTransient(err)
+		}
+		return err
+	})
+	return out, err
+}
+
+// copyFrom runs the command, which must write a tar archive to stdout,
+// compressed or not, and extracts it into dest.
+func copyFrom(cmd *exec.Cmd, host, dir, dest string) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Annotatef(err, "copying %s from %s", dir, host)
+	}
+	// The size of the archive is not known ahead.
+	meter := progress.New("copying "+dir+" from "+host, 0)
+	extractErr := extractCompressed(meter.Reader(stdout), dest)
+	if extractErr == nil {
+		meter.Done()
+	} else {
+		// Stop the remote tar, rather than waiting for it to fill the pipe.
+		_ = cmd.Process.Kill()
+	}
+	if err := cmd.Wait(); err != nil && extractErr == nil {
+		return errors.Annotatef(err, "copying %s from %s: %s", dir, host, strings.TrimSpace(stderr.String()))
+	}
+	return errors.Annotatef(extractErr, "copying %s from %s", dir, host)
+}
+
+func extractCompressed(r io.Reader, dest string) error {
+	cr, err := compress.NewReader(r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer func() { _ = cr.Close() }()
+	return extractTar(cr, dest)
+}
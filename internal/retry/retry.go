@@ -0,0 +1,122 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Logger is used to report each failed attempt that is retried.
+type Logger interface {
+	Warningf(string, ...interface{})
+}
+
+// Strategy is how an operation is retried when it fails transiently. The
+// zero Strategy makes a single attempt.
+type Strategy struct {
+	// Attempts is the number of attempts made, including the first.
+	Attempts int
+	// Delay is the wait before the second attempt, doubling before each
+	// attempt after that, up to MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// Timeout bounds each attempt, when not zero.
+	Timeout time.Duration
+	// Logger, when not nil, is told of each attempt that is retried.
+	Logger Logger
+}
+
+// Default is the strategy used when none is configured.
+var Default = Strategy{
+	Attempts: 3,
+	Delay:    500 * time.Millisecond,
+	MaxDelay: 5 * time.Second,
+	Timeout:  5 * time.Second,
+}
+
+// Do calls fn until it succeeds, fails with an error that is not transient,
+// the attempts are used up or the context is done. The error of the last
+// attempt is returned. What describes the operation in log messages.
+func (s Strategy) Do(ctx context.Context, what string, fn func(context.Context) error) error {
+	delay := s.Delay
+	for attempt := 1; ; attempt++ {
+		err := s.attempt(ctx, fn)
+		if err == nil || attempt >= s.Attempts || ctx.Err() != nil || !Transient(err) {
+			return err
+		}
+		if s.Logger != nil {
+			s.Logger.Warningf("%s failed (attempt %d of %d), retrying in %s: %v", what, attempt, s.Attempts, delay, err)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		if delay *= 2; s.MaxDelay > 0 && delay > s.MaxDelay {
+			delay = s.MaxDelay
+		}
+	}
+}
+
+// attempt calls fn once, within the attempt timeout. An attempt that runs
+// out of time is transient, unless the caller's context ran out too.
+func (s Strategy) attempt(ctx context.Context, fn func(context.Context) error) error {
+	if s.Timeout <= 0 {
+		return fn(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	err := fn(attemptCtx)
+	if err != nil && ctx.Err() == nil && attemptCtx.Err() != nil {
+		return MarkTransient(err)
+	}
+	return err
+}
+
+// transientError marks an error as transient.
+type transientError struct {
+	error
+}
+
+func (e transientError) Unwrap() error {
+	return e.error
+}
+
+// MarkTransient marks the error as transient, for failures that are known to
+// pass but are not recognised by Transient.
+func MarkTransient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return transientError{err}
+}
+
+// Transient returns whether the error is one that may pass if the operation
+// is tried again: a marked error, a timeout, or the connection being refused,
+// reset or unreachable.
+func Transient(err error) bool {
+	var marked transientError
+	if errors.As(err, &marked) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.EAGAIN, syscall.EINTR, syscall.ECONNREFUSED, syscall.ECONNRESET,
+		syscall.ECONNABORTED, syscall.EPIPE, syscall.ETIMEDOUT, syscall.EHOSTUNREACH,
+		syscall.ENETUNREACH,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
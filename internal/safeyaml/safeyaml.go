@@ -0,0 +1,125 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package safeyaml reads the YAML files the backstop repairs, which are the
+// ones most likely to be damaged, so that a corrupt or hostile file gives a
+// bounded, clear error rather than exhausting memory or panicking.
+package safeyaml
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// MaxSize is the largest file accepted, far larger than any agent.conf,
+	// cluster.yaml or info.yaml.
+	MaxSize = 1 << 20
+	// MaxDepth is the deepest nesting of mappings and sequences accepted.
+	MaxDepth = 32
+)
+
+// ReadFile reads the file at the path, refusing one larger than MaxSize
+// without reading all of it.
+func ReadFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return ReadAll(f)
+}
+
+// ReadAll reads r to the end, refusing more than MaxSize.
+func ReadAll(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxSize {
+		return nil, errors.Errorf("larger than the %dMiB limit for YAML", MaxSize>>20)
+	}
+	return data, nil
+}
+
+// Check returns an error if the data is not a single YAML document within
+// the limits: no larger than MaxSize, nested no deeper than MaxDepth, with no
+// anchors or aliases, and no key repeated within a mapping. Empty data is a
+// valid, empty document.
+func Check(data []byte) (err error) {
+	if len(data) > MaxSize {
+		return errors.Errorf("%d bytes is larger than the %dMiB limit for YAML", len(data), MaxSize>>20)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("malformed YAML: %v", r)
+		}
+	}()
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	var doc yaml.Node
+	if err := dec.Decode(&doc); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return errors.Annotate(err, "malformed YAML")
+	}
+	var next yaml.Node
+	if err := dec.Decode(&next); err == nil {
+		return errors.Errorf("more than one YAML document, the second at line %d", next.Line)
+	} else if err != io.EOF {
+		return errors.Annotate(err, "malformed YAML")
+	}
+	return checkNode(&doc, 0)
+}
+
+// checkNode checks the node and those it contains, at the given depth.
+func checkNode(node *yaml.Node, depth int) error {
+	if depth > MaxDepth {
+		return errors.Errorf("YAML nested more than %d deep at line %d", MaxDepth, node.Line)
+	}
+	if node.Kind == yaml.AliasNode || node.Anchor != "" {
+		return errors.Errorf("YAML anchor or alias at line %d, which are not used in these files", node.Line)
+	}
+	if node.Kind == yaml.MappingNode {
+		seen := make(map[string]bool)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if key.Kind != yaml.ScalarNode {
+				continue
+			}
+			if seen[key.Value] {
+				return errors.Errorf("YAML key %q repeated at line %d", key.Value, key.Line)
+			}
+			seen[key.Value] = true
+		}
+	}
+	for _, child := range node.Content {
+		if err := checkNode(child, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unmarshal checks the data, then decodes it into v, refusing any field v
+// does not have. Empty data leaves v unchanged.
+func Unmarshal(data []byte, v interface{}) (err error) {
+	if err := Check(data); err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("malformed YAML: %v", r)
+		}
+	}()
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(v); err != nil && err != io.EOF {
+		return errors.Trace(err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package systemlog writes log messages to the system log, the systemd
+// journal or syslog, so that they are collected with the machine's other
+// logs.
+package systemlog
+
+import (
+	"os"
+
+	"github.com/juju/errors"
+)
+
+// Priority is the syslog priority of a message.
+type Priority int
+
+// Message priorities, as defined by syslog.
+const (
+	Crit    Priority = 2
+	Err     Priority = 3
+	Warning Priority = 4
+	Notice  Priority = 5
+	Info    Priority = 6
+	Debug   Priority = 7
+)
+
+// Targets of the system log.
+const (
+	// TargetJournald writes to the systemd journal.
+	TargetJournald = "journald"
+	// TargetSyslog writes to the syslog daemon.
+	TargetSyslog = "syslog"
+)
+
+// Message is a message written to the system log.
+type Message struct {
+	Priority Priority
+	Text     string
+	// Fields are extra fields of the message, written to the journal
+	// only. Their names must be upper case letters, digits and
+	// underscores.
+	Fields map[string]string
+}
+
+// Writer writes messages to the system log.
+type Writer interface {
+	Write(Message) error
+	Close() error
+}
+
+// Open opens the system log for the program with the identifier, writing to
+// the target, or to the journal if it is running and to syslog otherwise if
+// the target is empty.
+func Open(identifier, target string) (Writer, error) {
+	switch target {
+	case "":
+		if journalRunning() {
+			return openJournal(identifier)
+		}
+		return openSyslog(identifier)
+	case TargetJournald:
+		return openJournal(identifier)
+	case TargetSyslog:
+		return openSyslog(identifier)
+	}
+	return nil, errors.NotValidf("system log target %q", target)
+}
+
+// UnderSystemd reports whether the program was started by systemd, as a
+// service or a transient unit.
+func UnderSystemd() bool {
+	return os.Getenv("INVOCATION_ID") != ""
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package systemlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+// journalSocket is where the journal receives messages in its native
+// protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// maxJournalMessage bounds the size of a message sent to the journal in a
+// single datagram. Longer messages are truncated, rather than passed in a
+// memfd.
+const maxJournalMessage = 128 << 10
+
+func journalRunning() bool {
+	_, err := os.Stat(journalSocket)
+	return err == nil
+}
+
+type journalWriter struct {
+	conn       *net.UnixConn
+	identifier string
+	pid        string
+}
+
+func openJournal(identifier string) (Writer, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, errors.Annotate(err, "connecting to the journal")
+	}
+	return &journalWriter{conn: conn, identifier: identifier, pid: fmt.Sprint(os.Getpid())}, nil
+}
+
+// Write sends the message to the journal in its native protocol: a field
+// per line, with values holding a newline written as their length followed
+// by the raw value.
+func (w *journalWriter) Write(msg Message) error {
+	text := msg.Text
+	if len(text) > maxJournalMessage {
+		text = text[:maxJournalMessage] + "... (truncated)"
+	}
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", text)
+	writeJournalField(&buf, "PRIORITY", fmt.Sprint(int(msg.Priority)))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", w.identifier)
+	writeJournalField(&buf, "SYSLOG_PID", w.pid)
+	for name, value := range msg.Fields {
+		writeJournalField(&buf, name, value)
+	}
+	_, err := w.conn.Write(buf.Bytes())
+	return errors.Trace(err)
+}
+
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(name + "\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+func (w *journalWriter) Close() error {
+	return errors.Trace(w.conn.Close())
+}
+
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func openSyslog(identifier string) (Writer, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, identifier)
+	if err != nil {
+		return nil, errors.Annotate(err, "connecting to syslog")
+	}
+	return syslogWriter{w: w}, nil
+}
+
+// Write sends the message to syslog. Syslog has no extra fields, so they
+// are dropped.
+func (w syslogWriter) Write(msg Message) error {
+	write := w.w.Info
+	switch msg.Priority {
+	case Crit:
+		write = w.w.Crit
+	case Err:
+		write = w.w.Err
+	case Warning:
+		write = w.w.Warning
+	case Notice:
+		write = w.w.Notice
+	case Debug:
+		write = w.w.Debug
+	}
+	return errors.Trace(write(msg.Text))
+}
+
+func (w syslogWriter) Close() error {
+	return errors.Trace(w.w.Close())
+}
+
+// IsJournalStream reports whether the file is connected to the journal, as
+// systemd connects a service's stderr, so that what is written to it is
+// already collected.
+func IsJournalStream(f *os.File) bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &stat); err != nil {
+		return false
+	}
+	return stream == fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package systemlog
+
+import (
+	"os"
+
+	"github.com/juju/errors"
+)
+
+func journalRunning() bool {
+	return false
+}
+
+func openJournal(string) (Writer, error) {
+	return nil, errors.NotSupportedf("the systemd journal")
+}
+
+func openSyslog(string) (Writer, error) {
+	return nil, errors.NotSupportedf("syslog")
+}
+
+// IsJournalStream reports whether the file is connected to the journal, as
+// systemd connects a service's stderr, so that what is written to it is
+// already collected.
+func IsJournalStream(*os.File) bool {
+	return false
+}